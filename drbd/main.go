@@ -22,12 +22,25 @@ import (
 	"fmt"
 	"log"
 	"log/syslog"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/linbit/drbd-flexvolume/pkg/api"
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/events"
+	"github.com/linbit/drbd-flexvolume/pkg/jsonlog"
+	"github.com/linbit/drbd-flexvolume/pkg/metrics"
+	"github.com/linbit/drbd-flexvolume/pkg/ratelimit"
 )
 
+// logFile receives a structured line for every call.
+const logFile = "/var/log/drbd-flexvolume.log"
+
 // Version is set via ldflags configued in the Makefile.
 var Version string
 
@@ -41,17 +54,212 @@ func main() {
 		os.Exit(0)
 	}
 
-	sysLog, err := syslog.New(syslog.LOG_INFO, "DRBD FlexVolume")
-	if err != nil {
-		log.Fatal(err)
+	api.PluginVersion = Version
+
+	// Nothing is written on the node in stateless mode, e.g. with a
+	// read-only root filesystem. Logs go to stderr only.
+	stateless := os.Getenv("DRBD_STATELESS_MODE") == "true"
+
+	if !stateless {
+		sysLog, err := syslog.New(syslog.LOG_INFO, "DRBD FlexVolume")
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(sysLog)
+	}
+
+	// Per command type timeouts, e.g. DRBD_MKFS_TIMEOUT=20m.
+	for kind := range drbd.CommandTimeouts {
+		env := "DRBD_" + strings.ToUpper(string(kind)) + "_TIMEOUT"
+		if timeout := os.Getenv(env); timeout != "" {
+			if err := drbd.SetCommandTimeout(kind, timeout); err != nil {
+				log.Printf("ignoring %s: %v", env, err)
+			}
+		}
+	}
+
+	// Commands off PATH, e.g. DRBD_DRBDADM_PATH=/opt/drbd/sbin/drbdadm.
+	for _, name := range drbd.Binaries {
+		env := "DRBD_" + strings.ToUpper(name) + "_PATH"
+		if path := os.Getenv(env); path != "" {
+			if err := drbd.SetBinaryPath(name, path); err != nil {
+				log.Printf("ignoring %s: %v", env, err)
+			}
+		}
+	}
+	if prefix := os.Getenv("DRBD_MKFS_PREFIX"); prefix != "" {
+		if err := drbd.SetMkfsPrefix(prefix); err != nil {
+			log.Printf("ignoring DRBD_MKFS_PREFIX: %v", err)
+		}
+	}
+
+	// Confine subprocesses to housekeeping CPUs, e.g. DRBD_CPU_AFFINITY=0-1.
+	if cpus := os.Getenv("DRBD_CPU_AFFINITY"); cpus != "" {
+		if err := drbd.SetCPUAffinity(cpus); err != nil {
+			log.Printf("ignoring DRBD_CPU_AFFINITY: %v", err)
+		}
+	}
+
+	// Structured call logging, e.g. DRBD_LOG_LEVEL=debug.
+	level, err := jsonlog.ParseLevel(os.Getenv("DRBD_LOG_LEVEL"))
+	if err != nil && os.Getenv("DRBD_LOG_LEVEL") != "" {
+		log.Printf("ignoring DRBD_LOG_LEVEL: %v", err)
+	}
+	if stateless {
+		api.Log = jsonlog.New(os.Stderr, level)
+	} else if f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+		api.Log = jsonlog.New(f, level)
+	} else {
+		log.Printf("unable to open %s: %v", logFile, err)
+	}
+
+	// Plugin-wide defaults of settings calls may override in their options.
+	api.LoadDefaults(os.Getenv)
+
+	if wait := os.Getenv("DRBD_LOCK_TIMEOUT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.LockTimeout = d
+		} else {
+			log.Printf("ignoring DRBD_LOCK_TIMEOUT: bad duration %q", wait)
+		}
 	}
-	log.SetOutput(sysLog)
 
-	log.Printf("called with %s: %s", apiCall, strings.Join(os.Args[2:], ", "))
+	if wait := os.Getenv("DRBD_SYNC_WAIT_TIMEOUT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.SyncWaitTimeout = d
+		} else {
+			log.Printf("ignoring DRBD_SYNC_WAIT_TIMEOUT: bad duration %q", wait)
+		}
+	}
+
+	if wait := os.Getenv("DRBD_DETACH_SECONDARY_WAIT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.DetachSecondaryWait = d
+		} else {
+			log.Printf("ignoring DRBD_DETACH_SECONDARY_WAIT: bad duration %q", wait)
+		}
+	}
+
+	if timeout := os.Getenv("DRBD_PROMOTE_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil && d >= 0 {
+			api.PromoteTimeout = d
+		} else {
+			log.Printf("ignoring DRBD_PROMOTE_TIMEOUT: bad duration %q", timeout)
+		}
+	}
+
+	if wait := os.Getenv("DRBD_DETACH_INSYNC_WAIT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.DetachInSyncWait = d
+		} else {
+			log.Printf("ignoring DRBD_DETACH_INSYNC_WAIT: bad duration %q", wait)
+		}
+	}
+
+	if wait := os.Getenv("DRBD_SHUTDOWN_GRACE"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.ShutdownGrace = d
+		} else {
+			log.Printf("ignoring DRBD_SHUTDOWN_GRACE: bad duration %q", wait)
+		}
+	}
+
+	if wait := os.Getenv("DRBD_DETACH_DEVICE_WAIT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.DetachDeviceWait = d
+		} else {
+			log.Printf("ignoring DRBD_DETACH_DEVICE_WAIT: bad duration %q", wait)
+		}
+	}
+
+	// Polling for device paths starts at DRBD_DEVICE_POLL_INTERVAL and slows
+	// down to DRBD_DEVICE_POLL_MAX_INTERVAL, e.g. 100ms and 5s.
+	for env, interval := range map[string]*time.Duration{
+		"DRBD_DEVICE_POLL_INTERVAL":     &drbd.DevPathInterval,
+		"DRBD_DEVICE_POLL_MAX_INTERVAL": &drbd.DevPathMaxInterval,
+	} {
+		if wait := os.Getenv(env); wait != "" {
+			if d, err := time.ParseDuration(wait); err == nil && d > 0 {
+				*interval = d
+			} else {
+				log.Printf("ignoring %s: bad duration %q", env, wait)
+			}
+		}
+	}
+
+	if minors := os.Getenv("DRBD_MAX_MINORS"); minors != "" {
+		if n, err := strconv.Atoi(minors); err == nil && n > 0 {
+			api.MaxMinors = n
+		} else {
+			log.Printf("ignoring DRBD_MAX_MINORS: bad number %q", minors)
+		}
+	}
+
+	if file := os.Getenv("DRBD_METRICS_FILE"); file != "" {
+		metrics.File = file
+	}
+	metrics.StatsdAddr = os.Getenv("DRBD_STATSD_ADDR")
+
+	// Set before the variables of single directories, which take precedence.
+	if dir := os.Getenv("DRBD_PLUGIN_DIR"); dir != "" {
+		api.SetPluginDir(dir)
+	}
+
+	if dir := os.Getenv("DRBD_DIAGNOSTICS_DIR"); dir != "" {
+		drbd.DiagnosticsDir = dir
+	}
+	if stateless {
+		api.SetStatelessMode()
+	}
+
+	if dir := os.Getenv("DRBD_PREMOUNT_HOOK_DIR"); dir != "" {
+		api.PreMountHookDir = dir
+	}
+
+	if pool := os.Getenv("DRBD_THIN_POOL"); pool != "" {
+		drbd.ThinPool = pool
+	}
+
+	log.Printf("called with %s: %s", apiCall, strings.Join(api.RedactArgs(os.Args[2:]), ", "))
+
+	drbd.DryRun = os.Getenv("DRBD_DRY_RUN") == "true"
+	drbd.AutoModprobe = os.Getenv("DRBD_AUTO_MODPROBE") == "true"
+
+	// drbdmanage or linstor, whichever is installed.
+	if _, err := drbd.DetectBackend(); err != nil {
+		log.Print(err)
+	}
+	api.ShadowOptions = os.Getenv("DRBD_SHADOW_OPTIONS") == "true"
+	api.NodeName = os.Getenv("DRBD_NODE_NAME")
+	api.Events = events.Config{
+		Server:         os.Getenv("DRBD_EVENTS_API_SERVER"),
+		CredentialsDir: os.Getenv("DRBD_EVENTS_CREDENTIALS_DIR"),
+	}
+
+	// Mutating calls per second, how many may start in quick succession
+	// after a quiet period and how long a call waits for its turn, e.g.
+	// DRBD_RATE_LIMIT=2 DRBD_RATE_BURST=10 DRBD_RATE_LIMIT_WAIT=1m.
+	if rate, err := strconv.ParseFloat(os.Getenv("DRBD_RATE_LIMIT"), 64); err == nil && rate > 0 {
+		api.RateLimit = ratelimit.Limiter{Rate: rate, Burst: math.Max(1, math.Ceil(rate))}
+		if burst, err := strconv.ParseFloat(os.Getenv("DRBD_RATE_BURST"), 64); err == nil && burst >= 1 {
+			api.RateLimit.Burst = burst
+		}
+	}
+	if wait := os.Getenv("DRBD_RATE_LIMIT_WAIT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil && d >= 0 {
+			api.RateLimitWait = d
+		} else {
+			log.Printf("ignoring DRBD_RATE_LIMIT_WAIT: bad duration %q", wait)
+		}
+	}
 
 	api := api.FlexVolumeApi{}
 
-	out, ret := api.Call(os.Args[1:])
+	// The Kubelet may kill calls that take too long.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	out, ret := api.CallUntilSignal(os.Args[1:], sigs)
 
 	log.Printf("responded to %s: %s", os.Args[1], out)
 
@@ -0,0 +1,128 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Implementations of actions, as reported by the actions action.
+const (
+	implementationFull = "full"
+	// implementationNoop actions succeed without doing anything.
+	implementationNoop = "noop"
+)
+
+// Whether an action may change assignments, mounts or devices, which the
+// rate limit applies to.
+const (
+	actionQuery    = false
+	actionMutating = true
+)
+
+// action is a driver action dispatch knows how to run.
+type action struct {
+	name           string
+	implementation string
+	// mutating is set for actions that may change anything, even if only
+	// with some arguments, e.g. reconcile --clean.
+	mutating bool
+	run      func(api FlexVolumeApi, s []string) (string, exitCode)
+}
+
+// actions are all driver actions, in the order they are listed. dispatch runs
+// only what is listed here. Set in init, as the actions action lists them.
+var actions []action
+
+func init() {
+	actions = []action{
+		{"init", implementationFull, actionQuery, func(api FlexVolumeApi, s []string) (string, exitCode) { return api.init() }},
+		{"attach", implementationFull, actionMutating, FlexVolumeApi.attach},
+		{"waitforattach", implementationFull, actionQuery, FlexVolumeApi.waitForAttach},
+		{"detach", implementationFull, actionMutating, FlexVolumeApi.detach},
+		{"mountdevice", implementationFull, actionMutating, FlexVolumeApi.mountDevice},
+		{"unmountdevice", implementationFull, actionMutating, FlexVolumeApi.unmountDevice},
+		{"mount", implementationFull, actionMutating, FlexVolumeApi.mount},
+		{"unmount", implementationFull, actionMutating, FlexVolumeApi.unmount},
+		{"getvolumename", implementationFull, actionQuery, FlexVolumeApi.getVolumeName},
+		{"isattached", implementationFull, actionQuery, FlexVolumeApi.isAttached},
+		{isAttachedNoWaitAction, implementationFull, actionQuery, FlexVolumeApi.isAttached},
+		{"getassignment", implementationFull, actionQuery, FlexVolumeApi.getAssignment},
+		{"history", implementationFull, actionQuery, FlexVolumeApi.history},
+		{"describe", implementationFull, actionQuery, FlexVolumeApi.describe},
+		{"migrate", implementationFull, actionMutating, FlexVolumeApi.migrate},
+		{"drainnode", implementationFull, actionMutating, FlexVolumeApi.drainNode},
+		{"recheck", implementationFull, actionMutating, FlexVolumeApi.recheck},
+		{"reconcile", implementationFull, actionMutating, FlexVolumeApi.reconcile},
+		{"getstatus", implementationFull, actionQuery, FlexVolumeApi.getStatus},
+		{"expandvolume", implementationFull, actionMutating, FlexVolumeApi.expandVolume},
+		{"protocol", implementationFull, actionQuery, FlexVolumeApi.protocol},
+		{"configdigest", implementationFull, actionQuery, FlexVolumeApi.configDigest},
+		{"verifystatus", implementationFull, actionQuery, FlexVolumeApi.verifyStatus},
+		{"getvolumelimits", implementationFull, actionQuery, func(api FlexVolumeApi, s []string) (string, exitCode) { return api.getVolumeLimits() }},
+		{"selftest", implementationFull, actionQuery, func(api FlexVolumeApi, s []string) (string, exitCode) { return api.selftest() }},
+		{"version", implementationFull, actionQuery, func(api FlexVolumeApi, s []string) (string, exitCode) { return api.version() }},
+		{"actions", implementationFull, actionQuery, func(api FlexVolumeApi, s []string) (string, exitCode) { return api.listActions() }},
+		{verifyWatchAction, implementationFull, actionQuery, FlexVolumeApi.verifyWatch},
+	}
+}
+
+// lookupAction returns the action called name, nil if there is none.
+func lookupAction(name string) *action {
+	for i := range actions {
+		if actions[i].name == name {
+			return &actions[i]
+		}
+	}
+	return nil
+}
+
+// actionNames lists the names of all actions, e.g. for error messages.
+func actionNames() string {
+	names := make([]string, len(actions))
+	for i, a := range actions {
+		names[i] = a.name
+	}
+	return strings.Join(names, ", ")
+}
+
+type actionInfo struct {
+	Name           string `json:"name"`
+	Implementation string `json:"implementation"`
+}
+
+type actionsResponse struct {
+	response
+	Actions []actionInfo `json:"actions"`
+}
+
+// listActions reports the actions this build supports and whether each does
+// anything, for tooling that discovers them.
+func (api FlexVolumeApi) listActions() (string, exitCode) {
+	infos := make([]actionInfo, len(actions))
+	for i, a := range actions {
+		infos[i] = actionInfo{Name: a.name, Implementation: a.implementation}
+	}
+	res, _ := json.Marshal(actionsResponse{
+		Actions:  infos,
+		response: response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
@@ -0,0 +1,98 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linbit/drbd-flexvolume/pkg/ratelimit"
+)
+
+func TestListActions(t *testing.T) {
+	out, ret := FlexVolumeApi{}.Call([]string{"actions"})
+	if ret != int(EXITSUCCESS) {
+		t.Fatalf("Called: Call([actions]), Expected: %d, Got: %d, %q", EXITSUCCESS, ret, out)
+	}
+	res := actionsResponse{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("Called: Call([actions]), Unexpected error: %v, %q", err, out)
+	}
+
+	// Every action dispatch runs is listed, and everything listed dispatches.
+	if len(res.Actions) != len(actions) {
+		t.Errorf("Called: Call([actions]), Expected: %d actions, Got: %d", len(actions), len(res.Actions))
+	}
+	listed := map[string]bool{}
+	for _, a := range res.Actions {
+		listed[a.Name] = true
+		if a.Implementation != implementationFull && a.Implementation != implementationNoop {
+			t.Errorf("Called: Call([actions]), Expected: implementation of %s %q or %q, Got: %q", a.Name, implementationFull, implementationNoop, a.Implementation)
+		}
+		if lookupAction(a.Name) == nil {
+			t.Errorf("Called: lookupAction(%q), Expected: listed action, Got: nil", a.Name)
+		}
+	}
+
+	// The FlexVolume API and the plugin's own additions.
+	for _, name := range []string{
+		"init", "attach", "waitforattach", "detach", "mountdevice", "unmountdevice", "mount", "unmount",
+		"getvolumename", "isattached", "expandvolume", "getvolumelimits", "version", "actions",
+	} {
+		if !listed[name] {
+			t.Errorf("Called: Call([actions]), Expected: %s listed, Got: %q", name, out)
+		}
+	}
+
+	out, ret = FlexVolumeApi{}.Call([]string{"nosuchaction"})
+	if ret != int(EXITBADAPICALL) {
+		t.Errorf("Called: Call([nosuchaction]), Expected: %d, Got: %d, %q", EXITBADAPICALL, ret, out)
+	}
+}
+
+func TestCallRateLimitsMutatingActions(t *testing.T) {
+	dir, restore := useTempCallDirs(t)
+	defer restore()
+	oldFile, oldLimit, oldWait := ratelimit.File, RateLimit, RateLimitWait
+	ratelimit.File, RateLimit, RateLimitWait = filepath.Join(dir, "ratelimit.json"), ratelimit.Limiter{Rate: 0.001, Burst: 1}, 0
+	defer func() { ratelimit.File, RateLimit, RateLimitWait = oldFile, oldLimit, oldWait }()
+
+	// The first mutating call takes the only token, even without resources.
+	FlexVolumeApi{}.Call([]string{"reconcile", "--clean"})
+
+	var limitTests = []struct {
+		call    []string
+		limited bool
+	}{
+		{[]string{"drainnode", "node1"}, true},
+		{[]string{"reconcile", "--clean"}, true},
+		{[]string{"recheck", `{"onDeviceMissing":"reassign"}`}, true},
+		{[]string{"version"}, false},
+		{[]string{"getassignment", `{"resource":"r0"}`, "node1"}, false},
+	}
+
+	for _, tt := range limitTests {
+		out, _ := FlexVolumeApi{}.Call(tt.call)
+		if limited := strings.Contains(out, "ratelimit:"); limited != tt.limited {
+			t.Errorf("Called: %q with an empty bucket, Expected: rate limited %t, Got: %s", tt.call, tt.limited, out)
+		}
+	}
+}
@@ -19,178 +19,2602 @@
 package api
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/events"
+	"github.com/linbit/drbd-flexvolume/pkg/history"
+	"github.com/linbit/drbd-flexvolume/pkg/jsonlog"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+	"github.com/linbit/drbd-flexvolume/pkg/metrics"
+	"github.com/linbit/drbd-flexvolume/pkg/ratelimit"
+	"github.com/linbit/drbd-flexvolume/pkg/registry"
 )
 
-// API status codes, used as exit codes in main.
+// exitCode is the API status code of a call, used as exit code in main.
+type exitCode int
+
+// API status codes. Whether a failed call is worth retrying decides its code.
 const (
-	EXITSUCCESS int = iota
+	EXITSUCCESS exitCode = iota
+	// EXITDRBDFAILURE is transient: retrying may succeed once the cluster
+	// catches up, e.g. a device that is not ready yet, a resource that is
+	// busy with another call or a failed drbdmanage command.
 	EXITDRBDFAILURE
+	// EXITBADAPICALL is terminal: the call itself is wrong and retrying it
+	// unchanged fails the same way, e.g. unparsable options, too few
+	// arguments, an invalid resource name or an unsupported action.
 	EXITBADAPICALL
 )
 
-type flexAPIErr struct {
-	message string
+type flexAPIErr struct {
+	message string
+}
+
+func (e flexAPIErr) Error() string {
+	return fmt.Sprintf("DRBD Flexvoume API: %s", e.message)
+}
+
+// APIVersion is the version of the response format, reported as apiVersion
+// in every response. Bump it whenever the fields of a response change.
+const APIVersion = "2"
+
+// schemaVersion always marshals as APIVersion, so that no response can be
+// sent without it.
+type schemaVersion string
+
+func (schemaVersion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(APIVersion)
+}
+
+type response struct {
+	APIVersion schemaVersion `json:"apiVersion"`
+	Status     string        `json:"status"`
+	Message    string        `json:"message"`
+	errorDetails
+}
+
+// Capabilities tells the Kubelet which optional parts of the FlexVolume API
+// the driver implements.
+type Capabilities struct {
+	Attach         bool `json:"attach"`
+	SELinuxRelabel bool `json:"selinuxRelabel"`
+}
+
+// DefaultCapabilities are the capabilities reported by init.
+var DefaultCapabilities = Capabilities{Attach: true, SELinuxRelabel: true}
+
+type initResponse struct {
+	response
+	Capabilities Capabilities `json:"capabilities"`
+	// Backend is the command resources are managed with.
+	Backend string `json:"backend,omitempty"`
+}
+
+type attachResponse struct {
+	response
+	AttachResult
+}
+
+type verifyStatusResponse struct {
+	response
+	Verify *drbd.VerifyResult `json:"verify,omitempty"`
+}
+
+type drainNodeResponse struct {
+	response
+	Summary *batchSummary `json:"summary"`
+}
+
+type migrateResponse struct {
+	response
+	// Phases completed or started, in order.
+	Phases  []string      `json:"phases"`
+	Summary *batchSummary `json:"summary"`
+}
+
+// mountCheck is the outcome of rechecking one recorded mount.
+type mountCheck struct {
+	Resource      string `json:"resource"`
+	Device        string `json:"device"`
+	Path          string `json:"path"`
+	DeviceMissing bool   `json:"deviceMissing"`
+	// Reassigned is set if the missing device was restored.
+	Reassigned bool   `json:"reassigned,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type versionResponse struct {
+	response
+	PluginVersion     string `json:"pluginVersion"`
+	DRBDUtilsVersion  string `json:"drbdUtilsVersion"`
+	DRBDKernelVersion string `json:"drbdKernelVersion"`
+}
+
+type statusResponse struct {
+	response
+	Device    string `json:"device"`
+	SizeBytes int64  `json:"sizeBytes"`
+	// MountPath and the usage of the filesystem are only set if the
+	// device is mounted.
+	MountPath      string  `json:"mountPath,omitempty"`
+	UsedBytes      *uint64 `json:"usedBytes,omitempty"`
+	AvailableBytes *uint64 `json:"availableBytes,omitempty"`
+	// OutOfSyncBytes is only set for resources replicating with protocol A,
+	// Lagging only if there is a lagThresholdBytes too.
+	OutOfSyncBytes *int64 `json:"outOfSyncBytes,omitempty"`
+	Lagging        *bool  `json:"lagging,omitempty"`
+}
+
+type reconcileResponse struct {
+	response
+	Orphans []drbd.Orphan `json:"orphans"`
+	// Cleaned is the number of orphans unmounted.
+	Cleaned int `json:"cleaned"`
+}
+
+type recheckResponse struct {
+	response
+	Mounts  []mountCheck  `json:"mounts"`
+	Summary *batchSummary `json:"summary"`
+}
+
+type isAttachedResponse struct {
+	response
+	Attached string `json:"attached"`
+	// ConnectionState summarizes replication of attached resources, see
+	// drbd.GetConnectionState.
+	ConnectionState string `json:"connectionState,omitempty"`
+}
+
+type mountDeviceResponse struct {
+	response
+	ReservedBlocksPercent string `json:"reservedBlocksPercent,omitempty"`
+	FSLabel               string `json:"fsLabel,omitempty"`
+	DeviceOpenRetries     int    `json:"deviceOpenRetries"`
+}
+
+type assignmentResponse struct {
+	response
+	Assignment string `json:"assignment"`
+	Planned    string `json:"planned"`
+}
+
+type configDigestResponse struct {
+	response
+	drbd.ConfigDigest
+}
+
+type expandResponse struct {
+	response
+	// Size is the volume's size in bytes after expanding.
+	Size int64 `json:"size"`
+	// FilesystemGrown is set if a mounted filesystem was grown as well.
+	FilesystemGrown bool `json:"filesystemGrown"`
+}
+
+type protocolResponse struct {
+	response
+	Configured  string              `json:"configured"`
+	Connections []drbd.PeerProtocol `json:"connections"`
+}
+
+type describeResponse struct {
+	response
+	Mount *registry.Entry `json:"mount,omitempty"`
+}
+
+type getVolNameResponse struct {
+	response
+	VolumeName string `json:"volumeName"`
+	// Options as interpreted by the plugin, only set when debug is requested.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+type options struct {
+	FsType string `json:"kubernetes.io/fsType"`
+	// "ro" for read-only volumes, "rw" or unset otherwise.
+	Readwrite   string `json:"kubernetes.io/readwrite"`
+	Resource    string `json:"resource"`
+	PVCResource string `json:"kubernetes.io/pvOrVolumeName"`
+	// Pod information passed by the Kubelet, recorded in the mount registry.
+	PodName      string `json:"kubernetes.io/pod.name"`
+	PodNamespace string `json:"kubernetes.io/pod.namespace"`
+	PodUID       string `json:"kubernetes.io/pod.uid"`
+	// Group ID from the pod's securityContext.fsGroup.
+	FSGroup string `json:"kubernetes.io/fsGroup"`
+	// Set by provisioners that know which StorageClass the volume came from.
+	StorageClass string `json:"storageClass"`
+	// Comma-separated options passed to mount, e.g. "noatime,discard".
+	MountOptions string `json:"mountOptions"`
+	// Create a filesystem on blank devices, unless "false".
+	SafeFormat string `json:"safeFormat"`
+	// Percentage of filesystem blocks reserved for the super-user, only
+	// applied when creating a fresh ext filesystem.
+	ReservedBlocksPercent string `json:"reservedBlocksPercent"`
+	// Extra arguments for mkfs when formatting a blank device, e.g.
+	// "-b 4096 -L data". Quotes keep spaces within an argument.
+	MkfsOptions string `json:"mkfsOptions"`
+	// Label given to the filesystem when formatting the device, e.g. the
+	// PV name.
+	FSLabel string `json:"fsLabel"`
+	// Give existing filesystems fsLabel too, if "true".
+	Relabel string `json:"relabel"`
+	// Link the raw device at the mount path instead of mounting a
+	// filesystem, if "true".
+	BlockMode string `json:"blockMode"`
+	// Check and repair existing filesystems with fsck before read-write
+	// mounts, if "true".
+	FsckOnMount string `json:"fsckOnMount"`
+	// Absolute path of an executable run with the device and the mount path
+	// before mounting, which fails the mount by exiting nonzero.
+	PreMountHook string `json:"preMountHook"`
+	// Mount and prepare the device in a staging directory and bind-mount it
+	// at the mount path only once that succeeded, if "true".
+	StagedMount string `json:"stagedMount"`
+	// Trim a freshly formatted filesystem after mounting it.
+	DiscardAfterFormat string `json:"discardAfterFormat"`
+	// Fully initialize filesystem metadata at format time.
+	DurableFormat string `json:"durableFormat"`
+	// Filesystem usage threshold in percent and what to do when it is
+	// exceeded at mount time: "warn" (the default) or "refuse".
+	FullThresholdPercent string `json:"fullThresholdPercent"`
+	OnFull               string `json:"onFull"`
+	// What attach does when the resource's I/O is suspended by fencing:
+	// "fail" (the default) or "wait" for it to resume.
+	OnFenced string `json:"onFenced"`
+	// Read the start of the device after attaching to warm the page cache,
+	// prewarmBytes defaults to defaultPrewarmBytes.
+	Prewarm      string `json:"prewarm"`
+	PrewarmBytes string `json:"prewarmBytes"`
+	// Out-of-sync bytes above which getstatus reports an asynchronously
+	// replicated resource as lagging.
+	LagThresholdBytes string `json:"lagThresholdBytes"`
+	// Thin pool over-commit ratio above which attach does what onOverCommit
+	// says: "warn" (the default) or "refuse".
+	MaxOverCommit string `json:"maxOverCommit"`
+	OnOverCommit  string `json:"onOverCommit"`
+	// Capture a diagnostic bundle when a mutating call fails.
+	DiagnosticBundleOnFailure string `json:"diagnosticBundleOnFailure"`
+	// Refuse to attach resources without any peers.
+	RequireReplication string `json:"requireReplication"`
+	// Free space in bytes the node's storage pool needs for attach.
+	MinPoolFreeBytes string `json:"minPoolFreeBytes"`
+	// What attach does when the local disk is Outdated: "refuse" (the
+	// default) or "wait" for it to become UpToDate.
+	OnOutdated string `json:"onOutdated"`
+	// Start an online verification against the peers after attaching.
+	VerifyAfterAttach string `json:"verifyAfterAttach"`
+	// What to do with resource names longer than DRBD allows: "fail" (the
+	// default) or "hash" to derive a shorter name.
+	LongNames string `json:"longNames"`
+	// What recheck does about mounts whose device vanished: "report" (the
+	// default) or "reassign" the resource to restore the device.
+	OnDeviceMissing string `json:"onDeviceMissing"`
+	// Log the summary of actions acting on several resources.
+	LogSummary string `json:"logSummary"`
+	// Diskful replicas that must remain when migrating a replica, defaults
+	// to defaultMinReplicas.
+	MinReplicas string `json:"minReplicas"`
+	// Write attach progress to a file for external watchers.
+	ProgressFile string `json:"progressFile"`
+	// Detach even if the device is still mounted.
+	Force string `json:"force"`
+	// Assign the resource diskless, "true", or with local storage on the
+	// node, "false" (the default).
+	Diskless string `json:"diskless"`
+	// Echo the resolved options back from getvolumename.
+	Debug string `json:"debug"`
+	// JSON array of resources for attach to assign at once, instead of the
+	// single resource.
+	Resources string `json:"resources"`
+	// JSON object mapping resources of the batch to those of it they need
+	// attached first.
+	DependsOn string `json:"dependsOn"`
+	// Directory of the volume to mount instead of the whole volume, created
+	// if it doesn't exist. Relative, without "..".
+	SubPath string `json:"subPath"`
+	// How long attach and isattached wait for the device or assignment,
+	// overriding DRBD_WAIT_TIMEOUT_SECONDS.
+	WaitTimeoutSeconds string `json:"waitTimeoutSeconds"`
+	// Diskful replicas the backend deploys when attach finds the resource
+	// not deployed anywhere, for on-demand provisioning.
+	PlacementCount string `json:"placementCount"`
+	// Storage pool diskful replicas are provisioned from.
+	StoragePool string `json:"storagePool"`
+	// Size in bytes of the volume of a resource attach creates when it isn't
+	// defined yet. Requires placementCount.
+	SizeBytes string `json:"sizeBytes"`
+
+	// Warnings about deprecated keys found while parsing.
+	deprecations []string
+	// The over-length resource name the resource was shortened from, which
+	// attach records for detach.
+	longName string
+	// Decoded values of the secret options, by key without the prefix.
+	// Unexported, so they never show up in the resolved options.
+	secrets map[string]string
+}
+
+// deprecatedOptions maps legacy option keys to the keys that replaced them.
+// Legacy keys are still honored unless the current key is also set.
+var deprecatedOptions = []struct {
+	legacy  string
+	current string
+}{
+	{"fsType", "kubernetes.io/fsType"},
+	{"readwrite", "kubernetes.io/readwrite"},
+}
+
+func (o *options) getResource() string {
+	if o.Resource != "" {
+		return o.Resource
+	}
+	return o.PVCResource
+}
+
+const secretOptionPrefix = "kubernetes.io/secret/"
+
+// sharedSecretKey is the key of the secret holding the DRBD shared secret.
+const sharedSecretKey = "shared-secret"
+
+// getSharedSecret returns the shared secret the resource's connections
+// authenticate with, empty if none was passed.
+func (o *options) getSharedSecret() string {
+	return o.secrets[sharedSecretKey]
+}
+
+// RedactArgs returns the arguments of a call as they may be logged, with the
+// values of secret options redacted.
+func RedactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, a := range args {
+		redacted[i] = a
+		opts := make(map[string]json.RawMessage)
+		if json.Unmarshal([]byte(a), &opts) != nil {
+			continue
+		}
+		found := false
+		for k := range opts {
+			if strings.HasPrefix(k, secretOptionPrefix) {
+				opts[k] = json.RawMessage(`"<redacted>"`)
+				found = true
+			}
+		}
+		if found {
+			out, _ := json.Marshal(opts)
+			redacted[i] = string(out)
+		}
+	}
+	return redacted
+}
+
+// resolved returns the options as the plugin interprets them, after legacy
+// keys have been mapped, with secret values redacted.
+func (o *options) resolved() map[string]string {
+	out, _ := json.Marshal(o)
+	resolved := make(map[string]string)
+	json.Unmarshal(out, &resolved)
+
+	for k, v := range resolved {
+		if v == "" {
+			delete(resolved, k)
+		}
+	}
+	return redactSecrets(resolved)
+}
+
+func redactSecrets(opts map[string]string) map[string]string {
+	for k := range opts {
+		if strings.HasPrefix(k, secretOptionPrefix) {
+			opts[k] = "<redacted>"
+		}
+	}
+	return opts
+}
+
+// describeOptionsError explains why the options in s could not be decoded,
+// without repeating any values of secret options.
+func describeOptionsError(s string, err error) string {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// The offset is just past the byte that failed to parse.
+		line, col := lineAndColumn(s, e.Offset-1)
+		msg := fmt.Sprintf("couldn't parse options: %v at line %d, column %d after %q", e, line, col, optionsContext(s, e.Offset))
+		if e.Offset >= int64(len(s)) {
+			msg += ", the options look truncated"
+		}
+		return msg
+	case *json.UnmarshalTypeError:
+		if e.Field == "" {
+			return fmt.Sprintf("couldn't parse options: expected a JSON object, got %s", e.Value)
+		}
+		// Newer Go versions report the field as a JSON pointer.
+		key := strings.NewReplacer("~1", "/", "~0", "~").Replace(e.Field)
+		return fmt.Sprintf("couldn't parse options: option %q must be a %s, got %s", key, e.Type, e.Value)
+	}
+	return "couldn't parse options: malformed JSON"
+}
+
+// lineAndColumn converts a byte offset into s to a 1-based line and column.
+func lineAndColumn(s string, offset int64) (int, int) {
+	if offset > int64(len(s)) {
+		offset = int64(len(s))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := s[:offset]
+	line := strings.Count(before, "\n") + 1
+	return line, len(before) - strings.LastIndex(before, "\n")
+}
+
+// deprecationWarning returns a message describing any deprecated keys in use.
+func (o *options) deprecationWarning() string {
+	return strings.Join(o.deprecations, "; ")
+}
+
+// ShadowOptions runs candidateParseOptions alongside parseOptions and logs
+// any differences between the two. The result of parseOptions is always the
+// one that is used.
+var ShadowOptions bool
+
+// candidateParseOptions is the option handling under evaluation in shadow
+// mode, nil when there is nothing to evaluate.
+var candidateParseOptions = strictParseOptions
+
+func parseOptions(s string) (options, error) {
+	return parseOptionsLogging(s, true)
+}
+
+// parseOptionsQuiet parses options like parseOptions, but neither logs them as
+// malformed nor compares them in shadow mode, for parsing the options of a
+// call a second time, as callSubject does.
+func parseOptionsQuiet(s string) (options, error) {
+	return parseOptionsLogging(s, false)
+}
+
+func parseOptionsLogging(s string, logging bool) (options, error) {
+	s, err := readOptionsFile(s)
+	if err != nil {
+		return options{}, flexAPIErr{err.Error()}
+	}
+	opts, err := doParseOptions(s)
+	if err != nil && logging {
+		Log.Log(jsonlog.Debug, jsonlog.Fields{"event": "malformedOptions", "options": maskSecretValues(s)})
+	}
+	if err != nil {
+		// Retry without what some Kubelets wrap the JSON in.
+		if clean := sanitizeOptions(s); clean != s {
+			if cleanOpts, cleanErr := doParseOptions(clean); cleanErr == nil {
+				s, opts, err = clean, cleanOpts, nil
+			}
+		}
+	}
+
+	if err == nil {
+		err = resolveOptionsResource(&opts)
+	}
+
+	if logging && ShadowOptions && candidateParseOptions != nil {
+		candidate, cErr := candidateParseOptions(s)
+		if cErr == nil {
+			cErr = resolveOptionsResource(&candidate)
+		}
+		for _, d := range diffOptions(opts, err, candidate, cErr) {
+			log.Printf("shadow options: %s", d)
+		}
+	}
+
+	return opts, err
+}
+
+// diffOptions describes how the candidate's result differs from the current.
+func diffOptions(current options, err error, candidate options, cErr error) []string {
+	var diffs []string
+
+	if (err == nil) != (cErr == nil) {
+		diffs = append(diffs, fmt.Sprintf("error: current %v, candidate %v", err, cErr))
+	}
+
+	cur, cand := current.resolved(), candidate.resolved()
+	keys := make(map[string]bool)
+	for k := range cur {
+		keys[k] = true
+	}
+	for k := range cand {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		if cur[k] != cand[k] {
+			diffs = append(diffs, fmt.Sprintf("%s: current %q, candidate %q", k, cur[k], cand[k]))
+		}
+	}
+
+	if current.deprecationWarning() != candidate.deprecationWarning() {
+		diffs = append(diffs, fmt.Sprintf("warnings: current %q, candidate %q", current.deprecationWarning(), candidate.deprecationWarning()))
+	}
+
+	return diffs
+}
+
+func doParseOptions(s string) (options, error) {
+	opts := options{}
+	raw := make(map[string]json.RawMessage)
+	err := json.Unmarshal([]byte(s), &raw)
+	if err != nil {
+		return opts, flexAPIErr{describeOptionsError(s, err)}
+	}
+
+	for _, d := range deprecatedOptions {
+		val, ok := raw[d.legacy]
+		if !ok {
+			continue
+		}
+		opts.deprecations = append(opts.deprecations,
+			fmt.Sprintf("option %q is deprecated, use %q instead", d.legacy, d.current))
+		if _, ok := raw[d.current]; !ok {
+			raw[d.current] = val
+		}
+		delete(raw, d.legacy)
+	}
+
+	// Accept the resources and their dependencies both as JSON and as a
+	// string holding it, which is all StorageClass parameters can hold.
+	if v, ok := raw["resources"]; ok && bytes.HasPrefix(bytes.TrimSpace(v), []byte("[")) {
+		raw["resources"], _ = json.Marshal(string(v))
+	}
+	if v, ok := raw["dependsOn"]; ok && bytes.HasPrefix(bytes.TrimSpace(v), []byte("{")) {
+		raw["dependsOn"], _ = json.Marshal(string(v))
+	}
+
+	// The Kubelet passes the data of secrets base64 encoded.
+	for k, v := range raw {
+		if !strings.HasPrefix(k, secretOptionPrefix) {
+			continue
+		}
+		var encoded string
+		if err := json.Unmarshal(v, &encoded); err != nil {
+			return opts, flexAPIErr{fmt.Sprintf("secret option %q must be a string", k)}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return opts, flexAPIErr{fmt.Sprintf("secret option %q is not base64 encoded", k)}
+		}
+		if opts.secrets == nil {
+			opts.secrets = make(map[string]string)
+		}
+		opts.secrets[strings.TrimPrefix(k, secretOptionPrefix)] = string(decoded)
+		delete(raw, k)
+	}
+
+	remapped, _ := json.Marshal(raw)
+	err = json.Unmarshal(remapped, &opts)
+	if err != nil {
+		return opts, flexAPIErr{describeOptionsError(string(remapped), err)}
+	}
+
+	if opts.ReservedBlocksPercent != "" {
+		pct, err := strconv.ParseFloat(opts.ReservedBlocksPercent, 64)
+		if err != nil || pct < 0 || pct > 5 {
+			return opts, flexAPIErr{fmt.Sprintf("reservedBlocksPercent must be a number between 0 and 5, got %q", opts.ReservedBlocksPercent)}
+		}
+	}
+
+	if opts.FullThresholdPercent != "" {
+		pct, err := strconv.ParseFloat(opts.FullThresholdPercent, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return opts, flexAPIErr{fmt.Sprintf("fullThresholdPercent must be a number between 0 and 100, got %q", opts.FullThresholdPercent)}
+		}
+	}
+
+	switch opts.Readwrite {
+	case "", "ro", "rw":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("kubernetes.io/readwrite must be one of \"ro\" or \"rw\", got %q", opts.Readwrite)}
+	}
+
+	mountOpts := make(map[string]bool)
+	for _, o := range opts.getMountOptions() {
+		mountOpts[o] = true
+	}
+	if mountOpts["ro"] && mountOpts["rw"] {
+		return opts, flexAPIErr{fmt.Sprintf("mountOptions %q contain both \"ro\" and \"rw\"", opts.MountOptions)}
+	}
+	if mountOpts["rw"] && opts.Readwrite == "ro" || mountOpts["ro"] && opts.Readwrite == "rw" {
+		return opts, flexAPIErr{fmt.Sprintf("mountOptions %q conflict with kubernetes.io/readwrite %q", opts.MountOptions, opts.Readwrite)}
+	}
+
+	switch opts.OnFull {
+	case "", "warn", "refuse":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("onFull must be one of \"warn\" or \"refuse\", got %q", opts.OnFull)}
+	}
+
+	switch opts.OnFenced {
+	case "", "fail", "wait":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("onFenced must be one of \"fail\" or \"wait\", got %q", opts.OnFenced)}
+	}
+
+	switch opts.OnOutdated {
+	case "", "refuse", "wait":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("onOutdated must be one of \"refuse\" or \"wait\", got %q", opts.OnOutdated)}
+	}
+
+	switch opts.OnDeviceMissing {
+	case "", "report", "reassign":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("onDeviceMissing must be one of \"report\" or \"reassign\", got %q", opts.OnDeviceMissing)}
+	}
+
+	if opts.MaxOverCommit != "" {
+		ratio, err := strconv.ParseFloat(opts.MaxOverCommit, 64)
+		if err != nil || ratio <= 0 {
+			return opts, flexAPIErr{fmt.Sprintf("maxOverCommit must be a positive number, got %q", opts.MaxOverCommit)}
+		}
+	}
+
+	switch opts.OnOverCommit {
+	case "", "warn", "refuse":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("onOverCommit must be one of \"warn\" or \"refuse\", got %q", opts.OnOverCommit)}
+	}
+
+	if opts.Resources != "" {
+		var names []string
+		if err := json.Unmarshal([]byte(opts.Resources), &names); err != nil || len(names) == 0 {
+			return opts, flexAPIErr{fmt.Sprintf("resources must be a non-empty JSON array of resource names, got %q", opts.Resources)}
+		}
+	}
+	if opts.DependsOn != "" {
+		var deps map[string][]string
+		if err := json.Unmarshal([]byte(opts.DependsOn), &deps); err != nil {
+			return opts, flexAPIErr{fmt.Sprintf("dependsOn must be a JSON object mapping resources to arrays of resources, got %q", opts.DependsOn)}
+		}
+		if _, err := attachOrder(opts.getResources(), deps); err != nil {
+			return opts, flexAPIErr{fmt.Sprintf("dependsOn: %v", err)}
+		}
+	}
+
+	if _, err := drbd.ParseMkfsOptions(opts.MkfsOptions); err != nil {
+		return opts, flexAPIErr{err.Error()}
+	}
+
+	if err := drbd.CheckSubPath(opts.SubPath); err != nil {
+		return opts, flexAPIErr{err.Error()}
+	}
+
+	if err := drbd.CheckFSLabel(opts.FsType, opts.FSLabel); err != nil {
+		return opts, flexAPIErr{err.Error()}
+	}
+
+	switch opts.Relabel {
+	case "", "true", "false":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("relabel must be one of \"true\" or \"false\", got %q", opts.Relabel)}
+	}
+	if opts.Relabel == "true" && opts.FSLabel == "" {
+		return opts, flexAPIErr{"relabel requires fsLabel"}
+	}
+
+	switch opts.BlockMode {
+	case "", "true", "false":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("blockMode must be one of \"true\" or \"false\", got %q", opts.BlockMode)}
+	}
+	if opts.BlockMode == "true" && (opts.FsType != "" || opts.SubPath != "") {
+		return opts, flexAPIErr{"blockMode excludes kubernetes.io/fsType and subPath"}
+	}
+
+	switch opts.StagedMount {
+	case "", "true", "false":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("stagedMount must be one of \"true\" or \"false\", got %q", opts.StagedMount)}
+	}
+	if opts.BlockMode == "true" && opts.StagedMount == "true" {
+		return opts, flexAPIErr{"blockMode excludes stagedMount"}
+	}
+
+	switch opts.FsckOnMount {
+	case "", "true", "false":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("fsckOnMount must be one of \"true\" or \"false\", got %q", opts.FsckOnMount)}
+	}
+	if opts.PreMountHook != "" && (!filepath.IsAbs(opts.PreMountHook) || filepath.Clean(opts.PreMountHook) != opts.PreMountHook) {
+		return opts, flexAPIErr{fmt.Sprintf("preMountHook must be a clean absolute path, got %q", opts.PreMountHook)}
+	}
+	if opts.PreMountHook != "" && filepath.Dir(opts.PreMountHook) != filepath.Clean(PreMountHookDir) {
+		return opts, flexAPIErr{fmt.Sprintf("preMountHook must be in %s, got %q", PreMountHookDir, opts.PreMountHook)}
+	}
+
+	switch opts.Diskless {
+	case "", "true", "false":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("diskless must be one of \"true\" or \"false\", got %q", opts.Diskless)}
+	}
+
+	switch opts.LongNames {
+	case "", "fail", "hash":
+	default:
+		return opts, flexAPIErr{fmt.Sprintf("longNames must be one of \"fail\" or \"hash\", got %q", opts.LongNames)}
+	}
+
+	if opts.FSGroup != "" {
+		if gid, err := strconv.ParseInt(opts.FSGroup, 10, 64); err != nil || gid < 0 {
+			return opts, flexAPIErr{fmt.Sprintf("kubernetes.io/fsGroup must be a group ID, got %q", opts.FSGroup)}
+		}
+	}
+
+	if opts.PrewarmBytes != "" {
+		size, err := strconv.ParseInt(opts.PrewarmBytes, 10, 64)
+		if err != nil || size <= 0 {
+			return opts, flexAPIErr{fmt.Sprintf("prewarmBytes must be a positive number of bytes, got %q", opts.PrewarmBytes)}
+		}
+	}
+
+	if opts.LagThresholdBytes != "" {
+		n, err := strconv.ParseInt(opts.LagThresholdBytes, 10, 64)
+		if err != nil || n < 0 {
+			return opts, flexAPIErr{fmt.Sprintf("lagThresholdBytes must be a number of bytes, got %q", opts.LagThresholdBytes)}
+		}
+	}
+
+	if opts.MinReplicas != "" {
+		n, err := strconv.Atoi(opts.MinReplicas)
+		if err != nil || n < 1 {
+			return opts, flexAPIErr{fmt.Sprintf("minReplicas must be a positive number, got %q", opts.MinReplicas)}
+		}
+	}
+
+	if opts.MinPoolFreeBytes != "" {
+		size, err := strconv.ParseInt(opts.MinPoolFreeBytes, 10, 64)
+		if err != nil || size < 0 {
+			return opts, flexAPIErr{fmt.Sprintf("minPoolFreeBytes must be a number of bytes, got %q", opts.MinPoolFreeBytes)}
+		}
+	}
+
+	if opts.WaitTimeoutSeconds != "" {
+		n, err := strconv.Atoi(opts.WaitTimeoutSeconds)
+		if err != nil || n < 1 {
+			return opts, flexAPIErr{fmt.Sprintf("waitTimeoutSeconds must be a positive number of seconds, got %q", opts.WaitTimeoutSeconds)}
+		}
+	}
+
+	if opts.PlacementCount != "" {
+		n, err := strconv.Atoi(opts.PlacementCount)
+		if err != nil || n < 1 {
+			return opts, flexAPIErr{fmt.Sprintf("placementCount must be a positive number, got %q", opts.PlacementCount)}
+		}
+	}
+
+	if opts.SizeBytes != "" {
+		n, err := strconv.ParseInt(opts.SizeBytes, 10, 64)
+		if err != nil || n < 1 {
+			return opts, flexAPIErr{fmt.Sprintf("sizeBytes must be a positive number of bytes, got %q", opts.SizeBytes)}
+		}
+		if opts.PlacementCount == "" {
+			return opts, flexAPIErr{"sizeBytes requires placementCount, the replicas of the created resource"}
+		}
+	}
+
+	// The pool is passed to the backend as an argument of its own.
+	if strings.HasPrefix(opts.StoragePool, "-") || strings.ContainsAny(opts.StoragePool, " \t\n") {
+		return opts, flexAPIErr{fmt.Sprintf("storagePool must be the name of a storage pool, got %q", opts.StoragePool)}
+	}
+
+	return opts, nil
+}
+
+// getMountOptions splits mountOptions, dropping empty entries.
+func (o *options) getMountOptions() []string {
+	var mountOpts []string
+	for _, opt := range strings.Split(o.MountOptions, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			mountOpts = append(mountOpts, opt)
+		}
+	}
+	return mountOpts
+}
+
+// readOnly reports whether the volume is to be mounted read-only.
+func (o *options) readOnly() bool {
+	for _, opt := range o.getMountOptions() {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return layered(o.Readwrite, DefaultReadWrite) == "ro"
+}
+
+// getMkfsOptions returns the extra mkfs arguments, validated by parseOptions.
+func (o *options) getMkfsOptions() []string {
+	args, _ := drbd.ParseMkfsOptions(o.MkfsOptions)
+	return args
+}
+
+// getResources returns the resources of a batch attach, none for attaching a
+// single resource.
+func (o *options) getResources() []string {
+	var names []string
+	json.Unmarshal([]byte(o.Resources), &names)
+	return names
+}
+
+// getDependsOn returns the resources each resource of a batch attach needs
+// attached first.
+func (o *options) getDependsOn() map[string][]string {
+	var deps map[string][]string
+	json.Unmarshal([]byte(o.DependsOn), &deps)
+	return deps
+}
+
+// diskless reports whether attach assigns the resource without local
+// storage.
+func (o *options) diskless() bool {
+	return o.Diskless == "true"
+}
+
+// getFSGroup returns the fsGroup to apply to the volume, nil if none is set.
+func (o *options) getFSGroup() *int64 {
+	if o.FSGroup == "" {
+		return nil
+	}
+	gid, _ := strconv.ParseInt(o.FSGroup, 10, 64)
+	return &gid
+}
+
+func (o *options) getMaxOverCommit() float64 {
+	ratio, _ := strconv.ParseFloat(o.MaxOverCommit, 64)
+	return ratio
+}
+
+func (o *options) getMinPoolFreeBytes() int64 {
+	size, _ := strconv.ParseInt(o.MinPoolFreeBytes, 10, 64)
+	return size
+}
+
+// getPlacementCount returns placementCount, validated by parseOptions, zero
+// if it isn't set.
+func (o *options) getPlacementCount() int {
+	n, _ := strconv.Atoi(o.PlacementCount)
+	return n
+}
+
+// getSizeBytes returns sizeBytes, validated by parseOptions, zero if it
+// isn't set.
+func (o *options) getSizeBytes() int64 {
+	size, _ := strconv.ParseInt(o.SizeBytes, 10, 64)
+	return size
+}
+
+// defaultMinReplicas is the number of diskful replicas migrate keeps when no
+// minReplicas is given.
+const defaultMinReplicas = 2
+
+// migrateTimeout bounds how long migrate waits for a new replica to sync.
+const migrateTimeout = time.Hour * 6
+
+func (o *options) getMinReplicas() int {
+	n, err := strconv.Atoi(o.MinReplicas)
+	if err != nil {
+		return defaultMinReplicas
+	}
+	return n
+}
+
+// defaultPrewarmBytes is read from the device when no prewarmBytes is given.
+const defaultPrewarmBytes = 256 << 20
+
+// prewarmTimeout bounds how long prewarming may keep running.
+const prewarmTimeout = time.Minute * 5
+
+func (o *options) getPrewarmBytes() int64 {
+	size, err := strconv.ParseInt(o.PrewarmBytes, 10, 64)
+	if err != nil {
+		return defaultPrewarmBytes
+	}
+	return size
+}
+
+// defaultFullThresholdPercent is used when no fullThresholdPercent is given.
+const defaultFullThresholdPercent = 95
+
+func (o *options) getFullThresholdPercent() float64 {
+	pct, err := strconv.ParseFloat(o.FullThresholdPercent, 64)
+	if err != nil {
+		return defaultFullThresholdPercent
+	}
+	return pct
+}
+
+// joinWarnings combines all non-empty warnings into a single message.
+func joinWarnings(warnings ...string) string {
+	return strings.Join(nonEmpty(warnings...), "; ")
+}
+
+// nonEmpty is warnings without the empty ones.
+func nonEmpty(warnings ...string) []string {
+	var w []string
+	for _, s := range warnings {
+		if s != "" {
+			w = append(w, s)
+		}
+	}
+	return w
+}
+
+// appendMessage adds msg to the message of the response out, keeping all of
+// its other fields.
+func appendMessage(out, msg string) string {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(out), &fields); err != nil {
+		return out
+	}
+	current, _ := fields["message"].(string)
+	fields["message"] = joinWarnings(current, msg)
+	res, _ := json.Marshal(fields)
+	return string(res)
+}
+
+type historyResponse struct {
+	response
+	Events []history.Event `json:"events"`
+}
+
+type FlexVolumeApi struct{}
+
+// Events configures posting the outcome of mutating calls as Kubernetes
+// Events, disabled unless a server is set.
+var Events events.Config
+
+// defaultWaitRetries is how often attach and isattached poll for the device
+// and assignment unless configured otherwise.
+const defaultWaitRetries = 4
+
+// waitPollInterval is roughly how long one poll of drbd.WaitForDevPath and
+// drbd.WaitForAssignment takes.
+const waitPollInterval = 2
+
+// WaitRetries is how often attach and isattached poll for the device and
+// assignment, for calls without waitTimeoutSeconds.
+var WaitRetries = defaultWaitRetries
+
+// ParseWaitTimeout converts a timeout in seconds into the number of polls
+// waiting for a device or assignment takes. Invalid or non-positive timeouts
+// yield the default.
+func ParseWaitTimeout(seconds string) int {
+	n, err := strconv.Atoi(seconds)
+	if err != nil || n <= 0 {
+		return defaultWaitRetries
+	}
+	return (n + waitPollInterval - 1) / waitPollInterval
+}
+
+// MaxMinors is the number of DRBD minors a node can handle, getvolumelimits
+// reports how many of them are still free. Zero or less means unknown.
+var MaxMinors = 1000
+
+// DetachDeviceWait is how long detach waits for the device node to be
+// removed after unassigning, zero skips the check.
+var DetachDeviceWait = time.Second * 10
+
+// DetachSecondaryWait is how long detach waits for the resource to become
+// Secondary after demoting it.
+var DetachSecondaryWait = time.Second * 10
+
+// DetachInSyncWait is how long detach waits for the peers to have all data
+// of the resource before unassigning it, zero skips the check.
+var DetachInSyncWait = time.Second * 30
+
+// PreMountHookDir is the directory the operator installs pre-mount hooks in.
+// Volumes can only name hooks directly in it, not any executable on the node.
+var PreMountHookDir = "/etc/drbd-flexvolume/hooks"
+
+// ResizeDeviceWait is how long expand waits for the device to grow before
+// growing the filesystem on it.
+var ResizeDeviceWait = time.Second * 20
+
+// PluginVersion is the version of the plugin build, empty if unknown.
+var PluginVersion string
+
+// PromoteTimeout is how long mount retries promoting a resource that is
+// Primary on another node.
+var PromoteTimeout = time.Second * 10
+
+// Log receives a structured line for every call and its outcome, nil
+// disables it. It never influences the response.
+var Log *jsonlog.Logger
+
+// RateLimit caps how often mutating calls may run on the node, disabled
+// unless a rate is set.
+var RateLimit ratelimit.Limiter
+
+// RateLimitWait bounds how long a mutating call waits for its turn under the
+// rate limit before it fails.
+var RateLimitWait = time.Second * 30
+
+// SyncWaitTimeout bounds how long attach waits for a diskful replica to
+// become UpToDate; the attach fails and is retried by the Kubelet if the
+// replica is still syncing after that.
+var SyncWaitTimeout = time.Minute
+
+// LockTimeout bounds how long attach, detach, mount, unmount, migrate and
+// drainnode wait for another call on the same resource to finish.
+var LockTimeout = time.Second * 10
+
+// lockedActions are serialized per resource. Attach and detach take their
+// locks themselves, as the typed API shares them with Call.
+var lockedActions = map[string]bool{
+	"mountdevice": true, "mount": true, "unmountdevice": true, "unmount": true, "drainnode": true,
+	"migrate": true,
+}
+
+func (api FlexVolumeApi) Call(s []string) (string, int) {
+	// The mount is gone after unmounting, look up the resource up front.
+	subj := callSubject(s)
+
+	action := ""
+	if len(s) > 0 {
+		action = s[0]
+	}
+	resources := subj.resources()
+	logResource := strings.Join(resources, ",")
+	Log.Log(jsonlog.Info, jsonlog.Fields{"event": "call", "action": action, "resource": logResource, "node": subj.node})
+	if opts := subj.opts.resolved(); len(opts) > 0 {
+		Log.Log(jsonlog.Debug, jsonlog.Fields{"event": "options", "action": action, "resource": logResource, "options": opts})
+	}
+
+	out, ret := "", EXITSUCCESS
+	// The bucket is a file, stateless mode has none to share.
+	if a := lookupAction(action); a != nil && a.mutating && RateLimit.Enabled() && !StatelessMode {
+		if err := RateLimit.Wait(RateLimitWait); err != nil {
+			res, _ := json.Marshal(response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			})
+			out, ret = string(res), EXITDRBDFAILURE
+		}
+	}
+	if out == "" {
+		start := time.Now()
+		out, ret = api.lockedDispatch(s, subj)
+		result := "success"
+		if ret != EXITSUCCESS {
+			result = "failure"
+		}
+		d := time.Since(start)
+		// The metrics file is a write stateless mode doesn't make.
+		if !StatelessMode {
+			if err := metrics.Record(action, result, d); err != nil {
+				log.Printf("unable to record metrics: %v", err)
+			}
+		}
+		if err := metrics.Emit(action, result, d); err != nil {
+			log.Printf("unable to emit metrics: %v", err)
+		}
+	}
+
+	if subj.opts.DiagnosticBundleOnFailure == "true" && ret != EXITSUCCESS {
+		// Calls that don't act on a resource still get a bundle.
+		diagnosed := resources
+		if len(diagnosed) == 0 {
+			diagnosed = []string{""}
+		}
+		for _, resource := range diagnosed {
+			bundle, err := drbd.CaptureDiagnostics(resource)
+			if err != nil {
+				log.Printf("unable to capture diagnostics of %s: %v", resource, err)
+			} else {
+				out = appendMessage(out, "diagnostics saved to "+bundle)
+			}
+		}
+	}
+
+	for _, resource := range resources {
+		recordHistory(s[0], resource, subj.node, out)
+		if Events.Enabled() {
+			one := subj
+			one.resource = resource
+			postEvent(s[0], one, out)
+		}
+	}
+
+	res := response{}
+	json.Unmarshal([]byte(out), &res)
+	level := jsonlog.Info
+	if ret != EXITSUCCESS {
+		level = jsonlog.Error
+	}
+	Log.Log(level, jsonlog.Fields{"event": "result", "action": action, "resource": logResource, "node": subj.node,
+		"status": res.Status, "message": res.Message, "reason": res.Reason, "exitCode": ret})
+
+	return out, int(ret)
+}
+
+// lockedDispatch dispatches the call holding the locks of its resources, for
+// actions that must not overlap on the same resource.
+func (api FlexVolumeApi) lockedDispatch(s []string, subj subject) (string, exitCode) {
+	resources := subj.resources()
+	if len(s) < 1 || !lockedActions[s[0]] || len(resources) == 0 {
+		return api.dispatch(s)
+	}
+
+	release, cerr := lockResources(s[0], resources)
+	if cerr != nil {
+		res, _ := json.Marshal(cerr.response())
+		return string(res), cerr.code
+	}
+	defer release()
+	return api.dispatch(s)
+}
+
+// lockResources takes the locks of the resources, returning a function
+// releasing them again. Calls acting on several resources take their locks
+// in sorted order, so that two of them can't each wait for a lock the other
+// holds.
+func lockResources(action string, resources []string) (func(), *CallError) {
+	sorted := append([]string{}, resources...)
+	sort.Strings(sorted)
+
+	var locks []*lock.Lock
+	release := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Release()
+		}
+	}
+	for _, resource := range sorted {
+		l, err := lock.Acquire(resource, LockTimeout)
+		if err != nil {
+			release()
+			if err == lock.ErrTimeout {
+				return nil, newCallError(EXITDRBDFAILURE, failureDetails(err),
+					"%s: resource %s is busy with another call, retry later", action, resource)
+			}
+			return nil, newCallError(EXITDRBDFAILURE, failureDetails(err),
+				"%s: unable to lock resource %s: %v", action, resource, err)
+		}
+		locks = append(locks, l)
+	}
+	return release, nil
+}
+
+func (api FlexVolumeApi) dispatch(s []string) (string, exitCode) {
+	if len(s) < 1 {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{"No driver action! Valid actions are: " + actionNames()}.Error(),
+			errorDetails: detailsInvalidArguments,
+		})
+		return string(res), EXITBADAPICALL
+	}
+	a := lookupAction(s[0])
+	if a == nil {
+		res, _ := json.Marshal(response{
+			Status:       "Not supported",
+			Message:      flexAPIErr{fmt.Sprintf("Unsupported driver action: %s", s[0])}.Error(),
+			errorDetails: detailsUnsupported,
+		})
+		return string(res), EXITBADAPICALL
+	}
+	return a.run(api, s)
+}
+
+// version reports the versions of the plugin and of the DRBD tooling on this
+// node, "unknown" for those that can't be told.
+func (api FlexVolumeApi) version() (string, exitCode) {
+	res, _ := json.Marshal(versionResponse{
+		PluginVersion:     versionOrUnknown(PluginVersion),
+		DRBDUtilsVersion:  drbd.UtilsVersion(),
+		DRBDKernelVersion: drbd.KernelVersion(),
+		response:          response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
+
+func versionOrUnknown(v string) string {
+	if v == "" {
+		return drbd.VersionUnknown
+	}
+	return v
+}
+
+func (api FlexVolumeApi) init() (string, exitCode) {
+	res, _ := json.Marshal(initResponse{
+		Capabilities: DefaultCapabilities,
+		Backend:      drbd.BackendName(),
+		response:     response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
+
+type selftestResponse struct {
+	response
+	Checks  []drbd.Check `json:"checks"`
+	Backend string       `json:"backend,omitempty"`
+}
+
+// selftest checks that the node has what the plugin needs to talk to DRBD,
+// and, if it does, that DRBD minors are left for more volumes.
+func (api FlexVolumeApi) selftest() (string, exitCode) {
+	p := drbd.CheckPrerequisites()
+	if p.OK() {
+		inUse, err := drbd.MinorsInUse()
+		p.Checks = append(p.Checks, minorsCheck(MaxMinors, inUse, err))
+	}
+	return selftestResult(p)
+}
+
+// minorsCheck reports how many of the maxMinors DRBD minors are in use, and
+// fails once all of them are.
+func minorsCheck(maxMinors, inUse int, err error) drbd.Check {
+	c := drbd.Check{Name: "minors"}
+	switch {
+	case err != nil:
+		c.Detail = fmt.Sprintf("unable to count DRBD minors in use: %v", err)
+	case maxMinors <= 0:
+		c.OK = true
+		c.Detail = fmt.Sprintf("%d in use", inUse)
+	case inUse >= maxMinors:
+		c.Detail = fmt.Sprintf("all %d DRBD minors in use", maxMinors)
+	default:
+		c.OK = true
+		c.Detail = fmt.Sprintf("%d of %d in use", inUse, maxMinors)
+	}
+	return c
+}
+
+func selftestResult(p drbd.Prerequisites) (string, exitCode) {
+	var failed []string
+	for _, c := range p.Checks {
+		if !c.OK {
+			failed = append(failed, c.Detail)
+		}
+	}
+	if len(failed) > 0 {
+		res, _ := json.Marshal(selftestResponse{
+			Checks:  p.Checks,
+			Backend: drbd.BackendName(),
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("selftest: %s", strings.Join(failed, "; "))}.Error(),
+				errorDetails: detailsCheckFailed,
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(selftestResponse{
+		Checks:   p.Checks,
+		Backend:  drbd.BackendName(),
+		response: response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
+
+type volumeLimits struct {
+	AttachLimit int `json:"attachLimit"`
+}
+
+type volumeLimitsResponse struct {
+	response
+	Capabilities volumeLimits `json:"capabilities"`
+}
+
+// getVolumeLimits reports how many more volumes can be attached to this
+// node, from the DRBD minors still free.
+func (api FlexVolumeApi) getVolumeLimits() (string, exitCode) {
+	inUse, err := drbd.MinorsInUse()
+	return volumeLimitsResult(MaxMinors, inUse, err)
+}
+
+func volumeLimitsResult(maxMinors, inUse int, err error) (string, exitCode) {
+	if maxMinors <= 0 || err != nil {
+		msg := "number of DRBD minors is unknown"
+		if err != nil {
+			msg = fmt.Sprintf("unable to count DRBD minors in use: %v", err)
+		}
+		res, _ := json.Marshal(response{
+			Status:       "Not supported",
+			Message:      flexAPIErr{fmt.Sprintf("getvolumelimits: %s", msg)}.Error(),
+			errorDetails: detailsUnsupported,
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	res, _ := json.Marshal(volumeLimitsResponse{
+		Capabilities: volumeLimits{AttachLimit: attachLimit(maxMinors, inUse)},
+		response:     response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// attachLimit is the number of minors left out of maxMinors.
+func attachLimit(maxMinors, inUse int) int {
+	if inUse >= maxMinors {
+		return 0
+	}
+	return maxMinors - inUse
+}
+
+func (api FlexVolumeApi) attach(s []string) (string, exitCode) {
+	if len(s) < 3 {
+		return tooFewArgsResponse(s)
+	}
+	s, err := withDRBDNode(s)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve node %q: %v", s[0], s[2], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	opts, err := parseOptions(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	if names := opts.getResources(); len(names) > 0 {
+		return api.attachResources(s, opts, names)
+	}
+
+	result, cerr := attachLocked(s[0], s[2], opts)
+	if cerr != nil {
+		res, _ := json.Marshal(attachResponse{
+			AttachResult: result,
+			response:     cerr.response(),
+		})
+		return string(res), cerr.code
+	}
+
+	res, _ := json.Marshal(attachResponse{
+		AttachResult: result,
+		response: response{
+			Status:  "Success",
+			Message: joinWarnings(result.Warnings...),
+		},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// attachResource attaches the resource of opts to node. On failure, the
+// result holds what was learned about the resource until then.
+func attachResource(action, node string, opts options) (AttachResult, *CallError) {
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return AttachResult{}, newCallError(EXITBADAPICALL, detailsInvalidName, "%s: %v", action, err)
+	}
+
+	resource := drbd.Resource{
+		Name:           opts.getResource(),
+		NodeName:       node,
+		Checkpoint:     opts.ProgressFile == "true",
+		MinPoolFree:    opts.getMinPoolFreeBytes(),
+		Diskless:       opts.diskless(),
+		SharedSecret:   opts.getSharedSecret(),
+		PlacementCount: opts.getPlacementCount(),
+		StoragePool:    opts.StoragePool,
+		Size:           opts.getSizeBytes(),
+	}
+	if opts.OnOverCommit == "refuse" {
+		resource.MaxOverCommit = opts.getMaxOverCommit()
+	}
+
+	if opts.longName != "" {
+		// Without the name map, detach would never find the resource.
+		if StatelessMode {
+			return AttachResult{}, newCallError(EXITBADAPICALL, detailsInvalidOptions,
+				"%s: shortened name of %q can't be recorded in stateless mode", action, opts.longName)
+		}
+		if err := recordName(opts.longName, resource.Name); err != nil {
+			return AttachResult{}, newCallError(EXITDRBDFAILURE, detailsFailure,
+				"%s: unable to record shortened name of %q: %v", action, opts.longName, err)
+		}
+	}
+
+	// Only diskful replicas created here are removed again by detach.
+	before, beforeErr := "", error(nil)
+	if !resource.Diskless {
+		before, beforeErr = drbd.AssignmentType(resource)
+	}
+	_, err := assignWithRetry(func() (bool, error) { return drbd.AssignRes(resource) }, assignBackoff(opts.getWaitRetries()), time.Sleep)
+	if err != nil {
+		return AttachResult{}, newCallError(EXITDRBDFAILURE, failureDetails(err),
+			"%s: failed to assign resource %s: %v", action, resource.Name, err)
+	}
+	if !resource.Diskless && beforeErr == nil && before == drbd.AssignmentNone {
+		if err := drbd.RecordOwned(resource); err != nil {
+			log.Printf("%s: unable to record the assignment of %s, detach will keep it: %v", action, resource.Name, err)
+		}
+	}
+
+	path, err := drbd.WaitForDevPath(resource, opts.getWaitRetries())
+	if err != nil {
+		return AttachResult{}, newCallError(EXITDRBDFAILURE, failureDetails(err),
+			"%s: unable to find device path for resource %s: %v", action, resource.Name, err)
+	}
+
+	// A diskful replica is Inconsistent until its initial sync is done,
+	// diskless ones read from their peers.
+	if !resource.Diskless {
+		if diskState, err := drbd.WaitForUpToDate(resource, SyncWaitTimeout); err != nil {
+			return AttachResult{DiskState: diskState}, newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+		}
+	}
+
+	// A resource without peers is not replicated, which workloads expecting
+	// HA must not be given.
+	var peers *int
+	if n, err := drbd.Peers(resource); err == nil {
+		peers = &n
+	} else if opts.RequireReplication == "true" {
+		return AttachResult{}, newCallError(EXITDRBDFAILURE, failureDetails(err),
+			"%s: unable to check replication of resource %s: %v", action, resource.Name, err)
+	}
+	if peers != nil && *peers == 0 && opts.RequireReplication == "true" {
+		return AttachResult{Peers: peers}, newCallError(EXITDRBDFAILURE, detailsNotReplicated,
+			"%s: resource %s is not replicated, it has no peers", action, resource.Name)
+	}
+
+	// A StandAlone resource does not replicate until it is connected again,
+	// which degrades it but doesn't fail the attach.
+	var reconnectWarning string
+	if peers != nil && *peers > 0 {
+		reconnectWarning = recoverStandAlone(resource.Name,
+			func() string { return drbd.GetConnectionState(resource) },
+			func() error { return drbd.Reconnect(resource) })
+	}
+
+	// A fenced resource has its I/O suspended, don't hand it out to be mounted.
+	if reason, err := drbd.Suspended(resource); err == nil && reason != "" {
+		err = fmt.Errorf("resource %s fenced, I/O suspended (%s)", resource.Name, reason)
+		if opts.OnFenced == "wait" {
+			err = drbd.WaitForResume(resource, opts.getWaitRetries())
+		}
+		if err != nil {
+			return AttachResult{}, newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+		}
+	}
+
+	// An Outdated disk knowingly holds stale data, never hand it out unless
+	// it catches up.
+	diskState, err := drbd.DiskState(resource)
+	if err == nil && diskState == drbd.DiskOutdated {
+		err = fmt.Errorf("resource %s disk is %s, refusing to use stale data", resource.Name, diskState)
+		if opts.OnOutdated == "wait" {
+			diskState, err = drbd.WaitForUpToDate(resource, opts.getWaitTimeout())
+		}
+		if err != nil {
+			return AttachResult{DiskState: diskState}, newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+		}
+	}
+
+	overCommit, overCommitWarning := checkOverCommit(opts.getMaxOverCommit())
+
+	// Prewarming is best effort, a failure doesn't fail the attach.
+	var prewarm, prewarmWarning string
+	if opts.Prewarm == "true" {
+		prewarm, err = drbd.Prewarm(path, opts.getPrewarmBytes(), prewarmTimeout)
+		if err != nil {
+			prewarmWarning = err.Error()
+		}
+	}
+
+	// Verification is expensive, it runs in the background after we return.
+	var verify, verifyWarning string
+	if opts.VerifyAfterAttach == "true" {
+		if err := startVerify(resource); err != nil {
+			verifyWarning = err.Error()
+		} else {
+			verify = drbd.VerifyRunning
+		}
+	}
+
+	return AttachResult{
+		Device:     path,
+		Prewarm:    prewarm,
+		DiskState:  diskState,
+		Verify:     verify,
+		Peers:      peers,
+		OverCommit: overCommit,
+		Warnings:   nonEmpty(reconnectWarning, overCommitWarning, prewarmWarning, verifyWarning),
+	}, nil
+}
+
+// assignBackoff is how attach retries transient assign failures, for at
+// most as long as it waits, polling waitRetries times, for the device
+// afterwards.
+func assignBackoff(waitRetries int) drbd.Backoff {
+	return drbd.Backoff{
+		Timeout:     time.Duration(waitRetries) * time.Second * 2,
+		Interval:    time.Second,
+		MaxInterval: time.Second * 8,
+	}
+}
+
+// assignWithRetry calls assign again as scheduled by b for as long as it
+// fails transiently, and returns its last result.
+func assignWithRetry(assign func() (bool, error), b drbd.Backoff, sleep func(time.Duration)) (bool, error) {
+	var ok bool
+	var err error
+	b.Poll(func(attempt, attempts int) bool {
+		ok, err = assign()
+		if err == nil || !drbd.IsTransient(err) {
+			return true
+		}
+		if attempt+1 < attempts {
+			log.Printf("retrying assignment after transient failure %d of %d: %v", attempt+1, attempts, err)
+		}
+		return false
+	}, sleep)
+	return ok, err
+}
+
+// recoverStandAlone reconnects the resource if it is StandAlone, e.g. after a
+// network partition, and warns if it stays disconnected.
+func recoverStandAlone(name string, state func() string, reconnect func() error) string {
+	if state() != "StandAlone" {
+		return ""
+	}
+	log.Printf("reconnecting StandAlone resource %s", name)
+	if err := reconnect(); err != nil {
+		return fmt.Sprintf("resource %s is StandAlone and not replicating: %v", name, err)
+	}
+	return ""
+}
+
+// waitForAttach confirms that the device attach returned, passed by the
+// Kubelet as waitforattach <device> <options>, belongs to the resource and
+// its node exists.
+func (api FlexVolumeApi) waitForAttach(s []string) (string, exitCode) {
+	if len(s) < 3 {
+		return tooFewArgsResponse(s)
+	}
+
+	opts, err := parseOptions(s[2])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+
+	resource := drbd.Resource{Name: opts.getResource()}
+	return waitForAttachResult(s[0], s[1], func() (string, error) {
+		return drbd.WaitForDevPath(resource, opts.getWaitRetries())
+	}, deviceExists)
+}
+
+func waitForAttachResult(action, requested string, wait func() (string, error), exists func(string) bool) (string, exitCode) {
+	device, err := wait()
+	if err = deviceError(requested, device, err, exists); err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", action, err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(attachResponse{
+		AttachResult: AttachResult{Device: device},
+		response:     response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// deviceError tells why the device a wait for it returned, with err, can't
+// be used, nil if it can. Unless requested is empty, it must be the device.
+func deviceError(requested, device string, err error, exists func(string) bool) error {
+	switch {
+	case err != nil:
+		return fmt.Errorf("device never appeared: %w", err)
+	case device == "":
+		return fmt.Errorf("device never appeared")
+	case requested != "" && requested != device:
+		return fmt.Errorf("expected device %s, but the resource's device is %s", requested, device)
+	case !exists(device):
+		return fmt.Errorf("device node %s does not exist", device)
+	}
+	return nil
+}
+
+func (api FlexVolumeApi) detach(s []string) (string, exitCode) {
+	if len(s) < 3 {
+		return tooFewArgsResponse(s)
+	}
+	s, err := withDRBDNode(s)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve node %q: %v", s[0], s[2], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	resource, err := volumeResource(s[1], s[2])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve resource %q: %v", s[0], s[1], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	// The Kubelet never passes options to detach, they are only given by
+	// hand, e.g. to force an emergency detach.
+	var opts options
+	if len(s) > 3 {
+		if opts, err = parseOptions(s[3]); err != nil {
+			res, _ := json.Marshal(response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			})
+			return string(res), EXITBADAPICALL
+		}
+	}
+
+	if cerr := detachLocked(s[0], resource, opts); cerr != nil {
+		res, _ := json.Marshal(cerr.response())
+		return string(res), cerr.code
+	}
+
+	res, _ := json.Marshal(response{Status: "Success"})
+	return string(res), EXITSUCCESS
+}
+
+// volumeResource is the resource of the volume on node, as detach is passed
+// volume names rather than options.
+func volumeResource(volume, node string) (drbd.Resource, error) {
+	name, err := resolveResourceName(resourceOfVolume(volume))
+	if err != nil {
+		return drbd.Resource{}, err
+	}
+	return drbd.Resource{Name: mappedName(name), NodeName: node}, nil
+}
+
+// detachResource unassigns the resource from its node.
+func detachResource(action string, resource drbd.Resource, opts options) *CallError {
+	if err := drbd.ValidateResourceName(resource.Name); err != nil {
+		return newCallError(EXITBADAPICALL, detailsInvalidName, "%s: %v", action, err)
+	}
+
+	// Mounts and roles can only be seen on the node itself.
+	if host, _ := os.Hostname(); host == resource.NodeName {
+		err := checkNotMounted(func() (bool, error) { return drbd.IsMounted(resource) }, opts.Force == "true")
+		if err != nil {
+			return newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+		}
+
+		// Unassigning a replica the peers haven't caught up with could lose
+		// the last writes.
+		if DetachInSyncWait > 0 {
+			err = drbd.WaitForInSync(resource, DetachInSyncWait)
+			if err != nil && opts.Force == "true" {
+				log.Printf("%s: detaching %s anyway: %v", action, resource.Name, err)
+			} else if err != nil {
+				return newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+			}
+		}
+
+		err = demoteForDetach(
+			func() (string, error) { return drbd.Role(resource) },
+			resource.Demote,
+			func() error { return drbd.WaitForSecondary(resource, DetachSecondaryWait) })
+		if err != nil && opts.Force == "true" {
+			log.Printf("%s: detaching %s anyway: %v", action, resource.Name, err)
+		} else if err != nil {
+			return newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+		}
+	}
+
+	var device string
+	var devErr error
+	unassigned, err := detachAssignment(
+		func() (string, error) { return drbd.AssignmentType(resource) },
+		func() bool { return drbd.Owned(resource) },
+		func() error {
+			// Look up the device while the resource is still assigned.
+			device, devErr = drbd.DevicePath(resource)
+			return drbd.UnassignRes(resource)
+		})
+	if err != nil {
+		return newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+	}
+	if !unassigned {
+		return nil
+	}
+	if err := drbd.ForgetOwned(resource); err != nil {
+		log.Printf("%s: unable to forget the assignment of %s: %v", action, resource.Name, err)
+	}
+
+	// A lingering device node could be mistaken for the resource on the next
+	// attach, detach only succeeds once it is gone.
+	if DetachDeviceWait > 0 {
+		if devErr != nil {
+			log.Printf("unable to verify removal of the device of %s: %v", resource.Name, devErr)
+		} else if err := drbd.WaitForDeviceGone(device, DetachDeviceWait); err != nil {
+			return newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+		}
+	}
+	return nil
+}
+
+// checkNotMounted refuses to detach resources whose device is still mounted,
+// unless forced. If that can't be told, detach goes ahead.
+func checkNotMounted(isMounted func() (bool, error), force bool) error {
+	if force {
+		return nil
+	}
+	mounted, err := isMounted()
+	if err != nil {
+		log.Printf("unable to check whether the device is mounted: %v", err)
+		return nil
+	}
+	if mounted {
+		return fmt.Errorf("device is still mounted, retry after unmounting it")
+	}
+	return nil
+}
+
+// demoteForDetach makes a Primary resource Secondary before it is unassigned,
+// and waits for it to be. A resource without a role to query is not
+// configured on the node anymore, and has nothing to demote.
+func demoteForDetach(role func() (string, error), demote func() error, waitSecondary func() error) error {
+	if current, err := role(); err != nil || current == drbd.RoleSecondary {
+		return nil
+	}
+	if err := demote(); err != nil {
+		return err
+	}
+	return waitSecondary()
+}
+
+// detachAssignment unassigns client assignments, and replicas with local
+// storage that attach created, and reports whether it did. Other local
+// replicas are kept, and resources that aren't assigned, e.g. when the
+// Kubelet retries a detach, are already detached.
+func detachAssignment(assignment func() (string, error), owned func() bool, unassign func() error) (bool, error) {
+	current, err := assignment()
+	if err != nil {
+		return false, err
+	}
+	if current != drbd.AssignmentDiskless && (current != drbd.AssignmentDiskful || !owned()) {
+		return false, nil
+	}
+	if err := unassign(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (api FlexVolumeApi) mountDevice(s []string) (string, exitCode) {
+	if len(s) < 4 {
+		return tooFewArgsResponse(s)
+	}
+
+	opts, err := parseOptions(s[3])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+
+	resource := drbd.Resource{Name: opts.getResource()}
+	if cerr := mountDeviceReady(s[0], func() (string, error) {
+		return drbd.WaitForDevPath(resource, opts.getWaitRetries())
+	}, deviceExists); cerr != nil {
+		res, _ := json.Marshal(cerr.response())
+		return string(res), cerr.code
+	}
+
+	mounter := drbd.Mounter{
+		Resource: &drbd.Resource{
+			Name:     opts.getResource(),
+			ReadOnly: opts.readOnly()},
+		FSType:                opts.FsType,
+		MountOptions:          opts.getMountOptions(),
+		FSGroup:               opts.getFSGroup(),
+		SafeFormat:            opts.safeFormat(),
+		ReservedBlocksPercent: opts.ReservedBlocksPercent,
+		MkfsOptions:           opts.getMkfsOptions(),
+		DiscardAfterFormat:    opts.DiscardAfterFormat == "true",
+		DurableFormat:         opts.DurableFormat == "true",
+		FullThresholdPercent:  opts.getFullThresholdPercent(),
+		RefuseFull:            opts.OnFull == "refuse",
+		SubPath:               opts.SubPath,
+		FSLabel:               opts.FSLabel,
+		Relabel:               opts.Relabel == "true",
+		PromoteTimeout:        PromoteTimeout,
+		BlockMode:             opts.BlockMode == "true",
+		FsckOnMount:           opts.FsckOnMount == "true",
+		PreMountHook:          opts.PreMountHook,
+		StagedMount:           opts.StagedMount == "true",
+	}
+
+	result, err := mounter.Mount(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %s", s[0], describeMountError(err))}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), mountExitCode(err)
+	}
+
+	if !StatelessMode {
+		err = registry.Record(registry.Entry{
+			Resource:     opts.getResource(),
+			Device:       result.Device,
+			Path:         s[1],
+			PVName:       opts.PVCResource,
+			Namespace:    opts.PodNamespace,
+			Pod:          opts.PodName,
+			PodUID:       opts.PodUID,
+			StorageClass: opts.StorageClass,
+			Time:         time.Now(),
+		})
+		if err != nil {
+			log.Printf("unable to record mount of %s: %v", opts.getResource(), err)
+		}
+	}
+
+	res, _ := json.Marshal(mountDeviceResponse{
+		ReservedBlocksPercent: result.ReservedBlocksPercent,
+		FSLabel:               result.FSLabel,
+		DeviceOpenRetries:     result.DeviceOpenRetries,
+		response: response{
+			Status:  "Success",
+			Message: joinWarnings(opts.deprecationWarning(), result.Warning),
+		},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// mountDeviceReady fails mountdevice, to be retried, while the device of the
+// resource isn't up on the node. The Kubelet may call mountdevice before
+// attach brought it up, or without calling attach at all.
+func mountDeviceReady(action string, wait func() (string, error), exists func(string) bool) *CallError {
+	device, err := wait()
+	if err = deviceError("", device, err, exists); err != nil {
+		err = &drbd.MountError{Cause: drbd.ErrDeviceNotReady, Err: err}
+		return newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %s", action, describeMountError(err))
+	}
+	return nil
+}
+
+// mountErrorMessages describe the causes of drbd.MountError.
+var mountErrorMessages = map[error]string{
+	drbd.ErrDeviceNotReady:   "device is not ready",
+	drbd.ErrFormatFailed:     "failed to create filesystem",
+	drbd.ErrAlreadyMounted:   "device is busy or already mounted",
+	drbd.ErrWrongFSType:      "device does not hold a filesystem of the requested type",
+	drbd.ErrFilesystemFull:   "filesystem is too full",
+	drbd.ErrPrimaryElsewhere: "resource is Primary on another node",
+	drbd.ErrMountFailed:      "mount failed",
+	drbd.ErrPreMountFailed:   "pre-mount check failed",
+}
+
+// describeMountError prefixes a human-readable cause to errors of
+// mounter.Mount, keeping the underlying error.
+func describeMountError(err error) string {
+	me, ok := err.(*drbd.MountError)
+	if !ok {
+		return err.Error()
+	}
+	if msg, ok := mountErrorMessages[me.Cause]; ok {
+		return fmt.Sprintf("%s: %v", msg, me.Err)
+	}
+	return me.Err.Error()
+}
+
+// mountExitCode is terminal for a device that holds another filesystem than
+// requested, which mounting again does not change.
+func mountExitCode(err error) exitCode {
+	if me, ok := err.(*drbd.MountError); ok && me.Cause == drbd.ErrWrongFSType {
+		return EXITBADAPICALL
+	}
+	return EXITDRBDFAILURE
+}
+
+// mount is the entrypoint of Kubelets that mount volumes straight into the
+// pod directory, either as mount <dir> <device> <options> or, without attach
+// support, as mount <dir> <options>. The device is always looked up from the
+// resource, so both are handled like mountdevice.
+func (api FlexVolumeApi) mount(s []string) (string, exitCode) {
+	dir, device, opts, err := parseMountArgs(s)
+	if err != nil {
+		return tooFewArgsResponse(s)
+	}
+	return api.mountDevice([]string{s[0], dir, device, opts})
+}
+
+// parseMountArgs returns the directory, device and options of either layout
+// of the mount call. Options always come last and are a JSON object, which
+// tells the two apart.
+func parseMountArgs(s []string) (string, string, string, error) {
+	switch {
+	case len(s) == 3 && strings.HasPrefix(strings.TrimSpace(s[2]), "{"):
+		return s[1], "", s[2], nil
+	case len(s) >= 4:
+		return s[1], s[2], s[3], nil
+	}
+	return "", "", "", fmt.Errorf("too few arguments")
+}
+
+func (api FlexVolumeApi) unmountDevice(s []string) (string, exitCode) {
+	return api.unmount(s)
+}
+
+// releaseTimeout bounds how long unmount waits for the device to be released.
+const releaseTimeout = time.Second * 10
+
+func (api FlexVolumeApi) unmount(s []string) (string, exitCode) {
+	if len(s) < 2 {
+		return tooFewArgsResponse(s)
+	}
+	umounter := drbd.Mounter{ReleaseTimeout: releaseTimeout}
+
+	err := umounter.UnMount(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	if !StatelessMode {
+		if err := registry.RemoveByPath(s[1]); err != nil {
+			log.Printf("unable to remove mount of %s from registry: %v", s[1], err)
+		}
+	}
+	res, _ := json.Marshal(response{Status: "Success"})
+	return string(res), EXITSUCCESS
+}
+
+func (api FlexVolumeApi) getVolumeName(s []string) (string, exitCode) {
+	if len(s) < 2 {
+		return tooFewArgsResponse(s)
+	}
+
+	opts, err := parseOptions(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+
+	volName := getVolNameResponse{
+		VolumeName: volumeName(opts.getResource(), func(name string) (string, error) {
+			return drbd.GetResourceUUID(drbd.Resource{Name: name})
+		}),
+		response: response{
+			Status:  "Success",
+			Message: opts.deprecationWarning(),
+		},
+	}
+	if opts.Debug == "true" {
+		volName.Options = opts.resolved()
+	}
+
+	res, _ := json.Marshal(volName)
+	return string(res), EXITSUCCESS
+}
+
+// checkOverCommit returns the thin pool's over-commit ratio and a warning if
+// it exceeds max. Nothing is checked when max is zero.
+func checkOverCommit(max float64) (float64, string) {
+	if max <= 0 {
+		return 0, ""
+	}
+	ratio, err := drbd.OverCommit()
+	if err != nil {
+		return 0, fmt.Sprintf("unable to check thin pool over-commit: %v", err)
+	}
+	if ratio > max {
+		return ratio, fmt.Sprintf("thin pool %s is over-committed %.2f times, more than %.2f", drbd.ThinPool, ratio, max)
+	}
+	return ratio, ""
+}
+
+// isAttachedNoWaitAction is isattached without waiting for a pending
+// assignment, for callers that want a quick probe. It is not part of the
+// FlexVolume API.
+const isAttachedNoWaitAction = "isattachednowait"
+
+func (api FlexVolumeApi) isAttached(s []string) (string, exitCode) {
+	if len(s) < 3 {
+		return tooFewArgsResponse(s)
+	}
+	s, err := withDRBDNode(s)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve node %q: %v", s[0], s[2], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	opts, err := parseOptions(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	attached, cerr := isAttachedResource(s[0], s[2], opts, s[0] != isAttachedNoWaitAction)
+	if cerr != nil {
+		res, _ := json.Marshal(cerr.response())
+		return string(res), cerr.code
+	}
+
+	res, _ := json.Marshal(isAttachedResponse{
+		Attached:        strconv.FormatBool(attached.Attached),
+		ConnectionState: attached.ConnectionState,
+		response: response{
+			Status:  "Success",
+			Message: opts.deprecationWarning(),
+		},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// isAttachedResource reports whether the resource of opts is attached to
+// node. If wait is set, it waits for a pending assignment and fails if the
+// resource does not get attached, otherwise it reports the current state, in
+// which a resource is not attached until its assignment has reached its
+// target state.
+func isAttachedResource(action, node string, opts options, wait bool) (IsAttachedResult, *CallError) {
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return IsAttachedResult{}, newCallError(EXITBADAPICALL, detailsInvalidName, "%s: %v", action, err)
+	}
+
+	resource := drbd.Resource{Name: opts.getResource(), NodeName: node}
+
+	var state string
+	var err error
+	if wait {
+		state, err = drbd.WaitForAssignment(resource, opts.getWaitRetries())
+	} else {
+		var assigned bool
+		if assigned, err = drbd.Assigned(resource); assigned {
+			state = drbd.AssignmentAssigned
+		} else {
+			state = drbd.AssignmentMissing
+		}
+	}
+	ok, cerr := attachedState(action, resource.Name, state, err)
+	if cerr != nil {
+		return IsAttachedResult{}, cerr
+	}
+
+	result := IsAttachedResult{Attached: ok}
+	if ok {
+		result.ConnectionState = drbd.GetConnectionState(resource)
+	}
+	return result, nil
+}
+
+// attachedState tells whether a resource is attached from the state of its
+// assignment and the error querying it returned. Resources that aren't
+// assigned to the node, or don't exist at all, simply aren't attached yet;
+// only failed queries and incomplete assignments are errors.
+func attachedState(action, name, state string, err error) (bool, *CallError) {
+	switch {
+	case errors.Is(err, drbd.ErrNotDefined):
+		return false, nil
+	case err != nil:
+		return false, newCallError(EXITDRBDFAILURE, failureDetails(err), "%s: %v", action, err)
+	case state == drbd.AssignmentMissing:
+		return false, nil
+	}
+	if cerr := assignmentStateError(action, name, state); cerr != nil {
+		return false, cerr
+	}
+	return true, nil
+}
+
+// assignmentStateError fails resources whose assignment is not complete. A
+// pending assignment may complete if asked again later, a failed one won't.
+func assignmentStateError(action, name, state string) *CallError {
+	switch state {
+	case drbd.AssignmentAssigned:
+		return nil
+	case drbd.AssignmentPending:
+		return newCallError(EXITDRBDFAILURE, detailsAssignmentPending,
+			"%s: resource %s not attached yet, its assignment is pending", action, name)
+	}
+	return newCallError(EXITBADAPICALL, detailsNotAttached,
+		"%s: resource %s not attached, its assignment failed", action, name)
+}
+
+// getAssignment reports whether the resource is, or will be once attached,
+// a diskless client or a diskful replica on the node. It never changes any
+// assignments.
+func (api FlexVolumeApi) getAssignment(s []string) (string, exitCode) {
+	if len(s) < 3 {
+		return tooFewArgsResponse(s)
+	}
+
+	opts, err := parseOptions(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+
+	resource := drbd.Resource{Name: opts.getResource(), NodeName: s[2]}
+
+	assignment, err := drbd.AssignmentType(resource)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(assignmentResponse{
+		Assignment: assignment,
+		Planned:    plannedAssignment(assignment, opts.diskless()),
+		response: response{
+			Status:  "Success",
+			Message: opts.deprecationWarning(),
+		},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// migrate moves the diskful replica of a resource from one node to another.
+// It is not part of the FlexVolume API and meant to be run by operators.
+func (api FlexVolumeApi) migrate(s []string) (string, exitCode) {
+	if len(s) < 4 {
+		return tooFewArgsResponse(s)
+	}
+
+	opts, err := parseOptions(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+
+	m := drbd.Migration{
+		Resource:    opts.getResource(),
+		From:        s[2],
+		To:          s[3],
+		MinReplicas: opts.getMinReplicas(),
+		Timeout:     migrateTimeout,
+	}
+
+	var phases []string
+	summary := newBatchSummary()
+	err = m.Run(func(phase string) {
+		log.Printf("migrating %s from %s to %s: %s", m.Resource, m.From, m.To, phase)
+		phases = append(phases, phase)
+	})
+	summary.add(m.Resource, err)
+	summary.finish(s[0], err != nil, opts.LogSummary == "true")
+	if err != nil {
+		res, _ := json.Marshal(migrateResponse{
+			Phases:  phases,
+			Summary: summary,
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(migrateResponse{
+		Phases:  phases,
+		Summary: summary,
+		response: response{
+			Status:  "Success",
+			Message: opts.deprecationWarning(),
+		},
+	})
+	return string(res), EXITSUCCESS
 }
 
-func (e flexAPIErr) Error() string {
-	return fmt.Sprintf("DRBD Flexvoume API: %s", e.message)
-}
+// drainNode unassigns every resource assigned to a node, e.g. before it is
+// decommissioned. Like migrate, it is meant to be run by operators.
+func (api FlexVolumeApi) drainNode(s []string) (string, exitCode) {
+	if len(s) < 2 {
+		return tooFewArgsResponse(s)
+	}
+	if err := drbd.ValidateNodeName(s[1]); err != nil {
+		return badResourceNameResponse(s, err)
+	}
 
-type response struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
-}
+	names, err := drbd.ListAssignedResources(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITDRBDFAILURE
+	}
 
-type attachResponse struct {
-	response
-	Device string `json:"device"`
+	summary := unassignAll(names, func(name string) error {
+		return drbd.UnassignRes(drbd.Resource{Name: name, NodeName: s[1]})
+	})
+	summary.finish(s[0], false, true)
+	if summary.Failed > 0 {
+		res, _ := json.Marshal(drainNodeResponse{
+			Summary: summary,
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: unable to unassign %d of %d resources from node %s", s[0], summary.Failed, len(names), s[1])}.Error(),
+				errorDetails: detailsPartialFailure,
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(drainNodeResponse{
+		Summary:  summary,
+		response: response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
 }
 
-type isAttachedResponse struct {
-	response
-	Attached string `json:"attached"`
+// unassignAll tries to unassign every resource, carrying on past failures.
+func unassignAll(names []string, unassign func(string) error) *batchSummary {
+	summary := newBatchSummary()
+	for _, name := range names {
+		summary.add(name, unassign(name))
+	}
+	return summary
 }
 
-type getVolNameResponse struct {
-	response
-	VolumeName string `json:"volumeName"`
+// plannedAssignment is the assignment the node ends up with after attach:
+// existing assignments are kept as they are, new ones are diskful unless
+// diskless is true.
+func plannedAssignment(current string, diskless bool) string {
+	if current == drbd.AssignmentNone {
+		if !diskless {
+			return drbd.AssignmentDiskful
+		}
+		return drbd.AssignmentDiskless
+	}
+	return current
 }
 
-type options struct {
-	FsType      string `json:"kubernetes.io/fsType"`
-	Readwrite   string `json:"kubernetes.io/readwrite"`
-	Resource    string `json:"resource"`
-	PVCResource string `json:"kubernetes.io/pvOrVolumeName"`
+// subject is what a mutating call acts on.
+type subject struct {
+	resource string
+	// batch are the resources of an attach of several resources, or of a
+	// drainnode, instead of the single resource.
+	batch []string
+	node  string
+	// Options, if the call was passed any.
+	opts options
 }
 
-func (o *options) getResource() string {
-	if o.Resource != "" {
-		return o.Resource
+// resources are the resources the call acts on, sorted.
+func (s subject) resources() []string {
+	if len(s.batch) > 0 {
+		return s.batch
 	}
-	return o.PVCResource
+	if s.resource != "" {
+		return []string{s.resource}
+	}
+	return nil
 }
 
-func parseOptions(s string) (options, error) {
-	opts := options{}
-	err := json.Unmarshal([]byte(s), &opts)
-	if err != nil {
-		return opts, flexAPIErr{fmt.Sprintf("couldn't parse options from %s", s)}
+// callSubject returns the resource and node a mutating call acts on, so that
+// it can be recorded in the resource's history. Non-mutating calls return an
+// empty resource, and so do invalid names, which are left to the actions to
+// reject: the resource names lock, history and diagnostics files.
+func callSubject(s []string) subject {
+	subj := parseCallSubject(s)
+	if drbd.ValidateResourceName(subj.resource) != nil {
+		subj.resource = ""
 	}
-
-	return opts, nil
+	for _, name := range subj.batch {
+		if drbd.ValidateResourceName(name) != nil {
+			subj.batch = nil
+			break
+		}
+	}
+	return subj
 }
 
-type FlexVolumeApi struct{}
-
-func (api FlexVolumeApi) Call(s []string) (string, int) {
-	if len(s) < 1 {
-		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{"No driver action! Valid actions are: init, attach, detach, mountdevice, unmountdevice, isattached"}.Error(),
-		})
-		return string(res), EXITBADAPICALL
+func parseCallSubject(s []string) subject {
+	if len(s) < 2 {
+		return subject{}
 	}
+
 	switch s[0] {
-	case "init":
-		return api.init()
 	case "attach":
-		return api.attach(s)
-	case "waitforattach":
-		return api.waitForAttach(s)
+		if len(s) < 3 {
+			return subject{}
+		}
+		opts, err := parseOptionsQuiet(s[1])
+		if err != nil {
+			return subject{}
+		}
+		if names := opts.getResources(); len(names) > 0 {
+			batch, err := resolveResourceNames(names)
+			if err != nil {
+				return subject{}
+			}
+			sort.Strings(batch)
+			return subject{batch: batch, node: s[2], opts: opts}
+		}
+		return subject{resource: opts.getResource(), node: s[2], opts: opts}
 	case "detach":
-		return api.detach(s)
+		if len(s) < 3 {
+			return subject{}
+		}
+		resource, err := volumeResource(s[1], s[2])
+		if err != nil {
+			return subject{}
+		}
+		return subject{resource: resource.Name, node: s[2]}
 	case "mountdevice":
-		return api.mountDevice(s)
-	case "unmountdevice":
-		return api.unmountDevice(s)
-	case "unmount":
-		return api.unmount(s)
-	case "isattached":
-		return api.isAttached(s)
-	default:
-		res, _ := json.Marshal(response{
-			Status:  "Not supported",
-			Message: flexAPIErr{fmt.Sprintf("Unsupported driver action: %s", s[0])}.Error(),
-		})
-		return string(res), EXITBADAPICALL
+		if len(s) < 4 {
+			return subject{}
+		}
+		opts, err := parseOptionsQuiet(s[3])
+		if err != nil {
+			return subject{}
+		}
+		return subject{resource: opts.getResource(), opts: opts}
+	case "mount":
+		_, _, raw, err := parseMountArgs(s)
+		if err != nil {
+			return subject{}
+		}
+		opts, err := parseOptionsQuiet(raw)
+		if err != nil {
+			return subject{}
+		}
+		return subject{resource: opts.getResource(), opts: opts}
+	case "migrate":
+		if len(s) < 4 {
+			return subject{}
+		}
+		opts, err := parseOptionsQuiet(s[1])
+		if err != nil {
+			return subject{}
+		}
+		return subject{resource: opts.getResource(), node: s[3], opts: opts}
+	case "drainnode":
+		if drbd.ValidateNodeName(s[1]) != nil {
+			return subject{}
+		}
+		// The resources drainnode is going to unassign.
+		batch, err := drbd.ListAssignedResources(s[1])
+		if err != nil {
+			return subject{}
+		}
+		sort.Strings(batch)
+		return subject{batch: batch, node: s[1]}
+	case "expandvolume":
+		target, _, err := parseExpandArgs(s)
+		if err != nil {
+			return subject{}
+		}
+		if strings.HasPrefix(target, "/") {
+			target, _ = drbd.ResourceFromMountPath(target)
+		}
+		return subject{resource: target}
+	case "unmountdevice", "unmount":
+		resource, _ := drbd.ResourceFromMountPath(s[1])
+		return subject{resource: resource}
 	}
+	return subject{}
 }
 
-func (api FlexVolumeApi) init() (string, int) {
-	res, _ := json.Marshal(response{Status: "Success"})
-	return string(res), EXITSUCCESS
+// postEvent reports the outcome of a call against the pod it was made for,
+// or the PV when the Kubelet didn't tell us about the pod.
+func postEvent(action string, subj subject, out string) {
+	res := response{}
+	json.Unmarshal([]byte(out), &res)
+
+	obj := events.ObjectReference{Kind: "PersistentVolume", Name: subj.resource}
+	if subj.opts.PVCResource != "" {
+		obj.Name = subj.opts.PVCResource
+	}
+	if subj.opts.PodName != "" && subj.opts.PodNamespace != "" {
+		obj = events.ObjectReference{
+			Kind:      "Pod",
+			Namespace: subj.opts.PodNamespace,
+			Name:      subj.opts.PodName,
+			UID:       subj.opts.PodUID,
+		}
+	}
+
+	// Action names are lower case ASCII, e.g. DRBDMountdeviceSucceeded.
+	name := strings.ToUpper(action[:1]) + action[1:]
+	eventType, reason := events.Normal, "DRBD"+name+"Succeeded"
+	if res.Status != "Success" {
+		eventType, reason = events.Warning, "DRBD"+name+"Failed"
+	}
+
+	msg := fmt.Sprintf("%s of resource %s: %s", action, subj.resource, res.Status)
+	if res.Message != "" {
+		msg += ": " + res.Message
+	}
+
+	if err := events.Post(Events, obj, eventType, reason, msg, subj.node); err != nil {
+		log.Printf("unable to post event for %s of %s: %v", action, subj.resource, err)
+	}
 }
 
-func (api FlexVolumeApi) attach(s []string) (string, int) {
-	if len(s) < 3 {
-		return tooFewArgsResponse(s)
+func recordHistory(action, resource, node, out string) {
+	if StatelessMode {
+		return
 	}
+	res := response{}
+	json.Unmarshal([]byte(out), &res)
 
-	opts, err := parseOptions(s[1])
+	err := history.Record(history.Event{
+		Time:     time.Now(),
+		Action:   action,
+		Resource: resource,
+		Node:     node,
+		Status:   res.Status,
+		Message:  res.Message,
+	})
 	if err != nil {
-		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
-		})
-		return string(res), EXITBADAPICALL
+		log.Printf("unable to record %s of %s: %v", action, resource, err)
 	}
+}
 
-	resource := drbd.Resource{Name: opts.getResource(), NodeName: s[2]}
+func (api FlexVolumeApi) history(s []string) (string, exitCode) {
+	if len(s) < 2 {
+		return tooFewArgsResponse(s)
+	}
 
-	_, err = drbd.AssignRes(resource)
+	var since, until time.Time
+	var err error
+	if len(s) > 2 {
+		since, err = time.Parse(time.RFC3339, s[2])
+	}
+	if err == nil && len(s) > 3 {
+		until, err = time.Parse(time.RFC3339, s[3])
+	}
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: failed to assign resource %s: %v", s[0], resource.Name, err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: time range must be given in RFC3339 format: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
-		return string(res), EXITDRBDFAILURE
+		return string(res), EXITBADAPICALL
 	}
 
-	path, err := drbd.WaitForDevPath(resource, 4)
+	if err := drbd.ValidateResourceName(s[1]); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+	events, err := history.Read(s[1], since, until)
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: unable to find device path for resource %s: %v", s[0], resource.Name, err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
 		return string(res), EXITDRBDFAILURE
 	}
 
-	res, _ := json.Marshal(attachResponse{
-		Device: path,
-		response: response{
-			Status: "Success",
-		},
+	res, _ := json.Marshal(historyResponse{
+		Events:   events,
+		response: response{Status: "Success"},
 	})
 	return string(res), EXITSUCCESS
 }
 
-func (api FlexVolumeApi) waitForAttach(s []string) (string, int) {
-	res, _ := json.Marshal(response{Status: "Success"})
-	return string(res), EXITSUCCESS
-}
+// verifyWatchAction is run by the plugin on itself to follow a verification
+// after attach has returned. It is not part of the FlexVolume API.
+const verifyWatchAction = "verifywatch"
 
-func (api FlexVolumeApi) detach(s []string) (string, int) {
-	if len(s) < 3 {
-		return tooFewArgsResponse(s)
+// verifyTimeout bounds how long a verification is followed.
+const verifyTimeout = time.Hour * 12
+
+// startVerify starts verifying the resource and leaves a copy of the plugin
+// running in the background to record the result.
+func startVerify(r drbd.Resource) error {
+	if err := drbd.StartVerify(r); err != nil {
+		return err
 	}
 
-	resource := drbd.Resource{Name: s[1], NodeName: s[2]}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to follow verification of %s: %w", r.Name, err)
+	}
+	if err := exec.Command(self, verifyWatchAction, r.Name).Start(); err != nil {
+		return fmt.Errorf("unable to follow verification of %s: %w", r.Name, err)
+	}
+	return nil
+}
 
-	// Do not unassign resources that have local storage.
-	if !drbd.IsClient(resource) {
-		res, _ := json.Marshal(response{Status: "Success"})
-		return string(res), EXITSUCCESS
+func (api FlexVolumeApi) verifyWatch(s []string) (string, exitCode) {
+	if len(s) < 2 {
+		return tooFewArgsResponse(s)
 	}
 
-	err := drbd.UnassignRes(resource)
+	if err := drbd.ValidateResourceName(s[1]); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+	err := drbd.WatchVerify(drbd.Resource{Name: s[1]}, verifyTimeout)
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
 		return string(res), EXITDRBDFAILURE
 	}
@@ -199,128 +2623,543 @@ func (api FlexVolumeApi) detach(s []string) (string, int) {
 	return string(res), EXITSUCCESS
 }
 
-func (api FlexVolumeApi) mountDevice(s []string) (string, int) {
-	if len(s) < 4 {
+// verifyStatus returns the result of the last verification of a resource.
+func (api FlexVolumeApi) verifyStatus(s []string) (string, exitCode) {
+	if len(s) < 2 {
 		return tooFewArgsResponse(s)
 	}
 
-	opts, err := parseOptions(s[3])
+	if err := drbd.ValidateResourceName(s[1]); err != nil {
+		return badResourceNameResponse(s, err)
+	}
+	result, err := drbd.GetVerifyResult(drbd.Resource{Name: s[1]})
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
-		return string(res), EXITBADAPICALL
+		return string(res), EXITDRBDFAILURE
 	}
 
-	mounter := drbd.Mounter{
-		Resource: &drbd.Resource{
-			Name: opts.getResource()},
-		FSType: opts.FsType,
+	msg := ""
+	if result == nil {
+		msg = fmt.Sprintf("resource %s was never verified", s[1])
+	}
+
+	res, _ := json.Marshal(verifyStatusResponse{
+		Verify:   result,
+		response: response{Status: "Success", Message: msg},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// parseExpandArgs returns the mount path or resource name and the size in
+// bytes passed to expandvolume.
+func parseExpandArgs(s []string) (string, int64, error) {
+	if len(s) < 3 {
+		return "", 0, fmt.Errorf("too few arguments passed: %s", s)
 	}
+	size, err := strconv.ParseInt(s[2], 10, 64)
+	if err != nil || size <= 0 {
+		return "", 0, fmt.Errorf("size must be a positive number of bytes, got %q", s[2])
+	}
+	return s[1], size, nil
+}
 
-	err = mounter.Mount(s[1])
+// expandVolume grows a resource and, when given the path it is mounted at,
+// its filesystem. Given a resource name, only the block device is grown.
+func (api FlexVolumeApi) expandVolume(s []string) (string, exitCode) {
+	target, size, err := parseExpandArgs(s)
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	mountPath := ""
+	resource := target
+	if strings.HasPrefix(target, "/") {
+		mountPath = target
+		resource, err = drbd.ResourceFromMountPath(mountPath)
+		if err != nil {
+			res, _ := json.Marshal(response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			})
+			return string(res), EXITDRBDFAILURE
+		}
+	}
+
+	newSize, err := drbd.Expand(drbd.Resource{Name: resource}, size)
+	if err != nil {
+		res, _ := json.Marshal(expandResponse{
+			Size: newSize,
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			},
 		})
 		return string(res), EXITDRBDFAILURE
 	}
 
-	res, _ := json.Marshal(response{Status: "Success"})
-	return string(res), EXITSUCCESS
-}
+	if mountPath != "" {
+		err := drbd.WaitForDeviceSize(drbd.Resource{Name: resource}, newSize, ResizeDeviceWait)
+		if err == nil {
+			err = drbd.GrowFilesystem(mountPath)
+		}
+		if err != nil {
+			res, _ := json.Marshal(expandResponse{
+				Size: newSize,
+				response: response{
+					Status:       "Failure",
+					Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+					errorDetails: failureDetails(err),
+				},
+			})
+			return string(res), EXITDRBDFAILURE
+		}
+	}
 
-func (api FlexVolumeApi) unmountDevice(s []string) (string, int) {
-	return api.unmount(s)
+	res, _ := json.Marshal(expandResponse{
+		Size:            newSize,
+		FilesystemGrown: mountPath != "",
+		response:        response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
 }
 
-func (api FlexVolumeApi) unmount(s []string) (string, int) {
+// protocol reports the replication protocol a resource is configured with
+// and the one in effect on each of its connections.
+func (api FlexVolumeApi) protocol(s []string) (string, exitCode) {
 	if len(s) < 2 {
 		return tooFewArgsResponse(s)
 	}
-	umounter := drbd.Mounter{}
 
-	err := umounter.UnMount(s[1])
+	configured, connections, err := drbd.Protocols(drbd.Resource{Name: s[1]})
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
 		return string(res), EXITDRBDFAILURE
 	}
-	res, _ := json.Marshal(response{Status: "Success"})
+
+	var mismatches []string
+	for _, c := range connections {
+		if c.Protocol != drbd.ProtocolUnknown && c.Protocol != configured {
+			mismatches = append(mismatches, fmt.Sprintf("connection to %s uses protocol %s, configured is %s", c.Peer, c.Protocol, configured))
+		}
+	}
+	if connections == nil {
+		connections = []drbd.PeerProtocol{}
+	}
+
+	res, _ := json.Marshal(protocolResponse{
+		Configured:  configured,
+		Connections: connections,
+		response:    response{Status: "Success", Message: strings.Join(mismatches, "; ")},
+	})
 	return string(res), EXITSUCCESS
 }
 
-func (api FlexVolumeApi) getVolumeName(s []string) (string, int) {
+// configDigest returns a stable hash of a resource's effective configuration
+// for drift detection. See drbd.GetConfigDigest for what is covered.
+func (api FlexVolumeApi) configDigest(s []string) (string, exitCode) {
 	if len(s) < 2 {
 		return tooFewArgsResponse(s)
 	}
 
-	opts, err := parseOptions(s[1])
+	digest, err := drbd.GetConfigDigest(drbd.Resource{Name: s[1]})
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
-		return string(res), EXITBADAPICALL
+		return string(res), EXITDRBDFAILURE
 	}
 
-	res, _ := json.Marshal(getVolNameResponse{
-		VolumeName: opts.getResource(),
-		response: response{
-			Status: "Success",
-		},
+	res, _ := json.Marshal(configDigestResponse{
+		ConfigDigest: digest,
+		response:     response{Status: "Success"},
 	})
 	return string(res), EXITSUCCESS
 }
 
-func (api FlexVolumeApi) isAttached(s []string) (string, int) {
-	if len(s) < 3 {
+// recheck looks for mounts recorded in the registry whose device has
+// vanished, e.g. because the assignment was removed out-of-band, and
+// optionally reassigns their resources. It is meant to be run periodically.
+func (api FlexVolumeApi) recheck(s []string) (string, exitCode) {
+	opts := options{}
+	if len(s) > 1 {
+		var err error
+		opts, err = parseOptions(s[1])
+		if err != nil {
+			res, _ := json.Marshal(response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			})
+			return string(res), EXITBADAPICALL
+		}
+	}
+
+	summary := newBatchSummary()
+	entries, err := registry.List()
+	if err != nil {
+		res, _ := json.Marshal(recheckResponse{
+			Mounts:  []mountCheck{},
+			Summary: summary.finish(s[0], true, opts.LogSummary == "true"),
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	var restore func(registry.Entry) error
+	if opts.OnDeviceMissing == "reassign" {
+		node, _ := os.Hostname()
+		restore = func(e registry.Entry) error {
+			r := drbd.Resource{Name: e.Resource, NodeName: node, Diskless: true}
+			if _, err := drbd.AssignRes(r); err != nil {
+				return err
+			}
+			_, err := drbd.WaitForDevPath(r, opts.getWaitRetries())
+			return err
+		}
+	}
+
+	checks := recheckMounts(entries, deviceExists, restore)
+
+	var missing []string
+	for _, c := range checks {
+		if c.DeviceMissing && !c.Reassigned {
+			msg := fmt.Sprintf("device %s of resource %s mounted at %s is missing", c.Device, c.Resource, c.Path)
+			log.Print(msg)
+			missing = append(missing, msg)
+			summary.add(c.Resource, errors.New(msg))
+		} else {
+			summary.add(c.Resource, nil)
+		}
+	}
+	summary.finish(s[0], false, opts.LogSummary == "true")
+	if len(missing) > 0 {
+		res, _ := json.Marshal(recheckResponse{
+			Mounts:  checks,
+			Summary: summary,
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %s", s[0], strings.Join(missing, "; "))}.Error(),
+				errorDetails: detailsCheckFailed,
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(recheckResponse{
+		Mounts:   checks,
+		Summary:  summary,
+		response: response{Status: "Success", Message: opts.deprecationWarning()},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// getStatus reports the size of the device of a resource attached to this
+// node, if it is mounted, the usage of its filesystem and, if it replicates
+// asynchronously, how far its peers lag behind.
+func (api FlexVolumeApi) getStatus(s []string) (string, exitCode) {
+	if len(s) < 2 {
 		return tooFewArgsResponse(s)
 	}
 
-	opts, err := parseOptions(s[1])
+	var opts options
+	if len(s) > 2 {
+		var err error
+		if opts, err = parseOptions(s[2]); err != nil {
+			res, _ := json.Marshal(response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			})
+			return string(res), EXITBADAPICALL
+		}
+	}
+
+	name, err := resolveResourceName(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve resource %q: %v", s[0], s[1], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+	host, _ := os.Hostname()
+	node, err := resolveNodeName(host)
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve node %q: %v", s[0], host, err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
 		return string(res), EXITBADAPICALL
 	}
+	resource := drbd.Resource{Name: mappedName(name), NodeName: node}
+	if err := drbd.ValidateResourceName(resource.Name); err != nil {
+		return badResourceNameResponse(s, err)
+	}
 
-	resource := drbd.Resource{Name: opts.getResource(), NodeName: s[2]}
+	device, err := drbd.DevicePath(resource)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITDRBDFAILURE
+	}
 
-	ok, err := drbd.WaitForAssignment(resource, 4)
+	status, err := volumeStatus(device,
+		func() (int64, error) { return drbd.GetDeviceSize(resource) },
+		func() (string, error) { return drbd.MountPoint(device) },
+		drbd.FSUsage)
 	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
 		})
 		return string(res), EXITDRBDFAILURE
 	}
 
-	if !ok {
+	// Lag is best effort, resources whose protocol can't be told don't
+	// report any.
+	status.OutOfSyncBytes, status.Lagging = replicationLag(
+		func() (bool, error) { return asyncReplicated(resource) },
+		func() (int64, error) { return drbd.OutOfSync(resource) },
+		opts.LagThresholdBytes)
+
+	status.response = response{Status: "Success"}
+	res, _ := json.Marshal(status)
+	return string(res), EXITSUCCESS
+}
+
+// asyncReplicated reports whether the resource is configured with, or
+// replicates to any peer with, protocol A.
+func asyncReplicated(resource drbd.Resource) (bool, error) {
+	configured, peers, err := drbd.Protocols(resource)
+	if err != nil {
+		return false, err
+	}
+	if configured == "A" {
+		return true, nil
+	}
+	for _, p := range peers {
+		if p.Protocol == "A" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// replicationLag returns the bytes out of sync of an asynchronously
+// replicated resource and, given a threshold, whether they exceed it. Neither
+// is returned for synchronously replicated resources or if either query
+// fails.
+func replicationLag(async func() (bool, error), outOfSync func() (int64, error), threshold string) (*int64, *bool) {
+	if ok, err := async(); err != nil || !ok {
+		return nil, nil
+	}
+	n, err := outOfSync()
+	if err != nil {
+		return nil, nil
+	}
+	if threshold == "" {
+		return &n, nil
+	}
+	// Validated by parseOptions.
+	max, _ := strconv.ParseInt(threshold, 10, 64)
+	lagging := n > max
+	return &n, &lagging
+}
+
+// volumeStatus collects the size of device and, if mountPoint finds it
+// mounted, the usage of its filesystem.
+func volumeStatus(device string, size func() (int64, error), mountPoint func() (string, error), usage func(string) (uint64, uint64, error)) (statusResponse, error) {
+	status := statusResponse{Device: device}
+	var err error
+	if status.SizeBytes, err = size(); err != nil {
+		return status, err
+	}
+
+	if status.MountPath, err = mountPoint(); err != nil || status.MountPath == "" {
+		return status, err
+	}
+	used, avail, err := usage(status.MountPath)
+	if err != nil {
+		return status, err
+	}
+	status.UsedBytes, status.AvailableBytes = &used, &avail
+	return status, nil
+}
+
+// reconcile reports the mounts of DRBD devices on this node that no resource
+// assigned to it provides, and unmounts those no pod uses when called as
+// reconcile --clean.
+func (api FlexVolumeApi) reconcile(s []string) (string, exitCode) {
+	clean := false
+	for _, arg := range s[1:] {
+		if arg != "--clean" {
+			res, _ := json.Marshal(response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: unknown argument %q", s[0], arg)}.Error(),
+				errorDetails: detailsInvalidArguments,
+			})
+			return string(res), EXITBADAPICALL
+		}
+		clean = true
+	}
+
+	host, _ := os.Hostname()
+	node, err := resolveNodeName(host)
+	if err != nil {
 		res, _ := json.Marshal(response{
-			Status:  "Failure",
-			Message: flexAPIErr{fmt.Sprintf("%s: resource %s not attached", s[0], resource.Name)}.Error(),
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: unable to resolve node %q: %v", s[0], host, err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	orphans, err := drbd.FindOrphans(node, clean)
+	if err != nil {
+		res, _ := json.Marshal(reconcileResponse{
+			Orphans: []drbd.Orphan{},
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+				errorDetails: failureDetails(err),
+			},
 		})
 		return string(res), EXITDRBDFAILURE
 	}
 
-	res, _ := json.Marshal(isAttachedResponse{
-		Attached: "true",
+	cleaned, failed := 0, 0
+	for _, o := range orphans {
+		log.Print(o)
+		if o.Unmounted {
+			cleaned++
+		}
+		if o.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		res, _ := json.Marshal(reconcileResponse{
+			Orphans: orphans,
+			Cleaned: cleaned,
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{fmt.Sprintf("%s: unable to unmount %d of %d orphaned mounts", s[0], failed, len(orphans))}.Error(),
+				errorDetails: detailsPartialFailure,
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(reconcileResponse{
+		Orphans:  orphans,
+		Cleaned:  cleaned,
 		response: response{Status: "Success"},
 	})
 	return string(res), EXITSUCCESS
 }
 
-func tooFewArgsResponse(s []string) (string, int) {
+// recheckMounts checks the device of every entry and, if restore is set,
+// tries to restore missing ones.
+func recheckMounts(entries []registry.Entry, exists func(string) bool, restore func(registry.Entry) error) []mountCheck {
+	checks := []mountCheck{}
+	for _, e := range entries {
+		c := mountCheck{Resource: e.Resource, Device: e.Device, Path: e.Path}
+		if !exists(e.Device) {
+			c.DeviceMissing = true
+			if restore != nil {
+				if err := restore(e); err != nil {
+					c.Error = err.Error()
+				} else {
+					c.Reassigned = exists(e.Device)
+				}
+			}
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func deviceExists(device string) bool {
+	_, err := os.Stat(device)
+	return !os.IsNotExist(err)
+}
+
+// describe returns the Kubernetes objects recorded for a mounted resource or
+// device.
+func (api FlexVolumeApi) describe(s []string) (string, exitCode) {
+	if len(s) < 2 {
+		return tooFewArgsResponse(s)
+	}
+
+	// Devices are looked up among the entries, names are file names.
+	if !strings.HasPrefix(s[1], "/dev/") {
+		if err := drbd.ValidateResourceName(s[1]); err != nil {
+			return badResourceNameResponse(s, err)
+		}
+	}
+	entry, err := registry.Lookup(s[1])
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	msg := ""
+	if entry == nil {
+		msg = fmt.Sprintf("no mount recorded for %s", s[1])
+	}
+
+	res, _ := json.Marshal(describeResponse{
+		Mount:    entry,
+		response: response{Status: "Success", Message: msg},
+	})
+	return string(res), EXITSUCCESS
+}
+
+func badResourceNameResponse(s []string, err error) (string, exitCode) {
+	res, _ := json.Marshal(response{
+		Status:       "Failure",
+		Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+		errorDetails: detailsInvalidName,
+	})
+	return string(res), EXITBADAPICALL
+}
+
+func tooFewArgsResponse(s []string) (string, exitCode) {
 	res, _ := json.Marshal(response{
-		Status:  "Failure",
-		Message: flexAPIErr{fmt.Sprintf("%s: too few arguments passed: %s", s[0], s)}.Error(),
+		Status:       "Failure",
+		Message:      flexAPIErr{fmt.Sprintf("%s: too few arguments passed: %s", s[0], s)}.Error(),
+		errorDetails: detailsInvalidArguments,
 	})
 	return string(res), EXITBADAPICALL
 }
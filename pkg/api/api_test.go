@@ -17,3 +17,1303 @@
  */
 
 package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/history"
+	"github.com/linbit/drbd-flexvolume/pkg/jsonlog"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+	"github.com/linbit/drbd-flexvolume/pkg/registry"
+)
+
+// useTempCallDirs has calls keep their history and locks in a new temporary
+// directory and run drbd commands with a FakeExecutor without scripts, so
+// that every command fails. It returns the directory and a function undoing
+// all of it.
+func useTempCallDirs(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHistory, oldLock, oldExec := history.Dir, lock.Dir, drbd.Exec
+	history.Dir, lock.Dir, drbd.Exec = dir, dir, &drbd.FakeExecutor{}
+	return dir, func() {
+		history.Dir, lock.Dir, drbd.Exec = oldHistory, oldLock, oldExec
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseOptionsReservedBlocksPercent(t *testing.T) {
+	var reservedBlocksTests = []struct {
+		in  string
+		out string
+		ok  bool
+	}{
+		{`{"resource":"r0"}`, "", true},
+		{`{"resource":"r0","reservedBlocksPercent":"0"}`, "0", true},
+		{`{"resource":"r0","reservedBlocksPercent":"5"}`, "5", true},
+		{`{"resource":"r0","reservedBlocksPercent":"1.5"}`, "1.5", true},
+		{`{"resource":"r0","reservedBlocksPercent":"6"}`, "", false},
+		{`{"resource":"r0","reservedBlocksPercent":"-1"}`, "", false},
+		{`{"resource":"r0","reservedBlocksPercent":"lots"}`, "", false},
+	}
+
+	for _, tt := range reservedBlocksTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if tt.ok && opts.ReservedBlocksPercent != tt.out {
+			t.Errorf("Called: parseOptions(%q), Expected: %q, Got: %q", tt.in, tt.out, opts.ReservedBlocksPercent)
+		}
+	}
+}
+
+func TestParseOptionsDeprecatedKeys(t *testing.T) {
+	var deprecatedTests = []struct {
+		in       string
+		fsType   string
+		warnings int
+	}{
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4"}`, "ext4", 0},
+		{`{"resource":"r0","fsType":"xfs"}`, "xfs", 1},
+		{`{"resource":"r0","fsType":"xfs","kubernetes.io/fsType":"ext4"}`, "ext4", 1},
+		{`{"resource":"r0","fsType":"xfs","readwrite":"ro"}`, "xfs", 2},
+	}
+
+	for _, tt := range deprecatedTests {
+		opts, err := parseOptions(tt.in)
+		if err != nil {
+			t.Errorf("Called: parseOptions(%q), Unexpected error: %v", tt.in, err)
+			continue
+		}
+		if opts.FsType != tt.fsType || len(opts.deprecations) != tt.warnings {
+			t.Errorf("Called: parseOptions(%q), Expected: %q with %d warnings, Got: %q with %q",
+				tt.in, tt.fsType, tt.warnings, opts.FsType, opts.deprecations)
+		}
+	}
+}
+
+func TestGetVolumeNameDebug(t *testing.T) {
+	var getVolNameTests = []struct {
+		in      string
+		options map[string]string
+	}{
+		{`{"resource":"r0"}`, nil},
+		{`{"resource":"r0","debug":"true","fsType":"xfs"}`,
+			map[string]string{"resource": "r0", "debug": "true", "kubernetes.io/fsType": "xfs"}},
+	}
+
+	for _, tt := range getVolNameTests {
+		out, ret := FlexVolumeApi{}.Call([]string{"getvolumename", tt.in})
+		if exitCode(ret) != EXITSUCCESS {
+			t.Errorf("Called: getvolumename %q, Expected: %d, Got: %d: %s", tt.in, EXITSUCCESS, ret, out)
+			continue
+		}
+		res := getVolNameResponse{}
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Errorf("Called: getvolumename %q, Unable to parse response %q: %v", tt.in, out, err)
+			continue
+		}
+		if res.VolumeName != "r0" || !reflect.DeepEqual(res.Options, tt.options) {
+			t.Errorf("Called: getvolumename %q, Expected: %q with options %q, Got: %q with options %q",
+				tt.in, "r0", tt.options, res.VolumeName, res.Options)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	in := map[string]string{
+		"resource":                      "r0",
+		secretOptionPrefix + "password": "hunter2",
+	}
+	expected := map[string]string{
+		"resource":                      "r0",
+		secretOptionPrefix + "password": "<redacted>",
+	}
+
+	out := redactSecrets(in)
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("Called: redactSecrets(%q), Expected: %q, Got: %q", in, expected, out)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	var optionsErrorTests = []struct {
+		in  string
+		msg string
+	}{
+		{"{\"resource\":\"r0\",\n\"kubernetes.io/secret/key\" \"c2VjcmV0\"}",
+			`couldn't parse options: invalid character '"' after object key at line 2, column 28 after "ernetes.io/secret/key\" \""`},
+		{`{"resource":"r0","kubernetes.io/secret/key":"c2VjcmV0`,
+			`couldn't parse options: unexpected end of JSON input at line 1, column 53 after "io/secret/key\":\"********", the options look truncated`},
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4"`,
+			`couldn't parse options: unexpected end of JSON input at line 1, column 46 after "rnetes.io/fsType\":\"ext4\"", the options look truncated`},
+		{`{"resource":"r0","kubernetes.io/fsType":4}`,
+			`couldn't parse options: option "kubernetes.io/fsType" must be a string, got number`},
+		{`["r0"]`, "couldn't parse options: expected a JSON object, got array"},
+	}
+
+	for _, tt := range optionsErrorTests {
+		expected := flexAPIErr{tt.msg}.Error()
+		_, err := parseOptions(tt.in)
+		if err == nil || err.Error() != expected {
+			t.Errorf("Called: parseOptions(%q), Expected: %q, Got: %v", tt.in, expected, err)
+		}
+	}
+}
+
+func TestParseOptionsFullThreshold(t *testing.T) {
+	var fullThresholdTests = []struct {
+		in        string
+		threshold float64
+		ok        bool
+	}{
+		{`{"resource":"r0"}`, defaultFullThresholdPercent, true},
+		{`{"resource":"r0","fullThresholdPercent":"80","onFull":"refuse"}`, 80, true},
+		{`{"resource":"r0","fullThresholdPercent":"101"}`, 0, false},
+		{`{"resource":"r0","onFull":"panic"}`, 0, false},
+	}
+
+	for _, tt := range fullThresholdTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if tt.ok && opts.getFullThresholdPercent() != tt.threshold {
+			t.Errorf("Called: parseOptions(%q), Expected: %v, Got: %v", tt.in, tt.threshold, opts.getFullThresholdPercent())
+		}
+	}
+}
+
+func TestParseOptionsReadwrite(t *testing.T) {
+	var readwriteTests = []struct {
+		in       string
+		readOnly bool
+		ok       bool
+	}{
+		{`{"resource":"r0","kubernetes.io/readwrite":"ro"}`, true, true},
+		{`{"resource":"r0","kubernetes.io/readwrite":"rw"}`, false, true},
+		{`{"resource":"r0"}`, false, true},
+		{`{"resource":"r0","kubernetes.io/readwrite":"readonly"}`, false, false},
+	}
+
+	for _, tt := range readwriteTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if readOnly := opts.Readwrite == "ro"; tt.ok && readOnly != tt.readOnly {
+			t.Errorf("Called: parseOptions(%q), Expected read-only: %v, Got: %v", tt.in, tt.readOnly, readOnly)
+		}
+	}
+}
+
+func TestParseOptionsMountOptions(t *testing.T) {
+	var mountOptionsTests = []struct {
+		in       string
+		options  []string
+		readOnly bool
+		ok       bool
+	}{
+		{`{"resource":"r0","mountOptions":""}`, nil, false, true},
+		{`{"resource":"r0","mountOptions":"noatime"}`, []string{"noatime"}, false, true},
+		{`{"resource":"r0","mountOptions":"noatime, discard,,nodelalloc"}`, []string{"noatime", "discard", "nodelalloc"}, false, true},
+		{`{"resource":"r0","mountOptions":"ro,noatime"}`, []string{"ro", "noatime"}, true, true},
+		{`{"resource":"r0","mountOptions":"ro,rw"}`, nil, false, false},
+		{`{"resource":"r0","mountOptions":"rw","kubernetes.io/readwrite":"ro"}`, nil, false, false},
+	}
+
+	for _, tt := range mountOptionsTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !reflect.DeepEqual(opts.getMountOptions(), tt.options) || opts.readOnly() != tt.readOnly {
+			t.Errorf("Called: parseOptions(%q), Expected: %q, read-only %v, Got: %q, %v", tt.in, tt.options, tt.readOnly, opts.getMountOptions(), opts.readOnly())
+		}
+	}
+}
+
+func TestParseOptionsDiskless(t *testing.T) {
+	var disklessTests = []struct {
+		in       string
+		ok       bool
+		diskless bool
+	}{
+		{`{"resource":"r0"}`, true, false},
+		{`{"resource":"r0","diskless":"true"}`, true, true},
+		{`{"resource":"r0","diskless":"false"}`, true, false},
+		{`{"resource":"r0","diskless":"yes"}`, false, false},
+	}
+
+	for _, tt := range disklessTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if err == nil && opts.diskless() != tt.diskless {
+			t.Errorf("Called: parseOptions(%q), Expected diskless: %v, Got: %v", tt.in, tt.diskless, opts.diskless())
+		}
+	}
+}
+
+func TestPlannedAssignment(t *testing.T) {
+	var plannedTests = []struct {
+		current  string
+		diskless bool
+		out      string
+	}{
+		{drbd.AssignmentNone, true, drbd.AssignmentDiskless},
+		{drbd.AssignmentNone, false, drbd.AssignmentDiskful},
+		{drbd.AssignmentDiskless, false, drbd.AssignmentDiskless},
+		{drbd.AssignmentDiskful, true, drbd.AssignmentDiskful},
+	}
+
+	for _, tt := range plannedTests {
+		planned := plannedAssignment(tt.current, tt.diskless)
+		if planned != tt.out {
+			t.Errorf("Called: plannedAssignment(%q, %v), Expected: %q, Got: %q", tt.current, tt.diskless, tt.out, planned)
+		}
+	}
+}
+
+func TestDiffOptions(t *testing.T) {
+	var diffOptionsTests = []struct {
+		current   string
+		candidate string
+		diffs     int
+	}{
+		{`{"resource":"r0"}`, `{"resource":"r0"}`, 0},
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4"}`, `{"resource":"r0","kubernetes.io/fsType":"xfs"}`, 1},
+		{`{"resource":"r0"}`, `{"resource":"r1","debug":"true"}`, 2},
+		{`{"resource":"r0","fsType":"ext4"}`, `{"resource":"r0","kubernetes.io/fsType":"ext4"}`, 1},
+		{`{"resource":"r0"}`, `{"resource":"r0","onFull":"panic"}`, 2},
+	}
+
+	for _, tt := range diffOptionsTests {
+		current, err := doParseOptions(tt.current)
+		candidate, cErr := doParseOptions(tt.candidate)
+		diffs := diffOptions(current, err, candidate, cErr)
+		if len(diffs) != tt.diffs {
+			t.Errorf("Called: diffOptions(%q, %q), Expected: %d differences, Got: %q", tt.current, tt.candidate, tt.diffs, diffs)
+		}
+	}
+}
+
+func TestRecheckMounts(t *testing.T) {
+	entries := []registry.Entry{
+		{Resource: "r0", Device: "/dev/drbd100", Path: "/mnt/r0"},
+		{Resource: "r1", Device: "/dev/drbd101", Path: "/mnt/r1"},
+	}
+	devices := map[string]bool{"/dev/drbd100": true}
+	exists := func(d string) bool { return devices[d] }
+
+	checks := recheckMounts(entries, exists, nil)
+	expected := []mountCheck{
+		{Resource: "r0", Device: "/dev/drbd100", Path: "/mnt/r0"},
+		{Resource: "r1", Device: "/dev/drbd101", Path: "/mnt/r1", DeviceMissing: true},
+	}
+	if !reflect.DeepEqual(checks, expected) {
+		t.Errorf("Called: recheckMounts(%v) reporting only, Expected: %v, Got: %v", entries, expected, checks)
+	}
+
+	var restored []string
+	checks = recheckMounts(entries, exists, func(e registry.Entry) error {
+		restored = append(restored, e.Resource)
+		devices[e.Device] = true
+		return nil
+	})
+	expected[1].Reassigned = true
+	if !reflect.DeepEqual(checks, expected) || !reflect.DeepEqual(restored, []string{"r1"}) {
+		t.Errorf("Called: recheckMounts(%v) reassigning, Expected: %v restoring [r1], Got: %v restoring %v", entries, expected, checks, restored)
+	}
+}
+
+func TestAppendMessage(t *testing.T) {
+	var appendMessageTests = []struct {
+		in  string
+		out string
+	}{
+		{`{"status":"Failure","message":"no device"}`, `{"message":"no device; see bundle","status":"Failure"}`},
+		{`{"status":"Failure","message":"","device":"/dev/drbd100"}`, `{"device":"/dev/drbd100","message":"see bundle","status":"Failure"}`},
+		{`not json`, `not json`},
+	}
+
+	for _, tt := range appendMessageTests {
+		out := appendMessage(tt.in, "see bundle")
+		if out != tt.out {
+			t.Errorf("Called: appendMessage(%q, %q), Expected: %q, Got: %q", tt.in, "see bundle", tt.out, out)
+		}
+	}
+}
+
+func TestInitCapabilities(t *testing.T) {
+	out, ret := FlexVolumeApi{}.Call([]string{"init"})
+	if exitCode(ret) != EXITSUCCESS {
+		t.Fatalf("Called: Call([init]), Expected: %d, Got: %d: %s", EXITSUCCESS, ret, out)
+	}
+
+	res := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("Called: Call([init]), Unexpected error decoding %q: %v", out, err)
+	}
+	capabilities, ok := res["capabilities"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Called: Call([init]), Expected a capabilities object, Got: %q", out)
+	}
+	if capabilities["attach"] != true || capabilities["selinuxRelabel"] != true {
+		t.Errorf("Called: Call([init]), Expected attach and selinuxRelabel capabilities, Got: %v", capabilities)
+	}
+}
+
+func TestParseExpandArgs(t *testing.T) {
+	var expandArgsTests = []struct {
+		in     []string
+		target string
+		size   int64
+		ok     bool
+	}{
+		{[]string{"expandvolume", "/mnt/r0", "2147483648"}, "/mnt/r0", 2147483648, true},
+		{[]string{"expandvolume", "r0", "1024"}, "r0", 1024, true},
+		{[]string{"expandvolume", "r0"}, "", 0, false},
+		{[]string{"expandvolume", "r0", "-1"}, "", 0, false},
+		{[]string{"expandvolume", "r0", "2Gi"}, "", 0, false},
+	}
+
+	for _, tt := range expandArgsTests {
+		target, size, err := parseExpandArgs(tt.in)
+		if target != tt.target || size != tt.size || (err == nil) != tt.ok {
+			t.Errorf("Called: parseExpandArgs(%q), Expected: %q, %d, %v, Got: %q, %d, %v", tt.in, tt.target, tt.size, tt.ok, target, size, err)
+		}
+	}
+}
+
+func TestParseWaitTimeout(t *testing.T) {
+	var waitTimeoutTests = []struct {
+		in      string
+		retries int
+	}{
+		{"", defaultWaitRetries},
+		{"60", 30},
+		{"1", 1},
+		{"3", 2},
+		{"0", defaultWaitRetries},
+		{"-10", defaultWaitRetries},
+		{"10s", defaultWaitRetries},
+	}
+
+	for _, tt := range waitTimeoutTests {
+		retries := ParseWaitTimeout(tt.in)
+		if retries != tt.retries {
+			t.Errorf("Called: ParseWaitTimeout(%q), Expected: %d, Got: %d", tt.in, tt.retries, retries)
+		}
+	}
+}
+
+func TestCallLogsFailingAttach(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+
+	var buf bytes.Buffer
+	Log = jsonlog.New(&buf, jsonlog.Debug)
+	defer func() { Log = nil }()
+
+	out, ret := FlexVolumeApi{}.Call([]string{"attach", `{"resource":"r0-logged"}`, "node-logged"})
+	if exitCode(ret) == EXITSUCCESS {
+		t.Fatalf("Called: Call([attach]) with no command succeeding, Expected a failure, Got: %s", out)
+	}
+
+	Log = nil
+	plain, _ := FlexVolumeApi{}.Call([]string{"attach", `{"resource":"r0-logged"}`, "node-logged"})
+	if plain != out {
+		t.Errorf("Called: Call([attach]) with and without logging, Expected the same response, Got: %q and %q", out, plain)
+	}
+
+	logged := buf.String()
+	for _, want := range []string{`"resource":"r0-logged"`, `"node":"node-logged"`, `"level":"error"`, `"event":"result"`} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("Called: Call([attach]) with logging, Expected log to contain %s, Got: %q", want, logged)
+		}
+	}
+}
+
+func TestCallAttachDryRun(t *testing.T) {
+	dir, restore := useTempCallDirs(t)
+	defer restore()
+	f := &drbd.FakeExecutor{}
+	oldOwned := drbd.OwnedDir
+	drbd.Exec, drbd.OwnedDir, drbd.DryRun = f, filepath.Join(dir, "owned"), true
+	defer func() { drbd.OwnedDir, drbd.DryRun = oldOwned, false }()
+
+	// No query finds any state, as on a node without DRBD.
+	out, ret := FlexVolumeApi{}.Call([]string{"attach", `{"resource":"r0"}`, "node1"})
+	res := attachResponse{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("Called: Call([attach r0]) in dry run, Unable to parse response %q: %v", out, err)
+	}
+	if exitCode(ret) != EXITSUCCESS || res.Status != "Success" || res.Device != "/dev/drbd/by-res/r0/0" {
+		t.Errorf("Called: Call([attach r0]) in dry run, Expected: %d Success on /dev/drbd/by-res/r0/0, Got: %d: %s", EXITSUCCESS, ret, out)
+	}
+	for _, call := range f.Ran() {
+		if strings.Contains(call, "assign-resource") {
+			t.Errorf("Called: Call([attach r0]) in dry run, Expected: only queries executed, Got: %q", call)
+		}
+	}
+	if _, err := os.Stat(drbd.OwnedDir); !os.IsNotExist(err) {
+		t.Errorf("Called: Call([attach r0]) in dry run, Expected: no assignment recorded, Got: %v", err)
+	}
+}
+
+func TestDescribeMountError(t *testing.T) {
+	cause := errors.New("exit status 32: mount: /mnt: wrong fs type")
+	var mountErrorTests = []struct {
+		in  error
+		out string
+	}{
+		{&drbd.MountError{Cause: drbd.ErrDeviceNotReady, Err: cause}, "device is not ready: " + cause.Error()},
+		{&drbd.MountError{Cause: drbd.ErrFormatFailed, Err: cause}, "failed to create filesystem: " + cause.Error()},
+		{&drbd.MountError{Cause: drbd.ErrAlreadyMounted, Err: cause}, "device is busy or already mounted: " + cause.Error()},
+		{&drbd.MountError{Cause: drbd.ErrWrongFSType, Err: cause}, "device does not hold a filesystem of the requested type: " + cause.Error()},
+		{&drbd.MountError{Cause: drbd.ErrFilesystemFull, Err: cause}, "filesystem is too full: " + cause.Error()},
+		{&drbd.MountError{Cause: drbd.ErrPrimaryElsewhere, Err: cause}, "resource is Primary on another node: " + cause.Error()},
+		{&drbd.MountError{Cause: drbd.ErrMountFailed, Err: cause}, "mount failed: " + cause.Error()},
+		{cause, cause.Error()},
+	}
+
+	for _, tt := range mountErrorTests {
+		out := describeMountError(tt.in)
+		if out != tt.out {
+			t.Errorf("Called: describeMountError(%v), Expected: %q, Got: %q", tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestMountExitCode(t *testing.T) {
+	cause := errors.New("exit status 32")
+	var exitCodeTests = []struct {
+		in  error
+		out exitCode
+	}{
+		{&drbd.MountError{Cause: drbd.ErrWrongFSType, Err: cause}, EXITBADAPICALL},
+		{&drbd.MountError{Cause: drbd.ErrDeviceNotReady, Err: cause}, EXITDRBDFAILURE},
+		{&drbd.MountError{Cause: drbd.ErrAlreadyMounted, Err: cause}, EXITDRBDFAILURE},
+		{&drbd.MountError{Cause: drbd.ErrPrimaryElsewhere, Err: cause}, EXITDRBDFAILURE},
+		{cause, EXITDRBDFAILURE},
+	}
+
+	for _, tt := range exitCodeTests {
+		out := mountExitCode(tt.in)
+		if out != tt.out {
+			t.Errorf("Called: mountExitCode(%v), Expected: %d, Got: %d", tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestCallTerminalFailures(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+
+	var terminalTests = [][]string{
+		{},
+		{"frobnicate"},
+		{"attach"},
+		{"attach", `{"resource":`, "node1"},
+		{"detach"},
+		{"mountdevice", "/mnt/r0", "/dev/drbd100", "not json"},
+		{"isattached", `{"resource":"r0","diskless":"maybe"}`, "node1"},
+		{"waitforattach", "/dev/drbd100"},
+		{"reconcile", "--force"},
+	}
+
+	for _, tt := range terminalTests {
+		out, ret := FlexVolumeApi{}.Call(tt)
+		if exitCode(ret) != EXITBADAPICALL || strings.Contains(out, `"status":"Success"`) {
+			t.Errorf("Called: %q, Expected: %d, Got: %d: %s", tt, EXITBADAPICALL, ret, out)
+		}
+	}
+}
+
+func TestVolumeLimitsResult(t *testing.T) {
+	var limitsTests = []struct {
+		max    int
+		inUse  int
+		err    error
+		status string
+		limit  int
+	}{
+		{1000, 0, nil, "Success", 1000},
+		{1000, 24, nil, "Success", 976},
+		{10, 12, nil, "Success", 0},
+		{0, 0, nil, "Not supported", 0},
+		{1000, 0, errors.New("drbdsetup: not found"), "Not supported", 0},
+	}
+
+	for _, tt := range limitsTests {
+		out, _ := volumeLimitsResult(tt.max, tt.inUse, tt.err)
+		var res volumeLimitsResponse
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Fatalf("Called: volumeLimitsResult(%d, %d, %v), Unexpected error: %v", tt.max, tt.inUse, tt.err, err)
+		}
+		if res.Status != tt.status || res.Capabilities.AttachLimit != tt.limit {
+			t.Errorf("Called: volumeLimitsResult(%d, %d, %v), Expected: %s %d, Got: %s", tt.max, tt.inUse, tt.err, tt.status, tt.limit, out)
+		}
+	}
+}
+
+func TestDetachAssignment(t *testing.T) {
+	var detachTests = []struct {
+		name       string
+		assignment string
+		owned      bool
+		queryErr   error
+		unassign   error
+		unassigned bool
+		ok         bool
+	}{
+		{"client", drbd.AssignmentDiskless, false, nil, nil, true, true},
+		{"retried detach", drbd.AssignmentNone, false, nil, nil, false, true},
+		{"local storage", drbd.AssignmentDiskful, false, nil, nil, false, true},
+		{"local storage attach created", drbd.AssignmentDiskful, true, nil, nil, true, true},
+		{"query failed", "", false, errors.New("drbdmanage not running"), nil, false, false},
+		{"unassign failed", drbd.AssignmentDiskless, false, nil, errors.New("operation failed"), false, false},
+	}
+
+	for _, tt := range detachTests {
+		calls := 0
+		unassigned, err := detachAssignment(
+			func() (string, error) { return tt.assignment, tt.queryErr },
+			func() bool { return tt.owned },
+			func() error {
+				calls++
+				return tt.unassign
+			})
+		if unassigned != tt.unassigned || (err == nil) != tt.ok {
+			t.Errorf("Called: detachAssignment(%s), Expected: %v, ok %v, Got: %v, %v", tt.name, tt.unassigned, tt.ok, unassigned, err)
+		}
+		if tt.assignment != drbd.AssignmentDiskless && !tt.owned && calls != 0 {
+			t.Errorf("Called: detachAssignment(%s), Expected: no unassign, Got: %d", tt.name, calls)
+		}
+	}
+}
+
+func TestCallRejectsBadResourceName(t *testing.T) {
+	dir, restore := useTempCallDirs(t)
+	defer restore()
+	history.Dir, lock.Dir = filepath.Join(dir, "history", "sub"), filepath.Join(dir, "lock", "sub")
+
+	var badNameTests = [][]string{
+		{"getvolumename", `{"resource":"r0; reboot"}`},
+		{"detach", "r0 r1", "node1"},
+		{"isattached", `{"resource":"$(id)"}`, "node1"},
+		{"getassignment", `{"resource":"r0; reboot"}`, "node1"},
+		{"attach", `{"resource":"../r0"}`, "node1"},
+		{"detach", "..", "node1"},
+		{"history", "../r0"},
+		{"drainnode", "../node1"},
+		{"migrate", `{"resource":"../r0"}`, "node1", "node2"},
+		{"verifystatus", "../r0"},
+		{"describe", "../r0"},
+	}
+
+	for _, tt := range badNameTests {
+		out, ret := FlexVolumeApi{}.Call(tt)
+		if exitCode(ret) != EXITBADAPICALL || !strings.Contains(out, `"status":"Failure"`) {
+			t.Errorf("Called: %q, Expected: %d, Got: %d: %s", tt, EXITBADAPICALL, ret, out)
+		}
+	}
+
+	// Nothing may be written next to the history and lock directories.
+	for _, d := range []string{"history", "lock"} {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, d))
+		for _, f := range files {
+			if f.Name() != "sub" {
+				t.Errorf("Called: %q, Expected: nothing outside %s, Got: %s", badNameTests, d, f.Name())
+			}
+		}
+	}
+}
+
+func TestSelftestResult(t *testing.T) {
+	var selftestTests = []struct {
+		checks []drbd.Check
+		ret    exitCode
+		status string
+	}{
+		{[]drbd.Check{{Name: "drbdadm", OK: true}, {Name: "kernel module", OK: true}}, EXITSUCCESS, "Success"},
+		{[]drbd.Check{{Name: "drbdadm", Detail: "drbdadm not found in PATH"}, {Name: "kernel module", OK: true}}, EXITDRBDFAILURE, "Failure"},
+	}
+
+	for _, tt := range selftestTests {
+		out, ret := selftestResult(drbd.Prerequisites{Checks: tt.checks})
+		var res selftestResponse
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Fatalf("Called: selftestResult(%v), Unexpected error: %v", tt.checks, err)
+		}
+		if ret != tt.ret || res.Status != tt.status || len(res.Checks) != len(tt.checks) {
+			t.Errorf("Called: selftestResult(%v), Expected: %d %s, Got: %d %s", tt.checks, tt.ret, tt.status, ret, out)
+		}
+	}
+}
+
+func TestMinorsCheck(t *testing.T) {
+	var minorsTests = []struct {
+		maxMinors int
+		inUse     int
+		err       error
+		ok        bool
+		detail    string
+	}{
+		{1000, 3, nil, true, "3 of 1000 in use"},
+		{0, 3, nil, true, "3 in use"},
+		{3, 3, nil, false, "all 3 DRBD minors in use"},
+		{1000, 0, errors.New("exit status 20"), false, "unable to count DRBD minors in use: exit status 20"},
+	}
+
+	for _, tt := range minorsTests {
+		c := minorsCheck(tt.maxMinors, tt.inUse, tt.err)
+		if c.Name != "minors" || c.OK != tt.ok || c.Detail != tt.detail {
+			t.Errorf("Called: minorsCheck(%d, %d, %v), Expected: %t %q, Got: %+v", tt.maxMinors, tt.inUse, tt.err, tt.ok, tt.detail, c)
+		}
+	}
+}
+
+func TestParseOptionsFSGroup(t *testing.T) {
+	gid := int64(2000)
+	var fsGroupTests = []struct {
+		in      string
+		ok      bool
+		fsGroup *int64
+	}{
+		{`{"resource":"r0"}`, true, nil},
+		{`{"resource":"r0","kubernetes.io/fsGroup":"2000"}`, true, &gid},
+		{`{"resource":"r0","kubernetes.io/fsGroup":"-1"}`, false, nil},
+		{`{"resource":"r0","kubernetes.io/fsGroup":"staff"}`, false, nil},
+	}
+
+	for _, tt := range fsGroupTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(opts.getFSGroup(), tt.fsGroup) {
+			t.Errorf("Called: parseOptions(%q), Expected fsGroup: %v, Got: %v", tt.in, tt.fsGroup, opts.getFSGroup())
+		}
+	}
+}
+
+func TestWaitForAttachResult(t *testing.T) {
+	var waitTests = []struct {
+		requested string
+		device    string
+		err       error
+		exists    bool
+		ret       exitCode
+	}{
+		{"/dev/drbd100", "/dev/drbd100", nil, true, EXITSUCCESS},
+		{"", "/dev/drbd100", nil, true, EXITSUCCESS},
+		{"/dev/drbd100", "", nil, true, EXITDRBDFAILURE},
+		{"/dev/drbd100", "", errors.New("DRBD: Malformed volInfo"), true, EXITDRBDFAILURE},
+		{"/dev/drbd100", "/dev/drbd101", nil, true, EXITDRBDFAILURE},
+		{"/dev/drbd100", "/dev/drbd100", nil, false, EXITDRBDFAILURE},
+	}
+
+	for _, tt := range waitTests {
+		out, ret := waitForAttachResult("waitforattach", tt.requested,
+			func() (string, error) { return tt.device, tt.err },
+			func(string) bool { return tt.exists })
+		var res attachResponse
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Fatalf("Called: waitForAttachResult(%q), Unexpected error: %v", tt.requested, err)
+		}
+		if ret != tt.ret {
+			t.Errorf("Called: waitForAttachResult(%q) with device %q, Expected: %d, Got: %d: %s", tt.requested, tt.device, tt.ret, ret, out)
+		}
+		if ret == EXITSUCCESS && res.Device != tt.device {
+			t.Errorf("Called: waitForAttachResult(%q), Expected device: %q, Got: %q", tt.requested, tt.device, res.Device)
+		}
+	}
+}
+
+func TestMountDeviceReady(t *testing.T) {
+	var readyTests = []struct {
+		name   string
+		device string
+		err    error
+		exists bool
+		ok     bool
+	}{
+		{"device present", "/dev/drbd100", nil, true, true},
+		{"not assigned", "", nil, false, false},
+		{"query failure", "", errors.New("DRBD: Malformed volInfo"), false, false},
+		{"device node missing", "/dev/drbd100", nil, false, false},
+	}
+
+	for _, tt := range readyTests {
+		cerr := mountDeviceReady("mountdevice",
+			func() (string, error) { return tt.device, tt.err },
+			func(string) bool { return tt.exists })
+		if tt.ok {
+			if cerr != nil {
+				t.Errorf("Called: mountDeviceReady() %s, Expected: nil, Got: %v", tt.name, cerr)
+			}
+			continue
+		}
+		if cerr == nil || !cerr.Retryable() || cerr.Reason != "DeviceNotReady" ||
+			!strings.Contains(cerr.Message, "mountdevice: device is not ready: ") {
+			t.Errorf("Called: mountDeviceReady() %s, Expected: retryable DeviceNotReady, Got: %+v", tt.name, cerr)
+		}
+	}
+}
+
+func TestUnassignAll(t *testing.T) {
+	var unassignAllTests = []struct {
+		names   []string
+		failing map[string]bool
+		failed  int
+	}{
+		{nil, nil, 0},
+		{[]string{"r0", "r1", "r2"}, nil, 0},
+		{[]string{"r0", "r1", "r2"}, map[string]bool{"r1": true}, 1},
+		{[]string{"r0", "r1"}, map[string]bool{"r0": true, "r1": true}, 2},
+	}
+
+	for _, tt := range unassignAllTests {
+		var tried []string
+		summary := unassignAll(tt.names, func(name string) error {
+			tried = append(tried, name)
+			if tt.failing[name] {
+				return errors.New("DRBD: Unable to unassign resource")
+			}
+			return nil
+		})
+		if !reflect.DeepEqual(tried, tt.names) {
+			t.Errorf("Called: unassignAll(%q), Expected attempts: %q, Got: %q", tt.names, tt.names, tried)
+		}
+		if summary.Failed != tt.failed || summary.Succeeded != len(tt.names)-tt.failed || len(summary.Items) != len(tt.names) {
+			t.Errorf("Called: unassignAll(%q) failing %v, Expected: %d failed, Got: %+v", tt.names, tt.failing, tt.failed, summary)
+		}
+		for _, item := range summary.Items {
+			if (item.Outcome == "failure") != tt.failing[item.Resource] {
+				t.Errorf("Called: unassignAll(%q) failing %v, Expected %s failure: %v, Got: %+v", tt.names, tt.failing, item.Resource, tt.failing[item.Resource], item)
+			}
+		}
+	}
+}
+
+func TestParseOptionsSharedSecret(t *testing.T) {
+	const secret = "s3cr3t"
+	// base64 of the secret, as the Kubelet passes it.
+	in := `{"resource":"r0","kubernetes.io/secret/shared-secret":"czNjcjN0"}`
+
+	opts, err := parseOptions(in)
+	if err != nil {
+		t.Fatalf("Called: parseOptions(%q), Unexpected error: %v", in, err)
+	}
+	if opts.getSharedSecret() != secret {
+		t.Errorf("Called: parseOptions(%q), Expected shared secret: %q, Got: %q", in, secret, opts.getSharedSecret())
+	}
+	resolved, _ := json.Marshal(opts.resolved())
+	if strings.Contains(string(resolved), secret) || strings.Contains(string(resolved), "czNjcjN0") {
+		t.Errorf("Called: parseOptions(%q).resolved(), Expected the secret left out, Got: %s", in, resolved)
+	}
+	for _, arg := range RedactArgs([]string{in, "node1"}) {
+		if strings.Contains(arg, "czNjcjN0") {
+			t.Errorf("Called: RedactArgs(%q), Expected the secret redacted, Got: %q", in, arg)
+		}
+	}
+
+	bad := `{"resource":"r0","kubernetes.io/secret/shared-secret":"not base64 s3cr3t"}`
+	if _, err := parseOptions(bad); err == nil || strings.Contains(err.Error(), secret) {
+		t.Errorf("Called: parseOptions(%q), Expected an error without the secret, Got: %v", bad, err)
+	}
+}
+
+func TestParseOptionsSubPath(t *testing.T) {
+	var subPathTests = []struct {
+		in      string
+		subPath string
+		ok      bool
+	}{
+		{`{"resource":"r0"}`, "", true},
+		{`{"resource":"r0","subPath":"data"}`, "data", true},
+		{`{"resource":"r0","subPath":"../r1"}`, "", false},
+		{`{"resource":"r0","subPath":"/etc"}`, "", false},
+	}
+
+	for _, tt := range subPathTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok || tt.ok && opts.SubPath != tt.subPath {
+			t.Errorf("Called: parseOptions(%q), Expected: %q, ok: %v, Got: %q, %v", tt.in, tt.subPath, tt.ok, opts.SubPath, err)
+		}
+	}
+}
+
+func TestParseMountArgs(t *testing.T) {
+	var mountArgsTests = []struct {
+		in     []string
+		dir    string
+		device string
+		opts   string
+		ok     bool
+	}{
+		{[]string{"mount", "/pods/v", "/dev/drbd100", `{"resource":"r0"}`}, "/pods/v", "/dev/drbd100", `{"resource":"r0"}`, true},
+		{[]string{"mount", "/pods/v", `{"resource":"r0"}`}, "/pods/v", "", `{"resource":"r0"}`, true},
+		{[]string{"mount", "/pods/v", "/dev/drbd100"}, "", "", "", false},
+		{[]string{"mount", "/pods/v"}, "", "", "", false},
+	}
+
+	for _, tt := range mountArgsTests {
+		dir, device, opts, err := parseMountArgs(tt.in)
+		if (err == nil) != tt.ok || dir != tt.dir || device != tt.device || opts != tt.opts {
+			t.Errorf("Called: parseMountArgs(%q), Expected: %q, %q, %q, ok %v, Got: %q, %q, %q, %v", tt.in, tt.dir, tt.device, tt.opts, tt.ok, dir, device, opts, err)
+		}
+	}
+}
+
+func TestCallLockedResource(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	oldTimeout := LockTimeout
+	LockTimeout = 0
+	defer func() { LockTimeout = oldTimeout }()
+
+	l, err := lock.Acquire("r0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+
+	out, ret := FlexVolumeApi{}.Call([]string{"detach", "r0", "node1"})
+	if exitCode(ret) != EXITDRBDFAILURE || !strings.Contains(out, "busy with another call, retry later") {
+		t.Errorf("Called: Call([detach r0]) while r0 is locked, Expected: %d, retry later, Got: %d: %s", EXITDRBDFAILURE, ret, out)
+	}
+
+	// drainnode holds the locks of every resource it unassigns.
+	f := &drbd.FakeExecutor{Commands: map[string]drbd.FakeCommand{
+		"drbdmanage list-assignments --nodes node1 --machine-readable": {
+			Output: "node1,r1,0,connect|deploy,connect|deploy\nnode1,r0,0,connect|deploy,connect|deploy\n"},
+	}}
+	drbd.Exec = f
+	out, ret = FlexVolumeApi{}.Call([]string{"drainnode", "node1"})
+	if exitCode(ret) != EXITDRBDFAILURE || !strings.Contains(out, "busy with another call, retry later") {
+		t.Errorf("Called: Call([drainnode node1]) while r0 is locked, Expected: %d, retry later, Got: %d: %s", EXITDRBDFAILURE, ret, out)
+	}
+	for _, call := range f.Ran() {
+		if strings.Contains(call, "unassign") {
+			t.Errorf("Called: Call([drainnode node1]) while r0 is locked, Expected: nothing unassigned, Got: %q", call)
+		}
+	}
+}
+
+func TestCheckNotMounted(t *testing.T) {
+	var mountedTests = []struct {
+		mounted bool
+		err     error
+		force   bool
+		ok      bool
+	}{
+		{false, nil, false, true},
+		{true, nil, false, false},
+		{true, nil, true, true},
+		{false, errors.New("DRBD: Unable to get device path"), false, true},
+	}
+
+	for _, tt := range mountedTests {
+		err := checkNotMounted(func() (bool, error) { return tt.mounted, tt.err }, tt.force)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: checkNotMounted(mounted %v, %v, force %v), Expected ok: %v, Got: %v", tt.mounted, tt.err, tt.force, tt.ok, err)
+		}
+	}
+}
+
+func TestResponseAPIVersion(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+
+	var versionTests = [][]string{
+		{"init"},
+		{"attach", `{"resource":"r0-version"}`, "node1"},
+		{"attach", `{"resource":`, "node1"},
+		{"isattachednowait", `{"resource":"r0-version"}`, "node1"},
+		{"isattached", `{"resource":"r0","diskless":"maybe"}`, "node1"},
+	}
+
+	for _, tt := range versionTests {
+		out, _ := FlexVolumeApi{}.Call(tt)
+		res := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Errorf("Called: %q, Unable to parse response %q: %v", tt, out, err)
+			continue
+		}
+		if res["apiVersion"] != APIVersion {
+			t.Errorf("Called: %q, Expected: apiVersion %q, Got: %v in %s", tt, APIVersion, res["apiVersion"], out)
+		}
+	}
+
+	// Responses still parse into their structs.
+	out, _ := FlexVolumeApi{}.Call([]string{"init"})
+	res := initResponse{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil || res.Status != "Success" {
+		t.Errorf("Called: init, Expected: a Success initResponse, Got: %+v, %v from %s", res, err, out)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	oldVersion := PluginVersion
+	defer func() { PluginVersion = oldVersion }()
+
+	var versionTests = []struct {
+		plugin   string
+		expected string
+	}{
+		{"v0.3.1-4-gdeadbee", "v0.3.1-4-gdeadbee"},
+		{"", "unknown"},
+	}
+
+	for _, tt := range versionTests {
+		PluginVersion = tt.plugin
+		out, ret := FlexVolumeApi{}.Call([]string{"version"})
+		res := versionResponse{}
+		if err := json.Unmarshal([]byte(out), &res); err != nil || ret != int(EXITSUCCESS) {
+			t.Errorf("Called: version, Expected: Success, Got: %s, %v", out, err)
+			continue
+		}
+		// The DRBD tooling need not be installed, but is always reported.
+		if res.PluginVersion != tt.expected || res.DRBDUtilsVersion == "" || res.DRBDKernelVersion == "" {
+			t.Errorf("Called: version with plugin version %q, Expected: pluginVersion %q and DRBD versions, Got: %s",
+				tt.plugin, tt.expected, out)
+		}
+	}
+}
+
+func TestAssignmentStateError(t *testing.T) {
+	var stateTests = []struct {
+		state     string
+		reason    string
+		retryable bool
+	}{
+		{drbd.AssignmentPending, detailsAssignmentPending.Reason, true},
+		{drbd.AssignmentFailed, detailsNotAttached.Reason, false},
+	}
+
+	if cerr := assignmentStateError("isattached", "r0", drbd.AssignmentAssigned); cerr != nil {
+		t.Errorf("Called: assignmentStateError(%q), Expected: nil, Got: %v", drbd.AssignmentAssigned, cerr)
+	}
+	for _, tt := range stateTests {
+		cerr := assignmentStateError("isattached", "r0", tt.state)
+		if cerr == nil || cerr.Reason != tt.reason || cerr.Retryable() != tt.retryable {
+			t.Errorf("Called: assignmentStateError(%q), Expected: %q, retryable %t, Got: %+v", tt.state, tt.reason, tt.retryable, cerr)
+		}
+	}
+}
+
+func TestAttachedState(t *testing.T) {
+	notDefined := &drbd.AssignError{Cause: drbd.ErrNotDefined, Err: errors.New(`DRBD: Resource "r0" not defined.`)}
+	var attachedTests = []struct {
+		name     string
+		state    string
+		err      error
+		attached bool
+		reason   string
+	}{
+		{"assigned", drbd.AssignmentAssigned, nil, true, ""},
+		{"not assigned", drbd.AssignmentMissing, nil, false, ""},
+		{"doesn't exist", "", notDefined, false, ""},
+		{"pending", drbd.AssignmentPending, nil, false, detailsAssignmentPending.Reason},
+		{"failed", drbd.AssignmentFailed, nil, false, detailsNotAttached.Reason},
+		{"query failure", "", errors.New("drbdmanage: connection refused"), false, detailsFailure.Reason},
+	}
+
+	for _, tt := range attachedTests {
+		attached, cerr := attachedState("isattached", "r0", tt.state, tt.err)
+		reason := ""
+		if cerr != nil {
+			reason = cerr.Reason
+		}
+		if attached != tt.attached || reason != tt.reason {
+			t.Errorf("Called: attachedState(%q) %s, Expected: %t, reason %q, Got: %t, %+v", tt.state, tt.name, tt.attached, tt.reason, attached, cerr)
+		}
+	}
+}
+
+func TestRecoverStandAlone(t *testing.T) {
+	var recoverTests = []struct {
+		name         string
+		state        string
+		reconnectErr error
+		reconnected  bool
+		warns        bool
+	}{
+		{"connected", "Connected", nil, false, false},
+		{"standalone recovers", "StandAlone", nil, true, false},
+		{"standalone fails", "StandAlone", errors.New("not connected within 10s"), true, true},
+	}
+
+	for _, tt := range recoverTests {
+		reconnected := false
+		warning := recoverStandAlone("r0",
+			func() string { return tt.state },
+			func() error { reconnected = true; return tt.reconnectErr })
+		if reconnected != tt.reconnected || (warning != "") != tt.warns {
+			t.Errorf("Called: recoverStandAlone(%s), Expected: reconnected %t, warning %t, Got: reconnected %t, warning %q",
+				tt.name, tt.reconnected, tt.warns, reconnected, warning)
+		}
+	}
+}
+
+func TestAssignWithRetry(t *testing.T) {
+	transient := &drbd.AssignError{Transient: true, Err: errors.New("controller busy")}
+	terminal := &drbd.AssignError{Err: errors.New("resource not defined")}
+	b := drbd.Backoff{Timeout: time.Second * 10, Interval: time.Second, MaxInterval: time.Second * 4}
+
+	var retryTests = []struct {
+		name   string
+		errs   []error
+		ok     bool
+		err    error
+		calls  int
+		sleeps []time.Duration
+	}{
+		{"two transient failures", []error{transient, transient, nil}, true, nil, 3,
+			[]time.Duration{time.Second, time.Second * 2}},
+		{"terminal failure", []error{terminal, nil}, false, terminal, 1, nil},
+		{"transient then terminal", []error{transient, terminal, nil}, false, terminal, 2,
+			[]time.Duration{time.Second}},
+		{"only transient failures", []error{transient, transient, transient, transient, transient}, false, transient, 4,
+			[]time.Duration{time.Second, time.Second * 2, time.Second * 4}},
+	}
+
+	for _, tt := range retryTests {
+		calls := 0
+		var sleeps []time.Duration
+		ok, err := assignWithRetry(func() (bool, error) {
+			err := tt.errs[calls]
+			calls++
+			return err == nil, err
+		}, b, func(d time.Duration) { sleeps = append(sleeps, d) })
+		if ok != tt.ok || err != tt.err || calls != tt.calls || !reflect.DeepEqual(sleeps, tt.sleeps) {
+			t.Errorf("Called: assignWithRetry() with %s, Expected: %v, %v after %d calls and waits %v, Got: %v, %v after %d calls and waits %v",
+				tt.name, tt.ok, tt.err, tt.calls, tt.sleeps, ok, err, calls, sleeps)
+		}
+	}
+}
+
+func TestParseOptionsFSLabel(t *testing.T) {
+	var fsLabelTests = []struct {
+		in string
+		ok bool
+	}{
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4","fsLabel":"web"}`, true},
+		{`{"resource":"r0","kubernetes.io/fsType":"xfs","fsLabel":"web","relabel":"true"}`, true},
+		{`{"resource":"r0","kubernetes.io/fsType":"xfs","fsLabel":"web-frontend-1"}`, false},
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4","fsLabel":"web","relabel":"yes"}`, false},
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4","relabel":"true"}`, false},
+	}
+
+	for _, tt := range fsLabelTests {
+		_, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+		}
+	}
+}
+
+func TestParseOptionsBlockMode(t *testing.T) {
+	var blockModeTests = []struct {
+		in string
+		ok bool
+	}{
+		{`{"resource":"r0","blockMode":"true"}`, true},
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4","blockMode":"false"}`, true},
+		{`{"resource":"r0","blockMode":"yes"}`, false},
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4","blockMode":"true"}`, false},
+		{`{"resource":"r0","subPath":"data","blockMode":"true"}`, false},
+		{`{"resource":"r0","stagedMount":"true"}`, true},
+		{`{"resource":"r0","stagedMount":"yes"}`, false},
+		{`{"resource":"r0","stagedMount":"true","blockMode":"true"}`, false},
+	}
+
+	for _, tt := range blockModeTests {
+		_, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+		}
+	}
+}
+
+func TestParseOptionsPreMount(t *testing.T) {
+	var preMountTests = []struct {
+		in string
+		ok bool
+	}{
+		{`{"resource":"r0","fsckOnMount":"true","preMountHook":"/etc/drbd-flexvolume/hooks/validate"}`, true},
+		{`{"resource":"r0","fsckOnMount":"always"}`, false},
+		{`{"resource":"r0","preMountHook":"validate"}`, false},
+		{`{"resource":"r0","preMountHook":"/etc/drbd-flexvolume/hooks/../hooks/validate"}`, false},
+		// Only hooks the operator installed may run.
+		{`{"resource":"r0","preMountHook":"/usr/local/bin/validate"}`, false},
+		{`{"resource":"r0","preMountHook":"/bin/sh"}`, false},
+		{`{"resource":"r0","preMountHook":"/etc/drbd-flexvolume/hooks/sub/validate"}`, false},
+		{`{"resource":"r0","preMountHook":"/etc/drbd-flexvolume/hooks"}`, false},
+	}
+
+	for _, tt := range preMountTests {
+		_, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+		}
+	}
+}
+
+func TestParseOptionsPlacement(t *testing.T) {
+	var placementTests = []struct {
+		in    string
+		count int
+		pool  string
+		ok    bool
+	}{
+		{`{"resource":"r0","placementCount":"3","storagePool":"ssd"}`, 3, "ssd", true},
+		{`{"resource":"r0"}`, 0, "", true},
+		{`{"resource":"r0","placementCount":"0"}`, 0, "", false},
+		{`{"resource":"r0","placementCount":"two"}`, 0, "", false},
+		{`{"resource":"r0","storagePool":"--auto-place"}`, 0, "", false},
+		{`{"resource":"r0","storagePool":"ssd pool"}`, 0, "", false},
+		{`{"resource":"r0","placementCount":"3","sizeBytes":"1073741824"}`, 3, "", true},
+		{`{"resource":"r0","sizeBytes":"1073741824"}`, 0, "", false},
+		{`{"resource":"r0","placementCount":"3","sizeBytes":"0"}`, 0, "", false},
+	}
+
+	for _, tt := range placementTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+			continue
+		}
+		if tt.ok && (opts.getPlacementCount() != tt.count || opts.StoragePool != tt.pool) {
+			t.Errorf("Called: parseOptions(%q), Expected: placement %d in %q, Got: %d in %q",
+				tt.in, tt.count, tt.pool, opts.getPlacementCount(), opts.StoragePool)
+		}
+	}
+}
+
+func TestDemoteForDetach(t *testing.T) {
+	errBusy := errors.New("device is held open by someone")
+	var demoteTests = []struct {
+		role    string
+		roleErr error
+		demote  error
+		wait    error
+		err     error
+		calls   string
+	}{
+		{"Primary", nil, nil, nil, nil, "role demote wait"},
+		{"Secondary", nil, nil, nil, nil, "role"},
+		{"", errors.New("resource unknown"), nil, nil, nil, "role"},
+		{"Primary", nil, errBusy, nil, errBusy, "role demote"},
+		{"Primary", nil, nil, errBusy, errBusy, "role demote wait"},
+	}
+
+	for _, tt := range demoteTests {
+		var calls []string
+		err := demoteForDetach(
+			func() (string, error) { calls = append(calls, "role"); return tt.role, tt.roleErr },
+			func() error { calls = append(calls, "demote"); return tt.demote },
+			func() error { calls = append(calls, "wait"); return tt.wait })
+		if err != tt.err || strings.Join(calls, " ") != tt.calls {
+			t.Errorf("Called: demoteForDetach() as %q, Expected: %v after %q, Got: %v after %q", tt.role, tt.err, tt.calls, err, calls)
+		}
+	}
+}
+
+func TestVolumeStatus(t *testing.T) {
+	size := func() (int64, error) { return 1 << 30, nil }
+	usage := func(path string) (uint64, uint64, error) {
+		if path != "/mnt/r0" {
+			return 0, 0, errors.New("not mounted")
+		}
+		return 1 << 20, 1 << 29, nil
+	}
+
+	status, err := volumeStatus("/dev/drbd100", size, func() (string, error) { return "/mnt/r0", nil }, usage)
+	if err != nil || status.SizeBytes != 1<<30 || status.MountPath != "/mnt/r0" ||
+		status.UsedBytes == nil || *status.UsedBytes != 1<<20 || status.AvailableBytes == nil || *status.AvailableBytes != 1<<29 {
+		t.Errorf("Called: volumeStatus(%q) mounted, Expected: size, path and usage, Got: %+v, %v", "/dev/drbd100", status, err)
+	}
+
+	status, err = volumeStatus("/dev/drbd100", size, func() (string, error) { return "", nil }, usage)
+	if err != nil || status.SizeBytes != 1<<30 || status.MountPath != "" || status.UsedBytes != nil || status.AvailableBytes != nil {
+		t.Errorf("Called: volumeStatus(%q) not mounted, Expected: size only, Got: %+v, %v", "/dev/drbd100", status, err)
+	}
+	out, _ := json.Marshal(status)
+	if strings.Contains(string(out), "usedBytes") || strings.Contains(string(out), "mountPath") {
+		t.Errorf("Called: volumeStatus(%q) not mounted, Expected no usage in JSON, Got: %s", "/dev/drbd100", out)
+	}
+
+	failing := func() (int64, error) { return 0, errors.New("blockdev failed") }
+	if _, err := volumeStatus("/dev/drbd100", failing, func() (string, error) { return "", nil }, usage); err == nil {
+		t.Errorf("Called: volumeStatus(%q) with failing size, Expected an error, Got: nil", "/dev/drbd100")
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	var lagTests = []struct {
+		async     bool
+		asyncErr  error
+		outOfSync int64
+		syncErr   error
+		threshold string
+		out       string
+	}{
+		{false, nil, 4096, nil, "1024", "-"},
+		{true, errors.New("drbdadm failed"), 4096, nil, "1024", "-"},
+		{true, nil, 4096, errors.New("drbdsetup failed"), "1024", "-"},
+		{true, nil, 4096, nil, "", "4096"},
+		{true, nil, 4096, nil, "1024", "4096 lagging"},
+		{true, nil, 1024, nil, "1024", "1024 not lagging"},
+		{true, nil, 0, nil, "0", "0 not lagging"},
+	}
+
+	for _, tt := range lagTests {
+		n, lagging := replicationLag(
+			func() (bool, error) { return tt.async, tt.asyncErr },
+			func() (int64, error) { return tt.outOfSync, tt.syncErr },
+			tt.threshold)
+		out := "-"
+		if n != nil {
+			out = strconv.FormatInt(*n, 10)
+		}
+		if lagging != nil && *lagging {
+			out += " lagging"
+		} else if lagging != nil {
+			out += " not lagging"
+		}
+		if out != tt.out {
+			t.Errorf("Called: replicationLag(async %t, %v, %d, %v, %q), Expected: %q, Got: %q",
+				tt.async, tt.asyncErr, tt.outOfSync, tt.syncErr, tt.threshold, tt.out, out)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+)
+
+// batchAttachment is the outcome of attaching one resource of a batch.
+type batchAttachment struct {
+	// Status is "Success", "Failure", "RolledBack" if the resource was
+	// unassigned again after another one failed, or "Skipped" if it was not
+	// tried at all.
+	Status  string `json:"status"`
+	Device  string `json:"device,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type batchAttachResponse struct {
+	response
+	Resources map[string]batchAttachment `json:"resources"`
+}
+
+// batchError is the failure of one resource of a batch, without the prefix
+// the response of its own call would carry.
+type batchError struct {
+	*CallError
+}
+
+func (e batchError) Error() string {
+	return strings.TrimPrefix(e.Message, flexAPIErr{}.Error())
+}
+
+func (e batchError) Unwrap() error {
+	return e.CallError
+}
+
+// resolveResourceNames resolves the names of a batch through the resource
+// map. A resource given twice, under whatever name, is an error.
+func resolveResourceNames(names []string) ([]string, error) {
+	var resolved []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		r, err := resolveResourceName(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve resource %q: %w", name, err)
+		}
+		if seen[r] {
+			return nil, fmt.Errorf("resource %s given more than once", r)
+		}
+		seen[r] = true
+		resolved = append(resolved, r)
+	}
+	return resolved, nil
+}
+
+// attachResources attaches all resources given in the resources option, for
+// pods with several volumes, each as attach alone would. The other options
+// apply to every resource. The locks of all of them are held throughout.
+func (api FlexVolumeApi) attachResources(s []string, opts options, names []string) (string, exitCode) {
+	given := names
+	names, err := resolveResourceNames(names)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: %v", s[0], err)}.Error(),
+			errorDetails: failureDetails(err),
+		})
+		return string(res), EXITBADAPICALL
+	}
+	for _, name := range names {
+		if err := drbd.ValidateResourceName(name); err != nil {
+			return badResourceNameResponse(s, err)
+		}
+	}
+	release, cerr := lockResources(s[0], names)
+	if cerr != nil {
+		res, _ := json.Marshal(cerr.response())
+		return string(res), cerr.code
+	}
+	defer release()
+	resolved := make(map[string]string)
+	for i, name := range given {
+		resolved[name] = names[i]
+	}
+	deps := make(map[string][]string)
+	for name, needs := range opts.getDependsOn() {
+		for _, n := range needs {
+			deps[resolved[name]] = append(deps[resolved[name]], resolved[n])
+		}
+	}
+	names, err = attachOrder(names, deps)
+	if err != nil {
+		res, _ := json.Marshal(response{
+			Status:       "Failure",
+			Message:      flexAPIErr{fmt.Sprintf("%s: dependsOn: %v", s[0], err)}.Error(),
+			errorDetails: detailsInvalidOptions,
+		})
+		return string(res), EXITBADAPICALL
+	}
+
+	// Every resource is attached with the options of the batch, naming it.
+	resourceOpts := func(name string) options {
+		o := opts
+		o.Resource, o.PVCResource, o.Resources, o.longName = name, "", "", ""
+		return o
+	}
+
+	summary := newBatchSummary()
+	results, err := attachBatch(names, deps,
+		func(name string) (bool, error) { return drbd.Assigned(drbd.Resource{Name: name, NodeName: s[2]}) },
+		func(name string) (string, error) {
+			result, cerr := attachResource(s[0], s[2], resourceOpts(name))
+			if cerr != nil {
+				return "", batchError{cerr}
+			}
+			return result.Device, nil
+		},
+		func(name string) error {
+			r := drbd.Resource{Name: name, NodeName: s[2]}
+			if err := drbd.UnassignRes(r); err != nil {
+				return err
+			}
+			return drbd.ForgetOwned(r)
+		})
+	for _, name := range names {
+		var itemErr error
+		if r := results[name]; r.Status != "Success" {
+			itemErr = fmt.Errorf("%s: %s", r.Status, r.Message)
+		}
+		summary.add(name, itemErr)
+	}
+	summary.finish(s[0], err != nil, opts.LogSummary == "true")
+
+	if err != nil {
+		res, _ := json.Marshal(batchAttachResponse{
+			Resources: results,
+			response: response{
+				Status:       "Failure",
+				Message:      flexAPIErr{err.Error()}.Error(),
+				errorDetails: failureDetails(err),
+			},
+		})
+		return string(res), EXITDRBDFAILURE
+	}
+
+	res, _ := json.Marshal(batchAttachResponse{
+		Resources: results,
+		response:  response{Status: "Success"},
+	})
+	return string(res), EXITSUCCESS
+}
+
+// attachOrder sorts the resources of a batch so that each comes after the
+// resources it depends on, and otherwise by name. Dependencies must be
+// resources of the batch and must not form a cycle.
+func attachOrder(names []string, deps map[string][]string) ([]string, error) {
+	inBatch := make(map[string]bool)
+	for _, name := range names {
+		inBatch[name] = true
+	}
+	waiting := make(map[string]int)
+	for name, needs := range deps {
+		if !inBatch[name] {
+			return nil, fmt.Errorf("resource %s is not in resources", name)
+		}
+		for _, n := range needs {
+			if !inBatch[n] {
+				return nil, fmt.Errorf("resource %s depends on %s, which is not in resources", name, n)
+			}
+			waiting[name]++
+		}
+	}
+
+	var order []string
+	done := make(map[string]bool)
+	for len(order) < len(names) {
+		var ready []string
+		for _, name := range names {
+			if !done[name] && waiting[name] == 0 {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) == 0 {
+			var cycle []string
+			for _, name := range names {
+				if !done[name] {
+					cycle = append(cycle, name)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("resources %s depend on each other", strings.Join(cycle, ", "))
+		}
+		sort.Strings(ready)
+		next := ready[0]
+		order = append(order, next)
+		done[next] = true
+		for name, needs := range deps {
+			for _, n := range needs {
+				if n == next {
+					waiting[name]--
+				}
+			}
+		}
+	}
+	return order, nil
+}
+
+// needs reports whether name depends on prerequisite, directly or through
+// other resources.
+func needs(deps map[string][]string, name, prerequisite string) bool {
+	for _, n := range deps[name] {
+		if n == prerequisite || needs(deps, n, prerequisite) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachBatch attaches the resources in order, returning the device of each.
+// Resources depending on one that failed are reported as skipped for it.
+// Once one fails, the rest are skipped and the ones this call assigned,
+// including the failed one if it got that far, are unassigned again in
+// reverse order, so that a pod never ends up with only part of its volumes.
+// Resources that were assigned before stay assigned; those that couldn't be
+// told are taken to be new.
+func attachBatch(names []string, deps map[string][]string, assigned func(string) (bool, error), attach func(string) (string, error), unassign func(string) error) (map[string]batchAttachment, error) {
+	results := make(map[string]batchAttachment)
+	var newlyAssigned []string
+
+	for i, name := range names {
+		// A query failing doesn't fail the resource, attach either manages
+		// or fails on its own.
+		was, err := assigned(name)
+		if err != nil {
+			was = false
+		}
+		device, err := attach(name)
+		if err == nil {
+			results[name] = batchAttachment{Status: "Success", Device: device}
+			if !was {
+				newlyAssigned = append(newlyAssigned, name)
+			}
+			continue
+		}
+
+		results[name] = batchAttachment{Status: "Failure", Message: err.Error()}
+		if now, aErr := assigned(name); aErr == nil && now && !was {
+			if uErr := unassign(name); uErr != nil {
+				results[name] = batchAttachment{Status: "Failure",
+					Message: fmt.Sprintf("%v, unable to roll back: %v", err, uErr)}
+			}
+		}
+		for _, skipped := range names[i+1:] {
+			results[skipped] = batchAttachment{Status: "Skipped"}
+			if needs(deps, skipped, name) {
+				results[skipped] = batchAttachment{Status: "Skipped", Message: fmt.Sprintf("prerequisite %s failed", name)}
+			}
+		}
+		for j := len(newlyAssigned) - 1; j >= 0; j-- {
+			n := newlyAssigned[j]
+			if uErr := unassign(n); uErr != nil {
+				results[n] = batchAttachment{Status: "Failure", Device: results[n].Device,
+					Message: fmt.Sprintf("unable to roll back: %v", uErr)}
+			} else {
+				results[n] = batchAttachment{Status: "RolledBack"}
+			}
+		}
+		return results, fmt.Errorf("resource %s: %w", name, err)
+	}
+	return results, nil
+}
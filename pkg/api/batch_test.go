@@ -0,0 +1,279 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linbit/drbd-flexvolume/pkg/history"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+)
+
+func TestAttachBatch(t *testing.T) {
+	var batchTests = []struct {
+		names        []string
+		preassigned  map[string]bool
+		failing      string
+		partial      bool
+		failUnassign bool
+		ok           bool
+		unassigned   []string
+		statuses     map[string]string
+	}{
+		{[]string{"r0", "r1", "r2"}, nil, "", false, false, true, nil,
+			map[string]string{"r0": "Success", "r1": "Success", "r2": "Success"}},
+		{[]string{"r0", "r1", "r2"}, nil, "r2", false, false, false, []string{"r1", "r0"},
+			map[string]string{"r0": "RolledBack", "r1": "RolledBack", "r2": "Failure"}},
+		{[]string{"r0", "r1", "r2"}, map[string]bool{"r0": true}, "r1", false, false, false, nil,
+			map[string]string{"r0": "Success", "r1": "Failure", "r2": "Skipped"}},
+		{[]string{"r0", "r1"}, nil, "r1", false, true, false, []string{"r0"},
+			map[string]string{"r0": "Failure", "r1": "Failure"}},
+		// Assigned, but e.g. never UpToDate: rolled back with the rest.
+		{[]string{"r0", "r1", "r2"}, nil, "r1", true, false, false, []string{"r1", "r0"},
+			map[string]string{"r0": "RolledBack", "r1": "Failure", "r2": "Skipped"}},
+	}
+
+	for _, tt := range batchTests {
+		var unassigned []string
+		attached := make(map[string]bool)
+		results, err := attachBatch(tt.names, nil,
+			func(name string) (bool, error) { return tt.preassigned[name] || attached[name], nil },
+			func(name string) (string, error) {
+				if name == tt.failing {
+					attached[name] = tt.partial
+					return "", errors.New("DRBD: Unable to assign resource")
+				}
+				attached[name] = true
+				return "/dev/drbd-" + name, nil
+			},
+			func(name string) error {
+				unassigned = append(unassigned, name)
+				if tt.failUnassign {
+					return errors.New("DRBD: Unable to unassign resource")
+				}
+				return nil
+			})
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: attachBatch(%q) failing %q, Expected ok: %v, Got: %v", tt.names, tt.failing, tt.ok, err)
+		}
+		if !reflect.DeepEqual(unassigned, tt.unassigned) {
+			t.Errorf("Called: attachBatch(%q) failing %q, Expected unassigned: %q, Got: %q", tt.names, tt.failing, tt.unassigned, unassigned)
+		}
+		statuses := make(map[string]string)
+		for name, r := range results {
+			statuses[name] = r.Status
+			if r.Status == "Success" && r.Device != "/dev/drbd-"+name {
+				t.Errorf("Called: attachBatch(%q), Expected device of %s: %q, Got: %q", tt.names, name, "/dev/drbd-"+name, r.Device)
+			}
+		}
+		if !reflect.DeepEqual(statuses, tt.statuses) {
+			t.Errorf("Called: attachBatch(%q) failing %q, Expected: %v, Got: %v", tt.names, tt.failing, tt.statuses, statuses)
+		}
+	}
+}
+
+func TestParseOptionsResources(t *testing.T) {
+	var resourcesTests = []struct {
+		in        string
+		resources []string
+		ok        bool
+	}{
+		{`{"resource":"r0"}`, nil, true},
+		{`{"resources":["r0","r1"]}`, []string{"r0", "r1"}, true},
+		{`{"resources":"[\"r0\",\"r1\"]"}`, []string{"r0", "r1"}, true},
+		{`{"resources":[]}`, nil, false},
+		{`{"resources":"r0,r1"}`, nil, false},
+		{`{"resources":[0,1]}`, nil, false},
+	}
+
+	for _, tt := range resourcesTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected ok: %v, Got: %v", tt.in, tt.ok, err)
+			continue
+		}
+		if resources := opts.getResources(); tt.ok && !reflect.DeepEqual(resources, tt.resources) {
+			t.Errorf("Called: parseOptions(%q), Expected resources: %q, Got: %q", tt.in, tt.resources, resources)
+		}
+	}
+}
+
+func TestCallAttachLegacyAndBatch(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+
+	// With every command failing, the single resource fails as it always
+	// did, with an attach response and no batch results.
+	out, ret := FlexVolumeApi{}.Call([]string{"attach", `{"resource":"r0"}`, "node1"})
+	if exitCode(ret) != EXITDRBDFAILURE || strings.Contains(out, `"resources"`) {
+		t.Errorf("Called: Call([attach r0]), Expected: %d without batch results, Got: %d: %s", EXITDRBDFAILURE, ret, out)
+	}
+
+	// Every name of a batch is checked before any is assigned.
+	out, ret = FlexVolumeApi{}.Call([]string{"attach", `{"resources":["r0","r1; reboot"]}`, "node1"})
+	if exitCode(ret) != EXITBADAPICALL || !strings.Contains(out, `"status":"Failure"`) {
+		t.Errorf("Called: Call([attach r0 r1; reboot]), Expected: %d, Got: %d: %s", EXITBADAPICALL, ret, out)
+	}
+}
+
+func TestCallAttachBatchLocksAndRecordsAll(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	oldTimeout := LockTimeout
+	LockTimeout = time.Millisecond * 50
+	defer func() { LockTimeout = oldTimeout }()
+
+	call := []string{"attach", `{"resources":["r1","r0"]}`, "node1"}
+
+	// A batch waits for the lock of every resource in it.
+	held, err := lock.Acquire("r1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, ret := FlexVolumeApi{}.Call(call)
+	held.Release()
+	if exitCode(ret) != EXITDRBDFAILURE || !strings.Contains(out, "resource r1 is busy") {
+		t.Errorf("Called: %q with r1 locked, Expected: %d busy, Got: %d: %s", call, EXITDRBDFAILURE, ret, out)
+	}
+	if l, err := lock.Acquire("r0", 0); err != nil {
+		t.Errorf("Called: %q with r1 locked, Expected r0 released again, Got: %v", call, err)
+	} else {
+		l.Release()
+	}
+
+	// Every resource of the batch is recorded in its own history.
+	FlexVolumeApi{}.Call(call)
+	for _, name := range []string{"r0", "r1"} {
+		events, err := history.Read(name, time.Time{}, time.Time{})
+		if err != nil || len(events) != 2 || events[1].Action != "attach" {
+			t.Errorf("Called: %q, Expected: 2 attach events of %s, Got: %+v, %v", call, name, events, err)
+		}
+	}
+
+	// The same resource twice would wait for its own lock.
+	twice := []string{"attach", `{"resources":["r0","r0"]}`, "node1"}
+	if out, ret := (FlexVolumeApi{}).Call(twice); exitCode(ret) != EXITBADAPICALL {
+		t.Errorf("Called: %q, Expected: %d, Got: %d: %s", twice, EXITBADAPICALL, ret, out)
+	}
+}
+
+func TestAttachOrder(t *testing.T) {
+	var orderTests = []struct {
+		names []string
+		deps  map[string][]string
+		order []string
+		ok    bool
+	}{
+		{[]string{"r1", "r0"}, nil, []string{"r0", "r1"}, true},
+		{[]string{"data", "wal"}, map[string][]string{"data": {"wal"}}, []string{"wal", "data"}, true},
+		{[]string{"a", "b", "c", "d"}, map[string][]string{"a": {"d"}, "b": {"a", "c"}}, []string{"c", "d", "a", "b"}, true},
+		{[]string{"a", "b"}, map[string][]string{"a": {"b"}, "b": {"a"}}, nil, false},
+		{[]string{"a"}, map[string][]string{"a": {"a"}}, nil, false},
+		{[]string{"a", "b"}, map[string][]string{"a": {"c"}}, nil, false},
+		{[]string{"a", "b"}, map[string][]string{"c": {"a"}}, nil, false},
+	}
+
+	for _, tt := range orderTests {
+		order, err := attachOrder(tt.names, tt.deps)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(order, tt.order) {
+			t.Errorf("Called: attachOrder(%q, %v), Expected: %q, ok %v, Got: %q, %v", tt.names, tt.deps, tt.order, tt.ok, order, err)
+		}
+	}
+}
+
+func TestAttachBatchQueryFailed(t *testing.T) {
+	names := []string{"r0", "r1"}
+	queried := make(map[string]bool)
+	var unassigned []string
+	results, err := attachBatch(names, nil,
+		func(name string) (bool, error) {
+			if name == "r0" && !queried[name] {
+				queried[name] = true
+				return false, errors.New("drbdmanage not running")
+			}
+			return true, nil
+		},
+		func(name string) (string, error) { return "/dev/drbd-" + name, nil },
+		func(name string) error {
+			unassigned = append(unassigned, name)
+			return nil
+		})
+	if err != nil || results["r0"].Status != "Success" || results["r1"].Status != "Success" {
+		t.Errorf("Called: attachBatch(%q) with the query of r0 failing, Expected: both attached, Got: %v, %v", names, results, err)
+	}
+	if len(unassigned) != 0 {
+		t.Errorf("Called: attachBatch(%q) with the query of r0 failing, Expected: nothing unassigned, Got: %q", names, unassigned)
+	}
+}
+
+func TestAttachBatchPrerequisiteFailed(t *testing.T) {
+	names := []string{"data", "wal", "logs", "other"}
+	deps := map[string][]string{"wal": {"data"}, "logs": {"wal"}}
+	results, err := attachBatch(names, deps,
+		func(string) (bool, error) { return false, nil },
+		func(name string) (string, error) { return "", errors.New("DRBD: Unable to assign resource") },
+		func(string) error { return nil })
+	if err == nil {
+		t.Fatalf("Called: attachBatch(%q) failing %q, Expected: error, Got: nil", names, "data")
+	}
+
+	var skippedTests = []struct {
+		name    string
+		message string
+	}{
+		{"wal", "prerequisite data failed"},
+		{"logs", "prerequisite data failed"},
+		{"other", ""},
+	}
+	for _, tt := range skippedTests {
+		if r := results[tt.name]; r.Status != "Skipped" || r.Message != tt.message {
+			t.Errorf("Called: attachBatch(%q) failing %q, Expected %s: Skipped %q, Got: %s %q", names, "data", tt.name, tt.message, r.Status, r.Message)
+		}
+	}
+}
+
+func TestParseOptionsDependsOn(t *testing.T) {
+	var dependsTests = []struct {
+		in   string
+		deps map[string][]string
+		ok   bool
+	}{
+		{`{"resources":["data","wal"],"dependsOn":{"wal":["data"]}}`, map[string][]string{"wal": {"data"}}, true},
+		{`{"resources":["data","wal"],"dependsOn":"{\"wal\":[\"data\"]}"}`, map[string][]string{"wal": {"data"}}, true},
+		{`{"resources":["data","wal"],"dependsOn":{"wal":["data"],"data":["wal"]}}`, nil, false},
+		{`{"resources":["data","wal"],"dependsOn":{"wal":["logs"]}}`, nil, false},
+		{`{"resources":["data","wal"],"dependsOn":["data"]}`, nil, false},
+		{`{"dependsOn":{"wal":["data"]}}`, nil, false},
+	}
+
+	for _, tt := range dependsTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q), Expected ok: %v, Got: %v", tt.in, tt.ok, err)
+			continue
+		}
+		if deps := opts.getDependsOn(); tt.ok && !reflect.DeepEqual(deps, tt.deps) {
+			t.Errorf("Called: parseOptions(%q), Expected dependsOn: %v, Got: %v", tt.in, tt.deps, deps)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"log"
+	"time"
+)
+
+// Settings that can be configured both plugin-wide, from the environment,
+// and per call, in the JSON options, are resolved in layers: an option
+// present in the call's options overrides the environment, which overrides
+// the built-in default. The package variables below hold the plugin-wide
+// layer, initialized to the defaults and replaced by LoadDefaults.
+
+// DefaultReadWrite is used for calls without kubernetes.io/readwrite, "rw"
+// or "ro". Empty, the default, is read-write unless mountOptions say "ro".
+var DefaultReadWrite = ""
+
+// DefaultSafeFormat is used for calls without safeFormat. Unless it is
+// "false", blank devices are formatted before mounting.
+var DefaultSafeFormat = "true"
+
+// LoadDefaults reads the plugin-wide layer from the environment through
+// getenv: DRBD_WAIT_TIMEOUT_SECONDS for WaitRetries, DRBD_READWRITE and
+// DRBD_SAFE_FORMAT. Invalid values are logged and leave the default.
+func LoadDefaults(getenv func(string) string) {
+	WaitRetries = ParseWaitTimeout(getenv("DRBD_WAIT_TIMEOUT_SECONDS"))
+
+	switch rw := getenv("DRBD_READWRITE"); rw {
+	case "", "ro", "rw":
+		DefaultReadWrite = rw
+	default:
+		log.Printf("ignoring DRBD_READWRITE: must be \"ro\" or \"rw\", got %q", rw)
+	}
+
+	switch safe := getenv("DRBD_SAFE_FORMAT"); safe {
+	case "":
+	case "true", "false":
+		DefaultSafeFormat = safe
+	default:
+		log.Printf("ignoring DRBD_SAFE_FORMAT: must be \"true\" or \"false\", got %q", safe)
+	}
+}
+
+// layered is the value of a setting given as option in the call's options,
+// or its plugin-wide value if the call didn't set it.
+func layered(option, global string) string {
+	if option != "" {
+		return option
+	}
+	return global
+}
+
+// getWaitRetries is how often the call polls for its device or assignment,
+// from waitTimeoutSeconds, validated by parseOptions, or WaitRetries.
+func (o *options) getWaitRetries() int {
+	if o.WaitTimeoutSeconds != "" {
+		return ParseWaitTimeout(o.WaitTimeoutSeconds)
+	}
+	return WaitRetries
+}
+
+// getWaitTimeout is how long the call waits for its resource to change
+// state, as long as polling getWaitRetries times takes.
+func (o *options) getWaitTimeout() time.Duration {
+	return time.Duration(o.getWaitRetries()*waitPollInterval) * time.Second
+}
+
+// safeFormat reports whether blank devices are formatted before mounting.
+func (o *options) safeFormat() bool {
+	return layered(o.SafeFormat, DefaultSafeFormat) != "false"
+}
@@ -0,0 +1,91 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLayeredPrecedence(t *testing.T) {
+	oldRetries, oldReadWrite, oldSafeFormat := WaitRetries, DefaultReadWrite, DefaultSafeFormat
+	defer func() { WaitRetries, DefaultReadWrite, DefaultSafeFormat = oldRetries, oldReadWrite, oldSafeFormat }()
+
+	var precedenceTests = []struct {
+		env        map[string]string
+		in         string
+		retries    int
+		readOnly   bool
+		safeFormat bool
+	}{
+		// Built-in defaults.
+		{nil, `{"resource":"r0"}`, defaultWaitRetries, false, true},
+		// The environment overrides the defaults.
+		{map[string]string{"DRBD_WAIT_TIMEOUT_SECONDS": "20", "DRBD_READWRITE": "ro", "DRBD_SAFE_FORMAT": "false"},
+			`{"resource":"r0"}`, 10, true, false},
+		// Options override the environment.
+		{map[string]string{"DRBD_WAIT_TIMEOUT_SECONDS": "20", "DRBD_READWRITE": "ro", "DRBD_SAFE_FORMAT": "false"},
+			`{"resource":"r0","waitTimeoutSeconds":"4","kubernetes.io/readwrite":"rw","safeFormat":"true"}`, 2, false, true},
+		{map[string]string{"DRBD_READWRITE": "rw", "DRBD_SAFE_FORMAT": "true"},
+			`{"resource":"r0","kubernetes.io/readwrite":"ro","safeFormat":"false"}`, defaultWaitRetries, true, false},
+		// Invalid environment values leave the defaults.
+		{map[string]string{"DRBD_WAIT_TIMEOUT_SECONDS": "soon", "DRBD_READWRITE": "maybe", "DRBD_SAFE_FORMAT": "maybe"},
+			`{"resource":"r0"}`, defaultWaitRetries, false, true},
+	}
+
+	for _, tt := range precedenceTests {
+		DefaultReadWrite, DefaultSafeFormat = "", "true"
+		LoadDefaults(func(key string) string { return tt.env[key] })
+		opts, err := parseOptions(tt.in)
+		if err != nil {
+			t.Errorf("Called: parseOptions(%q), Unexpected error: %v", tt.in, err)
+			continue
+		}
+		if opts.getWaitRetries() != tt.retries || opts.readOnly() != tt.readOnly || opts.safeFormat() != tt.safeFormat {
+			t.Errorf("Called: parseOptions(%q) with env %v, Expected: %d retries, read-only %t, safe format %t, Got: %d, %t, %t",
+				tt.in, tt.env, tt.retries, tt.readOnly, tt.safeFormat, opts.getWaitRetries(), opts.readOnly(), opts.safeFormat())
+		}
+	}
+}
+
+func TestGetWaitTimeout(t *testing.T) {
+	oldRetries := WaitRetries
+	defer func() { WaitRetries = oldRetries }()
+	WaitRetries = defaultWaitRetries
+
+	var timeoutTests = []struct {
+		in  string
+		out time.Duration
+	}{
+		{`{"resource":"r0"}`, time.Second * 8},
+		{`{"resource":"r0","waitTimeoutSeconds":"30"}`, time.Second * 30},
+		{`{"resource":"r0","waitTimeoutSeconds":"5"}`, time.Second * 6},
+	}
+
+	for _, tt := range timeoutTests {
+		opts, err := parseOptions(tt.in)
+		if err != nil {
+			t.Errorf("Called: parseOptions(%q), Unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got := opts.getWaitTimeout(); got != tt.out {
+			t.Errorf("Called: getWaitTimeout() of %q, Expected: %v, Got: %v", tt.in, tt.out, got)
+		}
+	}
+}
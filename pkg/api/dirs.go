@@ -0,0 +1,101 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/history"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+	"github.com/linbit/drbd-flexvolume/pkg/ratelimit"
+	"github.com/linbit/drbd-flexvolume/pkg/registry"
+)
+
+// PluginDir is the directory the plugin keeps its state below.
+var PluginDir = "/var/lib/drbd-flexvolume"
+
+// SetPluginDir moves everything the plugin keeps on the node, such as
+// staging mounts, locks and its records of mounts, below dir, for
+// distributions that don't use the standard locations. Configuration read
+// from /etc, progress files and metrics stay where they are.
+func SetPluginDir(dir string) {
+	PluginDir = dir
+	drbd.StagingDir = filepath.Join(dir, "staging")
+	drbd.VerifyDir = filepath.Join(dir, "verify")
+	drbd.DiagnosticsDir = filepath.Join(dir, "diagnostics")
+	drbd.OwnedDir = filepath.Join(dir, "owned")
+	lock.Dir = filepath.Join(dir, "lock")
+	history.Dir = filepath.Join(dir, "history")
+	registry.Dir = filepath.Join(dir, "mounts")
+	ratelimit.File = filepath.Join(dir, "ratelimit.json")
+	nameMapFile = filepath.Join(dir, "names.json")
+}
+
+// StatelessMode is set by SetStatelessMode.
+var StatelessMode bool
+
+// SetStatelessMode keeps the plugin from writing anything on the node, for
+// read-only root filesystems. Locks are only held within the process, so
+// overlapping calls are no longer serialized, and the call history, the
+// mount registry, the rate limit, the metrics file, the records of the drbd
+// package and diagnostic bundles are skipped. Shortened resource names can't
+// be recorded, attach refuses them. Staging mounts and sub paths are still
+// created, they are part of the mount.
+func SetStatelessMode() {
+	StatelessMode = true
+	lock.InProcess = true
+	drbd.Stateless = true
+}
+
+// readOptionsFile returns the options JSON in the file s names, for Kubelets
+// that pass a path instead of the JSON itself. Anything but the path of an
+// existing file is returned as it is. Only files below PluginDir are read,
+// so that calls can't be used to read arbitrary files.
+func readOptionsFile(s string) (string, error) {
+	path := strings.TrimSpace(s)
+	if !strings.HasPrefix(path, "/") {
+		return s, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return s, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	base, err := filepath.EvalSymlinks(PluginDir)
+	if err != nil {
+		return "", fmt.Errorf("options file %s is not below %s", path, PluginDir)
+	}
+	if rel, err := filepath.Rel(base, resolved); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("options file %s is not below %s", path, PluginDir)
+	}
+
+	data, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("unable to read options file: %w", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,174 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/history"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+	"github.com/linbit/drbd-flexvolume/pkg/ratelimit"
+	"github.com/linbit/drbd-flexvolume/pkg/registry"
+)
+
+func TestSetPluginDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldStaging, oldVerify, oldDiagnostics, oldOwned := drbd.StagingDir, drbd.VerifyDir, drbd.DiagnosticsDir, drbd.OwnedDir
+	oldLock, oldHistory, oldRegistry := lock.Dir, history.Dir, registry.Dir
+	oldRateLimit, oldNames := ratelimit.File, nameMapFile
+	defer func() {
+		drbd.StagingDir, drbd.VerifyDir, drbd.DiagnosticsDir, drbd.OwnedDir = oldStaging, oldVerify, oldDiagnostics, oldOwned
+		lock.Dir, history.Dir, registry.Dir = oldLock, oldHistory, oldRegistry
+		ratelimit.File, nameMapFile = oldRateLimit, oldNames
+	}()
+
+	SetPluginDir(dir)
+
+	var pathTests = []struct {
+		name string
+		path string
+		want string
+	}{
+		{"staging", drbd.StagingDir, filepath.Join(dir, "staging")},
+		{"verify", drbd.VerifyDir, filepath.Join(dir, "verify")},
+		{"diagnostics", drbd.DiagnosticsDir, filepath.Join(dir, "diagnostics")},
+		{"owned", drbd.OwnedDir, filepath.Join(dir, "owned")},
+		{"lock", lock.Dir, filepath.Join(dir, "lock")},
+		{"history", history.Dir, filepath.Join(dir, "history")},
+		{"registry", registry.Dir, filepath.Join(dir, "mounts")},
+		{"rate limit", ratelimit.File, filepath.Join(dir, "ratelimit.json")},
+		{"name map", nameMapFile, filepath.Join(dir, "names.json")},
+	}
+	for _, tt := range pathTests {
+		if tt.path != tt.want {
+			t.Errorf("Called: SetPluginDir(%q), Expected %s: %q, Got: %q", dir, tt.name, tt.want, tt.path)
+		}
+	}
+
+	// Files are then created below it.
+	l, err := lock.Acquire("r0", time.Second)
+	if err != nil {
+		t.Fatalf("Called: lock.Acquire(%q) below %q, Unexpected error: %v", "r0", dir, err)
+	}
+	l.Release()
+	if err := recordName("pvc-web", "r0"); err != nil {
+		t.Fatalf("Called: recordName(%q) below %q, Unexpected error: %v", "pvc-web", dir, err)
+	}
+	for _, path := range []string{filepath.Join(dir, "lock", "r0.lock"), filepath.Join(dir, "names.json")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Called: SetPluginDir(%q), Expected %s to exist, Got: %v", dir, path, err)
+		}
+	}
+}
+
+func TestSetStatelessMode(t *testing.T) {
+	dir, restore := useTempCallDirs(t)
+	defer restore()
+	oldRegistry, oldOwned, oldDiagnostics := registry.Dir, drbd.OwnedDir, drbd.DiagnosticsDir
+	oldRateLimit, oldLimit, oldNames := ratelimit.File, RateLimit, nameMapFile
+	registry.Dir, drbd.OwnedDir, drbd.DiagnosticsDir = filepath.Join(dir, "mounts"), filepath.Join(dir, "owned"), filepath.Join(dir, "diagnostics")
+	ratelimit.File, RateLimit, nameMapFile = filepath.Join(dir, "ratelimit.json"), ratelimit.Limiter{Rate: 1, Burst: 1}, filepath.Join(dir, "names.json")
+	defer func() {
+		registry.Dir, drbd.OwnedDir, drbd.DiagnosticsDir = oldRegistry, oldOwned, oldDiagnostics
+		ratelimit.File, RateLimit, nameMapFile = oldRateLimit, oldLimit, oldNames
+		StatelessMode, lock.InProcess, drbd.Stateless = false, false, false
+	}()
+
+	SetStatelessMode()
+
+	var statelessTests = []struct {
+		call []string
+		ret  exitCode
+	}{
+		{[]string{"detach", "r0", "node1", `{"diagnosticBundleOnFailure":"true"}`}, EXITDRBDFAILURE},
+		{[]string{"attach", `{"resource":"pvc-` + strings.Repeat("a", maxResourceNameLen) + `","longNames":"hash"}`, "node1"}, EXITBADAPICALL},
+		{[]string{"unmountdevice", "/mnt/r0"}, EXITSUCCESS},
+	}
+	for _, tt := range statelessTests {
+		if out, ret := (FlexVolumeApi{}).Call(tt.call); exitCode(ret) != tt.ret {
+			t.Errorf("Called: %q in stateless mode, Expected: %d, Got: %d: %s", tt.call, tt.ret, ret, out)
+		}
+	}
+
+	// Not even the directories are created.
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		t.Errorf("Called: Call() in stateless mode, Expected: nothing written, Got: %s", f.Name())
+	}
+}
+
+func TestParseOptionsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "drbd-flexvolume-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	oldDir := PluginDir
+	PluginDir = dir
+	defer func() { PluginDir = oldDir }()
+
+	inside := filepath.Join(dir, "r0.json")
+	secret := filepath.Join(outside, "r0.json")
+	escape := filepath.Join(dir, "escape.json")
+	for _, path := range []string{inside, secret} {
+		if err := ioutil.WriteFile(path, []byte(`{"resource":"r0-file"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, escape); err != nil {
+		t.Fatal(err)
+	}
+
+	var fileTests = []struct {
+		in       string
+		resource string
+		ok       bool
+	}{
+		{`{"resource":"r0"}`, "r0", true},
+		{inside, "r0-file", true},
+		{" " + inside + "\n", "r0-file", true},
+		{filepath.Join(dir, "missing.json"), "", false},
+		{secret, "", false},
+		{escape, "", false},
+		{dir, "", false},
+	}
+
+	for _, tt := range fileTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok || opts.getResource() != tt.resource {
+			t.Errorf("Called: parseOptions(%q), Expected: %q, ok: %v, Got: %q, %v", tt.in, tt.resource, tt.ok, opts.getResource(), err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+)
+
+// errorDetails tell controllers why a call failed, in addition to the
+// message meant for humans. Successful calls leave them out.
+type errorDetails struct {
+	ErrorCode string `json:"errorCode,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Details of failed calls. Codes group reasons that are handled alike.
+var (
+	detailsInvalidOptions    = errorDetails{"DRBD_E_INVALID", "InvalidOptions"}
+	detailsInvalidArguments  = errorDetails{"DRBD_E_INVALID", "InvalidArguments"}
+	detailsInvalidName       = errorDetails{"DRBD_E_INVALID", "InvalidResourceName"}
+	detailsUnsupported       = errorDetails{"DRBD_E_UNSUPPORTED", "UnsupportedAction"}
+	detailsResourceNotFound  = errorDetails{"DRBD_E_NOTFOUND", "ResourceNotFound"}
+	detailsTimeout           = errorDetails{"DRBD_E_TIMEOUT", "Timeout"}
+	detailsNotReplicated     = errorDetails{"DRBD_E_NOTREPLICATED", "NotReplicated"}
+	detailsNotAttached       = errorDetails{"DRBD_E_NOTATTACHED", "NotAttached"}
+	detailsAssignmentPending = errorDetails{"DRBD_E_NOTATTACHED", "AssignmentPending"}
+	detailsPartialFailure    = errorDetails{"DRBD_E_PARTIAL", "PartialFailure"}
+	detailsCheckFailed       = errorDetails{"DRBD_E_CHECK", "CheckFailed"}
+	detailsOutOfSync         = errorDetails{"DRBD_E_NOTREPLICATED", "OutOfSync"}
+	detailsInterrupted       = errorDetails{"DRBD_E_INTERRUPTED", "Interrupted"}
+	detailsModuleNotLoaded   = errorDetails{"DRBD_E_NOMODULE", "ModuleNotLoaded"}
+	detailsMinorsExhausted   = errorDetails{"DRBD_E_NOMINORS", "MinorsExhausted"}
+	detailsFailure           = errorDetails{"DRBD_E_FAILURE", "DRBDFailure"}
+)
+
+// mountErrorCode is the code of all reasons of mountErrorReasons.
+const mountErrorCode = "DRBD_E_MOUNT"
+
+// mountErrorReasons are the reasons of the causes of drbd.MountError.
+var mountErrorReasons = map[error]string{
+	drbd.ErrDeviceNotReady:   "DeviceNotReady",
+	drbd.ErrFormatFailed:     "FormatFailed",
+	drbd.ErrAlreadyMounted:   "AlreadyMounted",
+	drbd.ErrWrongFSType:      "WrongFSType",
+	drbd.ErrFilesystemFull:   "FilesystemFull",
+	drbd.ErrPrimaryElsewhere: "PrimaryElsewhere",
+	drbd.ErrMountFailed:      "MountFailed",
+	drbd.ErrPreMountFailed:   "PreMountFailed",
+}
+
+// failureDetails classifies the error a call failed with.
+func failureDetails(err error) errorDetails {
+	var apiErr flexAPIErr
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var mountErr *drbd.MountError
+	var callErr *CallError
+	switch {
+	case errors.As(err, &callErr):
+		return callErr.errorDetails
+	case errors.As(err, &apiErr), errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return detailsInvalidOptions
+	case errors.Is(err, drbd.ErrNotDefined):
+		return detailsResourceNotFound
+	case errors.Is(err, drbd.ErrMinorsExhausted):
+		return detailsMinorsExhausted
+	case errors.Is(err, drbd.ErrOutOfSync):
+		return detailsOutOfSync
+	case errors.Is(err, drbd.ErrInterrupted):
+		return detailsInterrupted
+	case errors.Is(err, drbd.ErrModuleNotLoaded):
+		return detailsModuleNotLoaded
+	case errors.Is(err, drbd.ErrCommandTimeout), errors.Is(err, lock.ErrTimeout):
+		return detailsTimeout
+	case errors.As(err, &mountErr):
+		if reason, ok := mountErrorReasons[mountErr.Cause]; ok {
+			return errorDetails{mountErrorCode, reason}
+		}
+	}
+	return detailsFailure
+}
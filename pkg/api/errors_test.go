@@ -0,0 +1,107 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+)
+
+func TestFailureDetails(t *testing.T) {
+	_, parseErr := parseOptions(`{"resource":`)
+	notFound := &drbd.AssignError{Cause: drbd.ErrNotDefined, Err: errors.New(`DRBD: Resource "r0" not defined.`)}
+	timeout := fmt.Errorf("DRBD: Unable to assign resource: %w", &drbd.TimeoutError{Command: "drbdmanage assign-resource r0 node1", Timeout: time.Minute})
+
+	var detailsTests = []struct {
+		err     error
+		details errorDetails
+	}{
+		{parseErr, detailsInvalidOptions},
+		{flexAPIErr{"onFull must be one of \"warn\" or \"refuse\""}, detailsInvalidOptions},
+		{notFound, detailsResourceNotFound},
+		{timeout, detailsTimeout},
+		{lock.ErrTimeout, detailsTimeout},
+		{fmt.Errorf("DRBD: Resource \"r0\" still has 1024 KiB out of sync after 30s: %w", drbd.ErrOutOfSync), detailsOutOfSync},
+		{fmt.Errorf("drbdadm primary r0: %w", drbd.ErrInterrupted), detailsInterrupted},
+		{&drbd.AssignError{Cause: drbd.ErrModuleNotLoaded, Err: fmt.Errorf("DRBD: %w", drbd.ErrModuleNotLoaded)}, detailsModuleNotLoaded},
+		{&drbd.AssignError{Cause: drbd.ErrMinorsExhausted, Err: errors.New("DRBD minor numbers exhausted")}, detailsMinorsExhausted},
+		{&drbd.MountError{Cause: drbd.ErrWrongFSType, Err: errors.New("wrong fs")}, errorDetails{mountErrorCode, "WrongFSType"}},
+		{errors.New("drbdmanage failed"), detailsFailure},
+		{nil, detailsFailure},
+	}
+
+	for _, tt := range detailsTests {
+		if details := failureDetails(tt.err); details != tt.details {
+			t.Errorf("Called: failureDetails(%v), Expected: %+v, Got: %+v", tt.err, tt.details, details)
+		}
+	}
+}
+
+func TestCallErrorDetails(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	oldTimeout := LockTimeout
+	LockTimeout = time.Millisecond * 10
+	defer func() { LockTimeout = oldTimeout }()
+
+	busy, err := lock.Acquire("r0-busy", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Release()
+
+	var callTests = []struct {
+		call    []string
+		details errorDetails
+	}{
+		{[]string{"init"}, errorDetails{}},
+		{[]string{"attach", `{"resource":`, "node1"}, detailsInvalidOptions},
+		{[]string{"attach", `{"resource":"r0-busy"}`, "node1"}, detailsTimeout},
+		{[]string{"attach"}, detailsInvalidArguments},
+		{[]string{"frobnicate"}, detailsUnsupported},
+	}
+
+	for _, tt := range callTests {
+		out, _ := FlexVolumeApi{}.Call(tt.call)
+		res := response{}
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Errorf("Called: %q, Unable to parse response %q: %v", tt.call, out, err)
+			continue
+		}
+		if res.errorDetails != tt.details {
+			t.Errorf("Called: %q, Expected: %+v, Got: %+v in %s", tt.call, tt.details, res.errorDetails, out)
+		}
+	}
+
+	// Successful calls leave the fields out entirely.
+	out, _ := FlexVolumeApi{}.Call([]string{"init"})
+	raw := make(map[string]interface{})
+	json.Unmarshal([]byte(out), &raw)
+	for _, key := range []string{"errorCode", "reason"} {
+		if _, ok := raw[key]; ok {
+			t.Errorf("Called: init, Expected no %s, Got: %s", key, out)
+		}
+	}
+}
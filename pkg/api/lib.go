@@ -0,0 +1,196 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+)
+
+// Options are the options of a volume, keyed like the JSON options the
+// Kubelet passes, e.g. "resource" or "kubernetes.io/fsType".
+type Options map[string]string
+
+// AttachResult is what attaching a resource found out about it.
+type AttachResult struct {
+	Device string `json:"device"`
+	// Prewarm is "completed" or "running" if the device cache was prewarmed.
+	Prewarm   string `json:"prewarm,omitempty"`
+	DiskState string `json:"diskState,omitempty"`
+	// Verify is "running" if an online verification was started.
+	Verify string `json:"verify,omitempty"`
+	// Peers is the number of peers the resource replicates to, if known.
+	Peers *int `json:"peers,omitempty"`
+	// OverCommit is the thin pool's over-commit ratio, if checked.
+	OverCommit float64 `json:"overCommit,omitempty"`
+	// Warnings are problems that did not fail the attach.
+	Warnings []string `json:"-"`
+}
+
+// IsAttachedResult is the attachment state of a resource.
+type IsAttachedResult struct {
+	Attached bool
+	// ConnectionState summarizes replication of attached resources, see
+	// drbd.GetConnectionState.
+	ConnectionState string
+}
+
+// CallError is a failed call of the typed API. It carries the same message
+// and error details Call responds with.
+type CallError struct {
+	Message string
+	errorDetails
+	code exitCode
+}
+
+func newCallError(code exitCode, details errorDetails, format string, a ...interface{}) *CallError {
+	return &CallError{
+		Message:      flexAPIErr{fmt.Sprintf(format, a...)}.Error(),
+		errorDetails: details,
+		code:         code,
+	}
+}
+
+func (e *CallError) Error() string {
+	return e.Message
+}
+
+// Retryable reports whether the call may succeed if it is made again. Calls
+// failing on their arguments or options never do.
+func (e *CallError) Retryable() bool {
+	return e.code != EXITBADAPICALL
+}
+
+func (e *CallError) response() response {
+	return response{Status: "Failure", Message: e.Message, errorDetails: e.errorDetails}
+}
+
+// Attach attaches resource to node, as the attach call does, from the
+// perspective of a program using the plugin as a library. An empty resource
+// is taken from opts. Like Call, it holds the lock of the resource, but it
+// doesn't record the call in the history.
+func (api FlexVolumeApi) Attach(resource, node string, opts Options) (AttachResult, error) {
+	o, node, cerr := typedCall("attach", resource, node, opts)
+	if cerr != nil {
+		return AttachResult{}, cerr
+	}
+	if len(o.getResources()) > 0 {
+		return AttachResult{}, newCallError(EXITBADAPICALL, detailsInvalidOptions,
+			"attach: attaching several resources is only supported by Call")
+	}
+	result, cerr := attachLocked("attach", node, o)
+	if cerr != nil {
+		return result, cerr
+	}
+	return result, nil
+}
+
+// attachLocked attaches the resource of opts to node holding its lock, for
+// both Attach and Call. Warnings start with the deprecation warning of opts.
+func attachLocked(action, node string, opts options) (AttachResult, *CallError) {
+	// Invalid names must not make it to the lock file.
+	if err := drbd.ValidateResourceName(opts.getResource()); err != nil {
+		return AttachResult{}, newCallError(EXITBADAPICALL, detailsInvalidName, "%s: %v", action, err)
+	}
+	release, cerr := lockResources(action, []string{opts.getResource()})
+	if cerr != nil {
+		return AttachResult{}, cerr
+	}
+	defer release()
+
+	result, cerr := attachResource(action, node, opts)
+	if w := opts.deprecationWarning(); w != "" && cerr == nil {
+		result.Warnings = append([]string{w}, result.Warnings...)
+	}
+	return result, cerr
+}
+
+// Detach unassigns the resource of volume from node, as the detach call
+// does.
+func (api FlexVolumeApi) Detach(volume, node string, opts Options) error {
+	o, node, cerr := typedCall("detach", "", node, opts)
+	if cerr != nil {
+		return cerr
+	}
+	resource, err := volumeResource(volume, node)
+	if err != nil {
+		return newCallError(EXITBADAPICALL, failureDetails(err),
+			"detach: unable to resolve resource %q: %v", volume, err)
+	}
+	if cerr := detachLocked("detach", resource, o); cerr != nil {
+		return cerr
+	}
+	return nil
+}
+
+// detachLocked unassigns the resource from its node holding its lock, for
+// both Detach and Call.
+func detachLocked(action string, resource drbd.Resource, opts options) *CallError {
+	if err := drbd.ValidateResourceName(resource.Name); err != nil {
+		return newCallError(EXITBADAPICALL, detailsInvalidName, "%s: %v", action, err)
+	}
+	release, cerr := lockResources(action, []string{resource.Name})
+	if cerr != nil {
+		return cerr
+	}
+	defer release()
+	return detachResource(action, resource, opts)
+}
+
+// IsAttached reports whether resource is attached to node, as the
+// isattached call does. An empty resource is taken from opts.
+func (api FlexVolumeApi) IsAttached(resource, node string, opts Options) (IsAttachedResult, error) {
+	o, node, cerr := typedCall("isattached", resource, node, opts)
+	if cerr != nil {
+		return IsAttachedResult{}, cerr
+	}
+	result, cerr := isAttachedResource("isattached", node, o, true)
+	if cerr != nil {
+		return result, cerr
+	}
+	return result, nil
+}
+
+// typedCall parses the options of a typed call, which are checked like
+// those Call is passed, and resolves the DRBD name of node.
+func typedCall(action, resource, node string, opts Options) (options, string, *CallError) {
+	all := Options{}
+	for k, v := range opts {
+		all[k] = v
+	}
+	if resource != "" {
+		all["resource"] = resource
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return options{}, node, newCallError(EXITBADAPICALL, failureDetails(err), "%s: %v", action, err)
+	}
+	o, err := parseOptions(string(data))
+	if err != nil {
+		return options{}, node, newCallError(EXITBADAPICALL, failureDetails(err), "%s: %v", action, err)
+	}
+	drbdNode, err := resolveNodeName(node)
+	if err != nil {
+		return options{}, node, newCallError(EXITBADAPICALL, failureDetails(err),
+			"%s: unable to resolve node %q: %v", action, node, err)
+	}
+	return o, drbdNode, nil
+}
@@ -0,0 +1,144 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+)
+
+func TestTypedCallErrors(t *testing.T) {
+	api := FlexVolumeApi{}
+	var typedTests = []struct {
+		name      string
+		call      func() error
+		reason    string
+		retryable bool
+		message   string
+	}{
+		{"Attach(bad name)", func() error {
+			_, err := api.Attach("r0 bad", "node1", nil)
+			return err
+		}, detailsInvalidName.Reason, false, ""},
+		{"Attach(bad relabel)", func() error {
+			_, err := api.Attach("r0", "node1", Options{"fsLabel": "web", "relabel": "yes"})
+			return err
+		}, detailsInvalidOptions.Reason, false, ""},
+		{"Attach(several resources)", func() error {
+			_, err := api.Attach("", "node1", Options{"resources": `["r0","r1"]`})
+			return err
+		}, detailsInvalidOptions.Reason, false, "only supported by Call"},
+		{"IsAttached(bad name)", func() error {
+			_, err := api.IsAttached("r0 bad", "node1", nil)
+			return err
+		}, detailsInvalidName.Reason, false, ""},
+		{"Detach(bad relabel)", func() error {
+			return api.Detach("r0", "node1", Options{"fsLabel": "web", "relabel": "yes"})
+		}, detailsInvalidOptions.Reason, false, ""},
+	}
+
+	for _, tt := range typedTests {
+		err := tt.call()
+		cerr, ok := err.(*CallError)
+		if !ok {
+			t.Errorf("Called: %s, Expected: *CallError, Got: %#v", tt.name, err)
+			continue
+		}
+		if cerr.Reason != tt.reason || cerr.Retryable() != tt.retryable || !strings.Contains(cerr.Message, tt.message) {
+			t.Errorf("Called: %s, Expected: %q, retryable %t, %q, Got: %q, retryable %t (%v)",
+				tt.name, tt.reason, tt.retryable, tt.message, cerr.Reason, cerr.Retryable(), cerr)
+		}
+	}
+}
+
+func TestTypedCallAttach(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	drbd.DryRun = true
+	defer func() { drbd.DryRun = false }()
+
+	result, err := FlexVolumeApi{}.Attach("r0", "node1", Options{"fsType": "ext4"})
+	if err != nil || result.Device != "/dev/drbd/by-res/r0/0" {
+		t.Errorf("Called: Attach(%q) in dry run, Expected: %q, Got: %q, %v", "r0", "/dev/drbd/by-res/r0/0", result.Device, err)
+	}
+	// The deprecated key is reported as with Call.
+	if len(result.Warnings) == 0 || !strings.Contains(result.Warnings[0], "deprecated") {
+		t.Errorf("Called: Attach(%q) with fsType, Expected: a deprecation warning, Got: %q", "r0", result.Warnings)
+	}
+}
+
+func TestTypedCallLockedResource(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	oldTimeout := LockTimeout
+	LockTimeout = 0
+	defer func() { LockTimeout = oldTimeout }()
+
+	l, err := lock.Acquire("r0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+
+	var lockedTests = []struct {
+		name string
+		call func() error
+	}{
+		{"Attach(r0)", func() error {
+			_, err := FlexVolumeApi{}.Attach("r0", "node1", nil)
+			return err
+		}},
+		{"Detach(r0)", func() error {
+			return FlexVolumeApi{}.Detach("r0", "node1", nil)
+		}},
+	}
+
+	for _, tt := range lockedTests {
+		err := tt.call()
+		cerr, ok := err.(*CallError)
+		if !ok || !cerr.Retryable() || !strings.Contains(cerr.Message, "busy with another call, retry later") {
+			t.Errorf("Called: %s while r0 is locked, Expected: a retryable busy error, Got: %v", tt.name, err)
+		}
+	}
+}
+
+func TestTypedCallMatchesCall(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+
+	out, _ := FlexVolumeApi{}.Call([]string{"attach", `{"resource":"r0 bad"}`, "node1"})
+	res := response{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("Unable to parse response %q: %v", out, err)
+	}
+
+	_, err := FlexVolumeApi{}.Attach("r0 bad", "node1", nil)
+	cerr, ok := err.(*CallError)
+	if !ok {
+		t.Fatalf("Called: Attach(%q), Expected: *CallError, Got: %#v", "r0 bad", err)
+	}
+	if cerr.Message != res.Message || cerr.errorDetails != res.errorDetails {
+		t.Errorf("Called: Attach(%q), Expected: %q %+v, Got: %q %+v",
+			"r0 bad", res.Message, res.errorDetails, cerr.Message, cerr.errorDetails)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+)
+
+// maxResourceNameLen is the longest resource name drbdmanage accepts.
+const maxResourceNameLen = drbd.MaxResourceNameLen
+
+// nameMapFile records the names derived from over-length resource names, so
+// that calls passing only the original name, such as detach, resolve to the
+// same resource.
+var nameMapFile = "/var/lib/drbd-flexvolume/names.json"
+
+// shortenName deterministically derives a name that fits maxResourceNameLen
+// from name, by truncating it and appending a hash of the full name.
+func shortenName(name string) string {
+	if len(name) <= maxResourceNameLen {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return name[:maxResourceNameLen-len(hash)-1] + "_" + hash
+}
+
+func readNameMap() (map[string]string, error) {
+	names := make(map[string]string)
+	data, err := ioutil.ReadFile(nameMapFile)
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("malformed name map %s: %v", nameMapFile, err)
+	}
+	return names, nil
+}
+
+// recordName remembers that name was shortened to short.
+func recordName(name, short string) error {
+	names, err := readNameMap()
+	if err != nil {
+		return err
+	}
+	if names[name] == short {
+		return nil
+	}
+	names[name] = short
+
+	if err := os.MkdirAll(filepath.Dir(nameMapFile), 0755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(names)
+	tmp := nameMapFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, nameMapFile)
+}
+
+// mappedName returns the name name was shortened to, or name itself if it
+// was never shortened.
+func mappedName(name string) string {
+	if len(name) <= maxResourceNameLen {
+		return name
+	}
+	names, err := readNameMap()
+	if err != nil {
+		return name
+	}
+	if short, ok := names[name]; ok {
+		return short
+	}
+	return name
+}
+
+// volumeNameSep separates the resource from its UUID in volume names. It is
+// not allowed in resource names, so the resource can always be split off.
+const volumeNameSep = "@"
+
+// volumeName is the unique name of the resource's volume, its name and UUID,
+// or just the name if the UUID is unknown.
+func volumeName(resource string, uuid func(string) (string, error)) string {
+	id, err := uuid(resource)
+	if err != nil || id == "" {
+		return resource
+	}
+	return resource + volumeNameSep + id
+}
+
+// resourceOfVolume returns the resource of a name returned by volumeName,
+// which the Kubelet passes to detach.
+func resourceOfVolume(name string) string {
+	return strings.SplitN(name, volumeNameSep, 2)[0]
+}
+
+// resourceMapFile optionally maps the names passed in the resource option,
+// e.g. PV names, to the DRBD resources backing them.
+var resourceMapFile = "/etc/drbd-flexvolume/resource-map.json"
+
+// resolveResourceName translates name through resourceMapFile. Names are
+// passed through as they are if there is no map or it has no entry for them.
+func resolveResourceName(name string) (string, error) {
+	data, err := ioutil.ReadFile(resourceMapFile)
+	if os.IsNotExist(err) {
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	resources := make(map[string]string)
+	if err := json.Unmarshal(data, &resources); err != nil {
+		return "", fmt.Errorf("malformed resource map %s: %v", resourceMapFile, err)
+	}
+	if resource, ok := resources[name]; ok && resource != "" {
+		return resource, nil
+	}
+	return name, nil
+}
+
+// resolveOptionsResource resolves the resource of opts through
+// resourceMapFile, then shortens it if it is too long and longNames allows
+// it. The original name is kept in opts.longName for attach to record.
+func resolveOptionsResource(opts *options) error {
+	if name := opts.getResource(); name != "" {
+		resource, err := resolveResourceName(name)
+		if err != nil {
+			return flexAPIErr{fmt.Sprintf("unable to resolve resource %q: %v", name, err)}
+		}
+		if resource != name {
+			opts.Resource = resource
+		}
+	}
+	return fitResourceName(opts)
+}
+
+// fitResourceName shortens the resource of opts to maxResourceNameLen if
+// longNames is "hash", or else rejects over-length names.
+func fitResourceName(opts *options) error {
+	name := opts.getResource()
+	if len(name) <= maxResourceNameLen {
+		return nil
+	}
+	if opts.LongNames != "hash" {
+		return flexAPIErr{fmt.Sprintf("resource name %q is %d characters long, at most %d are allowed", name, len(name), maxResourceNameLen)}
+	}
+	opts.Resource, opts.longName = shortenName(name), name
+	return nil
+}
+
+// NodeName, if set, is the DRBD node name of this node, used instead of
+// whatever node name the Kubelet passes.
+var NodeName string
+
+// nodeMapFile optionally maps the node names the Kubelet passes to DRBD node
+// names, for clusters where the two differ, e.g. FQDNs and short names.
+var nodeMapFile = "/etc/drbd-flexvolume/node-map.json"
+
+// resolveNodeName translates a node name passed by the Kubelet to the DRBD
+// node name, through NodeName or else nodeMapFile. Names are passed through
+// as they are if neither has anything for them.
+func resolveNodeName(name string) (string, error) {
+	if NodeName != "" {
+		return NodeName, nil
+	}
+	data, err := ioutil.ReadFile(nodeMapFile)
+	if os.IsNotExist(err) {
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	nodes := make(map[string]string)
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return "", fmt.Errorf("malformed node map %s: %v", nodeMapFile, err)
+	}
+	if node, ok := nodes[name]; ok && node != "" {
+		return node, nil
+	}
+	return name, nil
+}
+
+// withDRBDNode returns a copy of s with the node name the Kubelet passed as
+// s[2] translated by resolveNodeName, or s itself if that fails.
+func withDRBDNode(s []string) ([]string, error) {
+	node, err := resolveNodeName(s[2])
+	if err != nil {
+		return s, err
+	}
+	return append(append([]string{}, s[:2]...), append([]string{node}, s[3:]...)...), nil
+}
@@ -0,0 +1,226 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShortenName(t *testing.T) {
+	long := "pvc-" + strings.Repeat("0123456789", 6)
+
+	var shortenTests = []struct {
+		in  string
+		out string
+	}{
+		{"r0", "r0"},
+		{strings.Repeat("a", maxResourceNameLen), strings.Repeat("a", maxResourceNameLen)},
+		{long, long[:maxResourceNameLen-9] + "_" + shortenName(long)[maxResourceNameLen-8:]},
+	}
+
+	for _, tt := range shortenTests {
+		short := shortenName(tt.in)
+		if short != tt.out || len(short) > maxResourceNameLen {
+			t.Errorf("Called: shortenName(%q), Expected: %q, Got: %q", tt.in, tt.out, short)
+		}
+		if shortenName(tt.in) != short {
+			t.Errorf("Called: shortenName(%q) twice, Expected the same name both times", tt.in)
+		}
+	}
+
+	if shortenName(long) == shortenName(long+"x") {
+		t.Errorf("Called: shortenName on two different long names, Expected different names, Got: %q", shortenName(long))
+	}
+}
+
+func TestParseOptionsLongNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile := nameMapFile
+	nameMapFile = filepath.Join(dir, "names.json")
+	defer func() { nameMapFile = oldFile }()
+
+	long := "pvc-" + strings.Repeat("0123456789", 6)
+
+	if _, err := parseOptions(`{"resource":"` + long + `"}`); err == nil {
+		t.Errorf("Called: parseOptions with a %d character resource name, Expected an error, Got: nil", len(long))
+	}
+
+	opts, err := parseOptions(`{"resource":"` + long + `","longNames":"hash"}`)
+	if err != nil {
+		t.Fatalf("Called: parseOptions with longNames hash, Unexpected error: %v", err)
+	}
+	if opts.getResource() != shortenName(long) {
+		t.Errorf("Called: parseOptions with longNames hash, Expected: %q, Got: %q", shortenName(long), opts.getResource())
+	}
+
+	// Parsing leaves recording the name to attach.
+	if _, err := os.Stat(nameMapFile); !os.IsNotExist(err) {
+		t.Errorf("Called: parseOptions with longNames hash, Expected: no %s written, Got: %v", nameMapFile, err)
+	}
+	if opts.longName != long {
+		t.Errorf("Called: parseOptions with longNames hash, Expected: long name %q, Got: %q", long, opts.longName)
+	}
+	if err := recordName(opts.longName, opts.getResource()); err != nil {
+		t.Fatalf("Called: recordName(%q), Unexpected error: %v", long, err)
+	}
+
+	// Calls that only get the original name resolve through the recorded map.
+	if mappedName(long) != shortenName(long) {
+		t.Errorf("Called: mappedName(%q), Expected: %q, Got: %q", long, shortenName(long), mappedName(long))
+	}
+	if mappedName("r0") != "r0" {
+		t.Errorf("Called: mappedName(%q), Expected: %q, Got: %q", "r0", "r0", mappedName("r0"))
+	}
+}
+
+func TestResolveResourceName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile := resourceMapFile
+	resourceMapFile = filepath.Join(dir, "resource-map.json")
+	defer func() { resourceMapFile = oldFile }()
+
+	// Without a map every name is passed through.
+	if name, err := resolveResourceName("pv-web"); err != nil || name != "pv-web" {
+		t.Errorf("Called: resolveResourceName(%q) without map, Expected: %q, Got: %q, %v", "pv-web", "pv-web", name, err)
+	}
+
+	if err := ioutil.WriteFile(resourceMapFile, []byte(`{"pv-web":"r0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var resolveTests = []struct {
+		in  string
+		out string
+	}{
+		{"pv-web", "r0"},
+		{"pv-db", "pv-db"},
+	}
+	for _, tt := range resolveTests {
+		name, err := resolveResourceName(tt.in)
+		if err != nil || name != tt.out {
+			t.Errorf("Called: resolveResourceName(%q), Expected: %q, Got: %q, %v", tt.in, tt.out, name, err)
+		}
+	}
+
+	opts, err := parseOptions(`{"kubernetes.io/pvOrVolumeName":"pv-web"}`)
+	if err != nil || opts.getResource() != "r0" {
+		t.Errorf("Called: parseOptions with mapped PV name, Expected: %q, Got: %q, %v", "r0", opts.getResource(), err)
+	}
+
+	// Detach is recorded under the resource it unassigns.
+	if sub := callSubject([]string{"detach", "pv-web", "node1"}); sub.resource != "r0" {
+		t.Errorf("Called: callSubject(detach %q), Expected: %q, Got: %q", "pv-web", "r0", sub.resource)
+	}
+
+	if err := ioutil.WriteFile(resourceMapFile, []byte(`{"pv-web":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveResourceName("pv-web"); err == nil {
+		t.Errorf("Called: resolveResourceName(%q) with malformed map, Expected an error, Got: nil", "pv-web")
+	}
+	if _, err := parseOptions(`{"resource":"pv-web"}`); err == nil {
+		t.Errorf("Called: parseOptions with malformed map, Expected an error, Got: nil")
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	var volumeNameTests = []struct {
+		resource string
+		uuid     string
+		err      error
+		out      string
+	}{
+		{"r0", "6b0b3a2c-0c4f-4d23-9d43-1e7a0b6c2f11", nil, "r0@6b0b3a2c-0c4f-4d23-9d43-1e7a0b6c2f11"},
+		{"r0", "", errors.New("DRBD: drbdmanage has no resource UUIDs"), "r0"},
+		{"r0", "", nil, "r0"},
+	}
+
+	for _, tt := range volumeNameTests {
+		out := volumeName(tt.resource, func(string) (string, error) { return tt.uuid, tt.err })
+		if out != tt.out {
+			t.Errorf("Called: volumeName(%q) with UUID %q, %v, Expected: %q, Got: %q", tt.resource, tt.uuid, tt.err, tt.out, out)
+		}
+		if resource := resourceOfVolume(out); resource != tt.resource {
+			t.Errorf("Called: resourceOfVolume(%q), Expected: %q, Got: %q", out, tt.resource, resource)
+		}
+	}
+}
+
+func TestResolveNodeName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile := nodeMapFile
+	nodeMapFile = filepath.Join(dir, "node-map.json")
+	defer func() { nodeMapFile = oldFile }()
+
+	// Without a map or override every name is passed through.
+	if node, err := resolveNodeName("node1.example.com"); err != nil || node != "node1.example.com" {
+		t.Errorf("Called: resolveNodeName(%q) without map, Expected: %q, Got: %q, %v", "node1.example.com", "node1.example.com", node, err)
+	}
+
+	if err := ioutil.WriteFile(nodeMapFile, []byte(`{"node1.example.com":"node1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var resolveTests = []struct {
+		override string
+		in       string
+		out      string
+	}{
+		{"", "node1.example.com", "node1"},
+		{"", "node2.example.com", "node2.example.com"},
+		{"drbd-a", "node1.example.com", "drbd-a"},
+		{"drbd-a", "node2.example.com", "drbd-a"},
+	}
+	for _, tt := range resolveTests {
+		NodeName = tt.override
+		node, err := resolveNodeName(tt.in)
+		if err != nil || node != tt.out {
+			t.Errorf("Called: resolveNodeName(%q) with override %q, Expected: %q, Got: %q, %v", tt.in, tt.override, tt.out, node, err)
+		}
+	}
+	NodeName = ""
+
+	in := []string{"attach", `{"resource":"r0"}`, "node1.example.com"}
+	s, err := withDRBDNode(in)
+	if err != nil || len(s) != 3 || s[2] != "node1" || in[2] != "node1.example.com" {
+		t.Errorf("Called: withDRBDNode(%q), Expected: node1 in a copy, Got: %q, %q, %v", in, s, in, err)
+	}
+
+	if err := ioutil.WriteFile(nodeMapFile, []byte(`{"node1.example.com":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveNodeName("node1.example.com"); err == nil {
+		t.Errorf("Called: resolveNodeName(%q) with malformed map, Expected an error, Got: nil", "node1.example.com")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// optionsContextBytes is how much of the options before a syntax error is
+// quoted in the error.
+const optionsContextBytes = 24
+
+// sanitizeOptions strips what some Kubelets wrap valid options JSON in: a
+// byte order mark and trailing whitespace or NUL bytes.
+func sanitizeOptions(s string) string {
+	s = strings.TrimPrefix(s, "\ufeff")
+	return strings.TrimRight(s, " \t\r\n\x00")
+}
+
+// optionsContext is the part of s up to offset, at most optionsContextBytes
+// of it, with the values of secret options masked.
+func optionsContext(s string, offset int64) string {
+	if offset > int64(len(s)) {
+		offset = int64(len(s))
+	}
+	start := offset - optionsContextBytes
+	if start < 0 {
+		start = 0
+	}
+	return maskSecretValues(s)[start:offset]
+}
+
+// strictParseOptions is doParseOptions rejecting keys no option is read
+// from, such as misspelled ones, which doParseOptions silently ignores. The
+// keys the Kubelet adds under kubernetes.io/ are all let through.
+func strictParseOptions(s string) (options, error) {
+	opts, err := doParseOptions(s)
+	if err != nil {
+		return opts, err
+	}
+	raw := make(map[string]json.RawMessage)
+	json.Unmarshal([]byte(s), &raw)
+	var unknown []string
+	for k := range raw {
+		if !knownOption(k) {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return opts, flexAPIErr{fmt.Sprintf("unknown options %q", unknown)}
+	}
+	return opts, nil
+}
+
+// knownOption reports whether key is read into the options.
+func knownOption(key string) bool {
+	if strings.HasPrefix(key, "kubernetes.io/") {
+		return true
+	}
+	for _, d := range deprecatedOptions {
+		if key == d.legacy {
+			return true
+		}
+	}
+	t := reflect.TypeOf(options{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecretValues replaces the characters of the string values of secret
+// options in s with '*'. s may be malformed or truncated JSON, everything but
+// the masked characters is kept in place.
+func maskSecretValues(s string) string {
+	out := []byte(s)
+	var objects []bool
+	var key []byte
+	lastKey := ""
+	expectKey, inString, isKey, mask, escaped := false, false, false, false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+				if isKey {
+					// Keys may escape their slashes.
+					lastKey = string(key)
+					json.Unmarshal([]byte(`"`+string(key)+`"`), &lastKey)
+				}
+				continue
+			}
+			if isKey {
+				key = append(key, c)
+			} else if mask {
+				out[i] = '*'
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString, escaped = true, false
+			isKey = expectKey
+			mask = !isKey && strings.HasPrefix(lastKey, secretOptionPrefix)
+			key = key[:0]
+			expectKey = false
+		case '{', '[':
+			objects = append(objects, c == '{')
+			expectKey = c == '{'
+		case '}', ']':
+			if len(objects) > 0 {
+				objects = objects[:len(objects)-1]
+			}
+		case ',':
+			expectKey = len(objects) > 0 && objects[len(objects)-1]
+		}
+	}
+	return string(out)
+}
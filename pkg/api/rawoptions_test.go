@@ -0,0 +1,123 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseOptionsQuirks(t *testing.T) {
+	var quirkTests = []struct {
+		name     string
+		in       string
+		resource string
+		ok       bool
+	}{
+		{"well-formed", `{"resource":"r0"}`, "r0", true},
+		{"trailing whitespace", "{\"resource\":\"r0\"}\n\t ", "r0", true},
+		{"trailing NUL bytes", "{\"resource\":\"r0\"}\x00\x00", "r0", true},
+		{"byte order mark", "\ufeff{\"resource\":\"r0\"}", "r0", true},
+		{"duplicate keys", `{"resource":"r0","resource":"r1"}`, "r1", true},
+		{"truncated", `{"resource":"r0"`, "", false},
+		{"truncated with trailing whitespace", "{\"resource\":\"r0\"\n", "", false},
+	}
+
+	for _, tt := range quirkTests {
+		opts, err := parseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: parseOptions(%q) %s, Expected error: %v, Got: %v", tt.in, tt.name, !tt.ok, err)
+			continue
+		}
+		if tt.ok && opts.getResource() != tt.resource {
+			t.Errorf("Called: parseOptions(%q) %s, Expected: %q, Got: %q", tt.in, tt.name, tt.resource, opts.getResource())
+		}
+	}
+}
+
+func TestMaskSecretValues(t *testing.T) {
+	var maskTests = []struct {
+		in  string
+		out string
+	}{
+		{`{"resource":"r0","kubernetes.io/secret/key":"c2VjcmV0"}`, `{"resource":"r0","kubernetes.io/secret/key":"********"}`},
+		{`{"kubernetes.io\/secret\/key":"c2Vj\"cmV0","fsType":"ext4"}`, `{"kubernetes.io\/secret\/key":"**********","fsType":"ext4"}`},
+		{`{"kubernetes.io/secret/key" "c2VjcmV0"}`, `{"kubernetes.io/secret/key" "********"}`},
+		{`{"kubernetes.io/secret/keys":["a","b"],"resource":"r0"}`, `{"kubernetes.io/secret/keys":["*","*"],"resource":"r0"}`},
+		{`{"resource":"kubernetes.io/secret/key","fsType":"c2Vj`, `{"resource":"kubernetes.io/secret/key","fsType":"c2Vj`},
+		{`{"kubernetes.io/secret/key":"c2Vj`, `{"kubernetes.io/secret/key":"****`},
+	}
+
+	for _, tt := range maskTests {
+		if out := maskSecretValues(tt.in); out != tt.out {
+			t.Errorf("Called: maskSecretValues(%q), Expected: %q, Got: %q", tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestStrictParseOptions(t *testing.T) {
+	var strictTests = []struct {
+		in string
+		ok bool
+	}{
+		{`{"resource":"r0","kubernetes.io/fsType":"ext4"}`, true},
+		{`{"resource":"r0","fsType":"ext4"}`, true},
+		{`{"resource":"r0","kubernetes.io/pod.name":"p","kubernetes.io/serviceAccount.name":"default"}`, true},
+		{`{"resource":"r0","kubernetes.io/secret/shared-secret":"czNjcjN0"}`, true},
+		{`{"resource":"r0","placementcount":"3"}`, false},
+		{`{"resource":"r0","readOnlyy":"true"}`, false},
+		{`{"resource":`, false},
+	}
+
+	for _, tt := range strictTests {
+		_, err := strictParseOptions(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: strictParseOptions(%q), Expected error: %v, Got: %v", tt.in, !tt.ok, err)
+		}
+		// The current handling ignores unknown keys, which is what shadow
+		// mode reports.
+		current, cErr := doParseOptions(tt.in)
+		candidate, err := candidateParseOptions(tt.in)
+		if diffs := diffOptions(current, cErr, candidate, err); (len(diffs) == 0) != (tt.ok || cErr != nil) {
+			t.Errorf("Called: diffOptions(%q), Expected differences: %v, Got: %q", tt.in, !tt.ok && cErr == nil, diffs)
+		}
+	}
+}
+
+func TestCallShadowsOptionsOnce(t *testing.T) {
+	_, restore := useTempCallDirs(t)
+	defer restore()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	ShadowOptions = true
+	defer func() {
+		log.SetOutput(os.Stderr)
+		ShadowOptions = false
+	}()
+
+	// Unknown keys are what the candidate rejects.
+	call := []string{"attach", `{"resource":"r0","readOnlyy":"true"}`, "node1"}
+	FlexVolumeApi{}.Call(call)
+	if n := strings.Count(logged.String(), "shadow options: error:"); n != 1 {
+		t.Errorf("Called: %q in shadow mode, Expected: the difference logged once, Got: %d times in %q", call, n, logged.String())
+	}
+}
@@ -0,0 +1,100 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/linbit/drbd-flexvolume/pkg/drbd"
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+	"github.com/linbit/drbd-flexvolume/pkg/metrics"
+)
+
+// ShutdownGrace is how long a call may keep running after the plugin received
+// a signal such as SIGTERM, before its subprocesses are killed.
+var ShutdownGrace = time.Second * 10
+
+// interruptGrace is how long a call gets to fail and clean up after its
+// subprocesses were killed.
+var interruptGrace = time.Second * 5
+
+// CallUntilSignal is Call, unless one of sigs arrives. The call is then given
+// ShutdownGrace to finish, before its subprocesses are killed so that it fails
+// and rolls back through its usual error handling. If even that takes too
+// long, the call is abandoned: its locks are released, half-written metrics
+// are removed and it fails with EXITDRBDFAILURE, so that it is retried.
+func (api FlexVolumeApi) CallUntilSignal(s []string, sigs <-chan os.Signal) (string, int) {
+	action := ""
+	if len(s) > 0 {
+		action = s[0]
+	}
+	return untilSignal(action, func() (string, int) { return api.Call(s) }, sigs, drbd.Interrupt)
+}
+
+type callResult struct {
+	out string
+	ret int
+}
+
+// untilSignal runs call as CallUntilSignal does, interrupt kills its
+// subprocesses.
+func untilSignal(action string, call func() (string, int), sigs <-chan os.Signal, interrupt func()) (string, int) {
+	done := make(chan callResult, 1)
+	go func() {
+		out, ret := call()
+		done <- callResult{out, ret}
+	}()
+
+	var sig os.Signal
+	select {
+	case r := <-done:
+		return r.out, r.ret
+	case sig = <-sigs:
+	}
+	log.Printf("%s: received %v, waiting %v for the call to finish", action, sig, ShutdownGrace)
+
+	select {
+	case r := <-done:
+		return r.out, r.ret
+	case <-time.After(ShutdownGrace):
+	}
+	log.Printf("%s: still running after %v, killing its subprocesses", action, ShutdownGrace)
+	interrupt()
+
+	select {
+	case r := <-done:
+		return r.out, r.ret
+	case <-time.After(interruptGrace):
+	}
+
+	n := lock.ReleaseAll()
+	metrics.Abort()
+	log.Printf("%s: abandoned after %v, released %d locks", action, ShutdownGrace+interruptGrace, n)
+
+	res, _ := json.Marshal(response{
+		Status:       "Failure",
+		Message:      flexAPIErr{fmt.Sprintf("%s: interrupted by %v, retry later", action, sig)}.Error(),
+		errorDetails: detailsInterrupted,
+	})
+	return string(res), int(EXITDRBDFAILURE)
+}
@@ -0,0 +1,103 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linbit/drbd-flexvolume/pkg/lock"
+)
+
+func TestUntilSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldLock, oldGrace, oldInterruptGrace := lock.Dir, ShutdownGrace, interruptGrace
+	lock.Dir, ShutdownGrace, interruptGrace = dir, time.Millisecond*50, time.Millisecond*50
+	defer func() { lock.Dir, ShutdownGrace, interruptGrace = oldLock, oldGrace, oldInterruptGrace }()
+
+	var signalTests = []struct {
+		name string
+		// finish is when the call returns after its subprocesses were
+		// killed, never if negative.
+		finish time.Duration
+		ret    int
+		reason string
+	}{
+		{"finishes after interrupt", 0, int(EXITDRBDFAILURE), ""},
+		{"hangs", -1, int(EXITDRBDFAILURE), detailsInterrupted.Reason},
+	}
+
+	for _, tt := range signalTests {
+		sigs := make(chan os.Signal, 1)
+		interrupted := make(chan struct{})
+		locked := make(chan struct{})
+		call := func() (string, int) {
+			l, err := lock.Acquire("r0", 0)
+			if err != nil {
+				t.Errorf("Called: lock.Acquire(%q), Unexpected error: %v", "r0", err)
+				close(locked)
+				return "", int(EXITDRBDFAILURE)
+			}
+			defer l.Release()
+			close(locked)
+			<-interrupted
+			if tt.finish < 0 {
+				select {}
+			}
+			return `{"status":"Failure"}`, int(EXITDRBDFAILURE)
+		}
+		go func() {
+			<-locked
+			sigs <- syscall.SIGTERM
+		}()
+
+		out, ret := untilSignal("attach", call, sigs, func() { close(interrupted) })
+		if ret != tt.ret {
+			t.Errorf("Called: untilSignal(%q) %s, Expected: %d, Got: %d", "attach", tt.name, tt.ret, ret)
+		}
+		res := response{}
+		json.Unmarshal([]byte(out), &res)
+		if res.Reason != tt.reason {
+			t.Errorf("Called: untilSignal(%q) %s, Expected reason: %q, Got: %q", "attach", tt.name, tt.reason, res.Reason)
+		}
+
+		l, err := lock.Acquire("r0", 0)
+		if err != nil {
+			t.Errorf("Called: untilSignal(%q) %s, Expected: lock released, Got: %v", "attach", tt.name, err)
+			continue
+		}
+		l.Release()
+	}
+
+	// Calls finishing without a signal keep their result.
+	out, ret := untilSignal("attach", func() (string, int) { return `{"status":"Success"}`, int(EXITSUCCESS) }, make(chan os.Signal), func() {
+		t.Errorf("Called: untilSignal(%q) without signal, Expected: no interrupt", "attach")
+	})
+	if ret != int(EXITSUCCESS) || out != `{"status":"Success"}` {
+		t.Errorf("Called: untilSignal(%q) without signal, Expected: %q, Got: %q, %d", "attach", `{"status":"Success"}`, out, ret)
+	}
+}
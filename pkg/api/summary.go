@@ -0,0 +1,76 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// batchSummary is a consolidated report of an action acting on several
+// resources, meant for logging or archiving.
+type batchSummary struct {
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Duration  string    `json:"duration"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	// Aborted is set if the action stopped before processing all items,
+	// Items then only covers the ones processed so far.
+	Aborted bool        `json:"aborted,omitempty"`
+	Items   []batchItem `json:"items"`
+}
+
+// batchItem is the outcome for a single resource of a batch.
+type batchItem struct {
+	Resource string `json:"resource"`
+	Outcome  string `json:"outcome"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newBatchSummary() *batchSummary {
+	return &batchSummary{Started: time.Now(), Items: []batchItem{}}
+}
+
+// add records the outcome of one item, err being nil on success.
+func (b *batchSummary) add(resource string, err error) {
+	item := batchItem{Resource: resource, Outcome: "success"}
+	if err != nil {
+		item.Outcome = "failure"
+		item.Error = err.Error()
+		b.Failed++
+	} else {
+		b.Succeeded++
+	}
+	b.Items = append(b.Items, item)
+}
+
+// finish stamps the summary and, if requested, writes it to the log as a
+// single line of JSON.
+func (b *batchSummary) finish(action string, aborted bool, logSummary bool) *batchSummary {
+	b.Finished = time.Now()
+	b.Duration = b.Finished.Sub(b.Started).String()
+	b.Aborted = aborted
+	if logSummary {
+		data, _ := json.Marshal(b)
+		log.Printf("%s summary: %s", action, data)
+	}
+	return b
+}
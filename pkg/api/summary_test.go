@@ -0,0 +1,46 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBatchSummary(t *testing.T) {
+	b := newBatchSummary()
+	b.add("r0", nil)
+	b.add("r1", errors.New("no device"))
+	b.finish("recheck", true, false)
+
+	expected := []batchItem{
+		{Resource: "r0", Outcome: "success"},
+		{Resource: "r1", Outcome: "failure", Error: "no device"},
+	}
+	if !reflect.DeepEqual(b.Items, expected) {
+		t.Errorf("Called: batchSummary.add, Expected: %v, Got: %v", expected, b.Items)
+	}
+	if b.Succeeded != 1 || b.Failed != 1 || !b.Aborted {
+		t.Errorf("Called: batchSummary.finish, Expected: 1 succeeded, 1 failed, aborted, Got: %d, %d, %v", b.Succeeded, b.Failed, b.Aborted)
+	}
+	if b.Finished.Before(b.Started) || b.Duration == "" {
+		t.Errorf("Called: batchSummary.finish, Expected finish after %v with a duration, Got: %v, %q", b.Started, b.Finished, b.Duration)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// onlineCPUsFile lists the CPUs the kernel currently schedules on.
+var onlineCPUsFile = "/sys/devices/system/cpu/online"
+
+// cpuAffinity is the CPU list subprocesses are confined to, empty for no
+// affinity.
+var cpuAffinity string
+
+// SetCPUAffinity confines all subprocesses to the CPUs in list, given in the
+// kernel's list format such as "0-1,4". Every CPU must be online.
+func SetCPUAffinity(list string) error {
+	cpus, err := parseCPUList(list)
+	if err != nil {
+		return fmt.Errorf("DRBD: Bad CPU affinity %q: %v", list, err)
+	}
+
+	data, err := ioutil.ReadFile(onlineCPUsFile)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to determine online CPUs: %w", err)
+	}
+	online, err := parseCPUList(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to determine online CPUs: %w", err)
+	}
+
+	for cpu := range cpus {
+		if !online[cpu] {
+			return fmt.Errorf("DRBD: Bad CPU affinity %q: CPU %d is not online", list, cpu)
+		}
+	}
+	cpuAffinity = list
+	return nil
+}
+
+// Parse a CPU list in the kernel's format, e.g. "0-3,8".
+func parseCPUList(list string) (map[int]bool, error) {
+	cpus := make(map[int]bool)
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("malformed CPU %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("malformed CPU range %q", part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	return cpus, nil
+}
+
+// withAffinity wraps the command in taskset if a CPU affinity is set.
+func withAffinity(name string, args []string) (string, []string) {
+	if cpuAffinity == "" {
+		return name, args
+	}
+	return "taskset", append([]string{"-c", cpuAffinity, name}, args...)
+}
@@ -0,0 +1,75 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	var cpuListTests = []struct {
+		in   string
+		cpus map[int]bool
+		ok   bool
+	}{
+		{"0", map[int]bool{0: true}, true},
+		{"0-2,5", map[int]bool{0: true, 1: true, 2: true, 5: true}, true},
+		{"3-1", nil, false},
+		{"", nil, false},
+		{"a", nil, false},
+		{"-1", nil, false},
+	}
+
+	for _, tt := range cpuListTests {
+		cpus, err := parseCPUList(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && !reflect.DeepEqual(cpus, tt.cpus)) {
+			t.Errorf("Called: parseCPUList(%q), Expected: %v, %v, Got: %v, %v", tt.in, tt.cpus, tt.ok, cpus, err)
+		}
+	}
+}
+
+func TestSetCPUAffinity(t *testing.T) {
+	f, err := ioutil.TempFile("", "drbd-flexvolume-online")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("0-3\n")
+	f.Close()
+
+	oldFile := onlineCPUsFile
+	onlineCPUsFile = f.Name()
+	defer func() { onlineCPUsFile = oldFile; cpuAffinity = "" }()
+
+	if err := SetCPUAffinity("4"); err == nil {
+		t.Errorf("Called: SetCPUAffinity(%q) with CPUs 0-3 online, Expected an error, Got: nil", "4")
+	}
+
+	if err := SetCPUAffinity("0,2-3"); err != nil {
+		t.Fatalf("Called: SetCPUAffinity(%q) with CPUs 0-3 online, Unexpected error: %v", "0,2-3", err)
+	}
+	name, args := withAffinity("mkfs", []string{"-t", "ext4"})
+	expected := []string{"-c", "0,2-3", "mkfs", "-t", "ext4"}
+	if name != "taskset" || !reflect.DeepEqual(args, expected) {
+		t.Errorf("Called: withAffinity(%q, %q), Expected: %q %q, Got: %q %q", "mkfs", []string{"-t", "ext4"}, "taskset", expected, name, args)
+	}
+}
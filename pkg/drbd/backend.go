@@ -0,0 +1,598 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backend is the tooling resources are defined and assigned with.
+type Backend interface {
+	// Name is the name of the backend's command.
+	Name() string
+	// usable fails if the backend can't run any commands.
+	usable() error
+	exists(r Resource) (bool, error)
+	assigned(r Resource) (bool, error)
+	// assignmentState is one of the Assignment* states of r.
+	assignmentState(r Resource) (string, error)
+	// assignmentType is AssignmentNone, AssignmentDiskless or
+	// AssignmentDiskful.
+	assignmentType(r Resource) (string, error)
+	// nodeAssignments is the assignment type of the resource per node it
+	// is assigned to.
+	nodeAssignments(resource string) (map[string]string, error)
+	assignedResources(node string) ([]string, error)
+	assignArgs(r Resource) []string
+	// placeArgs deploys the replicas r.PlacementCount asks for, nil if
+	// there is no placement to do.
+	placeArgs(r Resource) []string
+	// createArgs are the commands defining r with a volume of kib KiB.
+	createArgs(r Resource, kib int64) [][]string
+	// storagePools reports whether replicas can be provisioned from a
+	// chosen storage pool.
+	storagePools() bool
+	// replicas is the number of nodes r is assigned to.
+	replicas(r Resource) (int, error)
+	unassignArgs(r Resource) []string
+	sharedSecretArgs(r Resource) []string
+	devicePath(r Resource) (string, error)
+	// resourceOfDevice is the resource whose device is device, empty if
+	// there is none.
+	resourceOfDevice(device string) (string, error)
+	resourceUUID(r Resource) (string, error)
+	// poolFree is the free space in bytes of the node's storage pool.
+	poolFree(node string) (int64, error)
+	// volumeSize is the configured size in bytes of r's volume.
+	volumeSize(r Resource) (int64, error)
+	resizeArgs(r Resource, kib int64) []string
+	// retry tries to complete failed or pending actions on r.
+	retry(r Resource)
+}
+
+// sharedSecretAlg is the HMAC connections authenticate with.
+const sharedSecretAlg = "sha256"
+
+// backend is what every command defining, assigning or querying resources
+// goes through. drbdmanage is what the plugin always used.
+var backend Backend = drbdmanageBackend{}
+
+// DetectBackend picks the backend whose command is in PATH, or at the path
+// set for it, preferring drbdmanage, and uses it from then on. Without any,
+// all operations going through the backend fail with the returned error.
+func DetectBackend() (string, error) {
+	b, err := detectBackend(lookPath)
+	if err != nil {
+		backend = missingBackend{err}
+		return "", err
+	}
+	backend = b
+	return b.Name(), nil
+}
+
+// BackendName returns the name of the backend in use, empty if none was
+// found.
+func BackendName() string {
+	return backend.Name()
+}
+
+func detectBackend(lookPath func(string) (string, error)) (Backend, error) {
+	for _, b := range []Backend{drbdmanageBackend{}, linstorBackend{}} {
+		if _, err := lookPath(b.Name()); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("DRBD: No supported backend found, neither drbdmanage nor linstor is in PATH")
+}
+
+type drbdmanageBackend struct{}
+
+func (drbdmanageBackend) Name() string { return "drbdmanage" }
+
+func (drbdmanageBackend) usable() error { return nil }
+
+func (drbdmanageBackend) exists(r Resource) (bool, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-resources", "--resources", r.Name, "--machine-readable")
+	if err != nil {
+		return false, err
+	}
+	return doResExists(r.Name, string(out))
+}
+
+func (drbdmanageBackend) assigned(r Resource) (bool, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-assignments", "--resources", r.Name, "--nodes", r.NodeName, "--machine-readable")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", out, err)
+	}
+	return doResAssigned(string(out))
+}
+
+func (drbdmanageBackend) assignmentState(r Resource) (string, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-assignments", "--resources", r.Name, "--nodes", r.NodeName, "--machine-readable")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", out, err)
+	}
+	return doAssignmentState(string(out))
+}
+
+func (drbdmanageBackend) assignmentType(r Resource) (string, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-assignments", "--resources", r.Name, "--nodes", r.NodeName, "--machine-readable")
+	if err != nil {
+		return "", fmt.Errorf("DRBD: Unable to get assignment information: %w: %s", err, out)
+	}
+	return doAssignmentType(string(out))
+}
+
+func (drbdmanageBackend) nodeAssignments(resource string) (map[string]string, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-assignments", "--resources", resource, "--machine-readable")
+	if err != nil {
+		return nil, fmt.Errorf("DRBD: Unable to get assignment information: %w: %s", err, out)
+	}
+	return doNodeAssignments(string(out))
+}
+
+func (drbdmanageBackend) assignedResources(node string) ([]string, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-assignments", "--nodes", node, "--machine-readable")
+	if err != nil {
+		return nil, fmt.Errorf("DRBD: Unable to get assignment information: %w: %s", err, out)
+	}
+	return doAssignedResources(string(out))
+}
+
+func (drbdmanageBackend) assignArgs(r Resource) []string {
+	args := []string{"drbdmanage", "assign-resource", r.Name, r.NodeName}
+	if r.Diskless {
+		args = append(args, "--client")
+	}
+	return args
+}
+
+func (drbdmanageBackend) placeArgs(r Resource) []string {
+	if r.PlacementCount <= 0 {
+		return nil
+	}
+	return []string{"drbdmanage", "deploy-resource", r.Name, strconv.Itoa(r.PlacementCount)}
+}
+
+func (drbdmanageBackend) createArgs(r Resource, kib int64) [][]string {
+	return [][]string{
+		{"drbdmanage", "new-resource", r.Name},
+		{"drbdmanage", "new-volume", r.Name, strconv.FormatInt(kib, 10) + "KiB"},
+	}
+}
+
+func (drbdmanageBackend) storagePools() bool { return false }
+
+func (drbdmanageBackend) replicas(r Resource) (int, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-assignments", "--resources", r.Name, "--machine-readable")
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get assignment information: %w: %s", err, out)
+	}
+	nodes, err := doAssignedResources(string(out))
+	return len(nodes), err
+}
+
+func (drbdmanageBackend) unassignArgs(r Resource) []string {
+	return []string{"drbdmanage", "unassign-resource", r.Name, r.NodeName, "--quiet"}
+}
+
+func (drbdmanageBackend) sharedSecretArgs(r Resource) []string {
+	return []string{"drbdmanage", "net-options", "--resource", r.Name,
+		"--cram-hmac-alg", sharedSecretAlg, "--shared-secret", r.SharedSecret}
+}
+
+func (drbdmanageBackend) devicePath(r Resource) (string, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-volumes", "--resources", r.Name, "--machine-readable")
+	if err != nil {
+		return "", fmt.Errorf("DRBD: Unable to get volume information: %w: %s", err, out)
+	}
+	return doGetDevPath(string(out))
+}
+
+func (drbdmanageBackend) resourceOfDevice(device string) (string, error) {
+	minor, err := getMinorFromDevice(device)
+	if err != nil {
+		return "", err
+	}
+	out, err := run(CmdQuery, "drbdmanage", "list-volumes", "--machine-readable")
+	if err != nil {
+		return "", fmt.Errorf("DRBD: Unable to get volume information: %w: %s", err, out)
+	}
+	return getResFromVolumes(string(out), minor)
+}
+
+// drbdmanage keeps no identifier of resources besides their names.
+func (drbdmanageBackend) resourceUUID(r Resource) (string, error) {
+	return "", fmt.Errorf("DRBD: drbdmanage has no resource UUIDs")
+}
+
+func (drbdmanageBackend) poolFree(node string) (int64, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-nodes", "--nodes", node, "--machine-readable")
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get node information: %w: %s", err, out)
+	}
+	return doPoolFree(string(out))
+}
+
+func (drbdmanageBackend) volumeSize(r Resource) (int64, error) {
+	out, err := run(CmdQuery, "drbdmanage", "list-volumes", "--resources", r.Name, "--machine-readable")
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get volume information: %w: %s", err, out)
+	}
+	return doVolumeSize(string(out))
+}
+
+// drbdmanage grows the backing storage on every node and then resizes the
+// DRBD device.
+func (drbdmanageBackend) resizeArgs(r Resource, kib int64) []string {
+	return []string{"drbdmanage", "resize-volume", r.Name, "0", strconv.FormatInt(kib, 10) + "KiB"}
+}
+
+func (drbdmanageBackend) retry(r Resource) {
+	run(CmdAssign, "drbdmanage", "resume-all")
+	time.Sleep(time.Second * 2)
+}
+
+// linstorBackend manages resources with the LINSTOR client, whose
+// machine-readable output is JSON.
+type linstorBackend struct{}
+
+func (linstorBackend) Name() string { return "linstor" }
+
+func (linstorBackend) usable() error { return nil }
+
+// linstorResource is what LINSTOR's v1 output lists for resources and
+// their volumes.
+type linstorResource struct {
+	Name     string   `json:"name"`
+	UUID     string   `json:"uuid"`
+	NodeName string   `json:"node_name"`
+	Flags    []string `json:"flags"`
+	Volumes  []struct {
+		DevicePath string `json:"device_path"`
+	} `json:"volumes"`
+	VolumeDefinitions []struct {
+		SizeKiB int64 `json:"size_kib"`
+	} `json:"volume_definitions"`
+}
+
+// diskless reports whether the resource has no local storage on its node.
+func (r linstorResource) diskless() bool {
+	for _, f := range r.Flags {
+		if f == "DISKLESS" || f == "DRBD_DISKLESS" {
+			return true
+		}
+	}
+	return false
+}
+
+// linstorPool is what LINSTOR's v1 output lists for storage pools.
+type linstorPool struct {
+	Name         string `json:"storage_pool_name"`
+	NodeName     string `json:"node_name"`
+	ProviderKind string `json:"provider_kind"`
+	FreeCapacity int64  `json:"free_capacity"`
+}
+
+func linstorQuery(args ...string) ([]byte, error) {
+	args = append([]string{"-m", "--output-version", "v1"}, args...)
+	out, err := run(CmdQuery, "linstor", args...)
+	if err != nil {
+		return nil, fmt.Errorf("DRBD: Unable to run linstor %s: %w: %s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+func linstorList(args ...string) ([]linstorResource, error) {
+	out, err := linstorQuery(args...)
+	if err != nil {
+		return nil, err
+	}
+	return doLinstorList(string(out))
+}
+
+// Parse the machine-readable output of linstor, a list of lists of objects.
+func doLinstorList(out string) ([]linstorResource, error) {
+	var lists [][]linstorResource
+	if err := json.Unmarshal([]byte(out), &lists); err != nil {
+		return nil, fmt.Errorf("DRBD: Malformed linstor output %q: %v", out, err)
+	}
+	var resources []linstorResource
+	for _, l := range lists {
+		resources = append(resources, l...)
+	}
+	return resources, nil
+}
+
+// Parse the machine-readable output of linstor storage-pool list.
+func doLinstorPools(out string) ([]linstorPool, error) {
+	var lists [][]linstorPool
+	if err := json.Unmarshal([]byte(out), &lists); err != nil {
+		return nil, fmt.Errorf("DRBD: Malformed linstor output %q: %v", out, err)
+	}
+	var pools []linstorPool
+	for _, l := range lists {
+		pools = append(pools, l...)
+	}
+	return pools, nil
+}
+
+func (linstorBackend) exists(r Resource) (bool, error) {
+	resources, err := linstorList("resource-definition", "list", "--resources", r.Name)
+	if err != nil {
+		return false, err
+	}
+	for _, res := range resources {
+		if strings.EqualFold(res.Name, r.Name) {
+			return true, nil
+		}
+	}
+	return false, notDefinedError(r.Name)
+}
+
+func (linstorBackend) assigned(r Resource) (bool, error) {
+	resources, err := linstorList("resource", "list", "--resources", r.Name, "--nodes", r.NodeName)
+	if err != nil {
+		return false, err
+	}
+	for _, res := range resources {
+		if strings.EqualFold(res.Name, r.Name) && strings.EqualFold(res.NodeName, r.NodeName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Resources linstor lists are created, it has no pending assignments.
+func (b linstorBackend) assignmentState(r Resource) (string, error) {
+	ok, err := b.assigned(r)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return AssignmentMissing, nil
+	}
+	return AssignmentAssigned, nil
+}
+
+func (linstorBackend) assignmentType(r Resource) (string, error) {
+	resources, err := linstorList("resource", "list", "--resources", r.Name, "--nodes", r.NodeName)
+	if err != nil {
+		return "", err
+	}
+	for _, res := range resources {
+		if strings.EqualFold(res.Name, r.Name) && strings.EqualFold(res.NodeName, r.NodeName) {
+			if res.diskless() {
+				return AssignmentDiskless, nil
+			}
+			return AssignmentDiskful, nil
+		}
+	}
+	return AssignmentNone, nil
+}
+
+func (linstorBackend) nodeAssignments(resource string) (map[string]string, error) {
+	resources, err := linstorList("resource", "list", "--resources", resource)
+	if err != nil {
+		return nil, err
+	}
+	assignments := make(map[string]string)
+	for _, res := range resources {
+		if !strings.EqualFold(res.Name, resource) {
+			continue
+		}
+		assignments[res.NodeName] = AssignmentDiskful
+		if res.diskless() {
+			assignments[res.NodeName] = AssignmentDiskless
+		}
+	}
+	return assignments, nil
+}
+
+func (linstorBackend) assignedResources(node string) ([]string, error) {
+	resources, err := linstorList("resource", "list", "--nodes", node)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, res := range resources {
+		if strings.EqualFold(res.NodeName, node) {
+			names = append(names, res.Name)
+		}
+	}
+	return names, nil
+}
+
+func (linstorBackend) assignArgs(r Resource) []string {
+	args := []string{"linstor", "resource", "create", r.NodeName, r.Name}
+	if r.Diskless {
+		args = append(args, "--drbd-diskless")
+	} else if r.StoragePool != "" {
+		args = append(args, "--storage-pool", r.StoragePool)
+	}
+	return args
+}
+
+func (linstorBackend) placeArgs(r Resource) []string {
+	if r.PlacementCount <= 0 {
+		return nil
+	}
+	args := []string{"linstor", "resource", "create", r.Name, "--auto-place", strconv.Itoa(r.PlacementCount)}
+	if r.StoragePool != "" {
+		args = append(args, "--storage-pool", r.StoragePool)
+	}
+	return args
+}
+
+func (linstorBackend) createArgs(r Resource, kib int64) [][]string {
+	return [][]string{
+		{"linstor", "resource-definition", "create", r.Name},
+		{"linstor", "volume-definition", "create", r.Name, strconv.FormatInt(kib, 10) + "KiB"},
+	}
+}
+
+func (linstorBackend) storagePools() bool { return true }
+
+func (linstorBackend) replicas(r Resource) (int, error) {
+	resources, err := linstorList("resource", "list", "--resources", r.Name)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, res := range resources {
+		if strings.EqualFold(res.Name, r.Name) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (linstorBackend) unassignArgs(r Resource) []string {
+	return []string{"linstor", "resource", "delete", r.NodeName, r.Name}
+}
+
+func (linstorBackend) sharedSecretArgs(r Resource) []string {
+	return []string{"linstor", "resource-definition", "drbd-options",
+		"--cram-hmac-alg", sharedSecretAlg, "--shared-secret", r.SharedSecret, r.Name}
+}
+
+// The minor, and with it the device, is the same on all nodes.
+func (linstorBackend) devicePath(r Resource) (string, error) {
+	resources, err := linstorList("volume", "list", "--resources", r.Name)
+	if err != nil {
+		return "", err
+	}
+	for _, res := range resources {
+		for _, v := range res.Volumes {
+			if v.DevicePath != "" {
+				return v.DevicePath, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("DRBD: No device found for resource %q", r.Name)
+}
+
+func (linstorBackend) resourceOfDevice(device string) (string, error) {
+	if _, err := getMinorFromDevice(device); err != nil {
+		return "", err
+	}
+	resources, err := linstorList("volume", "list")
+	if err != nil {
+		return "", err
+	}
+	for _, res := range resources {
+		for _, v := range res.Volumes {
+			if v.DevicePath == device {
+				return res.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (linstorBackend) resourceUUID(r Resource) (string, error) {
+	resources, err := linstorList("resource-definition", "list", "--resources", r.Name)
+	if err != nil {
+		return "", err
+	}
+	for _, res := range resources {
+		if strings.EqualFold(res.Name, r.Name) && res.UUID != "" {
+			return res.UUID, nil
+		}
+	}
+	return "", fmt.Errorf("DRBD: No UUID found for resource %q", r.Name)
+}
+
+// A volume is placed in a single pool, so the node's largest one counts.
+// Diskless pools hold no data.
+func (linstorBackend) poolFree(node string) (int64, error) {
+	out, err := linstorQuery("storage-pool", "list", "--nodes", node)
+	if err != nil {
+		return 0, err
+	}
+	pools, err := doLinstorPools(string(out))
+	if err != nil {
+		return 0, err
+	}
+	free := int64(-1)
+	for _, p := range pools {
+		if strings.EqualFold(p.NodeName, node) && p.ProviderKind != "DISKLESS" && p.FreeCapacity*1024 > free {
+			free = p.FreeCapacity * 1024
+		}
+	}
+	if free < 0 {
+		return 0, fmt.Errorf("DRBD: No storage pool found on node %q", node)
+	}
+	return free, nil
+}
+
+func (linstorBackend) volumeSize(r Resource) (int64, error) {
+	resources, err := linstorList("volume-definition", "list", "--resources", r.Name)
+	if err != nil {
+		return 0, err
+	}
+	for _, res := range resources {
+		if strings.EqualFold(res.Name, r.Name) && len(res.VolumeDefinitions) > 0 {
+			return res.VolumeDefinitions[0].SizeKiB * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("DRBD: Resource is not configured")
+}
+
+func (linstorBackend) resizeArgs(r Resource, kib int64) []string {
+	return []string{"linstor", "volume-definition", "set-size", r.Name, "0", strconv.FormatInt(kib, 10) + "KiB"}
+}
+
+// LINSTOR retries failed actions itself.
+func (linstorBackend) retry(r Resource) {
+	time.Sleep(time.Second * 2)
+}
+
+// missingBackend fails every operation when no backend was found.
+type missingBackend struct {
+	err error
+}
+
+func (missingBackend) Name() string { return "" }
+
+func (b missingBackend) usable() error                                     { return b.err }
+func (b missingBackend) exists(r Resource) (bool, error)                   { return false, b.err }
+func (b missingBackend) assigned(r Resource) (bool, error)                 { return false, b.err }
+func (b missingBackend) assignmentState(r Resource) (string, error)        { return "", b.err }
+func (b missingBackend) assignmentType(r Resource) (string, error)         { return "", b.err }
+func (b missingBackend) nodeAssignments(string) (map[string]string, error) { return nil, b.err }
+func (b missingBackend) assignedResources(string) ([]string, error)        { return nil, b.err }
+func (missingBackend) assignArgs(r Resource) []string                      { return nil }
+func (missingBackend) placeArgs(r Resource) []string                       { return nil }
+func (missingBackend) createArgs(r Resource, kib int64) [][]string         { return nil }
+func (missingBackend) storagePools() bool                                  { return false }
+func (b missingBackend) replicas(r Resource) (int, error)                  { return 0, b.err }
+func (missingBackend) unassignArgs(r Resource) []string                    { return nil }
+func (missingBackend) sharedSecretArgs(r Resource) []string                { return nil }
+func (b missingBackend) devicePath(r Resource) (string, error)             { return "", b.err }
+func (b missingBackend) resourceOfDevice(string) (string, error)           { return "", b.err }
+func (b missingBackend) resourceUUID(r Resource) (string, error)           { return "", b.err }
+func (b missingBackend) poolFree(string) (int64, error)                    { return 0, b.err }
+func (b missingBackend) volumeSize(r Resource) (int64, error)              { return 0, b.err }
+func (missingBackend) resizeArgs(r Resource, kib int64) []string           { return nil }
+func (missingBackend) retry(r Resource)                                    {}
@@ -0,0 +1,326 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectBackend(t *testing.T) {
+	var detectTests = []struct {
+		installed []string
+		backend   string
+	}{
+		{[]string{"drbdmanage", "linstor"}, "drbdmanage"},
+		{[]string{"drbdmanage"}, "drbdmanage"},
+		{[]string{"linstor"}, "linstor"},
+		{nil, ""},
+	}
+
+	for _, tt := range detectTests {
+		lookPath := func(bin string) (string, error) {
+			for _, i := range tt.installed {
+				if bin == i {
+					return "/usr/bin/" + bin, nil
+				}
+			}
+			return "", errors.New("executable file not found in $PATH")
+		}
+		b, err := detectBackend(lookPath)
+		if tt.backend == "" {
+			if err == nil || !strings.Contains(err.Error(), "No supported backend") {
+				t.Errorf("Called: detectBackend(%q), Expected: no supported backend error, Got: %v, %v", tt.installed, b, err)
+			}
+			continue
+		}
+		if err != nil || b.Name() != tt.backend {
+			t.Errorf("Called: detectBackend(%q), Expected: %q, Got: %v, %v", tt.installed, tt.backend, b, err)
+		}
+	}
+}
+
+func TestBackendArgs(t *testing.T) {
+	var argsTests = []struct {
+		backend  Backend
+		r        Resource
+		assign   string
+		unassign string
+	}{
+		{drbdmanageBackend{}, Resource{Name: "r0", NodeName: "node-a", Diskless: true},
+			"drbdmanage assign-resource r0 node-a --client",
+			"drbdmanage unassign-resource r0 node-a --quiet"},
+		{drbdmanageBackend{}, Resource{Name: "r0", NodeName: "node-a"},
+			"drbdmanage assign-resource r0 node-a",
+			"drbdmanage unassign-resource r0 node-a --quiet"},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a", Diskless: true},
+			"linstor resource create node-a r0 --drbd-diskless",
+			"linstor resource delete node-a r0"},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a"},
+			"linstor resource create node-a r0",
+			"linstor resource delete node-a r0"},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a", StoragePool: "ssd"},
+			"linstor resource create node-a r0 --storage-pool ssd",
+			"linstor resource delete node-a r0"},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a", Diskless: true, StoragePool: "ssd"},
+			"linstor resource create node-a r0 --drbd-diskless",
+			"linstor resource delete node-a r0"},
+		{missingBackend{errors.New("none")}, Resource{Name: "r0", NodeName: "node-a"}, "", ""},
+	}
+
+	for _, tt := range argsTests {
+		if assign := strings.Join(tt.backend.assignArgs(tt.r), " "); assign != tt.assign {
+			t.Errorf("Called: %T.assignArgs(%+v), Expected: %q, Got: %q", tt.backend, tt.r, tt.assign, assign)
+		}
+		if unassign := strings.Join(tt.backend.unassignArgs(tt.r), " "); unassign != tt.unassign {
+			t.Errorf("Called: %T.unassignArgs(%+v), Expected: %q, Got: %q", tt.backend, tt.r, tt.unassign, unassign)
+		}
+	}
+}
+
+func TestPlaceArgs(t *testing.T) {
+	var placeTests = []struct {
+		backend Backend
+		r       Resource
+		place   string
+	}{
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a", PlacementCount: 3, StoragePool: "ssd"},
+			"linstor resource create r0 --auto-place 3 --storage-pool ssd"},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a", PlacementCount: 2},
+			"linstor resource create r0 --auto-place 2"},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a", StoragePool: "ssd"}, ""},
+		{linstorBackend{}, Resource{Name: "r0", NodeName: "node-a"}, ""},
+		{drbdmanageBackend{}, Resource{Name: "r0", NodeName: "node-a", PlacementCount: 3, StoragePool: "ssd"},
+			"drbdmanage deploy-resource r0 3"},
+		{drbdmanageBackend{}, Resource{Name: "r0", NodeName: "node-a"}, ""},
+		{missingBackend{errors.New("none")}, Resource{Name: "r0", NodeName: "node-a", PlacementCount: 3}, ""},
+	}
+
+	for _, tt := range placeTests {
+		if place := strings.Join(tt.backend.placeArgs(tt.r), " "); place != tt.place {
+			t.Errorf("Called: %T.placeArgs(%+v), Expected: %q, Got: %q", tt.backend, tt.r, tt.place, place)
+		}
+	}
+}
+
+func TestPlaceResource(t *testing.T) {
+	DryRun = true
+	defer func() { DryRun = false }()
+
+	place := []string{"linstor", "resource", "create", "r0", "--auto-place", "3"}
+	var placeTests = []struct {
+		name     string
+		args     []string
+		replicas int
+		err      error
+		placed   bool
+		queried  bool
+	}{
+		{"unplaced", place, 0, nil, true, true},
+		{"already placed", place, 2, nil, false, true},
+		{"query fails", place, 0, errors.New("controller offline"), false, true},
+		{"no placement", nil, 0, nil, false, false},
+	}
+
+	for _, tt := range placeTests {
+		queried := false
+		placed, err := placeResource(tt.args, func() (int, error) {
+			queried = true
+			return tt.replicas, tt.err
+		})
+		if placed != tt.placed || queried != tt.queried || (err == nil) != (tt.err == nil) {
+			t.Errorf("Called: placeResource(%s), Expected: placed %t, queried %t, error %v, Got: placed %t, queried %t, %v",
+				tt.name, tt.placed, tt.queried, tt.err, placed, queried, err)
+		}
+	}
+}
+
+func TestAssignResCreatesThenPlaces(t *testing.T) {
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"drbdmanage list-resources --resources r0 --machine-readable":                 {},
+			"drbdmanage new-resource r0":                                                  {},
+			"drbdmanage new-volume r0 1024KiB":                                            {},
+			"drbdmanage list-assignments --resources r0 --nodes node1 --machine-readable": {},
+			"drbdmanage list-assignments --resources r0 --machine-readable":               {},
+			"drbdmanage deploy-resource r0 3":                                             {Output: "Error: not enough nodes\n", Err: errors.New("exit status 1")},
+		},
+		Files: map[string]string{moduleDir: ""},
+	}
+	defer useFake(f)()
+
+	r := Resource{Name: "r0", NodeName: "node1", PlacementCount: 3, Size: 1024*1024 - 1}
+	if _, err := AssignRes(r); err == nil {
+		t.Fatalf("Called: AssignRes(%+v), Expected: the failed placement, Got: nil", r)
+	}
+	var run []string
+	for _, call := range f.Ran() {
+		if strings.HasPrefix(call, "drbdmanage new-") || strings.HasPrefix(call, "drbdmanage deploy-") {
+			run = append(run, call)
+		}
+	}
+	expected := "drbdmanage new-resource r0,drbdmanage new-volume r0 1024KiB,drbdmanage deploy-resource r0 3"
+	if joined := strings.Join(run, ","); joined != expected {
+		t.Errorf("Called: AssignRes(%+v), Expected: %q, Got: %q", r, expected, joined)
+	}
+}
+
+func TestAssignResStoragePoolUnsupported(t *testing.T) {
+	f := &FakeExecutor{Files: map[string]string{moduleDir: ""}}
+	defer useFake(f)()
+
+	r := Resource{Name: "r0", NodeName: "node1", PlacementCount: 3, StoragePool: "ssd"}
+	_, err := AssignRes(r)
+	if err == nil || IsTransient(err) {
+		t.Errorf("Called: AssignRes(%+v) on drbdmanage, Expected: a terminal error, Got: %v", r, err)
+	}
+	if calls := f.Ran(); len(calls) != 0 {
+		t.Errorf("Called: AssignRes(%+v) on drbdmanage, Expected: no commands, Got: %q", r, calls)
+	}
+}
+
+func TestSharedSecretArgs(t *testing.T) {
+	r := Resource{Name: "r0", NodeName: "node-a", SharedSecret: "s3cr3t"}
+	var secretTests = []struct {
+		backend Backend
+		args    string
+	}{
+		{drbdmanageBackend{}, "drbdmanage net-options --resource r0 --cram-hmac-alg sha256 --shared-secret s3cr3t"},
+		{linstorBackend{}, "linstor resource-definition drbd-options --cram-hmac-alg sha256 --shared-secret s3cr3t r0"},
+	}
+
+	for _, tt := range secretTests {
+		args := tt.backend.sharedSecretArgs(r)
+		if joined := strings.Join(args, " "); joined != tt.args {
+			t.Errorf("Called: %T.sharedSecretArgs(%q), Expected: %q, Got: %q", tt.backend, r.Name, tt.args, joined)
+		}
+		if line := commandLine(args[0], args[1:]); strings.Contains(line, r.SharedSecret) {
+			t.Errorf("Called: commandLine(%T.sharedSecretArgs(%q)), Expected the secret redacted, Got: %q", tt.backend, r.Name, line)
+		}
+	}
+}
+
+func TestDoLinstorList(t *testing.T) {
+	var listTests = []struct {
+		out     string
+		devices []string
+		ok      bool
+	}{
+		{`[[{"name":"r0","node_name":"node-a","volumes":[{"device_path":"/dev/drbd1000"}]}]]`, []string{"/dev/drbd1000"}, true},
+		{`[[{"name":"r0","node_name":"node-a"}],[{"name":"r0","node_name":"node-b","volumes":[{"device_path":"/dev/drbd1000"}]}]]`, []string{"/dev/drbd1000"}, true},
+		{`[[]]`, nil, true},
+		{`Error: no such resource`, nil, false},
+	}
+
+	for _, tt := range listTests {
+		resources, err := doLinstorList(tt.out)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: doLinstorList(%q), Expected error: %v, Got: %v", tt.out, !tt.ok, err)
+			continue
+		}
+		var devices []string
+		for _, r := range resources {
+			for _, v := range r.Volumes {
+				devices = append(devices, v.DevicePath)
+			}
+		}
+		if !reflect.DeepEqual(devices, tt.devices) {
+			t.Errorf("Called: doLinstorList(%q), Expected: %q, Got: %q", tt.out, tt.devices, devices)
+		}
+	}
+}
+
+func TestDoLinstorListUUID(t *testing.T) {
+	out := `[[{"name":"r0","uuid":"6b0b3a2c-0c4f-4d23-9d43-1e7a0b6c2f11","props":{}}]]`
+	resources, err := doLinstorList(out)
+	if err != nil || len(resources) != 1 || resources[0].UUID != "6b0b3a2c-0c4f-4d23-9d43-1e7a0b6c2f11" {
+		t.Errorf("Called: doLinstorList(%q), Expected UUID: %q, Got: %+v, %v", out, "6b0b3a2c-0c4f-4d23-9d43-1e7a0b6c2f11", resources, err)
+	}
+}
+
+func TestLinstorQueries(t *testing.T) {
+	const v1 = "linstor -m --output-version v1 "
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			v1 + "resource list --resources r0":                {Output: `[[{"name":"r0","node_name":"node-a"},{"name":"r0","node_name":"node-b","flags":["DISKLESS"]}]]`},
+			v1 + "resource list --resources r0 --nodes node-b": {Output: `[[{"name":"r0","node_name":"node-b","flags":["DRBD_DISKLESS"]}]]`},
+			v1 + "resource list --resources r0 --nodes node-c": {Output: `[[]]`},
+			v1 + "storage-pool list --nodes node-a": {Output: `[[{"storage_pool_name":"DfltDisklessStorPool","node_name":"node-a","provider_kind":"DISKLESS"},` +
+				`{"storage_pool_name":"hdd","node_name":"node-a","provider_kind":"LVM","free_capacity":1024},` +
+				`{"storage_pool_name":"ssd","node_name":"node-a","provider_kind":"LVM_THIN","free_capacity":2048}]]`},
+			v1 + "volume-definition list --resources r0": {Output: `[[{"name":"r0","volume_definitions":[{"volume_number":0,"size_kib":102400}]}]]`},
+			v1 + "volume list":                           {Output: `[[{"name":"r0","node_name":"node-a","volumes":[{"device_path":"/dev/drbd1000"}]}]]`},
+		},
+	}
+	defer useFake(f)()
+	backend = linstorBackend{}
+
+	assignments, err := backend.nodeAssignments("r0")
+	expected := map[string]string{"node-a": AssignmentDiskful, "node-b": AssignmentDiskless}
+	if err != nil || !reflect.DeepEqual(assignments, expected) {
+		t.Errorf("Called: nodeAssignments(%q), Expected: %v, Got: %v, %v", "r0", expected, assignments, err)
+	}
+	var typeTests = []struct {
+		node       string
+		assignment string
+	}{
+		{"node-b", AssignmentDiskless},
+		{"node-c", AssignmentNone},
+	}
+	for _, tt := range typeTests {
+		assignment, err := AssignmentType(Resource{Name: "r0", NodeName: tt.node})
+		if err != nil || assignment != tt.assignment {
+			t.Errorf("Called: AssignmentType(%q on %q), Expected: %q, Got: %q, %v", "r0", tt.node, tt.assignment, assignment, err)
+		}
+	}
+	if free, err := PoolFree("node-a"); err != nil || free != 2048*1024 {
+		t.Errorf("Called: PoolFree(%q), Expected: %d, Got: %d, %v", "node-a", 2048*1024, free, err)
+	}
+	if size, err := VolumeSize(Resource{Name: "r0"}); err != nil || size != 102400*1024 {
+		t.Errorf("Called: VolumeSize(%q), Expected: %d, Got: %d, %v", "r0", 102400*1024, size, err)
+	}
+	if name, err := getResFromDevice("/dev/drbd1000"); err != nil || name != "r0" {
+		t.Errorf("Called: getResFromDevice(%q), Expected: %q, Got: %q, %v", "/dev/drbd1000", "r0", name, err)
+	}
+	if args := strings.Join(backend.resizeArgs(Resource{Name: "r0"}, 204800), " "); args != "linstor volume-definition set-size r0 0 204800KiB" {
+		t.Errorf("Called: resizeArgs(%q), Expected: %q, Got: %q", "r0", "linstor volume-definition set-size r0 0 204800KiB", args)
+	}
+}
+
+func TestMissingBackendUsable(t *testing.T) {
+	missing := errors.New("no backend")
+	f := &FakeExecutor{Files: map[string]string{moduleDir: ""}}
+	defer useFake(f)()
+	backend = missingBackend{missing}
+
+	if err := setSharedSecret(Resource{Name: "r0", SharedSecret: "s3cr3t"}); !errors.Is(err, missing) {
+		t.Errorf("Called: setSharedSecret() without backend, Expected: %v, Got: %v", missing, err)
+	}
+	if err := UnassignRes(Resource{Name: "r0", NodeName: "node-a"}); !errors.Is(err, missing) {
+		t.Errorf("Called: UnassignRes() without backend, Expected: %v, Got: %v", missing, err)
+	}
+	if _, err := Expand(Resource{Name: "r0"}, 1<<30); !errors.Is(err, missing) {
+		t.Errorf("Called: Expand() without backend, Expected: %v, Got: %v", missing, err)
+	}
+	if ran := f.Ran(); len(ran) != 0 {
+		t.Errorf("Called: without backend, Expected: no commands, Got: %q", ran)
+	}
+}
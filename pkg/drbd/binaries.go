@@ -0,0 +1,85 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// Binaries are the commands that can be run from a path given with
+// SetBinaryPath instead of being looked up in PATH.
+var Binaries = []string{
+	"drbdadm", "drbdsetup", "drbdmanage", "linstor",
+	"mount", "umount", "findmnt", "blkid", "mkfs", "fsck", "fstrim", "modprobe",
+}
+
+// binaryPaths holds the paths set with SetBinaryPath.
+var binaryPaths = map[string]string{}
+
+// mkfsPrefix, if set, is prepended to the filesystem type to run its mkfs
+// helper directly, e.g. /opt/sbin/mkfs. runs /opt/sbin/mkfs.ext4 for ext4.
+var mkfsPrefix string
+
+// SetBinaryPath runs name, one of Binaries, from the absolute path given
+// instead of looking it up in PATH. An empty path restores the lookup.
+func SetBinaryPath(name, path string) error {
+	if !containsString(Binaries, name) {
+		return fmt.Errorf("DRBD: Unknown command %q", name)
+	}
+	if path == "" {
+		delete(binaryPaths, name)
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("DRBD: Bad path %q for %s: must be absolute", path, name)
+	}
+	binaryPaths[name] = path
+	return nil
+}
+
+// SetMkfsPrefix runs the mkfs helper of each filesystem type as prefix
+// followed by the type, e.g. "/opt/sbin/mkfs.", instead of through mkfs
+// in PATH. An empty prefix restores mkfs.
+func SetMkfsPrefix(prefix string) error {
+	if prefix != "" && !filepath.IsAbs(prefix) {
+		return fmt.Errorf("DRBD: Bad mkfs prefix %q: must be absolute", prefix)
+	}
+	mkfsPrefix = prefix
+	return nil
+}
+
+// binaryCommand returns the command actually run for name and args, with
+// the overrides of SetBinaryPath and SetMkfsPrefix applied.
+func binaryCommand(name string, args []string) (string, []string) {
+	if name == "mkfs" && mkfsPrefix != "" && len(args) > 1 && args[0] == "-t" {
+		return mkfsPrefix + args[1], args[2:]
+	}
+	if path, ok := binaryPaths[name]; ok {
+		return path, args
+	}
+	return name, args
+}
+
+// lookPath is exec.LookPath for the path name is run from.
+func lookPath(name string) (string, error) {
+	path, _ := binaryCommand(name, nil)
+	return exec.LookPath(path)
+}
@@ -0,0 +1,112 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withBinaries sets the paths and mkfs prefix for the duration of a test.
+func withBinaries(t *testing.T, paths map[string]string, prefix string) func() {
+	oldPaths, oldPrefix := binaryPaths, mkfsPrefix
+	binaryPaths = map[string]string{}
+	for name, path := range paths {
+		if err := SetBinaryPath(name, path); err != nil {
+			t.Fatalf("Called: SetBinaryPath(%q, %q), Unexpected error: %v", name, path, err)
+		}
+	}
+	if err := SetMkfsPrefix(prefix); err != nil {
+		t.Fatalf("Called: SetMkfsPrefix(%q), Unexpected error: %v", prefix, err)
+	}
+	return func() { binaryPaths, mkfsPrefix = oldPaths, oldPrefix }
+}
+
+func TestSetBinaryPath(t *testing.T) {
+	defer withBinaries(t, nil, "")()
+
+	var pathTests = []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"drbdadm", "/opt/drbd/sbin/drbdadm", true},
+		{"mount", "", true},
+		{"drbdadm", "sbin/drbdadm", false},
+		{"rm", "/bin/rm", false},
+	}
+
+	for _, tt := range pathTests {
+		if err := SetBinaryPath(tt.name, tt.path); (err == nil) != tt.ok {
+			t.Errorf("Called: SetBinaryPath(%q, %q), Expected ok: %t, Got: %v", tt.name, tt.path, tt.ok, err)
+		}
+	}
+	if err := SetMkfsPrefix("mkfs."); err == nil {
+		t.Errorf("Called: SetMkfsPrefix(%q), Expected: error, Got: nil", "mkfs.")
+	}
+}
+
+func TestBinaryCommand(t *testing.T) {
+	var commandTests = []struct {
+		paths  map[string]string
+		prefix string
+		in     []string
+		out    []string
+	}{
+		{nil, "", []string{"drbdadm", "role", "r0"}, []string{"drbdadm", "role", "r0"}},
+		{nil, "", []string{"mkfs", "-t", "ext4", "/dev/drbd100"}, []string{"mkfs", "-t", "ext4", "/dev/drbd100"}},
+		{map[string]string{"drbdadm": "/opt/drbd/sbin/drbdadm"}, "", []string{"drbdadm", "role", "r0"}, []string{"/opt/drbd/sbin/drbdadm", "role", "r0"}},
+		{map[string]string{"drbdadm": "/opt/drbd/sbin/drbdadm"}, "", []string{"drbdsetup", "show"}, []string{"drbdsetup", "show"}},
+		{map[string]string{"mount": "/usr/local/bin/mount"}, "", []string{"mount", "--bind", "/a", "/b"}, []string{"/usr/local/bin/mount", "--bind", "/a", "/b"}},
+		{nil, "/opt/sbin/mkfs.", []string{"mkfs", "-t", "xfs", "-K", "/dev/drbd100"}, []string{"/opt/sbin/mkfs.xfs", "-K", "/dev/drbd100"}},
+		{map[string]string{"mkfs": "/opt/sbin/mkfs"}, "", []string{"mkfs", "-t", "ext4", "/dev/drbd100"}, []string{"/opt/sbin/mkfs", "-t", "ext4", "/dev/drbd100"}},
+	}
+
+	for _, tt := range commandTests {
+		restore := withBinaries(t, tt.paths, tt.prefix)
+		name, args := binaryCommand(tt.in[0], tt.in[1:])
+		restore()
+		if out := append([]string{name}, args...); !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("Called: binaryCommand(%q) with %v and prefix %q, Expected: %q, Got: %q", tt.in, tt.paths, tt.prefix, tt.out, out)
+		}
+	}
+}
+
+func TestRunStubBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-binaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := filepath.Join(dir, "drbdadm")
+	if err := ioutil.WriteFile(stub, []byte("#!/bin/sh\necho \"stub $*\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer withBinaries(t, map[string]string{"drbdadm": stub}, "")()
+
+	out, err := run(CmdQuery, "drbdadm", "role", "r0")
+	if err != nil || string(out) != "stub role r0\n" {
+		t.Errorf("Called: run(%q) with drbdadm at %s, Expected: %q, Got: %q, %v", "drbdadm role r0", stub, "stub role r0\n", out, err)
+	}
+	if path, err := lookPath("drbdadm"); err != nil || path != stub {
+		t.Errorf("Called: lookPath(%q), Expected: %q, Got: %q, %v", "drbdadm", stub, path, err)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// mountBlock links the resource's device at path for volumes used as raw
+// block devices, promoting the resource first unless it is read-only.
+func (m Mounter) mountBlock(path string) (MountResult, bool, error) {
+	device, err := WaitForDevPath(*m.Resource, 3)
+	if err != nil {
+		return MountResult{}, false, &MountError{ErrDeviceNotReady, fmt.Errorf("couldn't find Resource device path: %w", err)}
+	}
+
+	retries, err := waitForDeviceNode(device, deviceOpenRetries, time.Millisecond*500, openDevice)
+	result := MountResult{Device: device, DeviceOpenRetries: retries}
+	if err != nil {
+		return result, false, &MountError{ErrDeviceNotReady, err}
+	}
+
+	if !m.ReadOnly {
+		if err := m.promote(); err != nil {
+			return result, false, &MountError{promoteFailure(err), err}
+		}
+	}
+
+	if err := linkDevice(device, path); err != nil {
+		return result, !m.ReadOnly, &MountError{ErrMountFailed, err}
+	}
+	return result, !m.ReadOnly, nil
+}
+
+// linkDevice makes path a symlink to device, replacing an empty directory
+// left there, e.g. by the Kubelet. A link to device already is kept.
+func linkDevice(device, path string) error {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSymlink != 0:
+		if target := linkedDevice(path); target != device {
+			return fmt.Errorf("block path %s links to %s, not %s", path, target, device)
+		}
+		return nil
+	case err == nil && info.IsDir():
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("unable to replace directory %s with a link to %s: %w", path, device, err)
+		}
+	case err == nil:
+		return fmt.Errorf("block path %s exists, but is not a link to %s", path, device)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("unable to check block path %s: %w", path, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to make block path directory: %w", err)
+	}
+	if err := os.Symlink(device, path); err != nil {
+		return fmt.Errorf("unable to link %s to %s: %w", path, device, err)
+	}
+	return nil
+}
+
+// linkedDevice returns what the symlink at path points to, empty if path
+// isn't a symlink.
+func linkedDevice(path string) string {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return ""
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+// unmountBlock removes the link at path to device and demotes the resource
+// once the device has been released.
+func (m Mounter) unmountBlock(path, device string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove block link %s: %w", path, err)
+	}
+	if _, err := getMinorFromDevice(device); err != nil {
+		return nil
+	}
+	return releaseAndDemote(
+		func() error { return waitForRelease(device, m.ReleaseTimeout) },
+		func() error { return m.demoteDevice(device) })
+}
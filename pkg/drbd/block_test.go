@@ -0,0 +1,107 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "sda")
+	if err := ioutil.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var linkTests = []struct {
+		name  string
+		setup func(path string) error
+		ok    bool
+	}{
+		{"missing", func(path string) error { return nil }, true},
+		{"empty directory", func(path string) error { return os.Mkdir(path, 0755) }, true},
+		{"already linked", func(path string) error { return os.Symlink(device, path) }, true},
+		{"linked elsewhere", func(path string) error { return os.Symlink(filepath.Join(dir, "sdb"), path) }, false},
+		{"file", func(path string) error { return ioutil.WriteFile(path, nil, 0644) }, false},
+		{"directory with files", func(path string) error {
+			if err := os.Mkdir(path, 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(path, "data"), nil, 0644)
+		}, false},
+	}
+
+	for i, tt := range linkTests {
+		path := filepath.Join(dir, "pods", string(rune('a'+i)), "volume")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.setup(path); err != nil {
+			t.Fatal(err)
+		}
+
+		err := linkDevice(device, path)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: linkDevice(%q, %q) with %s, Expected error: %v, Got: %v", device, path, tt.name, !tt.ok, err)
+			continue
+		}
+		if linked := linkedDevice(path); tt.ok && linked != device {
+			t.Errorf("Called: linkDevice(%q, %q) with %s, Expected: link to %s, Got: %q", device, path, tt.name, device, linked)
+		}
+	}
+}
+
+func TestUnMountBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "sda")
+	if err := ioutil.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "volume")
+	if err := linkDevice(device, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link is removed, the device itself is neither mounted nor touched.
+	if err := (Mounter{}).UnMount(path); err != nil {
+		t.Errorf("Called: UnMount(%q) of a block link, Unexpected error: %v", path, err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Called: UnMount(%q) of a block link, Expected: link removed, Got: %v", path, err)
+	}
+	if _, err := os.Stat(device); err != nil {
+		t.Errorf("Called: UnMount(%q) of a block link, Expected: %s kept, Got: %v", path, device, err)
+	}
+
+	// Unmounting again finds nothing to do.
+	if err := (Mounter{}).UnMount(path); err != nil {
+		t.Errorf("Called: UnMount(%q) twice, Unexpected error: %v", path, err)
+	}
+}
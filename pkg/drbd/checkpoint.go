@@ -0,0 +1,115 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CheckpointDir holds the progress files of resources that are waited on
+// with Resource.Checkpoint set.
+var CheckpointDir = "/var/run/drbd-flexvolume/progress"
+
+// Checkpoint is the progress of a wait loop, as written for external watchers.
+type Checkpoint struct {
+	Resource string    `json:"resource"`
+	State    string    `json:"state"`
+	Percent  int       `json:"percent"`
+	Time     time.Time `json:"time"`
+}
+
+func checkpointPath(r Resource) string {
+	return filepath.Join(CheckpointDir, r.Name+".json")
+}
+
+// checkpoint records that r is in state, having made it through attempt of
+// maxRetries tries. Failures are only logged, progress reporting must never
+// break the operation it reports on.
+func checkpoint(r Resource, state string, attempt, maxRetries int) {
+	if !r.Checkpoint {
+		return
+	}
+
+	percent := 100
+	if maxRetries > 0 {
+		percent = attempt * 100 / maxRetries
+	}
+
+	data, _ := json.Marshal(Checkpoint{
+		Resource: r.Name,
+		State:    state,
+		Percent:  percent,
+		Time:     time.Now(),
+	})
+
+	if err := writeAtomic(checkpointPath(r), data); err != nil {
+		log.Printf("DRBD: unable to write progress of %s: %v", r.Name, err)
+	}
+}
+
+// clearCheckpoint removes the progress file of r, if any.
+func clearCheckpoint(r Resource) {
+	if !r.Checkpoint {
+		return
+	}
+	if err := os.Remove(checkpointPath(r)); err != nil && !os.IsNotExist(err) {
+		log.Printf("DRBD: unable to remove progress of %s: %v", r.Name, err)
+	}
+}
+
+// Stateless keeps the package from writing its records on the node, for
+// nodes where nothing may be written: progress files, the assignments attach
+// created and verification results are dropped, and diagnostic bundles are
+// refused.
+var Stateless bool
+
+// writeAtomic replaces path with data, so that readers either see the old or
+// the new contents, never a partial write. Nothing is written if Stateless.
+func writeAtomic(path string, data []byte) error {
+	if Stateless {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
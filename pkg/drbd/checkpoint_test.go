@@ -0,0 +1,64 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := CheckpointDir
+	CheckpointDir = dir
+	defer func() { CheckpointDir = oldDir }()
+
+	r := Resource{Name: "r0", Checkpoint: true}
+
+	checkpoint(r, "assigning", 1, 4)
+	data, err := ioutil.ReadFile(checkpointPath(r))
+	if err != nil {
+		t.Fatalf("Called: checkpoint(%q, %q, 1, 4), Expected a progress file, Got: %v", r.Name, "assigning", err)
+	}
+	c := Checkpoint{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Resource != "r0" || c.State != "assigning" || c.Percent != 25 {
+		t.Errorf("Called: checkpoint(%q, %q, 1, 4), Expected: %q, %q, 25, Got: %q, %q, %d", r.Name, "assigning", "r0", "assigning", c.Resource, c.State, c.Percent)
+	}
+
+	clearCheckpoint(r)
+	if _, err := os.Stat(checkpointPath(r)); !os.IsNotExist(err) {
+		t.Errorf("Called: clearCheckpoint(%q), Expected progress file to be removed, Got: %v", r.Name, err)
+	}
+
+	// Without Checkpoint set, nothing is written.
+	r.Checkpoint = false
+	checkpoint(r, "assigning", 1, 4)
+	if _, err := os.Stat(checkpointPath(r)); !os.IsNotExist(err) {
+		t.Errorf("Called: checkpoint(%q) without Checkpoint, Expected no progress file, Got: %v", r.Name, err)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ConnectionUnknown is reported if the connection state can't be told.
+const ConnectionUnknown = "Unknown"
+
+// GetConnectionState summarizes the replication state of the resource on
+// this node: "StandAlone" without any peers, the state of the first
+// connection that isn't established, e.g. "Connecting", the first resync in
+// progress, e.g. "SyncTarget", or "Connected" if replication is healthy.
+func GetConnectionState(r Resource) string {
+	out, err := run(CmdQuery, "drbdsetup", "status", r.Name)
+	if err != nil {
+		return ConnectionUnknown
+	}
+	return doConnectionState(string(out))
+}
+
+// statusPeer is a connection listed by `drbdsetup status`.
+type statusPeer struct {
+	name string
+	// connection is only shown while the peer isn't Connected.
+	connection string
+	// replication holds the states of the peer's volumes that show one,
+	// which they do while it isn't Established.
+	replication []string
+}
+
+// Parse the connections from `drbdsetup status` output. Connection lines are
+// indented by two spaces and start with the peer's name, while the local
+// volumes' lines at the same depth start with a key such as disk: or
+// volume:. Peer device lines below a connection are indented by four.
+func doStatusPeers(status string) []statusPeer {
+	var peers []statusPeer
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(line, "  ") {
+			continue
+		}
+		peerDevice := strings.HasPrefix(line, "   ")
+		if !peerDevice {
+			if strings.Contains(fields[0], ":") {
+				continue
+			}
+			peers = append(peers, statusPeer{name: fields[0]})
+			fields = fields[1:]
+		} else if len(peers) == 0 {
+			continue
+		}
+		peer := &peers[len(peers)-1]
+		for _, f := range fields {
+			switch {
+			case !peerDevice && strings.HasPrefix(f, "connection:"):
+				peer.connection = strings.TrimPrefix(f, "connection:")
+			case strings.HasPrefix(f, "replication:"):
+				peer.replication = append(peer.replication, strings.TrimPrefix(f, "replication:"))
+			}
+		}
+	}
+	return peers
+}
+
+// Summarize the connection state from `drbdsetup status` output, as
+// GetConnectionState describes.
+func doConnectionState(status string) string {
+	if strings.TrimSpace(status) == "" {
+		return ConnectionUnknown
+	}
+
+	peers := doStatusPeers(status)
+	if len(peers) == 0 {
+		return "StandAlone"
+	}
+	for _, p := range peers {
+		if p.connection != "" && p.connection != "Connected" {
+			return p.connection
+		}
+	}
+	for _, p := range peers {
+		for _, state := range p.replication {
+			if state != "Established" {
+				return state
+			}
+		}
+	}
+	return "Connected"
+}
+
+// reconnectTimeout is how long Reconnect waits for a resource to connect,
+// and reconnectInterval how often it polls its connection state meanwhile.
+var (
+	reconnectTimeout  = time.Second * 10
+	reconnectInterval = time.Millisecond * 500
+)
+
+// Not connected states of DRBD connections, anything else GetConnectionState
+// reports is connected, if possibly still resyncing.
+var disconnectedStates = map[string]bool{
+	ConnectionUnknown: true,
+	"StandAlone":      true,
+	"Disconnecting":   true,
+	"Unconnected":     true,
+	"Timeout":         true,
+	"BrokenPipe":      true,
+	"NetworkFailure":  true,
+	"ProtocolError":   true,
+	"TearDown":        true,
+	"Connecting":      true,
+}
+
+// Reconnect connects a StandAlone resource to its peers again, e.g. after a
+// network partition, and waits briefly for it to be connected.
+func Reconnect(r Resource) error {
+	connect := func() error {
+		out, err := run(CmdAssign, "drbdadm", "connect", r.Name)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+	state := func() string { return GetConnectionState(r) }
+	if err := reconnect(connect, state, reconnectTimeout, reconnectInterval); err != nil {
+		return fmt.Errorf("DRBD: Unable to reconnect resource %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+func reconnect(connect func() error, state func() string, timeout, interval time.Duration) error {
+	if err := connect(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		current := state()
+		if !disconnectedStates[current] {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not connected within %s, still %s", timeout, current)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// inSyncInterval is how often WaitForInSync polls the out-of-sync counters.
+var inSyncInterval = time.Millisecond * 500
+
+// ErrOutOfSync is the cause of WaitForInSync errors for resources whose
+// peers still lack data after the timeout.
+var ErrOutOfSync = errors.New("data out of sync")
+
+// WaitForInSync flushes cached writes and waits up to timeout for the peers
+// of the resource to have all its data, i.e. for its out-of-sync counters to
+// reach zero.
+func WaitForInSync(r Resource, timeout time.Duration) error {
+	if out, err := run(CmdUnmount, "sync"); err != nil {
+		return fmt.Errorf("DRBD: Unable to flush writes: %w: %s", err, out)
+	}
+	outOfSync := func() (int64, error) {
+		out, err := run(CmdQuery, "drbdsetup", "status", "--statistics", r.Name)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get status: %w: %s", err, out)
+		}
+		_, kib := doVerifyProgress(string(out))
+		return kib, nil
+	}
+	if err := waitForInSync(outOfSync, timeout, inSyncInterval); err != nil {
+		return fmt.Errorf("DRBD: Resource %q %w", r.Name, err)
+	}
+	return nil
+}
+
+func waitForInSync(outOfSync func() (int64, error), timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		kib, err := outOfSync()
+		if err == nil && kib == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("still has %d KiB out of sync after %s: %w", kib, timeout, ErrOutOfSync)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDoConnectionState(t *testing.T) {
+	var connectionTests = []struct {
+		in    string
+		state string
+	}{
+		{"", ConnectionUnknown},
+		{"r0 role:Secondary\n  disk:UpToDate\n", "StandAlone"},
+		{"r0 role:Secondary\n  disk:UpToDate\n  node1 role:Primary\n    peer-disk:UpToDate\n", "Connected"},
+		{"r0 role:Secondary\n  disk:Inconsistent\n  node1 role:Primary\n" +
+			"    replication:SyncTarget peer-disk:UpToDate done:12.50\n", "SyncTarget"},
+		{"r0 role:Primary\n  volume:0 disk:UpToDate\n  volume:1 disk:UpToDate\n" +
+			"  node1 connection:Connecting\n  node2 role:Secondary\n    volume:0 replication:SyncSource peer-disk:Inconsistent\n", "Connecting"},
+		{"r0 role:Primary\n  disk:UpToDate\n  node1 connection:StandAlone\n", "StandAlone"},
+		{"r0 role:Primary\n  disk:UpToDate\n  node1 role:Secondary\n    replication:Established peer-disk:UpToDate\n", "Connected"},
+		{"r0 role:Primary\n  disk:UpToDate\n  node1 connection:Connected role:Secondary\n  node2 connection:Connecting\n", "Connecting"},
+	}
+
+	for _, tt := range connectionTests {
+		state := doConnectionState(tt.in)
+		if state != tt.state {
+			t.Errorf("Called: doConnectionState(%q), Expected: %q, Got: %q", tt.in, tt.state, state)
+		}
+	}
+}
+
+func TestDoStatusPeers(t *testing.T) {
+	status := "r0 role:Primary\n  volume:0 disk:UpToDate\n  volume:1 disk:UpToDate\n" +
+		"  node1 connection:Connecting\n  node2 role:Secondary\n" +
+		"    volume:0 replication:SyncSource peer-disk:Inconsistent\n    volume:1 peer-disk:UpToDate\n"
+	expected := []statusPeer{
+		{name: "node1", connection: "Connecting"},
+		{name: "node2", replication: []string{"SyncSource"}},
+	}
+	if peers := doStatusPeers(status); !reflect.DeepEqual(peers, expected) {
+		t.Errorf("Called: doStatusPeers(%q), Expected: %+v, Got: %+v", status, expected, peers)
+	}
+	if peers := doStatusPeers("r0 role:Secondary\n  disk:UpToDate\n"); len(peers) != 0 {
+		t.Errorf("Called: doStatusPeers() without peers, Expected: none, Got: %+v", peers)
+	}
+}
+
+func TestWaitForInSync(t *testing.T) {
+	var inSyncTests = []struct {
+		name    string
+		counts  []int64
+		err     error
+		inSync  bool
+		outSync bool
+	}{
+		{"in sync", []int64{0}, nil, true, false},
+		{"catches up", []int64{4096, 1024, 0}, nil, true, false},
+		{"never in sync", []int64{4096}, nil, false, true},
+		{"status fails", []int64{0}, errors.New("exit status 10"), false, false},
+	}
+
+	for _, tt := range inSyncTests {
+		polls := 0
+		err := waitForInSync(func() (int64, error) {
+			n := tt.counts[polls]
+			if polls < len(tt.counts)-1 {
+				polls++
+			}
+			return n, tt.err
+		}, time.Millisecond*20, time.Millisecond)
+		if (err == nil) != tt.inSync || errors.Is(err, ErrOutOfSync) != tt.outSync {
+			t.Errorf("Called: waitForInSync(%s), Expected: in sync %t, out of sync %t, Got: %v", tt.name, tt.inSync, tt.outSync, err)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var reconnectTests = []struct {
+		name       string
+		connectErr error
+		states     []string
+		ok         bool
+	}{
+		{"recovers", nil, []string{"StandAlone", "Connecting", "Connected"}, true},
+		{"recovers resyncing", nil, []string{"Connecting", "SyncTarget"}, true},
+		{"connect fails", errors.New("exit status 10"), []string{"Connected"}, false},
+		{"stays standalone", nil, []string{"StandAlone"}, false},
+	}
+
+	for _, tt := range reconnectTests {
+		polls := 0
+		state := func() string {
+			s := tt.states[polls]
+			if polls < len(tt.states)-1 {
+				polls++
+			}
+			return s
+		}
+		err := reconnect(func() error { return tt.connectErr }, state, time.Millisecond*20, time.Millisecond)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: reconnect(%s), Expected: ok %t, Got: %v", tt.name, tt.ok, err)
+		}
+	}
+}
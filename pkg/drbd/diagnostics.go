@@ -0,0 +1,130 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DiagnosticsDir is where diagnostic bundles are written, one directory each.
+var DiagnosticsDir = "/var/lib/drbd-flexvolume/diagnostics"
+
+// Limits keeping diagnostic bundles from filling the disk.
+const (
+	// maxDiagnosticBytes is how much of each source is kept, the tail end
+	// being the most interesting part of logs.
+	maxDiagnosticBytes = 64 << 10
+	// maxDiagnosticBundles is how many bundles are kept, older ones are
+	// removed when a new one is captured.
+	maxDiagnosticBundles = 10
+)
+
+// diagnosticCommands are run for a bundle, the output of each is stored in
+// the named file.
+var diagnosticCommands = []struct {
+	file string
+	cmd  []string
+}{
+	{"drbdadm-status.txt", []string{"drbdadm", "status"}},
+	{"dmesg.txt", []string{"dmesg"}},
+	{"plugin-log.txt", []string{"journalctl", "-t", "DRBD FlexVolume", "-n", "500", "--no-pager"}},
+}
+
+// diagnosticFiles are copied into a bundle under the given name.
+var diagnosticFiles = []struct {
+	file string
+	path string
+}{
+	{"proc-drbd.txt", "/proc/drbd"},
+	{"mounts.txt", "/proc/mounts"},
+}
+
+// CaptureDiagnostics writes the state relevant to a failed operation on the
+// resource to a new timestamped bundle under DiagnosticsDir and returns its
+// path. Sources that can't be read are noted in their file instead. The
+// resource names the bundle, invalid names are refused.
+func CaptureDiagnostics(resource string) (string, error) {
+	if resource != "" {
+		if err := ValidateResourceName(resource); err != nil {
+			return "", err
+		}
+	}
+	if Stateless {
+		return "", fmt.Errorf("DRBD: Diagnostic bundles are not written in stateless mode")
+	}
+	bundle := filepath.Join(DiagnosticsDir, time.Now().UTC().Format("20060102T150405.000000000Z")+"-"+resource)
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return "", fmt.Errorf("DRBD: Unable to create diagnostic bundle %s: %w", bundle, err)
+	}
+
+	for _, c := range diagnosticCommands {
+		out, err := run(CmdQuery, c.cmd[0], c.cmd[1:]...)
+		if err != nil {
+			out = append(out, fmt.Sprintf("\n%v\n", err)...)
+		}
+		writeDiagnostic(bundle, c.file, out)
+	}
+	for _, f := range diagnosticFiles {
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			data = []byte(err.Error() + "\n")
+		}
+		writeDiagnostic(bundle, f.file, data)
+	}
+
+	pruneDiagnostics(DiagnosticsDir, maxDiagnosticBundles)
+	return bundle, nil
+}
+
+func writeDiagnostic(bundle, file string, data []byte) {
+	ioutil.WriteFile(filepath.Join(bundle, file), tail(data, maxDiagnosticBytes), 0644)
+}
+
+// tail returns at most the last max bytes of data.
+func tail(data []byte, max int) []byte {
+	if len(data) <= max {
+		return data
+	}
+	return data[len(data)-max:]
+}
+
+// pruneDiagnostics removes all but the newest keep bundles in dir. Bundle
+// names start with their timestamp, so they sort by age.
+func pruneDiagnostics(dir string, keep int) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var bundles []string
+	for _, e := range entries {
+		if e.IsDir() {
+			bundles = append(bundles, e.Name())
+		}
+	}
+	sort.Strings(bundles)
+	for len(bundles) > keep {
+		os.RemoveAll(filepath.Join(dir, bundles[0]))
+		bundles = bundles[1:]
+	}
+}
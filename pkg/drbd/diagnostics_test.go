@@ -0,0 +1,88 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTail(t *testing.T) {
+	var tailTests = []struct {
+		in  string
+		max int
+		out string
+	}{
+		{"abc", 5, "abc"},
+		{"abcdef", 3, "def"},
+		{"", 3, ""},
+	}
+
+	for _, tt := range tailTests {
+		out := string(tail([]byte(tt.in), tt.max))
+		if out != tt.out {
+			t.Errorf("Called: tail(%q, %d), Expected: %q, Got: %q", tt.in, tt.max, tt.out, out)
+		}
+	}
+}
+
+func TestPruneDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, b := range []string{"20240102T000000Z-r0", "20240101T000000Z-r1", "20240103T000000Z-r0"} {
+		os.Mkdir(filepath.Join(dir, b), 0755)
+	}
+
+	pruneDiagnostics(dir, 2)
+
+	entries, _ := ioutil.ReadDir(dir)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	expected := []string{"20240102T000000Z-r0", "20240103T000000Z-r0"}
+	if !reflect.DeepEqual(left, expected) {
+		t.Errorf("Called: pruneDiagnostics(%q, 2), Expected: %v, Got: %v", dir, expected, left)
+	}
+}
+
+func TestCaptureDiagnosticsInvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := DiagnosticsDir
+	DiagnosticsDir = filepath.Join(dir, "bundles")
+	defer func() { DiagnosticsDir = oldDir }()
+
+	if bundle, err := CaptureDiagnostics("../../r0"); err == nil {
+		t.Errorf("Called: CaptureDiagnostics(%q), Expected: error, Got: %s", "../../r0", bundle)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Called: CaptureDiagnostics(%q), Expected: nothing created, Got: %d entries", "../../r0", len(entries))
+	}
+}
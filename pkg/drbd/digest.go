@@ -0,0 +1,120 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// digestSections are the sections of a resource's configuration whose
+// options feed into its digest.
+var digestSections = map[string]bool{"net": true, "disk": true, "options": true}
+
+// digestExcluded options never feed into the digest, they hold secrets.
+var digestExcluded = map[string]bool{"net.shared-secret": true}
+
+// ConfigDigest is a stable hash of a resource's effective configuration.
+type ConfigDigest struct {
+	Digest string `json:"digest"`
+	// Fields lists exactly what was hashed, one "key=value" per entry.
+	Fields []string `json:"fields"`
+}
+
+// GetConfigDigest hashes the configuration of the resource as DRBD sees it.
+// The digest covers:
+//   - replicas: the number of hosts the resource is configured on
+//   - hosts: the sorted host names
+//   - protocol: the replication protocol, C if not set explicitly
+//   - every option in the net, disk and options sections, except
+//     shared-secret, as "<section>.<option>=<value>"
+func GetConfigDigest(r Resource) (ConfigDigest, error) {
+	out, err := run(CmdQuery, "drbdadm", "dump", r.Name)
+	if err != nil {
+		return ConfigDigest{}, fmt.Errorf("DRBD: Unable to get configuration of resource %q: %w: %s", r.Name, err, out)
+	}
+	return doConfigDigest(string(out))
+}
+
+// Compute the digest from the output of `drbdadm dump <resource>`.
+func doConfigDigest(config string) (ConfigDigest, error) {
+	var hosts, fields []string
+	var stack []string
+	protocol := "C"
+	inResource := false
+
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(line, "{"):
+			words := strings.Fields(strings.TrimSuffix(line, "{"))
+			if len(words) == 0 {
+				return ConfigDigest{}, fmt.Errorf("DRBD: Malformed configuration line %q", line)
+			}
+			if words[0] == "resource" {
+				inResource = true
+			} else if len(stack) == 1 && words[0] == "on" && len(words) > 1 {
+				hosts = append(hosts, words[1])
+			}
+			stack = append(stack, words[0])
+		case line == "}":
+			if len(stack) == 0 {
+				return ConfigDigest{}, fmt.Errorf("DRBD: Unbalanced braces in configuration")
+			}
+			stack = stack[:len(stack)-1]
+		case len(stack) == 2 && digestSections[stack[1]]:
+			words := strings.Fields(strings.TrimSuffix(line, ";"))
+			key := stack[1] + "." + words[0]
+			value := strings.Join(words[1:], " ")
+			if key == "net.protocol" {
+				protocol = value
+				continue
+			}
+			if !digestExcluded[key] {
+				fields = append(fields, key+"="+value)
+			}
+		}
+	}
+
+	if !inResource {
+		return ConfigDigest{}, fmt.Errorf("DRBD: No resource found in configuration")
+	}
+
+	sort.Strings(hosts)
+	sort.Strings(fields)
+	fields = append([]string{
+		"replicas=" + strconv.Itoa(len(hosts)),
+		"hosts=" + strings.Join(hosts, ","),
+		"protocol=" + protocol,
+	}, fields...)
+
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return ConfigDigest{Digest: hex.EncodeToString(sum[:]), Fields: fields}, nil
+}
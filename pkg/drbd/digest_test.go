@@ -0,0 +1,101 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"reflect"
+	"testing"
+)
+
+const dumpR0 = `# resource r0 on node0: not ignored, not stacked
+# defined at /var/lib/drbd.d/drbdmanage_r0.res:2
+resource r0 {
+    template-file /var/lib/drbd.d/drbdmanage_global_common.conf;
+    net {
+        allow-two-primaries no;
+        shared-secret    "s3cr3t";
+        cram-hmac-alg    sha1;
+    }
+    on node1 {
+        node-id 1;
+        volume 0 {
+            device       minor 100;
+            disk         /dev/drbdpool/r0_00;
+            meta-disk    internal;
+        }
+        address          ipv4 10.0.0.2:7000;
+    }
+    on node0 {
+        node-id 0;
+        volume 0 {
+            device       minor 100;
+            disk         /dev/drbdpool/r0_00;
+            meta-disk    internal;
+        }
+        address          ipv4 10.0.0.1:7000;
+    }
+    connection-mesh {
+        hosts node0 node1;
+    }
+}
+`
+
+func TestDoConfigDigest(t *testing.T) {
+	d, err := doConfigDigest(dumpR0)
+	if err != nil {
+		t.Fatalf("Called: doConfigDigest(dumpR0), Unexpected error: %v", err)
+	}
+
+	fields := []string{
+		"replicas=2",
+		"hosts=node0,node1",
+		"protocol=C",
+		"net.allow-two-primaries=no",
+		"net.cram-hmac-alg=sha1",
+	}
+	if !reflect.DeepEqual(d.Fields, fields) {
+		t.Errorf("Called: doConfigDigest(dumpR0), Expected fields: %q, Got: %q", fields, d.Fields)
+	}
+
+	// Secrets and comments must not change the digest.
+	other, _ := doConfigDigest("# dumped elsewhere\n" + dumpR0[:len(dumpR0)-2] + "}\n")
+	if other.Digest != d.Digest {
+		t.Errorf("Called: doConfigDigest on the same configuration, Expected: %q, Got: %q", d.Digest, other.Digest)
+	}
+
+	async, _ := doConfigDigest(`resource r0 {
+    net {
+        protocol A;
+        allow-two-primaries no;
+        cram-hmac-alg    sha1;
+    }
+    on node0 {
+    }
+    on node1 {
+    }
+}
+`)
+	if async.Digest == d.Digest || async.Fields[2] != "protocol=A" {
+		t.Errorf("Called: doConfigDigest with protocol A, Expected a different digest with %q, Got: %q", "protocol=A", async.Fields)
+	}
+
+	if _, err := doConfigDigest(""); err == nil {
+		t.Errorf("Called: doConfigDigest(%q), Expected an error, Got: nil", "")
+	}
+}
@@ -19,11 +19,16 @@
 package drbd
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -31,163 +36,1257 @@ type Resource struct {
 	Name     string
 	NodeName string
 	ReadOnly bool
+	// Checkpoint reports the progress of waiting on the resource to a file
+	// under CheckpointDir.
+	Checkpoint bool
+	// MinPoolFree is the free space in bytes the node's storage pool must
+	// have for the resource to be assigned. Zero disables the check.
+	MinPoolFree int64
+	// MaxOverCommit is the over-commit ratio of ThinPool above which the
+	// resource is not assigned. Zero disables the check.
+	MaxOverCommit float64
+	// Diskless assigns the resource as a client without local storage.
+	// Otherwise local storage is provisioned on the node.
+	Diskless bool
+	// SharedSecret authenticates the resource's connections to its peers,
+	// it is configured before the resource is assigned and never logged.
+	SharedSecret string
+	// PlacementCount, if set, is the number of diskful replicas deployed
+	// by the backend when the resource is assigned without having any.
+	PlacementCount int
+	// StoragePool is the pool diskful replicas are provisioned from, the
+	// backend's default if empty. Only LINSTOR supports pools.
+	StoragePool string
+	// Size is the size in bytes of the volume of a resource that doesn't
+	// exist yet, which is then created with PlacementCount replicas.
+	Size int64
 }
 
 type Mounter struct {
 	*Resource
 	FSType string
+	// SafeFormat creates a filesystem of FSType on blank devices before
+	// mounting them. Without it, mounting a blank device fails.
+	SafeFormat bool
+	// MountOptions are passed to mount with -o.
+	MountOptions []string
+	// FSGroup, if set, is made the group owner of everything on read-write
+	// mounts, with read and write access for the group.
+	FSGroup *int64
+	// ReservedBlocksPercent is passed to mkfs as the percentage of blocks
+	// reserved for the super-user when a fresh ext filesystem is created.
+	// Empty means use the mkfs default.
+	ReservedBlocksPercent string
+	// DiscardAfterFormat trims the whole filesystem after a fresh format has
+	// been mounted, returning unused blocks to thin or SSD backed storage.
+	DiscardAfterFormat bool
+	// DurableFormat disables lazy metadata initialization for ext
+	// filesystems and syncs the device before mounting it. This makes
+	// formatting much slower on large devices.
+	DurableFormat bool
+	// FullThresholdPercent is the filesystem usage, in percent, above which
+	// a mounted filesystem is considered full. Zero disables the check.
+	FullThresholdPercent float64
+	// RefuseFull unmounts and fails instead of warning when the filesystem
+	// is above FullThresholdPercent.
+	RefuseFull bool
+	// ReleaseTimeout is how long UnMount waits for the device to no longer
+	// be held open after unmounting.
+	ReleaseTimeout time.Duration
+	// MkfsOptions are passed to mkfs after the arguments the Mounter derives
+	// itself, only when a blank device is formatted.
+	MkfsOptions []string
+	// SubPath, if set, is the directory of the volume mounted at the path
+	// instead of the whole volume. The device is then mounted below
+	// StagingDir and the directory bind-mounted, created if missing.
+	SubPath string
+	// FSLabel is the label given to a fresh filesystem.
+	FSLabel string
+	// Relabel sets FSLabel on existing filesystems too, on read-write
+	// mounts.
+	Relabel bool
+	// PromoteTimeout is how long Mount retries promoting the resource while
+	// another node holds it Primary. Zero fails right away.
+	PromoteTimeout time.Duration
+	// BlockMode links the device at the path instead of mounting a
+	// filesystem, for volumes used as raw block devices. FSType is unused.
+	BlockMode bool
+	// FsckOnMount checks and repairs existing filesystems with fsck -p
+	// before read-write mounts, e.g. after an unclean shutdown.
+	FsckOnMount bool
+	// PreMountHook, if set, is an executable run with the device and the
+	// path before mounting. Mounting fails if it exits nonzero.
+	PreMountHook string
+	// StagedMount mounts and prepares the device below StagingDir and only
+	// bind-mounts it at the path once that succeeded, so the path never
+	// shows a half-prepared volume. Unused in BlockMode.
+	StagedMount bool
 }
 
-func (m Mounter) Mount(path string) error {
+// MountResult describes what Mount did to the device.
+type MountResult struct {
+	// Device is the path of the mounted device.
+	Device string
+	// Formatted is true if a new filesystem was created on the device.
+	Formatted bool
+	// ReservedBlocksPercent is the reserved-blocks percentage applied during
+	// formatting, empty if none was applied.
+	ReservedBlocksPercent string
+	// FSLabel is the label the filesystem was formatted or relabeled with,
+	// empty if it wasn't.
+	FSLabel string
+	// Warning is set if the filesystem was mounted despite being full.
+	Warning string
+	// DeviceOpenRetries is how often opening the device had to be retried
+	// while waiting for udev to create its node.
+	DeviceOpenRetries int
+}
+
+// Causes of a MountError, telling which step of mounting failed.
+var (
+	ErrDeviceNotReady   = errors.New("device not ready")
+	ErrFormatFailed     = errors.New("format failed")
+	ErrAlreadyMounted   = errors.New("device busy or already mounted")
+	ErrWrongFSType      = errors.New("wrong filesystem type")
+	ErrFilesystemFull   = errors.New("filesystem full")
+	ErrPrimaryElsewhere = errors.New("primary on another node")
+	ErrMountFailed      = errors.New("mount failed")
+	ErrPreMountFailed   = errors.New("pre-mount check failed")
+)
+
+// MountError is returned by Mounter.Mount. Cause is one of the Err* values
+// above, Err is the underlying error.
+type MountError struct {
+	Cause error
+	Err   error
+}
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("unable to mount device: %v", e.Err)
+}
+
+// Mount mounts the resource's device at path. For read-write mounts the
+// resource is promoted to Primary first and demoted again if mounting fails.
+// In BlockMode the device is linked at path instead.
+func (m Mounter) Mount(path string) (MountResult, error) {
+	if err := CheckModule(); err != nil {
+		return MountResult{}, err
+	}
+	if m.SubPath != "" || m.StagedMount && !m.BlockMode {
+		return m.mountSubPath(path)
+	}
+	mount := m.mount
+	if m.BlockMode {
+		mount = m.mountBlock
+	}
+	result, promoted, err := mount(path)
+	if err != nil && promoted {
+		if err := m.Resource.Demote(); err != nil {
+			log.Printf("DRBD: %v", err)
+		}
+	}
+	return result, err
+}
+
+func (m Mounter) mount(path string) (MountResult, bool, error) {
 	device, err := WaitForDevPath(*m.Resource, 3)
 	if err != nil {
-		return fmt.Errorf("unable to mount device, couldn't find Resource device path: %v", err)
+		return MountResult{}, false, &MountError{ErrDeviceNotReady, fmt.Errorf("couldn't find Resource device path: %w", err)}
+	}
+
+	retries, err := waitForDeviceNode(device, deviceOpenRetries, time.Millisecond*500, openDevice)
+	if err != nil {
+		return MountResult{Device: device, DeviceOpenRetries: retries}, false, &MountError{ErrDeviceNotReady, err}
+	}
+
+	if err := mountDir(path); err != nil {
+		return MountResult{Device: device, DeviceOpenRetries: retries}, false, &MountError{ErrMountFailed, err}
+	}
+
+	if !m.ReadOnly {
+		if err := m.promote(); err != nil {
+			return MountResult{Device: device, DeviceOpenRetries: retries}, false, &MountError{promoteFailure(err), err}
+		}
+	}
+
+	result, err := m.safeFormat(device)
+	result.Device = device
+	result.DeviceOpenRetries = retries
+	if err != nil {
+		var me *MountError
+		if !errors.As(err, &me) {
+			me = &MountError{ErrFormatFailed, err}
+		}
+		return result, !m.ReadOnly, me
+	}
+
+	if err := m.preMount(device, path, result.Formatted); err != nil {
+		return result, !m.ReadOnly, &MountError{ErrPreMountFailed, err}
+	}
+
+	out, err := run(CmdMount, "mount", m.mountArgs(device, path)...)
+	if err != nil {
+		return result, !m.ReadOnly, &MountError{mountFailure(string(out)), fmt.Errorf("%w: %s", err, out)}
+	}
+
+	if err := m.checkMountMode(path); err != nil {
+		m.UnMount(path)
+		return result, !m.ReadOnly, &MountError{ErrMountFailed, fmt.Errorf("%s: %w", device, err)}
+	}
+
+	if err := m.setFSGroup(path, groupOwned, func(name string, args ...string) ([]byte, error) {
+		return run(CmdChown, name, args...)
+	}); err != nil {
+		m.UnMount(path)
+		return result, !m.ReadOnly, &MountError{ErrMountFailed, err}
+	}
+
+	if result.Formatted && m.DiscardAfterFormat {
+		discard(device, path)
+	}
+
+	if m.FullThresholdPercent > 0 {
+		used, err := fsUsedPercent(path)
+		if err != nil {
+			log.Printf("DRBD: unable to check filesystem usage of %s: %v", path, err)
+		} else if used >= m.FullThresholdPercent {
+			if m.RefuseFull {
+				m.UnMount(path)
+				return result, !m.ReadOnly, &MountError{ErrFilesystemFull, fmt.Errorf("refusing to mount device %s, filesystem is %.1f%% full (threshold %.1f%%)", device, used, m.FullThresholdPercent)}
+			}
+			result.Warning = fmt.Sprintf("filesystem on %s is %.1f%% full (threshold %.1f%%)", device, used, m.FullThresholdPercent)
+		}
+	}
+
+	return result, !m.ReadOnly, nil
+}
+
+// setFSGroup gives FSGroup ownership of the filesystem mounted at path.
+// Walking large filesystems is slow, so nothing is changed if the mount
+// point already belongs to the group.
+func (m Mounter) setFSGroup(path string, owned func(string, int64) bool, runCmd func(string, ...string) ([]byte, error)) error {
+	if m.FSGroup == nil || m.ReadOnly {
+		return nil
+	}
+	gid := *m.FSGroup
+	if owned(path, gid) {
+		return nil
+	}
+
+	gidArg := strconv.FormatInt(gid, 10)
+	if out, err := runCmd("chgrp", "-R", gidArg, path); err != nil {
+		return fmt.Errorf("unable to change group of %s to %s: %w: %s", path, gidArg, err, out)
+	}
+	if out, err := runCmd("chmod", "-R", "g+rwX", path); err != nil {
+		return fmt.Errorf("unable to make %s group-writable: %w: %s", path, err, out)
+	}
+	return nil
+}
+
+// groupOwned reports whether path belongs to gid and is group-writable.
+func groupOwned(path string, gid int64) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return int64(st.Gid) == gid && fi.Mode().Perm()&0070 == 0070
+}
+
+// mountFailure tells the cause of a failed mount from its output.
+func mountFailure(out string) error {
+	switch {
+	case strings.Contains(out, "already mounted"), strings.Contains(out, "busy"):
+		return ErrAlreadyMounted
+	case strings.Contains(out, "wrong fs type"), strings.Contains(out, "unknown filesystem type"):
+		return ErrWrongFSType
+	}
+	return ErrMountFailed
+}
+
+// mountArgs builds the arguments used to mount device at path. Read-only
+// mounts never open the device for writing, so DRBD doesn't auto-promote the
+// resource to Primary for them.
+func (m Mounter) mountArgs(device, path string) []string {
+	var opts []string
+	if m.ReadOnly && !containsString(m.MountOptions, "ro") {
+		opts = append(opts, "ro")
+	}
+	opts = append(opts, m.MountOptions...)
+	for _, o := range handlerFor(m.FSType).mountOptions() {
+		if !containsString(opts, o) {
+			opts = append(opts, o)
+		}
+	}
+	if len(opts) == 0 {
+		return []string{device, path}
+	}
+	return []string{"-o", strings.Join(opts, ","), device, path}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMountMode makes sure the filesystem at path was mounted read-only or
+// read-write as requested. Filesystems already mounted elsewhere may silently
+// ignore the requested mode.
+func (m Mounter) checkMountMode(path string) error {
+	mounts, err := Exec.ReadFile("/proc/mounts")
+	if err != nil {
+		return fmt.Errorf("unable to verify mount mode: %w", err)
+	}
+	mode, err := doMountMode(string(mounts), path)
+	if err != nil {
+		return err
+	}
+
+	requested := "rw"
+	if m.ReadOnly {
+		requested = "ro"
+	}
+	if mode != requested {
+		return fmt.Errorf("requested %s mount, but %s is mounted %s", requested, path, mode)
+	}
+	return nil
+}
+
+// Parse whether path is mounted "ro" or "rw" from the contents of
+// /proc/mounts. The last entry for path is the one visible there.
+func doMountMode(mounts, path string) (string, error) {
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	mode := ""
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || unescape.Replace(fields[1]) != path {
+			continue
+		}
+		for _, o := range strings.Split(fields[3], ",") {
+			if o == "ro" || o == "rw" {
+				mode = o
+			}
+		}
+	}
+	if mode == "" {
+		return "", fmt.Errorf("%s not found in mount table", path)
+	}
+	return mode, nil
+}
+
+// deviceOpenRetries bounds how often opening a device node is retried.
+const deviceOpenRetries = 10
+
+func openDevice(device string) error {
+	return Exec.OpenDevice(device)
+}
+
+// waitForDeviceNode retries open while it fails because udev hasn't caught
+// up with the device yet, returning the number of retries needed.
+func waitForDeviceNode(device string, maxRetries int, interval time.Duration, open func(string) error) (int, error) {
+	var err error
+	for i := 0; i <= maxRetries; i++ {
+		err = open(device)
+		if err == nil {
+			return i, nil
+		}
+		if !isTransientOpenErr(err) {
+			return i, fmt.Errorf("couldn't open %s: %w", device, err)
+		}
+		if i < maxRetries {
+			time.Sleep(interval)
+		}
+	}
+	return maxRetries, fmt.Errorf("device node %s never became available after %d retries: %w", device, maxRetries, err)
+}
+
+func isTransientOpenErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOENT || err == syscall.ENXIO
+}
+
+func fsUsedPercent(path string) (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return usedPercent(stat.Blocks, stat.Bfree, stat.Bavail), nil
+}
+
+// usedPercent computes filesystem usage the same way df does: blocks
+// reserved for the super-user count neither as used nor as available.
+func usedPercent(blocks, free, avail uint64) float64 {
+	used := blocks - free
+	if used+avail == 0 {
+		return 0
+	}
+	return float64(used) / float64(used+avail) * 100
+}
+
+// discard trims the filesystem mounted at path. Failures are only logged,
+// a missed discard never causes the mount to fail.
+func discard(device, path string) {
+	if !discardSupported(device) {
+		log.Printf("DRBD: %s does not support discard, skipping discard after format", device)
+		return
+	}
+
+	out, err := run(CmdDiscard, "fstrim", path)
+	if err != nil {
+		log.Printf("DRBD: discard after format of %s failed: %v: %s", device, err, out)
+	}
+}
+
+func discardSupported(device string) bool {
+	out, err := Exec.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "queue/discard_max_bytes"))
+	if err != nil {
+		return false
+	}
+	return doDiscardSupported(string(out))
+}
+
+// Parse the contents of /sys/block/<dev>/queue/discard_max_bytes.
+func doDiscardSupported(s string) bool {
+	maxBytes, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return false
+	}
+	return maxBytes > 0
+}
+
+func (m Mounter) UnMount(path string) error {
+	// Block volumes are linked, not mounted.
+	if device := linkedDevice(path); device != "" {
+		return m.unmountBlock(path, device)
+	}
+
+	// If the path isn't a directory, we're not mounted there.
+	_, err := run(CmdQuery, "test", "-d", path)
+	if err != nil {
+		return nil
+	}
+
+	// If the path isn't mounted, then we're not mounted, but the Kubelet
+	// still takes a leftover mount point for a present volume.
+	out, err := run(CmdQuery, "findmnt", "-n", "-f", "-o", "SOURCE", path)
+	if err != nil {
+		removeMountPoint(path)
+		return nil
+	}
+	device := strings.TrimSpace(string(out))
+	// Bind mounts of sub paths have the bound directory appended, e.g.
+	// /dev/drbd100[/data].
+	if i := strings.Index(device, "["); i > 0 {
+		device = device[:i]
+	}
+
+	err = unmountAndRemove(path,
+		func() (bool, error) {
+			mounts, err := Exec.ReadFile("/proc/mounts")
+			return pathMounted(string(mounts), path), err
+		},
+		func() ([]byte, error) { return run(CmdUnmount, "umount", path) },
+		unmountRetryDelay)
+	if err != nil {
+		return err
+	}
+
+	if _, err := getMinorFromDevice(device); err != nil {
+		return nil
+	}
+
+	// Bind mounts leave the device mounted elsewhere, it stays Primary.
+	// Once the last sub path is gone, its staging mount goes as well.
+	if mounts, err := Exec.ReadFile("/proc/mounts"); err == nil && deviceMounted(string(mounts), device) {
+		staging, ok := stagedOnly(string(mounts), device)
+		if !ok {
+			return nil
+		}
+		err := unmountAndRemove(staging,
+			func() (bool, error) {
+				mounts, err := Exec.ReadFile("/proc/mounts")
+				return pathMounted(string(mounts), staging), err
+			},
+			func() ([]byte, error) { return run(CmdUnmount, "umount", staging) },
+			unmountRetryDelay)
+		if err != nil {
+			return err
+		}
+	}
+
+	return releaseAndDemote(
+		func() error { return waitForRelease(device, m.ReleaseTimeout) },
+		func() error { return m.demoteDevice(device) })
+}
+
+// demoteDevice demotes the resource, looked up by its device if the Mounter
+// has none.
+func (m Mounter) demoteDevice(device string) error {
+	r := m.Resource
+	if r == nil || r.Name == "" {
+		name, err := getResFromDevice(device)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return fmt.Errorf("DRBD: No resource found for device %s", device)
+		}
+		r = &Resource{Name: name}
+	}
+	return r.Demote()
+}
+
+// unmountRetryDelay is how long UnMount waits before retrying an unmount that
+// failed because the filesystem was busy.
+var unmountRetryDelay = time.Second * 2
+
+// unmountAndRemove unmounts path, retrying once if it is busy, and removes
+// the mount point once it is verified to be unmounted. Paths that are not
+// mounted are not unmounted again, only removed.
+func unmountAndRemove(path string, mounted func() (bool, error), umount func() ([]byte, error), retryDelay time.Duration) error {
+	if ok, err := mounted(); err == nil && !ok {
+		removeMountPoint(path)
+		return nil
+	}
+
+	out, err := umount()
+	if err != nil && unmountBusy(string(out)) {
+		time.Sleep(retryDelay)
+		out, err = umount()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to unmount device: %w: %s", err, out)
+	}
+
+	// Stacked mounts leave the path mounted, never remove what's below.
+	if ok, err := mounted(); err != nil || ok {
+		return fmt.Errorf("unable to unmount device: %s is still mounted", path)
+	}
+	removeMountPoint(path)
+	return nil
+}
+
+// unmountBusy reports whether umount failed because the filesystem is in use.
+func unmountBusy(out string) bool {
+	return strings.Contains(out, "target is busy") || strings.Contains(out, "device is busy")
+}
+
+// removeMountPoint removes the mount point directory if it is empty. Failing
+// to do so doesn't fail the unmount; the Kubelet cleans up after it too.
+func removeMountPoint(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to remove mount point %s: %v", path, err)
+	}
+}
+
+// pathMounted reports whether something is mounted at path according to
+// mounts, the contents of /proc/mounts, which escapes spaces in paths.
+func pathMounted(mounts, path string) bool {
+	escaped := strings.Replace(path, " ", "\\040", -1)
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == escaped {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAndDemote waits for the device to be released and demotes its
+// resource afterwards, even if the device is still held open, so that a
+// resource is never left Primary just because the wait failed.
+func releaseAndDemote(release, demote func() error) error {
+	releaseErr := release()
+	demoteErr := demote()
+	switch {
+	case releaseErr != nil && demoteErr != nil:
+		return fmt.Errorf("%v; %v", releaseErr, demoteErr)
+	case releaseErr != nil:
+		return releaseErr
+	}
+	return demoteErr
+}
+
+// IsMounted reports whether the resource's device is mounted anywhere on
+// this node.
+func IsMounted(r Resource) (bool, error) {
+	device, err := DevicePath(r)
+	if err != nil {
+		return false, err
+	}
+	mounts, err := Exec.ReadFile("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	return deviceMounted(string(mounts), device), nil
+}
+
+// deviceMounted reports whether device is mounted anywhere according to the
+// contents of /proc/mounts.
+func deviceMounted(mounts, device string) bool {
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == device {
+			return true
+		}
+	}
+	return false
+}
+
+// Promote makes the resource Primary on this node.
+func (r Resource) Promote() error {
+	out, err := run(CmdAssign, "drbdadm", "primary", r.Name)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to promote resource %q: %w: %s", r.Name, err, out)
+	}
+	return nil
+}
+
+// Demote makes the resource Secondary on this node.
+func (r Resource) Demote() error {
+	out, err := run(CmdAssign, "drbdadm", "secondary", r.Name)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to demote resource %q: %w: %s", r.Name, err, out)
+	}
+	return nil
+}
+
+// mountDir makes sure there is a directory to mount on at path, creating it
+// and its parents if missing. An existing directory, e.g. a mount point, is
+// left as it is.
+func mountDir(path string) error {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return fmt.Errorf("mount path %s exists, but is not a directory", path)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("unable to check mount path %s: %w", path, err)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to make mount directory: %w", err)
+	}
+	return nil
+}
+
+// promoteInterval and promoteMaxInterval are the first and the longest wait
+// between attempts to promote a resource that is Primary on another node.
+var (
+	promoteInterval    = time.Millisecond * 500
+	promoteMaxInterval = time.Second * 4
+)
+
+// promote makes the resource Primary. Another node holding it Primary may be
+// about to let go of it, e.g. during a failover, so that is retried for up to
+// PromoteTimeout.
+func (m Mounter) promote() error {
+	return promoteWithRetry(m.Resource.Promote, Backoff{
+		Timeout:     m.PromoteTimeout,
+		Interval:    promoteInterval,
+		MaxInterval: promoteMaxInterval,
+	}, time.Sleep)
+}
+
+func promoteWithRetry(promote func() error, b Backoff, sleep func(time.Duration)) error {
+	var err error
+	ok := b.Poll(func(attempt, attempts int) bool {
+		err = promote()
+		if err == nil || promoteFailure(err) != ErrPrimaryElsewhere {
+			return true
+		}
+		if attempt+1 < attempts {
+			log.Printf("retrying promotion %d of %d, another node is Primary: %v", attempt+1, attempts-1, err)
+		}
+		return false
+	}, sleep)
+	if !ok && b.Timeout > 0 {
+		return fmt.Errorf("gave up after %s: %w", b.Timeout, err)
+	}
+	return err
+}
+
+// promoteFailure tells why promoting a resource failed.
+func promoteFailure(err error) error {
+	msg := err.Error()
+	if strings.Contains(msg, "Multiple primaries not allowed") || strings.Contains(msg, "refused by peer") {
+		return ErrPrimaryElsewhere
+	}
+	return ErrMountFailed
+}
+
+// waitForRelease waits up to timeout for anything still holding device open
+// to let go of it, so that the device can be detached.
+func waitForRelease(device string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		holders := deviceHolders(device)
+		if len(holders) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("unmounted, but device %s is still held open by: %s", device, strings.Join(holders, ", "))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// deviceHolders lists the stacked block devices and processes that have
+// device open.
+func deviceHolders(device string) []string {
+	var holders []string
+
+	stacked, _ := Exec.ReadDir(filepath.Join("/sys/block", filepath.Base(device), "holders"))
+	holders = append(holders, stacked...)
+
+	// fuser exits nonzero if nobody has the device open.
+	out, err := run(CmdQuery, "fuser", device)
+	if err == nil {
+		for _, pid := range doFuserPIDs(string(out)) {
+			holders = append(holders, "pid "+pid)
+		}
+	}
+
+	return holders
+}
+
+// Parse the process IDs from the output of `fuser <device>`, which looks like
+// "/dev/drbd100:  1234  5678".
+func doFuserPIDs(s string) []string {
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s = s[i+1:]
+	}
+	var pids []string
+	for _, f := range strings.Fields(s) {
+		// fuser appends access type letters such as "c" or "m" to the PID.
+		pid := strings.TrimRight(f, "cerfFm")
+		if _, err := strconv.Atoi(pid); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+func (m Mounter) safeFormat(path string) (MountResult, error) {
+	// If there's no filesystem, then we'll have a nonzero exit code, but no
+	// output, formatNeeded handles this case.
+	out, _ := run(CmdQuery, "blkid", "-o", "udev", path)
+
+	result, err := m.format(path, string(out), func(args []string) ([]byte, error) {
+		return run(CmdMkfs, "mkfs", args...)
+	})
+	if err != nil || result.Formatted {
+		return result, err
+	}
+
+	relabeled, err := m.relabel(path, string(out), func(args []string) ([]byte, error) {
+		return run(CmdMkfs, args[0], args[1:]...)
+	})
+	if relabeled {
+		result.FSLabel = m.FSLabel
+	}
+	return result, err
+}
+
+// relabel gives the existing filesystem at path, as told by blkid, FSLabel
+// if Relabel is set and it has another label. It reports whether it did.
+func (m Mounter) relabel(path, blkid string, label func(args []string) ([]byte, error)) (bool, error) {
+	if !m.Relabel || m.FSLabel == "" || m.ReadOnly {
+		return false, nil
+	}
+	deviceFS, err := doCheckFSType(blkid)
+	if err != nil || deviceFS == "" || doFSLabel(blkid) == m.FSLabel {
+		return false, err
+	}
+	if err := CheckFSLabel(deviceFS, m.FSLabel); err != nil {
+		return false, err
+	}
+
+	out, err := label(handlerFor(deviceFS).relabelArgs(path, m.FSLabel))
+	if err != nil {
+		return false, fmt.Errorf("couldn't relabel %s filesystem: %w: %s", deviceFS, err, out)
+	}
+	return true, nil
+}
+
+// format runs mkfs on the device at path if blkid tells it is blank.
+func (m Mounter) format(path, blkid string, mkfs func(args []string) ([]byte, error)) (MountResult, error) {
+	format, err := m.formatNeeded(path, blkid)
+	if err != nil || !format {
+		return MountResult{}, err
+	}
+
+	args, result := m.mkfsArgs(path)
+	out, err := mkfs(args)
+	if err != nil {
+		return MountResult{}, fmt.Errorf("couldn't create %s filesystem: %w: %s", m.FSType, err, out)
+	}
+
+	if m.DurableFormat {
+		syscall.Sync()
+	}
+
+	return result, nil
+}
+
+// formatNeeded decides from the output of `blkid -o udev` whether the device
+// at path needs a new filesystem. Devices carrying any signature blkid knows
+// are never formatted.
+func (m Mounter) formatNeeded(path, blkid string) (bool, error) {
+	deviceFS, err := doCheckFSType(blkid)
+	if err != nil {
+		return false, fmt.Errorf("unable to format filesystem for %q: %w", path, err)
+	}
+
+	if deviceFS != "" {
+		if m.FSType != "" && deviceFS != m.FSType {
+			return false, &MountError{ErrWrongFSType, fmt.Errorf("device %q already formatted with %q filesystem, refusing to overwrite with %q filesystem", path, deviceFS, m.FSType)}
+		}
+		// Device is formatted correctly already.
+		return false, nil
+	}
+
+	switch {
+	case m.ReadOnly:
+		return false, fmt.Errorf("device %q has no filesystem, refusing to format it for a read-only mount", path)
+	case !m.SafeFormat:
+		return false, fmt.Errorf("device %q has no filesystem and formatting is disabled", path)
+	case m.FSType == "":
+		return false, fmt.Errorf("device %q has no filesystem and no filesystem type was given", path)
+	}
+	return true, nil
+}
+
+// mkfsArgs builds the arguments used to create a fresh filesystem on device.
+func (m Mounter) mkfsArgs(device string) ([]string, MountResult) {
+	fsArgs, result := handlerFor(m.FSType).mkfsArgs(m)
+	result.Formatted = true
+	args := append([]string{"-t", m.FSType}, fsArgs...)
+	if m.FSLabel != "" {
+		args = append(args, "-L", m.FSLabel)
+		result.FSLabel = m.FSLabel
+	}
+	args = append(args, m.MkfsOptions...)
+	return append(args, device), result
+}
+
+func isExtFS(fsType string) bool {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return true
+	}
+	return false
+}
+
+const fieldSep = ","
+
+// Backoff is a polling schedule: the first retry waits Interval, each one
+// after that twice as long as the one before, up to MaxInterval, for as long
+// as the waits add up to no more than Timeout.
+type Backoff struct {
+	Timeout     time.Duration
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// delays returns how long to wait before each retry.
+func (b Backoff) delays() []time.Duration {
+	var delays []time.Duration
+	var total time.Duration
+	for d := b.Interval; d > 0 && total+d <= b.Timeout; {
+		delays = append(delays, d)
+		total += d
+		d *= 2
+		if b.MaxInterval > 0 && d > b.MaxInterval {
+			d = b.MaxInterval
+		}
+	}
+	return delays
+}
+
+// Poll calls try until it succeeds or the schedule runs out, reporting
+// whether it succeeded. try is told its attempt and the number of attempts.
+func (b Backoff) Poll(try func(attempt, attempts int) bool, sleep func(time.Duration)) bool {
+	delays := b.delays()
+	for i := 0; ; i++ {
+		if try(i, len(delays)+1) {
+			return true
+		}
+		if i == len(delays) {
+			return false
+		}
+		sleep(delays[i])
+	}
+}
+
+// DevPathInterval and DevPathMaxInterval are the first and the longest wait
+// between polls for a device.
+var (
+	DevPathInterval    = time.Millisecond * 250
+	DevPathMaxInterval = time.Second * 2
+)
+
+// WaitForDevPath polls for the device of the resource for as long as
+// maxRetries polls two seconds apart would take, polling more often at first.
+func WaitForDevPath(r Resource, maxRetries int) (string, error) {
+	if maxRetries <= 0 {
+		return "", nil
+	}
+	return WaitForDevPathBackoff(r, Backoff{
+		Timeout:     time.Duration(maxRetries) * time.Second * 2,
+		Interval:    DevPathInterval,
+		MaxInterval: DevPathMaxInterval,
+	})
+}
+
+// WaitForDevPathBackoff polls for the device of the resource as scheduled
+// by b, returning as soon as it is known.
+func WaitForDevPathBackoff(r Resource, b Backoff) (string, error) {
+	var path string
+	var err error
+
+	defer clearCheckpoint(r)
+	b.Poll(func(attempt, attempts int) bool {
+		checkpoint(r, "waiting for device", attempt, attempts)
+		path, err = getDevPath(r)
+		return path != ""
+	}, time.Sleep)
+	return path, err
+}
+
+func getDevPath(r Resource) (string, error) {
+	devicePath, err := DevicePath(r)
+	if err != nil {
+		if dryRunAssumes(fmt.Sprintf("resource %q has a device", r.Name), err) {
+			return dryRunDevicePath(r), nil
+		}
+		return "", err
+	}
+
+	if err := Exec.Stat(devicePath); err != nil {
+		if dryRunAssumes(devicePath+" exists", err) {
+			return devicePath, nil
+		}
+		return "", fmt.Errorf("DRBD: Couldn't stat %s: %w", devicePath, err)
+	}
+
+	return devicePath, nil
+}
+
+// dryRunDevicePath stands in for the device of a resource a dry run didn't
+// assign: the udev link of its first volume.
+func dryRunDevicePath(r Resource) string {
+	return "/dev/drbd/by-res/" + r.Name + "/0"
+}
+
+// DevicePath returns the path of the resource's device, whether or not its
+// device node currently exists.
+func DevicePath(r Resource) (string, error) {
+	return backend.devicePath(r)
+}
+
+// WaitForDeviceGone polls until the device node no longer exists, giving
+// udev time to remove it after the resource was unassigned.
+func WaitForDeviceGone(device string, timeout time.Duration) error {
+	return waitForGone(device, timeout, time.Millisecond*250, func(d string) bool {
+		return !os.IsNotExist(Exec.Stat(d))
+	})
+}
+
+func waitForGone(device string, timeout, interval time.Duration, exists func(string) bool) error {
+	deadline := time.Now().Add(timeout)
+	for exists(device) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("DRBD: Device %s still exists %s after unassigning", device, timeout)
+		}
+		time.Sleep(interval)
+	}
+	return nil
+}
+
+func doGetDevPath(volInfo string) (string, error) {
+	if volInfo == "" {
+		return "", fmt.Errorf("DRBD: Resource is not configured")
+	}
+
+	s := strings.Split(volInfo, fieldSep)
+	if len(s) != 7 {
+		return "", fmt.Errorf("DRBD: Malformed volume string: %q", volInfo)
+	}
+
+	minor := s[5]
+	ok, err := regexp.MatchString("\\d+", minor)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("DRBD: Bad device minor %q in volume string: %q", minor, volInfo)
+	}
+
+	return "/dev/drbd" + minor, nil
+}
+
+func AssignRes(r Resource) (bool, error) {
+	// Trying again doesn't load the module.
+	if err := CheckModule(); err != nil {
+		return false, &AssignError{Cause: ErrModuleNotLoaded, Err: err}
+	}
+
+	if r.StoragePool != "" && !backend.storagePools() {
+		return false, &AssignError{Err: fmt.Errorf("DRBD: %s has no storage pools, unable to provision resource %q from pool %q", backend.Name(), r.Name, r.StoragePool)}
+	}
+
+	// Make sure the resource is defined before trying to assign it, creating
+	// it if it is to be placed and its size is known.
+	ok, err := resExists(r)
+	if err != nil && !errors.Is(err, ErrNotDefined) && dryRunAssumes(fmt.Sprintf("resource %q is defined", r.Name), err) {
+		ok, err = true, nil
+	}
+	if err != nil || !ok {
+		if !errors.Is(err, ErrNotDefined) || r.PlacementCount <= 0 || r.Size <= 0 {
+			return ok, transientAssignError(err)
+		}
+		if err := createResource(r); err != nil {
+			return false, transientAssignError(err)
+		}
 	}
 
-	err = m.safeFormat(device)
-	if err != nil {
-		return fmt.Errorf("unable to mount device: %v", err)
-	}
+	ok, err = assignUnlessStorageNode(
+		func() (bool, error) { return IsStorageNode(r, r.NodeName) },
+		func() (bool, error) { return assignRes(r) })
+	return ok, transientAssignError(err)
+}
 
-	out, err := exec.Command("mkdir", "-p", path).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unable to mount device, failed to make mount directory: %v: %s", err, out)
-	}
+// ErrNotDefined is the cause of AssignErrors for resources that don't exist.
+var ErrNotDefined = errors.New("resource not defined")
+
+// AssignError is returned by AssignRes. Transient errors, such as a failed
+// assign command or query, may go away when tried again; the others, such as
+// a lack of storage, won't. Cause, if set, is ErrNotDefined,
+// ErrMinorsExhausted or ErrModuleNotLoaded.
+type AssignError struct {
+	Transient bool
+	Cause     error
+	Err       error
+}
 
-	out, err = exec.Command("mount", device, path).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unable to mount device: %v: %s", err, out)
-	}
+func (e *AssignError) Error() string {
+	return e.Err.Error()
+}
 
-	return nil
+func (e *AssignError) Unwrap() error {
+	return e.Err
 }
 
-func (m Mounter) UnMount(path string) error {
-	// If the path isn't a directory, we're not mounted there.
-	_, err := exec.Command("test", "-d", path).CombinedOutput()
-	if err != nil {
-		return nil
-	}
+func (e *AssignError) Is(target error) bool {
+	return e.Cause != nil && target == e.Cause
+}
 
-	// If the path isn't mounted, then we're not mounted.
-	_, err = exec.Command("findmnt", "-f", path).CombinedOutput()
-	if err != nil {
+// IsTransient reports whether AssignRes failed with an error that is worth
+// retrying.
+func IsTransient(err error) bool {
+	var assignErr *AssignError
+	return errors.As(err, &assignErr) && assignErr.Transient
+}
+
+// transientAssignError makes err, unless it is an AssignError already, a
+// transient AssignError. Only a backend that can't be run at all is no
+// better on the next try.
+func transientAssignError(err error) error {
+	if err == nil {
 		return nil
 	}
-
-	out, err := exec.Command("umount", path).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unable to unmount device: %q: %s", err, out)
+	var assignErr *AssignError
+	if errors.As(err, &assignErr) {
+		return err
 	}
+	_, missing := backend.(missingBackend)
+	return &AssignError{Transient: !missing && !errors.Is(err, exec.ErrNotFound), Err: err}
+}
 
-	return nil
+// notDefinedError is the error for a resource that doesn't exist, which
+// can't be assigned until it is defined.
+func notDefinedError(resource string) error {
+	return &AssignError{Cause: ErrNotDefined, Err: fmt.Errorf("DRBD: Resource %q not defined.", resource)}
 }
 
-func (m Mounter) safeFormat(path string) error {
-	deviceFS, err := checkFSType(path)
-	if err != nil {
-		return fmt.Errorf("unable to format filesystem for %q: %v", path, err)
+// assignUnlessStorageNode only assigns the resource if the node doesn't hold
+// its storage already. There, the resource is in place whatever state its
+// assignment is in, and assigning it again, diskless or not, can only fail.
+// If that can't be told, the resource is assigned as usual.
+func assignUnlessStorageNode(storageNode func() (bool, error), assign func() (bool, error)) (bool, error) {
+	if ok, err := storageNode(); err == nil && ok {
+		return true, nil
 	}
+	return assign()
+}
 
-	// Device is formatted correctly already.
-	if deviceFS == m.FSType {
-		return nil
+func assignRes(r Resource) (bool, error) {
+	// If the resource is already assigned, we're done.
+	ok, err := resAssigned(r)
+	if err != nil && dryRunAssumes(fmt.Sprintf("resource %q is not assigned on node %q", r.Name, r.NodeName), err) {
+		ok, err = false, nil
 	}
-
-	if deviceFS != "" && deviceFS != m.FSType {
-		return fmt.Errorf("device %q already formatted with %q filesystem, refusing to overwrite with %q filesystem", path, deviceFS, m.FSType)
+	if err != nil || ok {
+		return ok, err
 	}
 
-	out, err := exec.Command("mkfs", "-t", m.FSType, path).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("couldn't create %s filesystem %v: %q", m.FSType, err, out)
+	if r.MinPoolFree > 0 {
+		free, err := PoolFree(r.NodeName)
+		if err != nil {
+			return false, err
+		}
+		if free < r.MinPoolFree {
+			return false, &AssignError{Err: fmt.Errorf("DRBD: Refusing to assign resource %q on node %q: storage pool has %d bytes free, %d required", r.Name, r.NodeName, free, r.MinPoolFree)}
+		}
 	}
 
-	return nil
-}
-
-const fieldSep = ","
-
-func WaitForDevPath(r Resource, maxRetries int) (string, error) {
-	var path string
-	var err error
+	if r.MaxOverCommit > 0 {
+		ratio, err := OverCommit()
+		if err != nil {
+			return false, err
+		}
+		if ratio > r.MaxOverCommit {
+			return false, &AssignError{Err: fmt.Errorf("DRBD: Refusing to assign resource %q on node %q: thin pool %s is over-committed %.2f times, at most %.2f allowed", r.Name, r.NodeName, ThinPool, ratio, r.MaxOverCommit)}
+		}
+	}
 
-	for i := 0; i < maxRetries; i++ {
-		path, err = getDevPath(r)
-		if path != "" {
-			return path, err
+	if r.SharedSecret != "" {
+		if err := setSharedSecret(r); err != nil {
+			return false, err
 		}
-		time.Sleep(time.Second * 2)
 	}
-	return path, err
-}
 
-func getDevPath(r Resource) (string, error) {
-	out, err := exec.Command("drbdmanage", "list-volumes", "--resources", r.Name, "--machine-readable").CombinedOutput()
+	// Placing the replicas may have deployed one on the node already.
+	placed, err := placeResource(backend.placeArgs(r), func() (int, error) { return backend.replicas(r) })
 	if err != nil {
-		return "", fmt.Errorf("DRBD: Unable to get volume information: %s", out)
+		return false, err
+	}
+	if placed {
+		if ok, err := resAssigned(r); err == nil && ok {
+			return true, nil
+		}
 	}
 
-	devicePath, err := doGetDevPath(string(out))
+	if err := backend.usable(); err != nil {
+		return false, err
+	}
+	args := backend.assignArgs(r)
+	out, err := run(CmdAssign, args[0], args[1:]...)
 	if err != nil {
-		return "", err
+		return false, minorsExhausted(out, fmt.Errorf("DRBD: Unable to assign resource %q on node %q: %w: %s", r.Name, r.NodeName, err, out))
 	}
-
-	if _, err := os.Lstat(devicePath); err != nil {
-		return "", fmt.Errorf("DRBD: Couldn't stat %s: %v", devicePath, err)
+	// A dry run made no assignment to wait for.
+	if DryRun {
+		return true, nil
 	}
 
-	return devicePath, nil
+	// A pending assignment may still complete, a failed one won't.
+	state, err := WaitForAssignment(r, 5)
+	switch {
+	case err != nil:
+		return false, err
+	case state == AssignmentFailed, state == AssignmentMissing:
+		return false, &AssignError{Err: fmt.Errorf("DRBD: Assignment of resource %q on node %q failed", r.Name, r.NodeName)}
+	case state == AssignmentPending:
+		return false, fmt.Errorf("DRBD: Assignment of resource %q on node %q still pending", r.Name, r.NodeName)
+	}
+	return true, nil
 }
 
-func doGetDevPath(volInfo string) (string, error) {
-	if volInfo == "" {
-		return "", fmt.Errorf("DRBD: Resource is not configured")
+// createResource defines the resource with a volume of r.Size bytes, rounded
+// up to whole KiB. It has no replicas until it is placed.
+func createResource(r Resource) error {
+	if err := backend.usable(); err != nil {
+		return err
 	}
-
-	s := strings.Split(volInfo, fieldSep)
-	if len(s) != 7 {
-		return "", fmt.Errorf("DRBD: Malformed volume string: %q", volInfo)
+	for _, args := range backend.createArgs(r, (r.Size+1023)/1024) {
+		if out, err := run(CmdAssign, args[0], args[1:]...); err != nil {
+			return fmt.Errorf("DRBD: Unable to create resource %q: %w: %s", r.Name, err, out)
+		}
 	}
+	return nil
+}
 
-	minor := s[5]
-	ok, err := regexp.MatchString("\\d+", minor)
-	if err != nil {
-		return "", err
+// placeResource runs the command placing the replicas of a resource if the
+// resource has none yet, and reports whether it did. Without a command,
+// there is no placement to do.
+func placeResource(args []string, replicas func() (int, error)) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
 	}
-	if !ok {
-		return "", fmt.Errorf("DRBD: Bad device minor %q in volume string: %q", minor, volInfo)
+	n, err := replicas()
+	if err != nil || n > 0 {
+		return false, err
 	}
-
-	return "/dev/drbd" + minor, nil
+	out, err := run(CmdAssign, args[0], args[1:]...)
+	if err != nil {
+		return false, minorsExhausted(out, fmt.Errorf("DRBD: Unable to place replicas: %w: %s", err, out))
+	}
+	return true, nil
 }
 
-func AssignRes(r Resource) (bool, error) {
-	// Make sure the resource is defined before trying to assign it.
-	if ok, err := resExists(r); err != nil || !ok {
-		return ok, err
+// setSharedSecret configures the resource's connections to authenticate with
+// its shared secret. The command's output is not trusted to leave it out.
+func setSharedSecret(r Resource) error {
+	if err := backend.usable(); err != nil {
+		return err
 	}
+	args := backend.sharedSecretArgs(r)
+	out, err := run(CmdAssign, args[0], args[1:]...)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to set the shared secret of resource %q: %w: %s", r.Name, err,
+			strings.Replace(string(out), r.SharedSecret, "<redacted>", -1))
+	}
+	return nil
+}
 
-	// If the resource is already assigned, we're done.
-	if ok, err := resAssigned(r); err != nil || ok {
-		return ok, err
+// PoolFree returns the free space in bytes of the node's storage pool.
+func PoolFree(node string) (int64, error) {
+	return backend.poolFree(node)
+}
+
+// Parse the pool free space from the output of `drbdmanage list-nodes`,
+// which reports pool sizes in KiB.
+func doPoolFree(nodeInfo string) (int64, error) {
+	fields := strings.Split(strings.TrimSpace(nodeInfo), fieldSep)
+	if len(fields) != 5 {
+		return 0, fmt.Errorf("DRBD: Malformed nodeInfo: %q", nodeInfo)
 	}
 
-	out, err := exec.Command("drbdmanage", "assign-resource", r.Name, r.NodeName, "--client").CombinedOutput()
-	if err != nil {
-		return false, fmt.Errorf("DRBD: Unable to assign resource %q on node %q: %s", r.Name, r.NodeName, out)
+	free, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || free < 0 {
+		return 0, fmt.Errorf("DRBD: Unknown pool free space %q in nodeInfo: %q", fields[2], nodeInfo)
 	}
-	return WaitForAssignment(r, 5)
+	return free * 1024, nil
 }
 
+// UnassignRes removes the resource from the node. Resources that aren't
+// assigned to the node, e.g. because an earlier call already removed them,
+// are not an error.
 func UnassignRes(r Resource) error {
-	out, err := exec.Command("drbdmanage", "unassign-resource", r.Name, r.NodeName, "--quiet").CombinedOutput()
+	err := unassign(r, func() (bool, error) { return resAssigned(r) }, func() ([]byte, error) {
+		if err := backend.usable(); err != nil {
+			return nil, err
+		}
+		args := backend.unassignArgs(r)
+		return run(CmdAssign, args[0], args[1:]...)
+	})
 	if err != nil {
-		return fmt.Errorf("DRBD: failed to unassign resource %q from node %q. Error: %s", r.Name, r.NodeName, out)
+		return err
 	}
 	ok, err := waitForUnassignment(r, 3)
 	if err != nil {
-		return fmt.Errorf("DRBD: failed to unassign resource %q from node %q. Error: %v", r.Name, r.NodeName, err)
+		return fmt.Errorf("DRBD: failed to unassign resource %q from node %q. Error: %w", r.Name, r.NodeName, err)
 	}
 	if !ok {
 		return fmt.Errorf("DRBD: failed to unassign resource %q from node %q. Error: Resource still assigned", r.Name, r.NodeName)
@@ -195,19 +1294,30 @@ func UnassignRes(r Resource) error {
 	return nil
 }
 
-func resExists(r Resource) (bool, error) {
-	out, err := exec.Command("drbdmanage", "list-resources", "--resources", r.Name, "--machine-readable").CombinedOutput()
-	if err != nil {
-		return false, err
+// unassign runs the unassign command unless the resource is known not to be
+// assigned. A failed command only counts if the resource is still assigned
+// afterwards.
+func unassign(r Resource, assigned func() (bool, error), cmd func() ([]byte, error)) error {
+	if ok, err := assigned(); err == nil && !ok {
+		return nil
+	}
+	out, err := cmd()
+	if err == nil {
+		return nil
+	}
+	if ok, qerr := assigned(); qerr == nil && !ok {
+		return nil
 	}
+	return fmt.Errorf("DRBD: failed to unassign resource %q from node %q. Error: %w: %s", r.Name, r.NodeName, err, out)
+}
 
-	// Inject real implementations here, test through the internal function.
-	return doResExists(r.Name, string(out))
+func resExists(r Resource) (bool, error) {
+	return backend.exists(r)
 }
 
 func doResExists(resource, resInfo string) (bool, error) {
 	if resInfo == "" {
-		return false, fmt.Errorf("DRBD: Resource %q not defined.", resource)
+		return false, notDefinedError(resource)
 	}
 	if strings.Split(resInfo, fieldSep)[0] != resource {
 		return false, fmt.Errorf("DRBD: Error retriving resource information from the following output: %q", resInfo)
@@ -216,18 +1326,41 @@ func doResExists(resource, resInfo string) (bool, error) {
 	return true, nil
 }
 
-// Poll drbdmanage until resource assignment is complete.
-func WaitForAssignment(r Resource, maxRetries int) (bool, error) {
+// States of an assignment, see WaitForAssignment.
+const (
+	AssignmentAssigned = "assigned"
+	AssignmentPending  = "pending"
+	AssignmentFailed   = "failed"
+	// AssignmentMissing is the state of resources that aren't assigned to
+	// the node, or don't exist at all.
+	AssignmentMissing = "missing"
+)
+
+// WaitForAssignment polls the backend until the assignment of the resource
+// is complete, and returns its last state: assigned, pending if it is still
+// being deployed, failed if it couldn't be completed, or missing if there is
+// no assignment on the node, which waiting longer doesn't change.
+func WaitForAssignment(r Resource, maxRetries int) (string, error) {
+	defer clearCheckpoint(r)
+	return waitForAssignment(func(i int) (string, error) {
+		checkpoint(r, "waiting for assignment", i, maxRetries)
+		return backend.assignmentState(r)
+	}, func() { retryFailedActions(r) }, maxRetries)
+}
+
+func waitForAssignment(state func(attempt int) (string, error), retry func(), maxRetries int) (string, error) {
 	for i := 0; i < maxRetries; i++ {
-		// If there are no errors and the resource is assigned, we can exit early.
-		if ok, err := resAssigned(r); err == nil && ok {
-			return ok, nil
+		current, err := state(i)
+		// Failures and missing assignments get retried once, before giving
+		// up on them.
+		if err == nil && (current == AssignmentAssigned || (current == AssignmentFailed || current == AssignmentMissing) && i > 0) {
+			return current, nil
 		}
 		// See if we can recover from any errors or complete pending state changes.
-		retryFailedActions(r)
+		retry()
 	}
 	// Return any errors that might have prevented resource assignment.
-	return resAssigned(r)
+	return state(maxRetries)
 }
 
 // Poll drbdmanage until resource unassignment is complete.
@@ -245,12 +1378,43 @@ func waitForUnassignment(r Resource, maxRetries int) (bool, error) {
 	return !ok, err
 }
 
-func resAssigned(r Resource) (bool, error) {
-	out, err := exec.Command("drbdmanage", "list-assignments", "--resources", r.Name, "--nodes", r.NodeName, "--machine-readable").CombinedOutput()
-	if err != nil {
-		return false, fmt.Errorf("%s: %v", out, err)
+// Assigned checks once, without waiting or retrying, whether the resource
+// is assigned to its node and in its target state.
+func Assigned(r Resource) (bool, error) {
+	return resAssigned(r)
+}
+
+// GetResourceUUID returns the cluster-wide UUID of the resource, which tells
+// apart resources of the same name defined at different times.
+func GetResourceUUID(r Resource) (string, error) {
+	return backend.resourceUUID(r)
+}
+
+// ListAssignedResources returns the names of all resources assigned to the
+// node, whatever state their assignments are in.
+func ListAssignedResources(node string) ([]string, error) {
+	return backend.assignedResources(node)
+}
+
+// Parse the resource names from the output of `drbdmanage list-assignments`
+// for all resources of a node.
+func doAssignedResources(assignmentInfo string) ([]string, error) {
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(assignmentInfo), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, fieldSep)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("DRBD: Malformed assignmentInfo: %q", line)
+		}
+		names = append(names, strings.TrimSpace(fields[1]))
 	}
-	return doResAssigned(string(out))
+	return names, nil
+}
+
+func resAssigned(r Resource) (bool, error) {
+	return backend.assigned(r)
 }
 
 func doResAssigned(assignmentInfo string) (bool, error) {
@@ -274,17 +1438,275 @@ func doResAssigned(assignmentInfo string) (bool, error) {
 	return true, nil
 }
 
-func retryFailedActions(r Resource) {
-	exec.Command("drbdmanage", "resume-all").CombinedOutput()
-	time.Sleep(time.Second * 2)
+// Parse the state of an assignment from the output of `drbdmanage
+// list-assignments`. An assignment whose current state lacks flags of its
+// target state is being deployed, one without a target to deploy to is
+// being removed.
+func doAssignmentState(assignmentInfo string) (string, error) {
+	assignmentInfo = strings.TrimSpace(assignmentInfo)
+	if assignmentInfo == "" {
+		return AssignmentMissing, nil
+	}
+
+	fields := strings.Split(assignmentInfo, fieldSep)
+	if len(fields) != 5 {
+		return "", fmt.Errorf("DRBD: Malformed assignmentInfo: %q", assignmentInfo)
+	}
+
+	currentState := strings.TrimSpace(fields[3])
+	targetState := strings.TrimSpace(fields[4])
+	if !stateFlags(targetState)["deploy"] {
+		return AssignmentFailed, nil
+	}
+	if currentState == targetState {
+		return AssignmentAssigned, nil
+	}
+	return AssignmentPending, nil
 }
 
-func IsClient(r Resource) bool {
-	out, err := exec.Command("drbdmanage", "list-assignments", "--resources", r.Name, "--nodes", r.NodeName, "--machine-readable").CombinedOutput()
+// stateFlags splits the flags of an assignment state, e.g. "connect|deploy".
+func stateFlags(state string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, f := range strings.Split(state, "|") {
+		if f != "" {
+			flags[f] = true
+		}
+	}
+	return flags
+}
+
+// Suspended returns why I/O on the resource is suspended, e.g. "fencing",
+// or an empty string if I/O is not suspended.
+func Suspended(r Resource) (string, error) {
+	out, err := run(CmdQuery, "drbdsetup", "status", r.Name)
 	if err != nil {
-		return false
+		return "", fmt.Errorf("DRBD: Unable to get status of resource %q: %w: %s", r.Name, err, out)
+	}
+	return doSuspended(string(out)), nil
+}
+
+// Parse the suspension reason from the first line of `drbdsetup status`.
+func doSuspended(status string) string {
+	lines := strings.SplitN(status, "\n", 2)
+	for _, f := range strings.Fields(lines[0]) {
+		if strings.HasPrefix(f, "suspended:") {
+			return strings.TrimPrefix(f, "suspended:")
+		}
+	}
+	return ""
+}
+
+// Disk states of interest to callers of DiskState.
+const (
+	DiskUpToDate = "UpToDate"
+	DiskOutdated = "Outdated"
+)
+
+// DiskState returns the state of the resource's local disk, e.g. "UpToDate"
+// or "Diskless".
+func DiskState(r Resource) (string, error) {
+	out, err := run(CmdQuery, "drbdsetup", "status", r.Name)
+	if err != nil {
+		return "", fmt.Errorf("DRBD: Unable to get status of resource %q: %w: %s", r.Name, err, out)
+	}
+	return doDiskState(string(out))
+}
+
+// Parse the local disk state from the output of `drbdsetup status`. Peer
+// disk states are indented further and use the peer-disk key, so the first
+// disk key belongs to the local volume.
+func doDiskState(status string) (string, error) {
+	for _, line := range strings.Split(status, "\n") {
+		for _, f := range strings.Fields(line) {
+			if strings.HasPrefix(f, "disk:") {
+				return strings.TrimPrefix(f, "disk:"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("DRBD: No disk state in status: %q", status)
+}
+
+// Peers returns the number of peers the resource is configured to replicate
+// to, whether or not they are currently connected.
+func Peers(r Resource) (int, error) {
+	out, err := run(CmdQuery, "drbdsetup", "status", r.Name)
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get status of resource %q: %w: %s", r.Name, err, out)
+	}
+	return doPeers(string(out)), nil
+}
+
+// Count the connections in the output of `drbdsetup status`.
+func doPeers(status string) int {
+	return len(doStatusPeers(status))
+}
+
+// upToDateInterval is how often WaitForUpToDate polls the disk state.
+var upToDateInterval = time.Second * 2
+
+// WaitForUpToDate polls the resource until its local disk is UpToDate or
+// timeout passes, returning the last disk state seen.
+func WaitForUpToDate(r Resource, timeout time.Duration) (string, error) {
+	// A replica a dry run assigned never syncs.
+	if DryRun {
+		state, err := DiskState(r)
+		if err == nil && state != DiskUpToDate {
+			err = fmt.Errorf("disk is %s", state)
+		}
+		if err != nil {
+			dryRunAssumes(fmt.Sprintf("resource %q is %s", r.Name, DiskUpToDate), err)
+		}
+		return state, nil
+	}
+	state, err := waitForUpToDate(func() (string, error) { return DiskState(r) }, timeout, upToDateInterval)
+	if err != nil {
+		return state, fmt.Errorf("DRBD: Resource %q %w", r.Name, err)
+	}
+	return state, nil
+}
+
+func waitForUpToDate(diskState func() (string, error), timeout, interval time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := diskState()
+		if err == nil && state == DiskUpToDate {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return state, err
+			}
+			return state, fmt.Errorf("disk did not become %s within %s, still %s", DiskUpToDate, timeout, state)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Roles of a resource on the local node.
+const (
+	RolePrimary   = "Primary"
+	RoleSecondary = "Secondary"
+)
+
+// Role returns the role of the resource on this node, e.g. "Primary".
+func Role(r Resource) (string, error) {
+	out, err := run(CmdQuery, "drbdsetup", "status", r.Name)
+	if err != nil {
+		return "", fmt.Errorf("DRBD: Unable to get status of resource %q: %w: %s", r.Name, err, out)
+	}
+	return doRole(string(out))
+}
+
+// Parse the local role from the output of `drbdsetup status`, whose first
+// line is the resource name followed by role:<role>.
+func doRole(status string) (string, error) {
+	lines := strings.SplitN(status, "\n", 2)
+	for _, f := range strings.Fields(lines[0]) {
+		if strings.HasPrefix(f, "role:") {
+			return strings.TrimPrefix(f, "role:"), nil
+		}
+	}
+	return "", fmt.Errorf("DRBD: Unable to find role in status %q", status)
+}
+
+// secondaryInterval is how often WaitForSecondary polls the role.
+var secondaryInterval = time.Millisecond * 500
+
+// WaitForSecondary polls the resource until it is Secondary on this node or
+// timeout passes.
+func WaitForSecondary(r Resource, timeout time.Duration) error {
+	if err := waitForSecondary(func() (string, error) { return Role(r) }, timeout, secondaryInterval); err != nil {
+		return fmt.Errorf("DRBD: Resource %q %w", r.Name, err)
+	}
+	return nil
+}
+
+func waitForSecondary(role func() (string, error), timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := role()
+		if err == nil && current == RoleSecondary {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("did not become %s within %s, still %s", RoleSecondary, timeout, current)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// WaitForResume polls the resource until its I/O is no longer suspended.
+func WaitForResume(r Resource, maxRetries int) error {
+	var reason string
+	var err error
+
+	for i := 0; i < maxRetries; i++ {
+		reason, err = Suspended(r)
+		if err == nil && reason == "" {
+			return nil
+		}
+		time.Sleep(time.Second * 2)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("DRBD: Resource %q fenced, I/O suspended (%s)", r.Name, reason)
+}
+
+// Prewarm states reported by Prewarm.
+const (
+	PrewarmCompleted = "completed"
+	PrewarmRunning   = "running"
+)
+
+// prewarmGrace is how long Prewarm waits for the read to finish before
+// leaving it running in the background.
+const prewarmGrace = time.Second
+
+// Prewarm reads the first size bytes of device to populate the page cache.
+// The read is bounded by timeout and keeps running in the background, even
+// after the plugin exits, if it doesn't finish right away.
+func Prewarm(device string, size int64, timeout time.Duration) (string, error) {
+	done := make(chan error, 1)
+	go func() {
+		out, err := run(CmdPrewarm, "timeout", prewarmArgs(device, size, timeout)...)
+		if err != nil {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("DRBD: Prewarming %s failed: %w", device, err)
+		}
+		return PrewarmCompleted, nil
+	case <-time.After(prewarmGrace):
+		return PrewarmRunning, nil
+	}
+}
+
+// prewarmArgs builds the arguments to timeout(1) needed to read size bytes
+// from device in 1MiB blocks.
+func prewarmArgs(device string, size int64, timeout time.Duration) []string {
+	blocks := (size + 1<<20 - 1) >> 20
+	return []string{
+		strconv.FormatInt(int64(timeout/time.Second), 10),
+		"dd", "if=" + device, "of=/dev/null", "bs=1M", "count=" + strconv.FormatInt(blocks, 10),
 	}
-	return doIsClient(string(out))
+}
+
+func retryFailedActions(r Resource) {
+	backend.retry(r)
+}
+
+func IsClient(r Resource) bool {
+	assignment, err := AssignmentType(r)
+	return err == nil && assignment == AssignmentDiskless
 }
 
 func doIsClient(assignmentInfo string) bool {
@@ -306,23 +1728,54 @@ func doIsClient(assignmentInfo string) bool {
 	return true
 }
 
-func getResFromDevice(r Resource, device string) (string, error) {
-	minor, err := getMinorFromDevice(device)
+// Assignment types as reported by AssignmentType.
+const (
+	AssignmentNone     = "none"
+	AssignmentDiskless = "diskless"
+	AssignmentDiskful  = "diskful"
+)
+
+// AssignmentType reports how, if at all, the resource is assigned to its node.
+func AssignmentType(r Resource) (string, error) {
+	return backend.assignmentType(r)
+}
+
+// IsStorageNode reports whether node holds backing storage of the resource,
+// i.e. it is assigned there diskful.
+func IsStorageNode(r Resource, node string) (bool, error) {
+	assignment, err := AssignmentType(Resource{Name: r.Name, NodeName: node})
 	if err != nil {
-		return "", err
+		return false, err
 	}
+	return assignment == AssignmentDiskful, nil
+}
 
-	out, err := exec.Command("drbdmanage", "list-volumes", "--machine-readable").CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("DRBD: Unable to get volume information: %s", out)
+func doAssignmentType(assignmentInfo string) (string, error) {
+	if assignmentInfo == "" {
+		return AssignmentNone, nil
+	}
+	fields := strings.Split(assignmentInfo, fieldSep)
+	if len(fields) != 5 {
+		return "", fmt.Errorf("DRBD: Malformed assignmentInfo: %q", assignmentInfo)
 	}
+	if doIsClient(assignmentInfo) {
+		return AssignmentDiskless, nil
+	}
+	return AssignmentDiskful, nil
+}
+
+func getResFromDevice(device string) (string, error) {
+	return backend.resourceOfDevice(device)
+}
 
-	res, err := getResFromVolumes(string(out), minor)
+// ResourceFromMountPath returns the name of the resource whose device is
+// mounted at path.
+func ResourceFromMountPath(path string) (string, error) {
+	out, err := run(CmdQuery, "findmnt", "-n", "-o", "SOURCE", path)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("DRBD: Unable to find device mounted at %q: %w: %s", path, err, out)
 	}
-
-	return res, nil
+	return getResFromDevice(strings.TrimSpace(string(out)))
 }
 
 func getMinorFromDevice(device string) (string, error) {
@@ -349,18 +1802,6 @@ func getResFromVolumes(volumes, minor string) (string, error) {
 	return "", nil
 }
 
-func checkFSType(dev string) (string, error) {
-	// If there's no filesystem, then we'll have a nonzero exit code, but no output
-	// doCheckFSType handles this case.
-	out, _ := exec.Command("blkid", "-o", "udev", dev).CombinedOutput()
-
-	FSType, err := doCheckFSType(string(out))
-	if err != nil {
-		return "", err
-	}
-	return FSType, nil
-}
-
 // Parse the filesystem from the output of `blkid -o udev`
 func doCheckFSType(s string) (string, error) {
 	f := strings.Fields(s)
@@ -386,3 +1827,14 @@ func doCheckFSType(s string) (string, error) {
 	}
 	return fs, nil
 }
+
+// doFSLabel returns the filesystem label in the output of `blkid -o udev`,
+// with special characters such as spaces replaced by udev.
+func doFSLabel(s string) string {
+	for _, f := range strings.Fields(s) {
+		if strings.HasPrefix(f, "ID_FS_LABEL=") {
+			return strings.TrimPrefix(f, "ID_FS_LABEL=")
+		}
+	}
+	return ""
+}
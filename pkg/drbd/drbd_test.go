@@ -18,7 +18,16 @@
 
 package drbd
 
-import "testing"
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
 
 func TestDoGetDevPath(t *testing.T) {
 	var volumeStringTests = []struct {
@@ -58,6 +67,25 @@ func TestDoResExists(t *testing.T) {
 	}
 }
 
+func TestDoPoolFree(t *testing.T) {
+	var poolFreeTests = []struct {
+		nodeInfo string
+		out      int64
+	}{
+		{"node0,10485760,4194304,,ok\n", 4294967296},
+		{"node1,0,0,,ok\n", 0},
+		{"node2,-1,-1,,ok\n", 0},
+		{"", 0},
+	}
+
+	for _, tt := range poolFreeTests {
+		free, _ := doPoolFree(tt.nodeInfo)
+		if free != tt.out {
+			t.Errorf("Called: doPoolFree(%q), Expected: %d, Got: %d", tt.nodeInfo, tt.out, free)
+		}
+	}
+}
+
 func TestDoResAssigned(t *testing.T) {
 	var resAssignmentTests = []struct {
 		assignmentInfo string
@@ -77,6 +105,364 @@ func TestDoResAssigned(t *testing.T) {
 	}
 }
 
+func TestDoAssignmentState(t *testing.T) {
+	var assignmentStateTests = []struct {
+		assignmentInfo string
+		state          string
+		ok             bool
+	}{
+		{"node0,test0,0,connect|deploy,connect|deploy\n", AssignmentAssigned, true},
+		{"node1,test1,0,connect|deploy|diskless,connect|deploy|diskless\n", AssignmentAssigned, true},
+		{"node0,test0,0,,connect|deploy\n", AssignmentPending, true},
+		{"node0,test0,0,deploy,connect|deploy\n", AssignmentPending, true},
+		{"node0,test0,0,connect|deploy,\n", AssignmentFailed, true},
+		{"", AssignmentMissing, true},
+		{"node0,test0\n", "", false},
+	}
+
+	for _, tt := range assignmentStateTests {
+		state, err := doAssignmentState(tt.assignmentInfo)
+		if state != tt.state || (err == nil) != tt.ok {
+			t.Errorf("Called: doAssignmentState(%q), Expected: %q, ok %t, Got: %q, %v", tt.assignmentInfo, tt.state, tt.ok, state, err)
+		}
+	}
+}
+
+func TestWaitForAssignment(t *testing.T) {
+	var waitTests = []struct {
+		name    string
+		states  []string
+		state   string
+		retries int
+	}{
+		{"assigned", []string{AssignmentAssigned}, AssignmentAssigned, 0},
+		{"assigned after pending", []string{AssignmentPending, AssignmentPending, AssignmentAssigned}, AssignmentAssigned, 2},
+		{"still pending", []string{AssignmentPending}, AssignmentPending, 5},
+		{"failed", []string{AssignmentFailed}, AssignmentFailed, 1},
+		{"recovered from failure", []string{AssignmentFailed, AssignmentAssigned}, AssignmentAssigned, 1},
+		{"missing", []string{AssignmentMissing}, AssignmentMissing, 1},
+		{"assigned after missing", []string{AssignmentMissing, AssignmentAssigned}, AssignmentAssigned, 1},
+	}
+
+	for _, tt := range waitTests {
+		retries := 0
+		state, err := waitForAssignment(func(attempt int) (string, error) {
+			if attempt < len(tt.states) {
+				return tt.states[attempt], nil
+			}
+			return tt.states[len(tt.states)-1], nil
+		}, func() { retries++ }, 5)
+		if err != nil || state != tt.state || retries != tt.retries {
+			t.Errorf("Called: waitForAssignment(%s), Expected: %q after %d retries, Got: %q after %d retries, %v",
+				tt.name, tt.state, tt.retries, state, retries, err)
+		}
+	}
+}
+
+func TestDoAssignedResources(t *testing.T) {
+	var assignedResourcesTests = []struct {
+		assignmentInfo string
+		out            []string
+		ok             bool
+	}{
+		{"node0,test0,0,connect|deploy,connect|deploy\nnode0,test1,0,connect|deploy|diskless,connect|deploy|diskless\n", []string{"test0", "test1"}, true},
+		{"node0,test0,0,,connect|deploy\n", []string{"test0"}, true},
+		{"", nil, true},
+		{"node0,test0\n", nil, false},
+	}
+
+	for _, tt := range assignedResourcesTests {
+		names, err := doAssignedResources(tt.assignmentInfo)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(names, tt.out) {
+			t.Errorf("Called: doAssignedResources(%q), Expected: %q, Got: %q, %v", tt.assignmentInfo, tt.out, names, err)
+		}
+	}
+}
+
+func TestAssignUnlessStorageNode(t *testing.T) {
+	var storageNodeTests = []struct {
+		name        string
+		storageNode bool
+		err         error
+		assigned    bool
+	}{
+		{"storage node passthrough", true, nil, false},
+		{"remote node", false, nil, true},
+		{"unknown assignment", false, errors.New("DRBD: Unable to get assignment information"), true},
+	}
+
+	for _, tt := range storageNodeTests {
+		assigned := false
+		ok, err := assignUnlessStorageNode(
+			func() (bool, error) { return tt.storageNode, tt.err },
+			func() (bool, error) {
+				assigned = true
+				return true, nil
+			})
+		if !ok || err != nil || assigned != tt.assigned {
+			t.Errorf("Called: assignUnlessStorageNode(%s), Expected: assigned %v, Got: assigned %v, %v, %v", tt.name, tt.assigned, assigned, ok, err)
+		}
+	}
+}
+
+func TestBackoffDelays(t *testing.T) {
+	ms := time.Millisecond
+	var delaysTests = []struct {
+		b      Backoff
+		delays []time.Duration
+	}{
+		{Backoff{Timeout: 2000 * ms, Interval: 250 * ms, MaxInterval: 500 * ms},
+			[]time.Duration{250 * ms, 500 * ms, 500 * ms, 500 * ms}},
+		{Backoff{Timeout: 6000 * ms, Interval: 250 * ms, MaxInterval: 2000 * ms},
+			[]time.Duration{250 * ms, 500 * ms, 1000 * ms, 2000 * ms, 2000 * ms}},
+		{Backoff{Timeout: 1000 * ms, Interval: 100 * ms},
+			[]time.Duration{100 * ms, 200 * ms, 400 * ms}},
+		{Backoff{Timeout: 100 * ms, Interval: 250 * ms, MaxInterval: 2000 * ms}, nil},
+		{Backoff{Timeout: 1000 * ms}, nil},
+	}
+
+	for _, tt := range delaysTests {
+		if delays := tt.b.delays(); !reflect.DeepEqual(delays, tt.delays) {
+			t.Errorf("Called: %+v.delays(), Expected: %v, Got: %v", tt.b, tt.delays, delays)
+		}
+	}
+}
+
+func TestBackoffPoll(t *testing.T) {
+	b := Backoff{Timeout: time.Second * 6, Interval: time.Millisecond * 250, MaxInterval: time.Second * 2}
+	var pollTests = []struct {
+		// appears is the attempt the device shows up at, -1 for never.
+		appears int
+		ok      bool
+		tries   int
+		slept   int
+	}{
+		{0, true, 1, 0},
+		{2, true, 3, 2},
+		{-1, false, 6, 5},
+	}
+
+	for _, tt := range pollTests {
+		tries, slept := 0, 0
+		ok := b.Poll(func(attempt, attempts int) bool {
+			tries++
+			if attempts != 6 {
+				t.Errorf("Called: Poll(), Expected: 6 attempts, Got: %d", attempts)
+			}
+			return attempt == tt.appears
+		}, func(time.Duration) { slept++ })
+		if ok != tt.ok || tries != tt.tries || slept != tt.slept {
+			t.Errorf("Called: Poll() with device at attempt %d, Expected: %v after %d tries, %d waits, Got: %v after %d tries, %d waits",
+				tt.appears, tt.ok, tt.tries, tt.slept, ok, tries, slept)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	var transientTests = []struct {
+		err       error
+		transient bool
+	}{
+		{transientAssignError(errors.New("controller busy")), true},
+		{transientAssignError(&TimeoutError{Command: "drbdmanage assign-resource", Timeout: time.Second}), true},
+		{transientAssignError(notDefinedError("r0")), false},
+		{transientAssignError(&AssignError{Err: errors.New("storage pool full")}), false},
+		{errors.New("not an assign error"), false},
+		{nil, false},
+	}
+
+	for _, tt := range transientTests {
+		if transient := IsTransient(tt.err); transient != tt.transient {
+			t.Errorf("Called: IsTransient(%v), Expected: %v, Got: %v", tt.err, tt.transient, transient)
+		}
+	}
+
+	if _, err := doResExists("r0", ""); IsTransient(err) {
+		t.Errorf("Called: doResExists(%q, \"\"), Expected: a terminal error, Got: %v", "r0", err)
+	}
+}
+
+func TestDoSuspended(t *testing.T) {
+	var suspendedTests = []struct {
+		status string
+		out    string
+	}{
+		{"r0 role:Secondary\n  disk:UpToDate\n  peer role:Primary\n    peer-disk:UpToDate\n", ""},
+		{"r0 role:Secondary suspended:fencing\n  disk:UpToDate\n", "fencing"},
+		{"r0 role:Primary suspended:user\n  disk:UpToDate\n", "user"},
+		{"", ""},
+	}
+
+	for _, tt := range suspendedTests {
+		reason := doSuspended(tt.status)
+		if reason != tt.out {
+			t.Errorf("Called: doSuspended(%q), Expected: %q, Got: %q", tt.status, tt.out, reason)
+		}
+	}
+}
+
+func TestPrewarmArgs(t *testing.T) {
+	var prewarmArgsTests = []struct {
+		size    int64
+		timeout time.Duration
+		out     []string
+	}{
+		{1 << 30, time.Minute * 5, []string{"300", "dd", "if=/dev/drbd100", "of=/dev/null", "bs=1M", "count=1024"}},
+		{1, time.Second * 30, []string{"30", "dd", "if=/dev/drbd100", "of=/dev/null", "bs=1M", "count=1"}},
+	}
+
+	for _, tt := range prewarmArgsTests {
+		args := prewarmArgs("/dev/drbd100", tt.size, tt.timeout)
+		if !reflect.DeepEqual(args, tt.out) {
+			t.Errorf("Called: prewarmArgs(%q, %d, %v), Expected: %q, Got: %q", "/dev/drbd100", tt.size, tt.timeout, tt.out, args)
+		}
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	prewarm := "timeout 30 dd if=/dev/drbd100 of=/dev/null bs=1M count=1"
+	var prewarmTests = []struct {
+		command FakeCommand
+		state   string
+		ok      bool
+	}{
+		{FakeCommand{}, PrewarmCompleted, true},
+		{FakeCommand{Output: "dd: /dev/drbd100: No such device", Err: errors.New("exit status 1")}, "", false},
+	}
+
+	for _, tt := range prewarmTests {
+		f := &FakeExecutor{Commands: map[string]FakeCommand{prewarm: tt.command}}
+		restore := useFake(f)
+		state, err := Prewarm("/dev/drbd100", 1, time.Second*30)
+		restore()
+		if state != tt.state || (err == nil) != tt.ok {
+			t.Errorf("Called: Prewarm(%q), Expected: %q, ok %t, Got: %q, %v", "/dev/drbd100", tt.state, tt.ok, state, err)
+		}
+		if ran := f.Ran(); !reflect.DeepEqual(ran, []string{prewarm}) {
+			t.Errorf("Called: Prewarm(%q), Expected: %q, Got: %q", "/dev/drbd100", prewarm, ran)
+		}
+	}
+}
+
+func TestDoFuserPIDs(t *testing.T) {
+	var fuserTests = []struct {
+		in  string
+		out []string
+	}{
+		{"/dev/drbd100:  1234  5678\n", []string{"1234", "5678"}},
+		{"/dev/drbd100:  1234m\n", []string{"1234"}},
+		{"", nil},
+	}
+
+	for _, tt := range fuserTests {
+		pids := doFuserPIDs(tt.in)
+		if !reflect.DeepEqual(pids, tt.out) {
+			t.Errorf("Called: doFuserPIDs(%q), Expected: %q, Got: %q", tt.in, tt.out, pids)
+		}
+	}
+}
+
+func TestDoDiskState(t *testing.T) {
+	var diskStateTests = []struct {
+		status string
+		out    string
+	}{
+		{"r0 role:Secondary\n  disk:UpToDate\n  peer role:Primary\n    peer-disk:UpToDate\n", "UpToDate"},
+		{"r0 role:Secondary\n  disk:Outdated\n  peer connection:Connecting\n", "Outdated"},
+		{"r0 role:Secondary\n  disk:Diskless\n  peer role:Secondary\n    peer-disk:Outdated\n", "Diskless"},
+		{"r0 role:Secondary\n  disk:Inconsistent\n  peer role:Secondary\n    replication:SyncTarget peer-disk:UpToDate done:42.10\n", "Inconsistent"},
+		{"", ""},
+	}
+
+	for _, tt := range diskStateTests {
+		state, _ := doDiskState(tt.status)
+		if state != tt.out {
+			t.Errorf("Called: doDiskState(%q), Expected: %q, Got: %q", tt.status, tt.out, state)
+		}
+	}
+}
+
+func TestWaitForUpToDate(t *testing.T) {
+	var waitTests = []struct {
+		states []string
+		ok     bool
+	}{
+		{[]string{"UpToDate"}, true},
+		{[]string{"Inconsistent", "Inconsistent", "UpToDate"}, true},
+		{[]string{"Inconsistent"}, false},
+		{[]string{"Outdated"}, false},
+	}
+
+	for _, tt := range waitTests {
+		polls := 0
+		diskState := func() (string, error) {
+			state := tt.states[len(tt.states)-1]
+			if polls < len(tt.states) {
+				state = tt.states[polls]
+			}
+			polls++
+			return state, nil
+		}
+		state, err := waitForUpToDate(diskState, time.Millisecond*50, time.Millisecond)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: waitForUpToDate(%q), Expected ok: %v, Got: %q, %v", tt.states, tt.ok, state, err)
+		}
+		if tt.ok && polls != len(tt.states) {
+			t.Errorf("Called: waitForUpToDate(%q), Expected: %d polls, Got: %d", tt.states, len(tt.states), polls)
+		}
+	}
+}
+
+func TestWaitForSecondary(t *testing.T) {
+	var waitTests = []struct {
+		roles []string
+		ok    bool
+	}{
+		{[]string{"Secondary"}, true},
+		{[]string{"Primary", "Primary", "Secondary"}, true},
+		{[]string{"Primary"}, false},
+	}
+
+	for _, tt := range waitTests {
+		polls := 0
+		role := func() (string, error) {
+			current := tt.roles[len(tt.roles)-1]
+			if polls < len(tt.roles) {
+				current = tt.roles[polls]
+			}
+			polls++
+			return current, nil
+		}
+		err := waitForSecondary(role, time.Millisecond*50, time.Millisecond)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: waitForSecondary(%q), Expected ok: %v, Got: %v", tt.roles, tt.ok, err)
+		}
+		if tt.ok && polls != len(tt.roles) {
+			t.Errorf("Called: waitForSecondary(%q), Expected: %d polls, Got: %d", tt.roles, len(tt.roles), polls)
+		}
+	}
+}
+
+func TestDoRole(t *testing.T) {
+	var roleTests = []struct {
+		in  string
+		out string
+		ok  bool
+	}{
+		{"r0 role:Primary\n  disk:UpToDate\n  peer role:Secondary\n    peer-disk:UpToDate\n", "Primary", true},
+		{"r0 role:Secondary\n  disk:Diskless\n", "Secondary", true},
+		{"r0 role:Secondary suspended:user\n  disk:UpToDate\n", "Secondary", true},
+		{"", "", false},
+	}
+
+	for _, tt := range roleTests {
+		out, err := doRole(tt.in)
+		if out != tt.out || (err == nil) != tt.ok {
+			t.Errorf("Called: doRole(%q), Expected: %q, ok: %v, Got: %q, %v", tt.in, tt.out, tt.ok, out, err)
+		}
+	}
+}
+
 func TestDoIsClient(t *testing.T) {
 	var isClientTests = []struct {
 		assignmentInfo string
@@ -95,6 +481,25 @@ func TestDoIsClient(t *testing.T) {
 	}
 }
 
+func TestDoAssignmentType(t *testing.T) {
+	var assignmentTypeTests = []struct {
+		assignmentInfo string
+		out            string
+	}{
+		{"node0,test0,1,connect|deploy|diskless,connect|deploy|diskless\n", AssignmentDiskless},
+		{"node0,test0,1,connect|deploy,connect|deploy\n", AssignmentDiskful},
+		{"", AssignmentNone},
+		{"node0,test0\n", ""},
+	}
+
+	for _, tt := range assignmentTypeTests {
+		assignment, _ := doAssignmentType(tt.assignmentInfo)
+		if assignment != tt.out {
+			t.Errorf("Called: doAssignmentType(%q), Expected: %q, Got: %q", tt.assignmentInfo, tt.out, assignment)
+		}
+	}
+}
+
 func TestDoGetMinorFromDevice(t *testing.T) {
 	var getMinorTests = []struct {
 		device string
@@ -151,3 +556,555 @@ func TestDoCheckFSType(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatNeeded(t *testing.T) {
+	const ext4 = "ID_FS_UUID=15336bdb-4584-4c30-9719-754f5c4744e1\nID_FS_TYPE=ext4\n"
+	const partitioned = "ID_PART_TABLE_UUID=8d1d0f57\nID_PART_TABLE_TYPE=dos\n"
+
+	var formatNeededTests = []struct {
+		blkid    string
+		fsType   string
+		safe     bool
+		readOnly bool
+		format   bool
+		ok       bool
+	}{
+		// Already formatted, skip mkfs.
+		{ext4, "ext4", true, false, false, true},
+		{ext4, "", true, false, false, true},
+		// Blank, format then mount.
+		{"", "ext4", true, false, true, true},
+		{"\n", "xfs", true, false, true, true},
+		// Never format over a signature or without being allowed to.
+		{ext4, "xfs", true, false, false, false},
+		{partitioned, "ext4", true, false, false, false},
+		{"", "ext4", false, false, false, false},
+		{"", "ext4", true, true, false, false},
+		{"", "", true, false, false, false},
+	}
+
+	for _, tt := range formatNeededTests {
+		m := Mounter{Resource: &Resource{ReadOnly: tt.readOnly}, FSType: tt.fsType, SafeFormat: tt.safe}
+		format, err := m.formatNeeded("/dev/drbd100", tt.blkid)
+		if format != tt.format || (err == nil) != tt.ok {
+			t.Errorf("Called: formatNeeded(%q, %q) with FSType %q, SafeFormat %v, ReadOnly %v, Expected: %v, %v, Got: %v, %v",
+				"/dev/drbd100", tt.blkid, tt.fsType, tt.safe, tt.readOnly, tt.format, tt.ok, format, err)
+		}
+	}
+}
+
+func TestMountWrongFSType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-wrongfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "volume")
+
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"drbdmanage list-volumes --resources r0 --machine-readable": {Output: "r0,,0,102400,7000,100,\n"},
+			"drbdadm primary r0":         {},
+			"drbdadm secondary r0":       {},
+			"blkid -o udev /dev/drbd100": {Output: "ID_FS_TYPE=xfs\n"},
+		},
+		Files: map[string]string{moduleDir: "", "/dev/drbd100": ""},
+	}
+	defer useFake(f)()
+
+	m := Mounter{Resource: &Resource{Name: "r0"}, FSType: "ext4", SafeFormat: true}
+	_, err = m.Mount(path)
+	if me, ok := err.(*MountError); !ok || me.Cause != ErrWrongFSType {
+		t.Errorf("Called: Mount(%q) of an xfs device as ext4, Expected: %v, Got: %v", path, ErrWrongFSType, err)
+	}
+}
+
+func TestMkfsArgs(t *testing.T) {
+	var mkfsArgsTests = []struct {
+		fsType   string
+		reserved string
+		durable  bool
+		args     []string
+		applied  string
+	}{
+		{"ext4", "", false, []string{"-t", "ext4", "/dev/drbd100"}, ""},
+		{"ext4", "0", false, []string{"-t", "ext4", "-m", "0", "/dev/drbd100"}, "0"},
+		{"ext3", "2.5", false, []string{"-t", "ext3", "-m", "2.5", "/dev/drbd100"}, "2.5"},
+		{"xfs", "1", false, []string{"-t", "xfs", "/dev/drbd100"}, ""},
+		{"ext4", "", true, []string{"-t", "ext4", "-E", "lazy_itable_init=0,lazy_journal_init=0", "/dev/drbd100"}, ""},
+		{"xfs", "", true, []string{"-t", "xfs", "/dev/drbd100"}, ""},
+	}
+
+	for _, tt := range mkfsArgsTests {
+		m := Mounter{FSType: tt.fsType, ReservedBlocksPercent: tt.reserved, DurableFormat: tt.durable}
+		args, result := m.mkfsArgs("/dev/drbd100")
+		if !reflect.DeepEqual(args, tt.args) || result.ReservedBlocksPercent != tt.applied {
+			t.Errorf("Called: mkfsArgs(%q) with FSType %q and ReservedBlocksPercent %q, Expected: %q, %q, Got: %q, %q",
+				"/dev/drbd100", tt.fsType, tt.reserved, tt.args, tt.applied, args, result.ReservedBlocksPercent)
+		}
+	}
+}
+
+func TestDoDiscardSupported(t *testing.T) {
+	var discardMaxBytesTests = []struct {
+		in  string
+		out bool
+	}{
+		{"2147450880\n", true},
+		{"0\n", false},
+		{"", false},
+		{"garbage\n", false},
+	}
+
+	for _, tt := range discardMaxBytesTests {
+		ok := doDiscardSupported(tt.in)
+		if ok != tt.out {
+			t.Errorf("Called: doDiscardSupported(%q), Expected: %v, Got: %v", tt.in, tt.out, ok)
+		}
+	}
+}
+
+func TestUsedPercent(t *testing.T) {
+	var usedPercentTests = []struct {
+		blocks uint64
+		free   uint64
+		avail  uint64
+		out    float64
+	}{
+		{1000, 1000, 950, 0},
+		{1000, 500, 450, 52.63157894736842},
+		{1000, 50, 0, 100},
+		{0, 0, 0, 0},
+	}
+
+	for _, tt := range usedPercentTests {
+		used := usedPercent(tt.blocks, tt.free, tt.avail)
+		if used != tt.out {
+			t.Errorf("Called: usedPercent(%d, %d, %d), Expected: %v, Got: %v", tt.blocks, tt.free, tt.avail, tt.out, used)
+		}
+	}
+}
+
+func TestWaitForDeviceNode(t *testing.T) {
+	var deviceNodeTests = []struct {
+		errs    []error
+		retries int
+		ok      bool
+	}{
+		{[]error{nil}, 0, true},
+		{[]error{&os.PathError{Op: "open", Path: "/dev/drbd100", Err: syscall.ENOENT}, syscall.ENXIO, nil}, 2, true},
+		{[]error{syscall.EACCES}, 0, false},
+		{[]error{syscall.ENOENT, syscall.ENOENT, syscall.ENOENT, syscall.ENOENT}, 3, false},
+	}
+
+	for _, tt := range deviceNodeTests {
+		calls := 0
+		open := func(string) error {
+			err := tt.errs[calls]
+			if calls < len(tt.errs)-1 {
+				calls++
+			}
+			return err
+		}
+
+		retries, err := waitForDeviceNode("/dev/drbd100", 3, 0, open)
+		if retries != tt.retries || (err == nil) != tt.ok {
+			t.Errorf("Called: waitForDeviceNode(%q) with errors %v, Expected: %d retries, success %v, Got: %d, %v", "/dev/drbd100", tt.errs, tt.retries, tt.ok, retries, err)
+		}
+	}
+}
+
+func TestDoMountMode(t *testing.T) {
+	mounts := "/dev/sda1 / ext4 rw,relatime 0 0\n" +
+		"/dev/drbd100 /mnt/r0 ext4 ro,relatime 0 0\n" +
+		"/dev/drbd101 /mnt/with\\040space xfs rw,noatime 0 0\n" +
+		"/dev/drbd102 /mnt/r2 ext4 rw,relatime 0 0\n" +
+		"/dev/drbd102 /mnt/r2 ext4 ro,relatime 0 0\n"
+
+	var mountModeTests = []struct {
+		path string
+		mode string
+		ok   bool
+	}{
+		{"/mnt/r0", "ro", true},
+		{"/mnt/with space", "rw", true},
+		{"/mnt/r2", "ro", true},
+		{"/mnt/r3", "", false},
+	}
+
+	for _, tt := range mountModeTests {
+		mode, err := doMountMode(mounts, tt.path)
+		if mode != tt.mode || (err == nil) != tt.ok {
+			t.Errorf("Called: doMountMode(%q, %q), Expected: %q, %v, Got: %q, %v", mounts, tt.path, tt.mode, tt.ok, mode, err)
+		}
+	}
+}
+
+func TestDoPeers(t *testing.T) {
+	var peersTests = []struct {
+		in    string
+		peers int
+	}{
+		{"r0 role:Secondary\n  disk:UpToDate\n", 0},
+		{"r0 role:Secondary\n  disk:UpToDate\n  node1 role:Primary\n    peer-disk:UpToDate\n", 1},
+		{"r0 role:Primary\n  volume:0 disk:UpToDate\n  volume:1 disk:UpToDate\n" +
+			"  node1 connection:Connecting\n  node2 role:Secondary\n    volume:0 peer-disk:UpToDate\n    volume:1 peer-disk:UpToDate\n", 2},
+	}
+
+	for _, tt := range peersTests {
+		peers := doPeers(tt.in)
+		if peers != tt.peers {
+			t.Errorf("Called: doPeers(%q), Expected: %d, Got: %d", tt.in, tt.peers, peers)
+		}
+	}
+}
+
+func TestWaitForGone(t *testing.T) {
+	var goneTests = []struct {
+		lingers int
+		ok      bool
+	}{
+		{0, true},
+		{3, true},
+		{-1, false},
+	}
+
+	for _, tt := range goneTests {
+		calls := 0
+		exists := func(string) bool {
+			calls++
+			return tt.lingers < 0 || calls <= tt.lingers
+		}
+
+		err := waitForGone("/dev/drbd100", time.Millisecond*20, time.Millisecond, exists)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: waitForGone(%q) with the device lingering for %d checks, Expected success: %v, Got: %v", "/dev/drbd100", tt.lingers, tt.ok, err)
+		}
+	}
+}
+
+func TestMountArgs(t *testing.T) {
+	var mountArgsTests = []struct {
+		readOnly bool
+		options  []string
+		args     []string
+	}{
+		{true, nil, []string{"-o", "ro", "/dev/drbd100", "/mnt/r0"}},
+		{false, nil, []string{"/dev/drbd100", "/mnt/r0"}},
+		{false, []string{"noatime", "discard"}, []string{"-o", "noatime,discard", "/dev/drbd100", "/mnt/r0"}},
+		{true, []string{"noatime"}, []string{"-o", "ro,noatime", "/dev/drbd100", "/mnt/r0"}},
+		{true, []string{"noatime", "ro"}, []string{"-o", "noatime,ro", "/dev/drbd100", "/mnt/r0"}},
+	}
+
+	for _, tt := range mountArgsTests {
+		m := Mounter{Resource: &Resource{Name: "r0", ReadOnly: tt.readOnly}, MountOptions: tt.options}
+		args := m.mountArgs("/dev/drbd100", "/mnt/r0")
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Called: mountArgs(%q, %q) with ReadOnly %v, Expected: %q, Got: %q", "/dev/drbd100", "/mnt/r0", tt.readOnly, tt.args, args)
+		}
+	}
+}
+
+func TestMountFailure(t *testing.T) {
+	var mountFailureTests = []struct {
+		in  string
+		out error
+	}{
+		{"mount: /mnt: /dev/drbd100 already mounted on /mnt.", ErrAlreadyMounted},
+		{"mount: /mnt: target is busy.", ErrAlreadyMounted},
+		{"mount: /mnt: wrong fs type, bad option, bad superblock on /dev/drbd100.", ErrWrongFSType},
+		{"mount: /mnt: unknown filesystem type 'zfs'.", ErrWrongFSType},
+		{"mount: /mnt: permission denied.", ErrMountFailed},
+	}
+
+	for _, tt := range mountFailureTests {
+		out := mountFailure(tt.in)
+		if out != tt.out {
+			t.Errorf("Called: mountFailure(%q), Expected: %v, Got: %v", tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestUnassign(t *testing.T) {
+	var unassignTests = []struct {
+		name     string
+		assigned []bool
+		cmdErr   error
+		calls    int
+		ok       bool
+	}{
+		{"assigned", []bool{true}, nil, 1, true},
+		{"already unassigned", []bool{false}, nil, 0, true},
+		{"unassigned meanwhile", []bool{true, false}, errors.New("exit status 1"), 1, true},
+		{"failed", []bool{true, true}, errors.New("exit status 1"), 1, false},
+	}
+
+	for _, tt := range unassignTests {
+		queries, calls := 0, 0
+		assigned := func() (bool, error) {
+			ok := tt.assigned[queries]
+			queries++
+			return ok, nil
+		}
+		cmd := func() ([]byte, error) {
+			calls++
+			return []byte("Error: operation failed"), tt.cmdErr
+		}
+		err := unassign(Resource{Name: "r0", NodeName: "node1"}, assigned, cmd)
+		if (err == nil) != tt.ok || calls != tt.calls {
+			t.Errorf("Called: unassign(%s), Expected: ok %v after %d calls, Got: %v after %d calls", tt.name, tt.ok, tt.calls, err, calls)
+		}
+	}
+}
+
+func TestSetFSGroup(t *testing.T) {
+	gid := int64(2000)
+	var fsGroupTests = []struct {
+		fsGroup  *int64
+		readOnly bool
+		owned    bool
+		cmds     [][]string
+	}{
+		{&gid, false, false, [][]string{
+			{"chgrp", "-R", "2000", "/mnt"},
+			{"chmod", "-R", "g+rwX", "/mnt"},
+		}},
+		{&gid, false, true, nil},
+		{&gid, true, false, nil},
+		{nil, false, false, nil},
+	}
+
+	for _, tt := range fsGroupTests {
+		var cmds [][]string
+		m := Mounter{Resource: &Resource{ReadOnly: tt.readOnly}, FSGroup: tt.fsGroup}
+		err := m.setFSGroup("/mnt",
+			func(string, int64) bool { return tt.owned },
+			func(name string, args ...string) ([]byte, error) {
+				cmds = append(cmds, append([]string{name}, args...))
+				return nil, nil
+			})
+		if err != nil || !reflect.DeepEqual(cmds, tt.cmds) {
+			t.Errorf("Called: setFSGroup(fsGroup %v, ro %v, owned %v), Expected: %q, Got: %q, %v", tt.fsGroup, tt.readOnly, tt.owned, tt.cmds, cmds, err)
+		}
+	}
+}
+
+func TestReleaseAndDemote(t *testing.T) {
+	held := errors.New("unmounted, but device /dev/drbd100 is still held open by: pid 42")
+	busy := errors.New("DRBD: Unable to demote resource \"r0\": exit status 11")
+	var demoteTests = []struct {
+		release error
+		demote  error
+		out     string
+	}{
+		{nil, nil, ""},
+		{held, nil, held.Error()},
+		{nil, busy, busy.Error()},
+		{held, busy, held.Error() + "; " + busy.Error()},
+	}
+
+	for _, tt := range demoteTests {
+		demoted := false
+		err := releaseAndDemote(
+			func() error { return tt.release },
+			func() error {
+				demoted = true
+				return tt.demote
+			})
+		out := ""
+		if err != nil {
+			out = err.Error()
+		}
+		if !demoted || out != tt.out {
+			t.Errorf("Called: releaseAndDemote(%v, %v), Expected: demoted, %q, Got: demoted %v, %q", tt.release, tt.demote, tt.out, demoted, out)
+		}
+	}
+}
+
+func TestMountDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-mountdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mountDirTests = []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"missing", filepath.Join(dir, "pods", "uid", "mount"), true},
+		{"exists", dir, true},
+		{"file", file, false},
+		{"below a file", filepath.Join(file, "mount"), false},
+	}
+
+	for _, tt := range mountDirTests {
+		err := mountDir(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: mountDir(%s), Expected: ok %t, Got: %v", tt.name, tt.ok, err)
+			continue
+		}
+		if info, sErr := os.Stat(tt.path); tt.ok && (sErr != nil || !info.IsDir()) {
+			t.Errorf("Called: mountDir(%s), Expected: a directory at %s, Got: %v", tt.name, tt.path, sErr)
+		}
+	}
+}
+
+func TestPromoteWithRetry(t *testing.T) {
+	elsewhere := errors.New("DRBD: Unable to promote resource \"r0\": exit status 11: Multiple primaries not allowed by config")
+	other := errors.New("DRBD: Unable to promote resource \"r0\": exit status 17: No disk")
+	b := Backoff{Timeout: time.Second * 4, Interval: time.Second}
+	var promoteTests = []struct {
+		name     string
+		failures int
+		err      error
+		attempts int
+		cause    error
+	}{
+		{"promotes", 0, elsewhere, 1, nil},
+		{"peer releases after 2 attempts", 2, elsewhere, 3, nil},
+		{"peer never releases", 100, elsewhere, 3, ErrPrimaryElsewhere},
+		{"other failure", 100, other, 1, ErrMountFailed},
+	}
+
+	for _, tt := range promoteTests {
+		attempts := 0
+		err := promoteWithRetry(func() error {
+			attempts++
+			if attempts <= tt.failures {
+				return tt.err
+			}
+			return nil
+		}, b, func(time.Duration) {})
+		var cause error
+		if err != nil {
+			cause = promoteFailure(err)
+		}
+		if attempts != tt.attempts || cause != tt.cause {
+			t.Errorf("Called: promoteWithRetry(%s), Expected: %d attempts, %v, Got: %d attempts, %v", tt.name, tt.attempts, tt.cause, attempts, err)
+		}
+	}
+}
+
+func TestDeviceMounted(t *testing.T) {
+	mounts := `/dev/sda1 / ext4 rw,relatime 0 0
+/dev/drbd100 /var/lib/kubelet/plugins/kubernetes.io/flexvolume/linbit/drbd/mounts/r0 ext4 rw,relatime 0 0
+`
+	var mountedTests = []struct {
+		device  string
+		mounted bool
+	}{
+		{"/dev/drbd100", true},
+		{"/dev/drbd101", false},
+		{"/dev/drbd10", false},
+	}
+
+	for _, tt := range mountedTests {
+		if mounted := deviceMounted(mounts, tt.device); mounted != tt.mounted {
+			t.Errorf("Called: deviceMounted(%q), Expected: %v, Got: %v", tt.device, tt.mounted, mounted)
+		}
+	}
+}
+
+func TestPathMounted(t *testing.T) {
+	mounts := `/dev/sda1 / ext4 rw,relatime 0 0
+/dev/drbd100 /var/lib/kubelet/pods/uid/volumes/linbit~drbd/r0 ext4 rw,relatime 0 0
+/dev/drbd101 /mnt/with\040space ext4 rw,relatime 0 0
+`
+	var mountedTests = []struct {
+		path    string
+		mounted bool
+	}{
+		{"/var/lib/kubelet/pods/uid/volumes/linbit~drbd/r0", true},
+		{"/var/lib/kubelet/pods/uid/volumes/linbit~drbd/r1", false},
+		{"/mnt/with space", true},
+		{"/mnt", false},
+	}
+
+	for _, tt := range mountedTests {
+		if mounted := pathMounted(mounts, tt.path); mounted != tt.mounted {
+			t.Errorf("Called: pathMounted(%q), Expected: %v, Got: %v", tt.path, tt.mounted, mounted)
+		}
+	}
+}
+
+func TestUnmountAndRemove(t *testing.T) {
+	var unmountTests = []struct {
+		name string
+		// mounted is the answer to each check, the last one repeats.
+		mounted []bool
+		// busy is how many umount calls fail as busy before one succeeds.
+		busy    int
+		ok      bool
+		umounts int
+		removed bool
+	}{
+		{"unmount then rmdir", []bool{true, false}, 0, true, 1, true},
+		{"busy once, retried", []bool{true, false}, 1, true, 2, true},
+		{"still busy after retry", []bool{true}, 2, false, 2, false},
+		{"still mounted after unmount", []bool{true}, 0, false, 1, false},
+		{"not a mountpoint, skip", []bool{false}, 0, true, 0, true},
+	}
+
+	for _, tt := range unmountTests {
+		dir, err := ioutil.TempDir("", "drbd-flexvolume-unmount")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "r0")
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		checks, umounts := 0, 0
+		mounted := func() (bool, error) {
+			m := tt.mounted[len(tt.mounted)-1]
+			if checks < len(tt.mounted) {
+				m = tt.mounted[checks]
+			}
+			checks++
+			return m, nil
+		}
+		umount := func() ([]byte, error) {
+			umounts++
+			if umounts <= tt.busy {
+				return []byte("umount: " + path + ": target is busy."), errors.New("exit status 32")
+			}
+			return nil, nil
+		}
+
+		err = unmountAndRemove(path, mounted, umount, time.Millisecond)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: unmountAndRemove(%s), Expected ok: %v, Got: %v", tt.name, tt.ok, err)
+		}
+		if umounts != tt.umounts {
+			t.Errorf("Called: unmountAndRemove(%s), Expected: %d umount calls, Got: %d", tt.name, tt.umounts, umounts)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) != tt.removed {
+			t.Errorf("Called: unmountAndRemove(%s), Expected mount point removed: %v, Got: %v", tt.name, tt.removed, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPromoteFailure(t *testing.T) {
+	var promoteTests = []struct {
+		in  string
+		out error
+	}{
+		{"r0: State change failed: (-1) Multiple primaries not allowed by config", ErrPrimaryElsewhere},
+		{"r0: State change failed: (-10) State change was refused by peer node", ErrPrimaryElsewhere},
+		{"r0: State change failed: (-2) Need access to UpToDate data", ErrMountFailed},
+	}
+
+	for _, tt := range promoteTests {
+		if out := promoteFailure(errors.New(tt.in)); out != tt.out {
+			t.Errorf("Called: promoteFailure(%q), Expected: %v, Got: %v", tt.in, tt.out, out)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CommandType groups subprocesses with similar expected run times, each
+// type has its own timeout.
+type CommandType string
+
+const (
+	// CmdQuery is a read-only state query that should return instantly.
+	CmdQuery CommandType = "query"
+	// CmdAssign changes resource assignments.
+	CmdAssign CommandType = "assign"
+	// CmdMount mounts a device or prepares its mount point.
+	CmdMount CommandType = "mount"
+	// CmdMkfs creates a filesystem, which may take a while on large devices.
+	CmdMkfs CommandType = "mkfs"
+	// CmdUnmount unmounts a filesystem.
+	CmdUnmount CommandType = "unmount"
+	// CmdDiscard trims a filesystem.
+	CmdDiscard CommandType = "discard"
+	// CmdResize grows a volume or filesystem.
+	CmdResize CommandType = "resize"
+	// CmdChown changes the group ownership of a whole filesystem.
+	CmdChown CommandType = "chown"
+	// CmdModprobe loads a kernel module.
+	CmdModprobe CommandType = "modprobe"
+	// CmdFsck checks and repairs a filesystem before mounting it.
+	CmdFsck CommandType = "fsck"
+	// CmdHook runs a pre-mount hook given in the options.
+	CmdHook CommandType = "hook"
+	// CmdPrewarm reads a device into the page cache, bounded by timeout(1)
+	// as well.
+	CmdPrewarm CommandType = "prewarm"
+)
+
+// CommandTimeouts holds the maximum run time for each type of subprocess.
+var CommandTimeouts = map[CommandType]time.Duration{
+	CmdQuery:    time.Second * 30,
+	CmdAssign:   time.Minute * 2,
+	CmdMount:    time.Minute,
+	CmdMkfs:     time.Minute * 10,
+	CmdUnmount:  time.Minute,
+	CmdDiscard:  time.Minute * 5,
+	CmdResize:   time.Minute * 5,
+	CmdChown:    time.Minute * 10,
+	CmdModprobe: time.Second * 30,
+	CmdFsck:     time.Minute * 10,
+	CmdHook:     time.Minute * 5,
+	CmdPrewarm:  time.Minute * 10,
+}
+
+// SetCommandTimeout overrides the timeout of kind with a duration such as
+// "90s" or "5m".
+func SetCommandTimeout(kind CommandType, timeout string) error {
+	if _, ok := CommandTimeouts[kind]; !ok {
+		return fmt.Errorf("DRBD: Unknown command type %q", kind)
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return fmt.Errorf("DRBD: Bad %s command timeout %q: %v", kind, timeout, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("DRBD: Bad %s command timeout %q: must be positive", kind, timeout)
+	}
+	CommandTimeouts[kind] = d
+	return nil
+}
+
+// ErrCommandTimeout is the cause of the errors of commands that were killed
+// for exceeding the timeout of their type.
+var ErrCommandTimeout = errors.New("command timed out")
+
+// TimeoutError is returned for a command killed after Timeout.
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Command, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return ErrCommandTimeout
+}
+
+// ErrInterrupted is the cause of the errors of commands that were killed, or
+// not started, because the plugin was interrupted.
+var ErrInterrupted = errors.New("command interrupted")
+
+// interrupted is cancelled by Interrupt.
+var interrupted, interrupt = context.WithCancel(context.Background())
+
+// Interrupt kills running subprocesses and makes run refuse to start new ones,
+// so that an interrupted call fails quickly through its usual error handling.
+func Interrupt() {
+	interrupt()
+}
+
+// DryRun makes run log commands that change anything instead of executing
+// them. Queries still run, so that the logged commands follow the real state.
+var DryRun bool
+
+// dryRunAssumes reports whether a dry run carries on as if err hadn't
+// happened, logging what it assumed instead. The changes a dry run skips
+// never take effect, so the queries checking for them fail or find the node
+// as it was.
+func dryRunAssumes(assumption string, err error) bool {
+	if !DryRun {
+		return false
+	}
+	log.Printf("DRBD: dry run, assuming %s: %v", assumption, err)
+	return true
+}
+
+// secretFlags are followed by values that must never be logged.
+var secretFlags = map[string]bool{"--shared-secret": true}
+
+// commandLine is the command as it may be logged, with secrets redacted.
+func commandLine(name string, args []string) string {
+	shown := make([]string, len(args))
+	for i, a := range args {
+		shown[i] = a
+		if i > 0 && secretFlags[args[i-1]] {
+			shown[i] = "<redacted>"
+		}
+	}
+	return strings.TrimSpace(name + " " + strings.Join(shown, " "))
+}
+
+// run executes the command with Exec and returns its combined output. The
+// command is run from the path set for it, if any.
+func run(kind CommandType, name string, args ...string) ([]byte, error) {
+	name, args = binaryCommand(name, args)
+	if DryRun && kind != CmdQuery {
+		log.Printf("DRBD: dry run, not running: %s", commandLine(name, args))
+		return nil, nil
+	}
+	return Exec.Run(kind, name, args...)
+}
+
+// Run executes the command, killing it if it runs longer than the timeout for
+// its kind.
+func (osExecutor) Run(kind CommandType, name string, args ...string) ([]byte, error) {
+	if interrupted.Err() != nil {
+		return nil, fmt.Errorf("%s: %w", commandLine(name, args), ErrInterrupted)
+	}
+
+	ctx, cancel := context.WithTimeout(interrupted, CommandTimeouts[kind])
+	defer cancel()
+
+	cmd, cmdArgs := withAffinity(name, args)
+	out, err := exec.CommandContext(ctx, cmd, cmdArgs...).CombinedOutput()
+	if interrupted.Err() != nil {
+		return out, fmt.Errorf("%s: %w", commandLine(name, args), ErrInterrupted)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, &TimeoutError{Command: commandLine(name, args), Timeout: CommandTimeouts[kind]}
+	}
+	return out, err
+}
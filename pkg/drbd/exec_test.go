@@ -0,0 +1,183 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetCommandTimeout(t *testing.T) {
+	defaults := make(map[CommandType]time.Duration)
+	for k, v := range CommandTimeouts {
+		defaults[k] = v
+	}
+	defer func() { CommandTimeouts = defaults }()
+
+	var setTimeoutTests = []struct {
+		kind    CommandType
+		timeout string
+		out     time.Duration
+		ok      bool
+	}{
+		{CmdMkfs, "20m", time.Minute * 20, true},
+		{CmdQuery, "5s", time.Second * 5, true},
+		{CmdQuery, "-5s", time.Second * 5, false},
+		{CmdQuery, "soon", time.Second * 5, false},
+		{"resync", "1h", 0, false},
+	}
+
+	for _, tt := range setTimeoutTests {
+		err := SetCommandTimeout(tt.kind, tt.timeout)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: SetCommandTimeout(%q, %q), Expected error: %v, Got: %v", tt.kind, tt.timeout, !tt.ok, err)
+		}
+		if CommandTimeouts[tt.kind] != tt.out {
+			t.Errorf("Called: SetCommandTimeout(%q, %q), Expected: %v, Got: %v", tt.kind, tt.timeout, tt.out, CommandTimeouts[tt.kind])
+		}
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	old := CommandTimeouts[CmdQuery]
+	CommandTimeouts[CmdQuery] = time.Millisecond * 50
+	defer func() { CommandTimeouts[CmdQuery] = old }()
+
+	start := time.Now()
+	_, err := run(CmdQuery, "sleep", "5")
+	if !errors.Is(err, ErrCommandTimeout) {
+		t.Errorf("Called: run(%q, %q, %q), Expected: %v, Got: %v", CmdQuery, "sleep", "5", ErrCommandTimeout, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Called: run(%q, %q, %q), Expected to be killed after %v, took %v", CmdQuery, "sleep", "5", CommandTimeouts[CmdQuery], time.Since(start))
+	}
+}
+
+func TestRunNoTimeout(t *testing.T) {
+	old := CommandTimeouts[CmdQuery]
+	CommandTimeouts[CmdQuery] = time.Second * 5
+	defer func() { CommandTimeouts[CmdQuery] = old }()
+
+	if _, err := run(CmdQuery, "sh", "-c", "exit 3"); err == nil || errors.Is(err, ErrCommandTimeout) {
+		t.Errorf("Called: run(%q, %q), Expected: exit status 3, Got: %v", CmdQuery, "exit 3", err)
+	}
+}
+
+func TestRunInterrupt(t *testing.T) {
+	oldInterrupted, oldInterrupt := interrupted, interrupt
+	interrupted, interrupt = context.WithCancel(context.Background())
+	defer func() { interrupted, interrupt = oldInterrupted, oldInterrupt }()
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		Interrupt()
+	}()
+	start := time.Now()
+	if _, err := run(CmdQuery, "sleep", "5"); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("Called: run(%q, %q, %q), Expected: %v, Got: %v", CmdQuery, "sleep", "5", ErrInterrupted, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Called: run(%q, %q, %q), Expected to be killed on Interrupt, took %v", CmdQuery, "sleep", "5", time.Since(start))
+	}
+
+	// Nothing starts after Interrupt.
+	if _, err := run(CmdQuery, "true"); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("Called: run(%q, %q) after Interrupt, Expected: %v, Got: %v", CmdQuery, "true", ErrInterrupted, err)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	var commandLineTests = []struct {
+		name string
+		args []string
+		out  string
+	}{
+		{"drbdadm", []string{"primary", "r0"}, "drbdadm primary r0"},
+		{"drbdmanage", []string{"net-options", "--shared-secret", "s3cr3t", "--resource", "r0"}, "drbdmanage net-options --shared-secret <redacted> --resource r0"},
+		{"drbdmanage", []string{"--shared-secret"}, "drbdmanage --shared-secret"},
+	}
+
+	for _, tt := range commandLineTests {
+		out := commandLine(tt.name, tt.args)
+		if out != tt.out {
+			t.Errorf("Called: commandLine(%q, %q), Expected: %q, Got: %q", tt.name, tt.args, tt.out, out)
+		}
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	DryRun = true
+	defer func() { DryRun = false }()
+
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "ran")
+
+	for _, kind := range []CommandType{CmdAssign, CmdMount, CmdMkfs, CmdUnmount, CmdDiscard, CmdResize, CmdChown, CmdModprobe, CmdFsck, CmdHook, CmdPrewarm} {
+		out, err := run(kind, "sh", "-c", "touch "+marker+"; exit 1")
+		if err != nil || len(out) != 0 {
+			t.Errorf("Called: run(%q) in dry run, Expected: no output and no error, Got: %q, %v", kind, out, err)
+		}
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("Called: run() in dry run, Expected: commands not executed, Got: %s created", marker)
+	}
+
+	// Queries don't change anything and still run.
+	if out, err := run(CmdQuery, "echo", "queried"); err != nil || strings.TrimSpace(string(out)) != "queried" {
+		t.Errorf("Called: run(%q) in dry run, Expected: %q, Got: %q, %v", CmdQuery, "queried", out, err)
+	}
+}
+
+func TestTimeoutsWrapped(t *testing.T) {
+	timeout := FakeCommand{Err: &TimeoutError{Command: "drbd", Timeout: time.Second}}
+	r := Resource{Name: "r0", NodeName: "node1"}
+	f := &FakeExecutor{Commands: map[string]FakeCommand{
+		"drbdadm primary r0": timeout,
+		"drbdsetup show":     timeout,
+		"drbdmanage list-volumes --resources r0 --machine-readable": timeout,
+		"drbdadm verify r0": timeout,
+	}}
+	defer useFake(f)()
+
+	var wrapTests = []struct {
+		name string
+		call func() error
+	}{
+		{"Promote", r.Promote},
+		{"MinorsInUse", func() error { _, err := MinorsInUse(); return err }},
+		{"DevicePath", func() error { _, err := DevicePath(r); return err }},
+		{"StartVerify", func() error { return StartVerify(r) }},
+	}
+
+	for _, tt := range wrapTests {
+		if err := tt.call(); !errors.Is(err, ErrCommandTimeout) {
+			t.Errorf("Called: %s() with a command timing out, Expected: %v, Got: %v", tt.name, ErrCommandTimeout, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// Executor runs the commands of the package and reads the state of the node
+// they change. Tests replace Exec, e.g. with a FakeExecutor, to script both.
+type Executor interface {
+	// Run runs a command of kind and returns its combined output.
+	Run(kind CommandType, name string, args ...string) ([]byte, error)
+	// ReadFile returns the contents of a file such as /proc/mounts.
+	ReadFile(path string) ([]byte, error)
+	// ReadDir returns the names of the entries of a directory such as
+	// /sys/block/drbd100/holders, sorted.
+	ReadDir(path string) ([]string, error)
+	// Stat returns an error satisfying os.IsNotExist if there is nothing at
+	// path. Symlinks are not followed.
+	Stat(path string) error
+	// OpenDevice opens the device node read-only and closes it again.
+	OpenDevice(path string) error
+}
+
+// Exec is what commands, device nodes and the mount table go through.
+var Exec Executor = osExecutor{}
+
+// osExecutor runs commands on the node and reads its files.
+type osExecutor struct{}
+
+func (osExecutor) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (osExecutor) ReadDir(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
+
+func (osExecutor) Stat(path string) error {
+	_, err := os.Lstat(path)
+	return err
+}
+
+func (osExecutor) OpenDevice(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
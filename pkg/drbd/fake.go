@@ -0,0 +1,144 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FakeCommand is the scripted outcome of a command run by a FakeExecutor.
+type FakeCommand struct {
+	Output string
+	Err    error
+	// Files are written to the FakeExecutor once the command ran, e.g. the
+	// mount table after mount. Removed are deleted from it.
+	Files   map[string]string
+	Removed []string
+	// Then replace the scripts of commands once the command ran, e.g. of
+	// queries whose answers it changes.
+	Then map[string]FakeCommand
+}
+
+// FakeExecutor is an Executor for tests. It answers commands as scripted and
+// keeps files in memory, so nothing on the node is run or touched.
+type FakeExecutor struct {
+	mu sync.Mutex
+	// Commands script the outcome of commands by their command line, e.g.
+	// "drbdadm primary r0". Commands without a script fail.
+	Commands map[string]FakeCommand
+	// Files are the contents of the files on the fake node, including
+	// device nodes, which are opened fine if they are in here.
+	Files map[string]string
+	// Calls are the command lines in the order they were run.
+	Calls []string
+}
+
+// Run records the command and returns its scripted outcome.
+func (f *FakeExecutor) Run(kind CommandType, name string, args ...string) ([]byte, error) {
+	line := strings.TrimSpace(name + " " + strings.Join(args, " "))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, line)
+	c, ok := f.Commands[line]
+	if !ok {
+		return nil, fmt.Errorf("fake: no script for %q", line)
+	}
+	if f.Files == nil {
+		f.Files = map[string]string{}
+	}
+	for path, data := range c.Files {
+		f.Files[path] = data
+	}
+	for _, path := range c.Removed {
+		delete(f.Files, path)
+	}
+	for line, then := range c.Then {
+		f.Commands[line] = then
+	}
+	return []byte(c.Output), c.Err
+}
+
+// ReadFile returns the contents of path on the fake node.
+func (f *FakeExecutor) ReadFile(path string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.Files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+	return []byte(data), nil
+}
+
+// ReadDir lists what Files holds below path, which exists if anything is in
+// it.
+func (f *FakeExecutor) ReadDir(path string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[string]bool)
+	var names []string
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p := range f.Files {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(p, prefix), "/", 2)[0]
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Stat finds path if it is in Files.
+func (f *FakeExecutor) Stat(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.Files[path]; !ok {
+		return &os.PathError{Op: "lstat", Path: path, Err: syscall.ENOENT}
+	}
+	return nil
+}
+
+// OpenDevice opens path if it is in Files.
+func (f *FakeExecutor) OpenDevice(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.Files[path]; !ok {
+		return &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+	return nil
+}
+
+// Ran returns the command lines run so far.
+func (f *FakeExecutor) Ran() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.Calls...)
+}
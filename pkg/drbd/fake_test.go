@@ -0,0 +1,185 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// useFake makes the package run and read everything through f, with the
+// drbdmanage backend, until the returned function is called.
+func useFake(f *FakeExecutor) func() {
+	oldExec, oldBackend := Exec, backend
+	Exec, backend = f, drbdmanageBackend{}
+	return func() { Exec, backend = oldExec, oldBackend }
+}
+
+func TestFakeExecutor(t *testing.T) {
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"drbdadm primary r0": {Then: map[string]FakeCommand{"drbdadm role r0": {Output: "Primary\n"}}},
+			"drbdadm role r0":    {Output: "Secondary\n"},
+		},
+		Files: map[string]string{"/dev/drbd100": ""},
+	}
+	defer useFake(f)()
+
+	if out, _ := run(CmdQuery, "drbdadm", "role", "r0"); string(out) != "Secondary\n" {
+		t.Errorf("Called: run(%q), Expected: %q, Got: %q", "drbdadm role r0", "Secondary\n", out)
+	}
+	if err := (Resource{Name: "r0"}).Promote(); err != nil {
+		t.Errorf("Called: Promote(), Unexpected error: %v", err)
+	}
+	if out, _ := run(CmdQuery, "drbdadm", "role", "r0"); string(out) != "Primary\n" {
+		t.Errorf("Called: run(%q) after promoting, Expected: %q, Got: %q", "drbdadm role r0", "Primary\n", out)
+	}
+	if _, err := run(CmdQuery, "drbdadm", "down", "r0"); err == nil {
+		t.Errorf("Called: run(%q) without script, Expected: error, Got: nil", "drbdadm down r0")
+	}
+	if err := openDevice("/dev/drbd100"); err != nil {
+		t.Errorf("Called: openDevice(%q), Unexpected error: %v", "/dev/drbd100", err)
+	}
+	if err := openDevice("/dev/drbd101"); !isTransientOpenErr(err) {
+		t.Errorf("Called: openDevice(%q), Expected: missing device node, Got: %v", "/dev/drbd101", err)
+	}
+
+	expected := []string{"drbdadm role r0", "drbdadm primary r0", "drbdadm role r0", "drbdadm down r0"}
+	if ran := f.Ran(); !reflect.DeepEqual(ran, expected) {
+		t.Errorf("Called: Ran(), Expected: %q, Got: %q", expected, ran)
+	}
+}
+
+func TestFakeSysfs(t *testing.T) {
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"fuser /dev/drbd100": {Output: "/dev/drbd100:  1234\n"},
+		},
+		Files: map[string]string{
+			"/sys/block/drbd100/holders/dm-1":            "",
+			"/sys/block/drbd100/holders/dm-0":            "",
+			"/sys/block/drbd100/queue/discard_max_bytes": "2147450880\n",
+			"/sys/block/drbd101/queue/discard_max_bytes": "0\n",
+		},
+	}
+	defer useFake(f)()
+
+	expected := []string{"dm-0", "dm-1", "pid 1234"}
+	if holders := deviceHolders("/dev/drbd100"); !reflect.DeepEqual(holders, expected) {
+		t.Errorf("Called: deviceHolders(%q), Expected: %q, Got: %q", "/dev/drbd100", expected, holders)
+	}
+	var discardTests = []struct {
+		device string
+		out    bool
+	}{
+		{"/dev/drbd100", true},
+		{"/dev/drbd101", false},
+		{"/dev/drbd102", false},
+	}
+	for _, tt := range discardTests {
+		if out := discardSupported(tt.device); out != tt.out {
+			t.Errorf("Called: discardSupported(%q), Expected: %v, Got: %v", tt.device, tt.out, out)
+		}
+	}
+}
+
+func TestAttachMountUnmountDetach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pods", "volume")
+	oldCheckpoints := CheckpointDir
+	CheckpointDir = dir
+	defer func() { CheckpointDir = oldCheckpoints }()
+
+	const (
+		assignment = "node1,r0,0,connect|deploy|diskless,connect|deploy|diskless\n"
+		volume     = "r0,,0,102400,7000,100,\n"
+	)
+	listAssignment := "drbdmanage list-assignments --resources r0 --nodes node1 --machine-readable"
+	mounted := "/dev/drbd100 " + path + " ext4 rw,relatime 0 0\n"
+
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"drbdmanage list-resources --resources r0 --machine-readable": {Output: "r0,0,\n"},
+			listAssignment: {},
+			"drbdmanage assign-resource r0 node1 --client": {
+				Files: map[string]string{"/dev/drbd100": ""},
+				Then:  map[string]FakeCommand{listAssignment: {Output: assignment}},
+			},
+			"drbdmanage list-volumes --resources r0 --machine-readable": {Output: volume},
+			"drbdadm primary r0":              {},
+			"blkid -o udev /dev/drbd100":      {Output: "ID_FS_TYPE=ext4\n"},
+			"mount /dev/drbd100 " + path:      {Files: map[string]string{"/proc/mounts": mounted}},
+			"test -d " + path:                 {},
+			"findmnt -n -f -o SOURCE " + path: {Output: "/dev/drbd100\n"},
+			"umount " + path:                  {Files: map[string]string{"/proc/mounts": ""}},
+			"fuser /dev/drbd100":              {Err: errors.New("exit status 1")},
+			"drbdadm secondary r0":            {},
+			"drbdmanage unassign-resource r0 node1 --quiet": {
+				Removed: []string{"/dev/drbd100"},
+				Then:    map[string]FakeCommand{listAssignment: {}},
+			},
+		},
+		Files: map[string]string{moduleDir: "", "/proc/mounts": ""},
+	}
+	defer useFake(f)()
+
+	r := Resource{Name: "r0", NodeName: "node1", Diskless: true}
+	if _, err := AssignRes(r); err != nil {
+		t.Fatalf("Called: AssignRes(%q), Unexpected error: %v, ran: %q", r.Name, err, f.Ran())
+	}
+	device, err := WaitForDevPath(r, 1)
+	if err != nil || device != "/dev/drbd100" {
+		t.Fatalf("Called: WaitForDevPath(%q), Expected: %q, Got: %q, %v", r.Name, "/dev/drbd100", device, err)
+	}
+
+	m := Mounter{Resource: &r, FSType: "ext4"}
+	if _, err := m.Mount(path); err != nil {
+		t.Fatalf("Called: Mount(%q), Unexpected error: %v, ran: %q", path, err, f.Ran())
+	}
+	if err := m.UnMount(path); err != nil {
+		t.Fatalf("Called: UnMount(%q), Unexpected error: %v, ran: %q", path, err, f.Ran())
+	}
+	if err := UnassignRes(r); err != nil {
+		t.Fatalf("Called: UnassignRes(%q), Unexpected error: %v, ran: %q", r.Name, err, f.Ran())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Called: UnMount(%q), Expected: mount point removed, Got: %v", path, err)
+	}
+
+	listResource := "drbdmanage list-resources --resources r0 --machine-readable"
+	listVolume := "drbdmanage list-volumes --resources r0 --machine-readable"
+	expected := []string{
+		listResource, listAssignment, listAssignment, "drbdmanage assign-resource r0 node1 --client", listAssignment,
+		listVolume,
+		listVolume, "drbdadm primary r0", "blkid -o udev /dev/drbd100", "mount /dev/drbd100 " + path,
+		"test -d " + path, "findmnt -n -f -o SOURCE " + path, "umount " + path, "fuser /dev/drbd100", "drbdadm secondary r0",
+		listAssignment, "drbdmanage unassign-resource r0 node1 --quiet", listAssignment,
+	}
+	if ran := f.Ran(); !reflect.DeepEqual(ran, expected) {
+		t.Errorf("Called: attach, mount, unmount and detach, Expected: %q, Got: %q", expected, ran)
+	}
+}
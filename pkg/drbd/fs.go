@@ -0,0 +1,179 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseMkfsOptions splits options for mkfs into arguments at whitespace.
+// Single or double quotes keep whitespace within an argument, e.g. for a
+// label. Arguments are never interpreted by a shell, but must not start
+// with "/" either, so that no device to format can be slipped in.
+func ParseMkfsOptions(options string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+	for _, c := range options {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("mkfsOptions %q have an unterminated quote", options)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	for _, a := range args {
+		if strings.HasPrefix(a, "/") {
+			return nil, fmt.Errorf("mkfsOptions must not contain paths, got %q", a)
+		}
+	}
+	return args, nil
+}
+
+// fsHandler supplies what differs between filesystems when creating and
+// mounting them.
+type fsHandler interface {
+	// mountOptions are added to every mount unless already given.
+	mountOptions() []string
+	// mkfsArgs returns the filesystem specific arguments to mkfs and what
+	// of the Mounter's settings they apply.
+	mkfsArgs(m Mounter) ([]string, MountResult)
+	// maxLabelLen is the longest label the filesystem takes, zero if it has
+	// no labels.
+	maxLabelLen(fsType string) int
+	// relabelArgs is the command that sets the label of the filesystem on
+	// device.
+	relabelArgs(device, label string) []string
+}
+
+// CheckFSLabel rejects labels that filesystems of fsType can't hold. Labels
+// for unknown filesystem types are only checked once the type is known.
+func CheckFSLabel(fsType, label string) error {
+	if label == "" || fsType == "" {
+		return nil
+	}
+	if strings.HasPrefix(label, "-") {
+		return fmt.Errorf("fsLabel %q must not start with \"-\"", label)
+	}
+	max := handlerFor(fsType).maxLabelLen(fsType)
+	if max == 0 {
+		return fmt.Errorf("fsLabel is not supported for %s filesystems", fsType)
+	}
+	if len(label) > max {
+		return fmt.Errorf("fsLabel %q is %d bytes long, %s filesystems take at most %d", label, len(label), fsType, max)
+	}
+	return nil
+}
+
+// handlerFor returns the handler of fsType. Unknown filesystems are handled
+// like ext4, which passes nothing but the type to mkfs for them.
+func handlerFor(fsType string) fsHandler {
+	switch fsType {
+	case "xfs":
+		return xfsHandler{}
+	case "btrfs":
+		return btrfsHandler{}
+	}
+	return extHandler{}
+}
+
+type extHandler struct{}
+
+func (extHandler) mountOptions() []string { return nil }
+
+func (extHandler) maxLabelLen(fsType string) int {
+	if isExtFS(fsType) {
+		return 16
+	}
+	return 0
+}
+
+func (extHandler) relabelArgs(device, label string) []string {
+	return []string{"tune2fs", "-L", label, device}
+}
+
+func (extHandler) mkfsArgs(m Mounter) ([]string, MountResult) {
+	result := MountResult{}
+	if !isExtFS(m.FSType) {
+		return nil, result
+	}
+
+	var args []string
+	if m.ReservedBlocksPercent != "" {
+		args = append(args, "-m", m.ReservedBlocksPercent)
+		result.ReservedBlocksPercent = m.ReservedBlocksPercent
+	}
+	if m.DurableFormat {
+		args = append(args, "-E", "lazy_itable_init=0,lazy_journal_init=0")
+	}
+	return args, result
+}
+
+type xfsHandler struct{}
+
+// Clones of a volume carry the UUID of its filesystem, which xfs refuses to
+// mount twice on the same node without nouuid.
+func (xfsHandler) mountOptions() []string { return []string{"nouuid"} }
+
+func (xfsHandler) maxLabelLen(string) int { return 12 }
+
+func (xfsHandler) relabelArgs(device, label string) []string {
+	return []string{"xfs_admin", "-L", label, device}
+}
+
+func (xfsHandler) mkfsArgs(m Mounter) ([]string, MountResult) {
+	return nil, MountResult{}
+}
+
+type btrfsHandler struct{}
+
+func (btrfsHandler) mountOptions() []string { return nil }
+
+func (btrfsHandler) maxLabelLen(string) int { return 255 }
+
+func (btrfsHandler) relabelArgs(device, label string) []string {
+	return []string{"btrfs", "filesystem", "label", device, label}
+}
+
+// DRBD already replicates the device, so metadata is kept once instead of
+// the duplicate copy mkfs.btrfs defaults to on a single device.
+func (btrfsHandler) mkfsArgs(m Mounter) ([]string, MountResult) {
+	return []string{"-m", "single"}, MountResult{}
+}
@@ -0,0 +1,186 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHandlerMountArgs(t *testing.T) {
+	var handlerMountTests = []struct {
+		fsType  string
+		options []string
+		args    []string
+	}{
+		{"xfs", nil, []string{"-o", "nouuid", "/dev/drbd100", "/mnt/r0"}},
+		{"xfs", []string{"noatime", "nouuid"}, []string{"-o", "noatime,nouuid", "/dev/drbd100", "/mnt/r0"}},
+		{"ext4", nil, []string{"/dev/drbd100", "/mnt/r0"}},
+		{"btrfs", []string{"noatime"}, []string{"-o", "noatime", "/dev/drbd100", "/mnt/r0"}},
+		{"vfat", nil, []string{"/dev/drbd100", "/mnt/r0"}},
+	}
+
+	for _, tt := range handlerMountTests {
+		m := Mounter{Resource: &Resource{Name: "r0"}, FSType: tt.fsType, MountOptions: tt.options}
+		args := m.mountArgs("/dev/drbd100", "/mnt/r0")
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Called: mountArgs(%q, %q) with FSType %q, Expected: %q, Got: %q", "/dev/drbd100", "/mnt/r0", tt.fsType, tt.args, args)
+		}
+	}
+}
+
+func TestHandlerMkfsArgs(t *testing.T) {
+	var handlerMkfsTests = []struct {
+		fsType   string
+		reserved string
+		args     []string
+	}{
+		{"btrfs", "", []string{"-t", "btrfs", "-m", "single", "/dev/drbd100"}},
+		{"btrfs", "1", []string{"-t", "btrfs", "-m", "single", "/dev/drbd100"}},
+		{"vfat", "1", []string{"-t", "vfat", "/dev/drbd100"}},
+	}
+
+	for _, tt := range handlerMkfsTests {
+		m := Mounter{FSType: tt.fsType, ReservedBlocksPercent: tt.reserved}
+		args, result := m.mkfsArgs("/dev/drbd100")
+		if !reflect.DeepEqual(args, tt.args) || !result.Formatted || result.ReservedBlocksPercent != "" {
+			t.Errorf("Called: mkfsArgs(%q) with FSType %q, Expected: %q, Got: %q, %+v", "/dev/drbd100", tt.fsType, tt.args, args, result)
+		}
+	}
+}
+
+func TestParseMkfsOptions(t *testing.T) {
+	var mkfsOptionsTests = []struct {
+		in   string
+		args []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"-b 4096 -i 16384", []string{"-b", "4096", "-i", "16384"}, true},
+		{"  -L data\t-b 4096 ", []string{"-L", "data", "-b", "4096"}, true},
+		{`-L "my data"`, []string{"-L", "my data"}, true},
+		{`-L 'it"s'`, []string{"-L", `it"s`}, true},
+		{"-L data; rm -rf x", []string{"-L", "data;", "rm", "-rf", "x"}, true},
+		{`-L "data`, nil, false},
+		{"-b 4096 /dev/sda", nil, false},
+	}
+
+	for _, tt := range mkfsOptionsTests {
+		args, err := ParseMkfsOptions(tt.in)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Called: ParseMkfsOptions(%q), Expected: %q, ok: %v, Got: %q, %v", tt.in, tt.args, tt.ok, args, err)
+		}
+	}
+}
+
+func TestFormatMkfsOptions(t *testing.T) {
+	const ext4 = "ID_FS_UUID=15336bdb-4584-4c30-9719-754f5c4744e1\nID_FS_TYPE=ext4\n"
+	var formatTests = []struct {
+		blkid string
+		args  []string
+	}{
+		{"", []string{"-t", "ext4", "-b", "4096", "-L", "data", "/dev/drbd100"}},
+		{ext4, nil},
+	}
+
+	for _, tt := range formatTests {
+		m := Mounter{Resource: &Resource{}, FSType: "ext4", SafeFormat: true, MkfsOptions: []string{"-b", "4096", "-L", "data"}}
+		var args []string
+		result, err := m.format("/dev/drbd100", tt.blkid, func(a []string) ([]byte, error) {
+			args = a
+			return nil, nil
+		})
+		if err != nil || !reflect.DeepEqual(args, tt.args) || result.Formatted != (tt.args != nil) {
+			t.Errorf("Called: format(%q) with blkid %q, Expected mkfs: %q, Got: %q, %+v, %v", "/dev/drbd100", tt.blkid, tt.args, args, result, err)
+		}
+	}
+}
+
+func TestCheckFSLabel(t *testing.T) {
+	var labelTests = []struct {
+		fsType string
+		label  string
+		ok     bool
+	}{
+		{"ext4", "pvc-3f2a9c1e", true},
+		{"ext4", "0123456789abcdef", true},
+		{"ext4", "0123456789abcdefg", false},
+		{"xfs", "pvc-3f2a9c1e", true},
+		{"xfs", "pvc-3f2a9c1e7", false},
+		{"btrfs", "pvc-3f2a9c1e-4b5d-11e8-8c0a-525400123456", true},
+		{"vfat", "data", false},
+		{"ext4", "-O metadata_csum", false},
+		{"", "a-label-too-long-for-anything-but-btrfs", true},
+		{"xfs", "", true},
+	}
+
+	for _, tt := range labelTests {
+		if err := CheckFSLabel(tt.fsType, tt.label); (err == nil) != tt.ok {
+			t.Errorf("Called: CheckFSLabel(%q, %q), Expected ok: %v, Got: %v", tt.fsType, tt.label, tt.ok, err)
+		}
+	}
+}
+
+func TestFormatFSLabel(t *testing.T) {
+	m := Mounter{Resource: &Resource{}, FSType: "xfs", SafeFormat: true, FSLabel: "web"}
+	var args []string
+	result, err := m.format("/dev/drbd100", "", func(a []string) ([]byte, error) {
+		args = a
+		return nil, nil
+	})
+	expected := []string{"-t", "xfs", "-L", "web", "/dev/drbd100"}
+	if err != nil || !reflect.DeepEqual(args, expected) || result.FSLabel != "web" {
+		t.Errorf("Called: format(%q) with fsLabel %q, Expected mkfs: %q, Got: %q, %+v, %v", "/dev/drbd100", "web", expected, args, result, err)
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	const (
+		ext4    = "ID_FS_TYPE=ext4\nID_FS_LABEL=old\n"
+		ext4Web = "ID_FS_TYPE=ext4\nID_FS_LABEL=web\n"
+		xfs     = "ID_FS_TYPE=xfs\n"
+	)
+	var relabelTests = []struct {
+		m     Mounter
+		blkid string
+		args  []string
+		ok    bool
+	}{
+		{Mounter{Resource: &Resource{}, FSLabel: "web", Relabel: true}, ext4, []string{"tune2fs", "-L", "web", "/dev/drbd100"}, true},
+		{Mounter{Resource: &Resource{}, FSLabel: "web", Relabel: true}, xfs, []string{"xfs_admin", "-L", "web", "/dev/drbd100"}, true},
+		{Mounter{Resource: &Resource{}, FSLabel: "web", Relabel: true}, ext4Web, nil, true},
+		{Mounter{Resource: &Resource{}, FSLabel: "web"}, ext4, nil, true},
+		{Mounter{Resource: &Resource{ReadOnly: true}, FSLabel: "web", Relabel: true}, ext4, nil, true},
+		{Mounter{Resource: &Resource{}, FSLabel: "web", Relabel: true}, "", nil, true},
+		{Mounter{Resource: &Resource{}, FSLabel: "web-frontend-1", Relabel: true}, ext4, []string{"tune2fs", "-L", "web-frontend-1", "/dev/drbd100"}, true},
+		{Mounter{Resource: &Resource{}, FSLabel: "web-frontend-1", Relabel: true}, xfs, nil, false},
+	}
+
+	for _, tt := range relabelTests {
+		var args []string
+		relabeled, err := tt.m.relabel("/dev/drbd100", tt.blkid, func(a []string) ([]byte, error) {
+			args = a
+			return nil, nil
+		})
+		if (err == nil) != tt.ok || !reflect.DeepEqual(args, tt.args) || relabeled != (tt.args != nil) {
+			t.Errorf("Called: relabel(%q) with fsLabel %q and blkid %q, Expected: %q, ok: %v, Got: %q, %v, %v",
+				"/dev/drbd100", tt.m.FSLabel, tt.blkid, tt.args, tt.ok, args, relabeled, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// fsckUncorrected is the lowest exit status of fsck for errors it left
+// uncorrected. Lower ones, 1 for corrected errors and 2 for a suggested
+// reboot, don't keep the filesystem from being mounted.
+const fsckUncorrected = 4
+
+// preMount runs what has to pass before the device is mounted at path: fsck
+// if FsckOnMount is set, unless the filesystem was just created, and then
+// PreMountHook.
+func (m Mounter) preMount(device, path string, formatted bool) error {
+	if m.FsckOnMount && !formatted && !m.ReadOnly {
+		err := fsck(device, m.FSType, func(args ...string) ([]byte, error) {
+			return run(CmdFsck, "fsck", args...)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if m.PreMountHook != "" {
+		if out, err := run(CmdHook, m.PreMountHook, device, path); err != nil {
+			return fmt.Errorf("pre-mount hook %s failed: %w: %s", m.PreMountHook, err, out)
+		}
+	}
+	return nil
+}
+
+// fsck checks and repairs the filesystem on device, of fsType if set. With
+// -p, clean filesystems are skipped.
+func fsck(device, fsType string, runFsck func(args ...string) ([]byte, error)) error {
+	args := []string{"-p", device}
+	if fsType != "" {
+		args = []string{"-t", fsType, "-p", device}
+	}
+	out, err := runFsck(args...)
+	if err == nil {
+		return nil
+	}
+	var exit interface{ ExitCode() int }
+	if errors.As(err, &exit) && exit.ExitCode() < fsckUncorrected {
+		log.Printf("DRBD: fsck corrected errors on %s: %s", device, out)
+		return nil
+	}
+	return fmt.Errorf("fsck of %s failed: %w: %s", device, err, out)
+}
@@ -0,0 +1,122 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// exitStatus is the error of a command that exited nonzero.
+type exitStatus int
+
+func (e exitStatus) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitStatus) ExitCode() int { return int(e) }
+
+func TestPreMount(t *testing.T) {
+	const hook = "/usr/local/bin/validate"
+	var preMountTests = []struct {
+		name      string
+		m         Mounter
+		formatted bool
+		fsckErr   error
+		hookErr   error
+		ran       []string
+		ok        bool
+	}{
+		{"nothing", Mounter{}, false, nil, nil, nil, true},
+		{"fsck clean", Mounter{FsckOnMount: true, FSType: "ext4"}, false, nil, nil,
+			[]string{"fsck -t ext4 -p /dev/drbd100"}, true},
+		{"fsck corrected", Mounter{FsckOnMount: true}, false, exitStatus(1), nil,
+			[]string{"fsck -p /dev/drbd100"}, true},
+		{"fsck uncorrected", Mounter{FsckOnMount: true, FSType: "ext4"}, false, exitStatus(4), nil,
+			[]string{"fsck -t ext4 -p /dev/drbd100"}, false},
+		{"fsck fresh filesystem", Mounter{FsckOnMount: true, FSType: "ext4"}, true, exitStatus(4), nil, nil, true},
+		{"fsck read-only", Mounter{Resource: &Resource{ReadOnly: true}, FsckOnMount: true}, false, exitStatus(4), nil, nil, true},
+		{"hook", Mounter{PreMountHook: hook}, false, nil, nil,
+			[]string{hook + " /dev/drbd100 /mnt/r0"}, true},
+		{"hook fails", Mounter{PreMountHook: hook}, false, nil, exitStatus(1),
+			[]string{hook + " /dev/drbd100 /mnt/r0"}, false},
+		{"fsck fails before hook", Mounter{FsckOnMount: true, FSType: "ext4", PreMountHook: hook}, false, exitStatus(8), nil,
+			[]string{"fsck -t ext4 -p /dev/drbd100"}, false},
+	}
+
+	for _, tt := range preMountTests {
+		if tt.m.Resource == nil {
+			tt.m.Resource = &Resource{Name: "r0"}
+		}
+		f := &FakeExecutor{Commands: map[string]FakeCommand{
+			"fsck -t ext4 -p /dev/drbd100": {Err: tt.fsckErr},
+			"fsck -p /dev/drbd100":         {Err: tt.fsckErr},
+			hook + " /dev/drbd100 /mnt/r0": {Err: tt.hookErr},
+		}}
+		restore := useFake(f)
+		err := tt.m.preMount("/dev/drbd100", "/mnt/r0", tt.formatted)
+		restore()
+
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: preMount() with %s, Expected error: %v, Got: %v", tt.name, !tt.ok, err)
+		}
+		if ran := f.Ran(); !reflect.DeepEqual(ran, tt.ran) {
+			t.Errorf("Called: preMount() with %s, Expected: %q, Got: %q", tt.name, tt.ran, ran)
+		}
+	}
+}
+
+func TestMountHookFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "volume")
+	const hook = "/usr/local/bin/validate"
+
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"drbdmanage list-volumes --resources r0 --machine-readable": {Output: "r0,,0,102400,7000,100,\n"},
+			"drbdadm primary r0":           {},
+			"blkid -o udev /dev/drbd100":   {Output: "ID_FS_TYPE=ext4\n"},
+			hook + " /dev/drbd100 " + path: {Output: "checksum mismatch\n", Err: exitStatus(1)},
+			"drbdadm secondary r0":         {},
+		},
+		Files: map[string]string{moduleDir: "", "/dev/drbd100": ""},
+	}
+	defer useFake(f)()
+
+	m := Mounter{Resource: &Resource{Name: "r0"}, FSType: "ext4", PreMountHook: hook}
+	_, err = m.Mount(path)
+	if me, ok := err.(*MountError); !ok || me.Cause != ErrPreMountFailed {
+		t.Errorf("Called: Mount(%q) with failing hook, Expected: %v, Got: %v", path, ErrPreMountFailed, err)
+	}
+	// Nothing is mounted and the resource is demoted again.
+	ran := f.Ran()
+	for _, line := range ran {
+		if line == "mount /dev/drbd100 "+path {
+			t.Errorf("Called: Mount(%q) with failing hook, Expected: not mounted, Got: %q", path, ran)
+		}
+	}
+	if len(ran) == 0 || ran[len(ran)-1] != "drbdadm secondary r0" {
+		t.Errorf("Called: Mount(%q) with failing hook, Expected: demoted last, Got: %q", path, ran)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Migration phases passed to the progress function of Migration.Run.
+const (
+	MigrateAssigning = "assigning"
+	MigrateSyncing   = "syncing"
+	MigrateRemoving  = "removing"
+	MigrateDone      = "done"
+)
+
+// Migration moves a diskful replica of a resource from one node to another.
+type Migration struct {
+	Resource string
+	From     string
+	To       string
+	// MinReplicas is the number of diskful replicas that must remain.
+	MinReplicas int
+	// Timeout bounds how long the new replica may take to become UpToDate.
+	Timeout time.Duration
+}
+
+// Run adds a diskful replica on To, waits for it to finish syncing and only
+// then removes the replica on From, so the resource never has fewer diskful
+// replicas than before. If a phase fails, the replicas assigned so far are
+// left in place.
+func (m Migration) Run(progress func(phase string)) error {
+	assignments, err := backend.nodeAssignments(m.Resource)
+	if err != nil {
+		return err
+	}
+	if err := checkMigration(assignments, m.From, m.To, m.MinReplicas); err != nil {
+		return fmt.Errorf("DRBD: Refusing to migrate resource %q: %w", m.Resource, err)
+	}
+
+	progress(MigrateAssigning)
+	args := backend.assignArgs(Resource{Name: m.Resource, NodeName: m.To})
+	out, err := run(CmdAssign, args[0], args[1:]...)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to assign resource %q on node %q: %w: %s", m.Resource, m.To, err, out)
+	}
+	if state, err := WaitForAssignment(Resource{Name: m.Resource, NodeName: m.To}, 5); err != nil {
+		return fmt.Errorf("DRBD: Resource %q not assigned on node %q: %w", m.Resource, m.To, err)
+	} else if state != AssignmentAssigned {
+		return fmt.Errorf("DRBD: Resource %q not assigned on node %q: assignment %s", m.Resource, m.To, state)
+	}
+
+	progress(MigrateSyncing)
+	if err := waitForNodeUpToDate(m.Resource, m.To, m.Timeout); err != nil {
+		return err
+	}
+
+	progress(MigrateRemoving)
+	if err := UnassignRes(Resource{Name: m.Resource, NodeName: m.From}); err != nil {
+		return err
+	}
+
+	progress(MigrateDone)
+	return nil
+}
+
+// checkMigration makes sure moving the replica on from to to is possible and
+// leaves at least minReplicas diskful replicas.
+func checkMigration(assignments map[string]string, from, to string, minReplicas int) error {
+	if from == to {
+		return fmt.Errorf("source and target node are both %q", from)
+	}
+	if assignments[from] != AssignmentDiskful {
+		return fmt.Errorf("node %q has no diskful replica", from)
+	}
+	if t, ok := assignments[to]; ok {
+		return fmt.Errorf("node %q is already assigned as %s", to, t)
+	}
+
+	var diskful int
+	for _, t := range assignments {
+		if t == AssignmentDiskful {
+			diskful++
+		}
+	}
+	if diskful < minReplicas {
+		return fmt.Errorf("resource has %d diskful replicas, %d required", diskful, minReplicas)
+	}
+	return nil
+}
+
+// Parse the assignment type per node from the output of
+// `drbdmanage list-assignments` for all nodes of a resource.
+func doNodeAssignments(assignmentInfo string) (map[string]string, error) {
+	assignments := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(assignmentInfo), "\n") {
+		if line == "" {
+			continue
+		}
+		t, err := doAssignmentType(line)
+		if err != nil {
+			return nil, err
+		}
+		assignments[strings.Split(line, fieldSep)[0]] = t
+	}
+	return assignments, nil
+}
+
+// migrateErrorGrace is how long waitForNodeUpToDate keeps retrying a failing
+// status query before it gives up, instead of waiting out the whole timeout.
+var migrateErrorGrace = time.Minute
+
+// waitForNodeUpToDate polls the resource until the disk on node is UpToDate.
+func waitForNodeUpToDate(resource, node string, timeout time.Duration) error {
+	local, _ := os.Hostname()
+	return waitForNodeState(func() (string, error) {
+		out, err := run(CmdQuery, "drbdsetup", "status", resource)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", err, out)
+		}
+		if node == local {
+			return doDiskState(string(out))
+		}
+		return doPeerDiskState(string(out), node)
+	}, resource, node, timeout, migrateErrorGrace, time.Second*2)
+}
+
+// waitForNodeState polls state every interval until it is UpToDate, for up
+// to timeout. Errors are retried at the same pace, but fail the wait once
+// they have persisted for errorGrace.
+func waitForNodeState(state func() (string, error), resource, node string, timeout, errorGrace, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var failingSince time.Time
+	for {
+		current, err := state()
+		switch {
+		case err == nil && current == DiskUpToDate:
+			return nil
+		case err != nil:
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+			if time.Since(failingSince) >= errorGrace || time.Now().After(deadline) {
+				return fmt.Errorf("DRBD: Unable to get the disk state of resource %q on node %q: %w", resource, node, err)
+			}
+		default:
+			failingSince = time.Time{}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("DRBD: Resource %q on node %q did not become %s within %s, still %s", resource, node, DiskUpToDate, timeout, current)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Parse the disk state of a peer from the output of `drbdsetup status`. Each
+// peer starts a connection line holding its name and role, followed by its
+// volumes' peer-disk states.
+func doPeerDiskState(status, peer string) (string, error) {
+	inPeer := false
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && strings.HasPrefix(fields[1], "role:") && strings.HasPrefix(line, "  ") {
+			inPeer = fields[0] == peer
+			continue
+		}
+		if !inPeer {
+			continue
+		}
+		for _, f := range fields {
+			if strings.HasPrefix(f, "peer-disk:") {
+				return strings.TrimPrefix(f, "peer-disk:"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("DRBD: No disk state for peer %q in status: %q", peer, status)
+}
@@ -0,0 +1,142 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDoNodeAssignments(t *testing.T) {
+	in := "node0,r0,0,connect|deploy,connect|deploy\n" +
+		"node1,r0,0,connect|deploy,connect|deploy\n" +
+		"node2,r0,0,connect|deploy|diskless,connect|deploy|diskless\n"
+	expected := map[string]string{
+		"node0": AssignmentDiskful,
+		"node1": AssignmentDiskful,
+		"node2": AssignmentDiskless,
+	}
+
+	assignments, err := doNodeAssignments(in)
+	if err != nil || !reflect.DeepEqual(assignments, expected) {
+		t.Errorf("Called: doNodeAssignments(%q), Expected: %v, Got: %v, %v", in, expected, assignments, err)
+	}
+
+	if _, err := doNodeAssignments("node0,r0\n"); err == nil {
+		t.Errorf("Called: doNodeAssignments(%q), Expected an error, Got: nil", "node0,r0\n")
+	}
+}
+
+func TestCheckMigration(t *testing.T) {
+	assignments := map[string]string{
+		"node0": AssignmentDiskful,
+		"node1": AssignmentDiskful,
+		"node2": AssignmentDiskless,
+	}
+
+	var checkMigrationTests = []struct {
+		from        string
+		to          string
+		minReplicas int
+		ok          bool
+	}{
+		{"node0", "node3", 2, true},
+		{"node0", "node3", 3, false},
+		{"node0", "node0", 1, false},
+		{"node2", "node3", 1, false},
+		{"node0", "node1", 1, false},
+		{"node0", "node2", 1, false},
+	}
+
+	for _, tt := range checkMigrationTests {
+		err := checkMigration(assignments, tt.from, tt.to, tt.minReplicas)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: checkMigration(%v, %q, %q, %d), Expected error: %v, Got: %v",
+				assignments, tt.from, tt.to, tt.minReplicas, !tt.ok, err)
+		}
+	}
+}
+
+func TestDoPeerDiskState(t *testing.T) {
+	status := "r0 role:Primary\n  disk:UpToDate\n" +
+		"  node1 role:Secondary\n    peer-disk:UpToDate\n" +
+		"  node3 role:Secondary\n    replication:SyncSource peer-disk:Inconsistent done:12.50\n"
+
+	var peerDiskStateTests = []struct {
+		peer  string
+		state string
+		ok    bool
+	}{
+		{"node1", "UpToDate", true},
+		{"node3", "Inconsistent", true},
+		{"node4", "", false},
+	}
+
+	for _, tt := range peerDiskStateTests {
+		state, err := doPeerDiskState(status, tt.peer)
+		if state != tt.state || (err == nil) != tt.ok {
+			t.Errorf("Called: doPeerDiskState(%q, %q), Expected: %q, Got: %q, %v", status, tt.peer, tt.state, state, err)
+		}
+	}
+}
+
+func TestWaitForNodeState(t *testing.T) {
+	failed := errors.New("exit status 10")
+	var waitTests = []struct {
+		name   string
+		states []string
+		errs   []error
+		ok     bool
+		polls  int
+	}{
+		{"up to date", []string{DiskUpToDate}, nil, true, 1},
+		{"syncing", []string{"Inconsistent", "Inconsistent", DiskUpToDate}, nil, true, 3},
+		{"recovers from an error", []string{"", DiskUpToDate}, []error{failed}, true, 2},
+		// Persisting errors give up long before the timeout.
+		{"keeps failing", []string{""}, []error{failed}, false, 0},
+		{"never up to date", []string{"Inconsistent"}, nil, false, 0},
+	}
+
+	for _, tt := range waitTests {
+		start := time.Now()
+		polls := 0
+		err := waitForNodeState(func() (string, error) {
+			i := polls
+			polls++
+			var err error
+			if i < len(tt.errs) {
+				err = tt.errs[i]
+			} else if len(tt.errs) >= len(tt.states) {
+				err = tt.errs[len(tt.errs)-1]
+			}
+			if i >= len(tt.states) {
+				i = len(tt.states) - 1
+			}
+			return tt.states[i], err
+		}, "r0", "node1", time.Millisecond*500, time.Millisecond*25, time.Millisecond*10)
+		if (err == nil) != tt.ok || (tt.ok && polls != tt.polls) {
+			t.Errorf("Called: waitForNodeState() %s, Expected: ok %t after %d polls, Got: %v after %d", tt.name, tt.ok, tt.polls, err, polls)
+		}
+		if len(tt.errs) > 0 && !tt.ok && (!errors.Is(err, failed) || time.Since(start) >= time.Millisecond*500) {
+			t.Errorf("Called: waitForNodeState() %s, Expected: %v before the timeout, Got: %v after %s", tt.name, failed, err, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// MinorsInUse returns the number of DRBD minors that are configured on this
+// node.
+func MinorsInUse() (int, error) {
+	out, err := run(CmdQuery, "drbdsetup", "show")
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get runtime configuration: %w: %s", err, out)
+	}
+	return doMinorsInUse(string(out)), nil
+}
+
+var deviceMinor = regexp.MustCompile(`\bdevice\s+minor\s+(\d+)\s*;`)
+
+// Count the distinct minors in the output of `drbdsetup show`, with one
+// "device minor N;" line per volume.
+func doMinorsInUse(show string) int {
+	minors := map[string]bool{}
+	for _, m := range deviceMinor.FindAllStringSubmatch(show, -1) {
+		minors[m[1]] = true
+	}
+	return len(minors)
+}
+
+// ErrMinorsExhausted is the cause of AssignErrors for resources the backend
+// or the kernel has no DRBD minor number left for.
+var ErrMinorsExhausted = errors.New("DRBD minor numbers exhausted, detach volumes or raise the minor limit")
+
+// minorsExhaustedOutput matches what drbdmanage, LINSTOR and drbdsetup print
+// when they run out of minor numbers.
+var minorsExhaustedOutput = regexp.MustCompile(`(?i)no (more )?free minor|(unable|failed) to allocate (a )?minor|minor numbers? (pool )?exhausted|minor_count`)
+
+// minorsExhausted returns the AssignError for a command that failed with err
+// and output out if out says it ran out of minor numbers, and err otherwise.
+func minorsExhausted(out []byte, err error) error {
+	if err == nil || !minorsExhaustedOutput.Match(out) {
+		return err
+	}
+	return &AssignError{Cause: ErrMinorsExhausted, Err: fmt.Errorf("%w: %w", ErrMinorsExhausted, err)}
+}
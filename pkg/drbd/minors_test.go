@@ -0,0 +1,112 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDoMinorsInUse(t *testing.T) {
+	var minorsTests = []struct {
+		in  string
+		out int
+	}{
+		{"", 0},
+		{`resource r0 {
+    _this_host {
+        node-id			0;
+        volume 0 {
+            device			minor 100;
+            disk			"/dev/drbdpool/r0_00";
+            meta-disk			internal;
+        }
+        volume 1 {
+            device			minor 101;
+            disk			none;
+        }
+    }
+}
+resource r1 {
+    _this_host {
+        node-id			0;
+        volume 0 {
+            device			minor 102;
+        }
+    }
+}`, 3},
+		{"device minor 100;\ndevice minor 100;\n", 1},
+	}
+
+	for _, tt := range minorsTests {
+		out := doMinorsInUse(tt.in)
+		if out != tt.out {
+			t.Errorf("Called: doMinorsInUse(%q), Expected: %d, Got: %d", tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestMinorsExhausted(t *testing.T) {
+	failed := errors.New("DRBD: Unable to assign resource \"r0\" on node \"node1\": exit status 1")
+	var exhaustedTests = []struct {
+		out       string
+		err       error
+		exhausted bool
+	}{
+		{"Error: No free minor numbers available\n", failed, true},
+		{"ERROR:\nDescription:\n    Unable to allocate a minor number\n", failed, true},
+		{"minor number pool exhausted", failed, true},
+		{"Error: Storage pool drbdpool is full\n", failed, false},
+		{"No free minor numbers available\n", nil, false},
+	}
+
+	for _, tt := range exhaustedTests {
+		err := minorsExhausted([]byte(tt.out), tt.err)
+		if errors.Is(err, ErrMinorsExhausted) != tt.exhausted || (err == nil) != (tt.err == nil) {
+			t.Errorf("Called: minorsExhausted(%q, %v), Expected: exhausted %t, Got: %v", tt.out, tt.err, tt.exhausted, err)
+		}
+	}
+}
+
+func TestAssignResMinorsExhausted(t *testing.T) {
+	listAssignment := "drbdmanage list-assignments --resources r0 --nodes node1 --machine-readable"
+	f := &FakeExecutor{
+		Commands: map[string]FakeCommand{
+			"drbdmanage list-resources --resources r0 --machine-readable": {Output: "r0,0,\n"},
+			listAssignment: {},
+			"drbdmanage assign-resource r0 node1 --client": {
+				Output: "Error: No free minor numbers available\n",
+				Err:    errors.New("exit status 1"),
+			},
+		},
+		Files: map[string]string{moduleDir: ""},
+	}
+	defer useFake(f)()
+
+	r := Resource{Name: "r0", NodeName: "node1", Diskless: true}
+	_, err := AssignRes(r)
+	if !errors.Is(err, ErrMinorsExhausted) || IsTransient(err) {
+		t.Fatalf("Called: AssignRes(%q), Expected: %v, not transient, Got: %v", r.Name, ErrMinorsExhausted, err)
+	}
+	expected := `DRBD minor numbers exhausted, detach volumes or raise the minor limit: DRBD: Unable to assign resource "r0" on node "node1": exit status 1: Error: No free minor numbers available`
+	if strings.TrimSpace(err.Error()) != expected {
+		t.Errorf("Called: AssignRes(%q), Expected: %q, Got: %q", r.Name, expected, err)
+	}
+}
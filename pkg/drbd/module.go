@@ -0,0 +1,75 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ErrModuleNotLoaded is returned by assigning and mounting if the DRBD kernel
+// module isn't loaded, which would otherwise fail with obscure device errors.
+var ErrModuleNotLoaded = errors.New("drbd kernel module is not loaded, run modprobe drbd")
+
+// AutoModprobe makes CheckModule try to load a missing DRBD kernel module.
+var AutoModprobe bool
+
+// moduleDir exists while the DRBD kernel module is loaded.
+const moduleDir = "/sys/module/drbd"
+
+// moduleLoaded reports whether the DRBD kernel module is loaded.
+func moduleLoaded() bool {
+	for _, path := range []string{moduleDir, procDRBD} {
+		if err := Exec.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckModule returns ErrModuleNotLoaded if the DRBD kernel module isn't
+// loaded, after trying to load it with modprobe if AutoModprobe is set.
+func CheckModule() error {
+	return checkModule(moduleLoaded, func() error {
+		out, err := run(CmdModprobe, "modprobe", "drbd")
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}, AutoModprobe)
+}
+
+func checkModule(loaded func() bool, modprobe func() error, auto bool) error {
+	if loaded() {
+		return nil
+	}
+	if auto {
+		if err := modprobe(); err != nil {
+			log.Printf("DRBD: unable to load the drbd kernel module: %v", err)
+		} else if loaded() {
+			return nil
+		}
+	}
+	err := fmt.Errorf("DRBD: %w", ErrModuleNotLoaded)
+	if dryRunAssumes("the drbd kernel module is loaded", err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckModule(t *testing.T) {
+	var moduleTests = []struct {
+		name string
+		// loaded is whether the module is loaded before and after modprobe.
+		loaded      [2]bool
+		auto        bool
+		modprobeErr error
+		modprobed   bool
+		err         error
+	}{
+		{"loaded", [2]bool{true, true}, false, nil, false, nil},
+		{"loaded, auto", [2]bool{true, true}, true, nil, false, nil},
+		{"missing", [2]bool{false, false}, false, nil, false, ErrModuleNotLoaded},
+		{"missing, auto", [2]bool{false, true}, true, nil, true, nil},
+		{"missing, modprobe fails", [2]bool{false, false}, true, errors.New("modprobe: FATAL: Module drbd not found"), true, ErrModuleNotLoaded},
+		{"missing, modprobe loads nothing", [2]bool{false, false}, true, nil, true, ErrModuleNotLoaded},
+	}
+
+	for _, tt := range moduleTests {
+		modprobed := false
+		loaded := func() bool {
+			if modprobed {
+				return tt.loaded[1]
+			}
+			return tt.loaded[0]
+		}
+		modprobe := func() error {
+			modprobed = true
+			return tt.modprobeErr
+		}
+
+		err := checkModule(loaded, modprobe, tt.auto)
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("Called: checkModule() %s, Expected: %v, Got: %v", tt.name, tt.err, err)
+		}
+		if modprobed != tt.modprobed {
+			t.Errorf("Called: checkModule() %s, Expected modprobe: %t, Got: %t", tt.name, tt.modprobed, modprobed)
+		}
+	}
+}
+
+func TestAssignResModuleNotLoaded(t *testing.T) {
+	f := &FakeExecutor{Files: map[string]string{}}
+	defer useFake(f)()
+
+	r := Resource{Name: "r0", NodeName: "node1"}
+	_, err := AssignRes(r)
+	if !errors.Is(err, ErrModuleNotLoaded) || IsTransient(err) {
+		t.Errorf("Called: AssignRes(%q) without the module, Expected: %v, not transient, Got: %v, transient %t", r.Name, ErrModuleNotLoaded, err, IsTransient(err))
+	}
+	if ran := f.Ran(); len(ran) != 0 {
+		t.Errorf("Called: AssignRes(%q) without the module, Expected: no commands, Got: %q", r.Name, ran)
+	}
+}
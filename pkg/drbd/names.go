@@ -0,0 +1,67 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MaxResourceNameLen is the longest resource name drbdmanage accepts.
+const MaxResourceNameLen = 48
+
+var resourceName = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_-]*$`)
+
+// MaxNodeNameLen is the longest host name, and so node name, there can be.
+const MaxNodeNameLen = 253
+
+var nodeName = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// ValidateResourceName makes sure name is a valid DRBD resource name: letters,
+// digits, underscores and, except for the first character, hyphens, at most
+// MaxResourceNameLen characters long. Names are passed to drbdmanage and
+// drbdadm as arguments, anything else could break those commands.
+func ValidateResourceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("DRBD: Resource name must not be empty")
+	}
+	if len(name) > MaxResourceNameLen {
+		return fmt.Errorf("DRBD: Resource name %q is %d characters long, at most %d are allowed", name, len(name), MaxResourceNameLen)
+	}
+	if !resourceName.MatchString(name) {
+		return fmt.Errorf("DRBD: Resource name %q may only contain letters, digits, underscores and hyphens, and must not start with a hyphen", name)
+	}
+	return nil
+}
+
+// ValidateNodeName makes sure name is a valid DRBD node name, which are host
+// names: like resource names, but they may contain dots and be up to
+// MaxNodeNameLen characters long.
+func ValidateNodeName(name string) error {
+	if name == "" {
+		return fmt.Errorf("DRBD: Node name must not be empty")
+	}
+	if len(name) > MaxNodeNameLen {
+		return fmt.Errorf("DRBD: Node name %q is %d characters long, at most %d are allowed", name, len(name), MaxNodeNameLen)
+	}
+	if !nodeName.MatchString(name) {
+		return fmt.Errorf("DRBD: Node name %q may only contain letters, digits, underscores, dots and hyphens, and must not start with a hyphen or dot", name)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateResourceName(t *testing.T) {
+	var nameTests = []struct {
+		in string
+		ok bool
+	}{
+		{"r0", true},
+		{"pvc-4a1b2c3d", true},
+		{"_backup_01", true},
+		{"0day", true},
+		{strings.Repeat("a", MaxResourceNameLen), true},
+		{"", false},
+		{strings.Repeat("a", MaxResourceNameLen+1), false},
+		{"-r0", false},
+		{"r0 r1", false},
+		{"r0;reboot", false},
+		{"$(id)", false},
+		{"r0/../r1", false},
+		{"r0.backup", false},
+		{"r0\n", false},
+	}
+
+	for _, tt := range nameTests {
+		err := ValidateResourceName(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: ValidateResourceName(%q), Expected ok: %v, Got: %v", tt.in, tt.ok, err)
+		}
+	}
+}
+
+func TestValidateNodeName(t *testing.T) {
+	var nameTests = []struct {
+		in string
+		ok bool
+	}{
+		{"node1", true},
+		{"node1.example.com", true},
+		{"k8s_worker-01", true},
+		{strings.Repeat("a", MaxNodeNameLen), true},
+		{"", false},
+		{strings.Repeat("a", MaxNodeNameLen+1), false},
+		{"-node1", false},
+		{".node1", false},
+		{"node1 node2", false},
+		{"node1;reboot", false},
+		{"../node1", false},
+		{"node1\n", false},
+	}
+
+	for _, tt := range nameTests {
+		err := ValidateNodeName(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: ValidateNodeName(%q), Expected ok: %v, Got: %v", tt.in, tt.ok, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ThinPool is the LVM thin pool, as "<volume group>/<pool>", that
+// drbdmanage allocates volumes from.
+var ThinPool = "drbdpool/drbdthinpool"
+
+// OverCommit returns how far ThinPool is over-committed: the total size of
+// the volumes provisioned from it divided by its size.
+func OverCommit() (float64, error) {
+	out, err := run(CmdQuery, "lvs", "--noheadings", "--units", "b", "--nosuffix", "--separator", ",",
+		"-o", "lv_name,lv_size,pool_lv", vgOf(ThinPool))
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get thin pool information: %s", out)
+	}
+	return doOverCommit(string(out), ThinPool)
+}
+
+func vgOf(pool string) string {
+	return strings.SplitN(pool, "/", 2)[0]
+}
+
+// Parse the over-commit ratio of pool from lvs output with one
+// "lv_name,lv_size,pool_lv" line per logical volume of its volume group.
+func doOverCommit(lvsInfo, pool string) (float64, error) {
+	parts := strings.SplitN(pool, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("DRBD: Thin pool %q is not of the form <volume group>/<pool>", pool)
+	}
+	poolLV := parts[1]
+
+	var size, provisioned int64
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(lvsInfo), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), fieldSep)
+		if len(fields) != 3 {
+			return 0, fmt.Errorf("DRBD: Malformed lvsInfo: %q", line)
+		}
+		lvSize, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("DRBD: Unknown volume size %q in lvsInfo: %q", fields[1], line)
+		}
+		switch {
+		case fields[0] == poolLV:
+			size = lvSize
+			found = true
+		case fields[2] == poolLV:
+			provisioned += lvSize
+		}
+	}
+
+	if !found || size <= 0 {
+		return 0, fmt.Errorf("DRBD: Thin pool %q not found", pool)
+	}
+	return float64(provisioned) / float64(size), nil
+}
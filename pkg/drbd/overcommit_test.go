@@ -0,0 +1,44 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import "testing"
+
+func TestDoOverCommit(t *testing.T) {
+	var overCommitTests = []struct {
+		in    string
+		pool  string
+		ratio float64
+		ok    bool
+	}{
+		{"  drbdthinpool,1000,\n  r0_00,1500,drbdthinpool\n  r1_00,500,drbdthinpool\n  other,9000,\n",
+			"drbdpool/drbdthinpool", 2, true},
+		{"  drbdthinpool,1000,\n", "drbdpool/drbdthinpool", 0, true},
+		{"  r0_00,1500,drbdthinpool\n", "drbdpool/drbdthinpool", 0, false},
+		{"  drbdthinpool,1000,\n", "drbdthinpool", 0, false},
+		{"  drbdthinpool,big,\n", "drbdpool/drbdthinpool", 0, false},
+	}
+
+	for _, tt := range overCommitTests {
+		ratio, err := doOverCommit(tt.in, tt.pool)
+		if ratio != tt.ratio || (err == nil) != tt.ok {
+			t.Errorf("Called: doOverCommit(%q, %q), Expected: %v, %v, Got: %v, %v", tt.in, tt.pool, tt.ratio, tt.ok, ratio, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OwnedDir records the diskful assignments attach created, one file per
+// resource and node, so that detach removes them again. Local replicas the
+// plugin didn't create are never unassigned.
+var OwnedDir = "/var/lib/drbd-flexvolume/owned"
+
+func ownedPath(r Resource) (string, error) {
+	name := r.Name + "@" + r.NodeName
+	if r.Name == "" || r.NodeName == "" || filepath.Base(name) != name {
+		return "", fmt.Errorf("DRBD: Invalid assignment %q on node %q", r.Name, r.NodeName)
+	}
+	return filepath.Join(OwnedDir, name), nil
+}
+
+// RecordOwned notes that the plugin created the diskful assignment of r.
+func RecordOwned(r Resource) error {
+	// A dry run made no assignment detach could remove.
+	if DryRun {
+		return nil
+	}
+	path, err := ownedPath(r)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"))
+}
+
+// Owned reports whether the plugin created the diskful assignment of r.
+func Owned(r Resource) bool {
+	path, err := ownedPath(r)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// ForgetOwned drops the record of the assignment of r, if any.
+func ForgetOwned(r Resource) error {
+	path, err := ownedPath(r)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
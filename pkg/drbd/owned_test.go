@@ -0,0 +1,59 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOwned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-owned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := OwnedDir
+	OwnedDir = dir
+	defer func() { OwnedDir = oldDir }()
+
+	r := Resource{Name: "r0", NodeName: "node-a"}
+	if Owned(r) {
+		t.Errorf("Called: Owned(%q) before recording, Expected: false, Got: true", r.Name)
+	}
+	if err := RecordOwned(r); err != nil {
+		t.Fatalf("Called: RecordOwned(%q), Unexpected error: %v", r.Name, err)
+	}
+	if !Owned(r) {
+		t.Errorf("Called: Owned(%q) after recording, Expected: true, Got: false", r.Name)
+	}
+	if Owned(Resource{Name: "r0", NodeName: "node-b"}) {
+		t.Errorf("Called: Owned(%q) on another node, Expected: false, Got: true", r.Name)
+	}
+	if err := ForgetOwned(r); err != nil || Owned(r) {
+		t.Errorf("Called: ForgetOwned(%q), Expected: forgotten, Got: %v, %v", r.Name, Owned(r), err)
+	}
+	if err := ForgetOwned(r); err != nil {
+		t.Errorf("Called: ForgetOwned(%q) twice, Unexpected error: %v", r.Name, err)
+	}
+	if err := RecordOwned(Resource{Name: "r0", NodeName: "../node-a"}); err == nil {
+		t.Errorf("Called: RecordOwned() for node %q, Expected: error, Got: nil", "../node-a")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtocolUnknown is reported for connections whose protocol can't be told,
+// e.g. while they are being established.
+const ProtocolUnknown = "unknown"
+
+// PeerProtocol is the replication protocol in effect towards a peer.
+type PeerProtocol struct {
+	Peer     string `json:"peer"`
+	Protocol string `json:"protocol"`
+}
+
+// Protocols reports the replication protocol the resource is configured
+// with and the one in effect on each of its connections.
+func Protocols(r Resource) (string, []PeerProtocol, error) {
+	out, err := run(CmdQuery, "drbdadm", "dump", r.Name)
+	if err != nil {
+		return "", nil, fmt.Errorf("DRBD: Unable to get configuration of resource %q: %w: %s", r.Name, err, out)
+	}
+	digest, err := doConfigDigest(string(out))
+	if err != nil {
+		return "", nil, err
+	}
+	// The configured protocol is always the third field of the digest.
+	configured := strings.TrimPrefix(digest.Fields[2], "protocol=")
+
+	out, err = run(CmdQuery, "drbdsetup", "show", "--show-defaults", r.Name)
+	if err != nil {
+		return configured, nil, fmt.Errorf("DRBD: Unable to get runtime configuration of resource %q: %w: %s", r.Name, err, out)
+	}
+	show := string(out)
+
+	out, err = run(CmdQuery, "drbdsetup", "status", r.Name)
+	if err != nil {
+		return configured, nil, fmt.Errorf("DRBD: Unable to get status of resource %q: %w: %s", r.Name, err, out)
+	}
+	return configured, doPeerProtocols(show, string(out)), nil
+}
+
+// Parse the protocol of each connection from the output of `drbdsetup show`,
+// where every connection block holds a net section with the peer's _name and
+// its protocol. Connections that aren't established according to the
+// `drbdsetup status` output are reported as ProtocolUnknown.
+func doPeerProtocols(show, status string) []PeerProtocol {
+	var protocols []PeerProtocol
+	var stack []string
+	var peer, protocol string
+
+	for _, line := range strings.Split(show, "\n") {
+		words := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		switch {
+		case len(words) == 0:
+		case words[len(words)-1] == "{":
+			stack = append(stack, words[0])
+			if words[0] == "connection" {
+				peer, protocol = "", ""
+			}
+		case words[0] == "}":
+			if len(stack) == 0 {
+				continue
+			}
+			if stack[len(stack)-1] == "connection" && peer != "" {
+				if protocol == "" || !peerEstablished(status, peer) {
+					protocol = ProtocolUnknown
+				}
+				protocols = append(protocols, PeerProtocol{Peer: peer, Protocol: protocol})
+			}
+			stack = stack[:len(stack)-1]
+		case len(stack) > 1 && stack[len(stack)-1] == "net" && stack[len(stack)-2] == "connection" && len(words) > 1:
+			switch words[0] {
+			case "_name":
+				peer = strings.Trim(words[1], `"`)
+			case "protocol":
+				protocol = words[1]
+			}
+		}
+	}
+	return protocols
+}
+
+// peerEstablished reports whether the connection to peer is up according to
+// the output of `drbdsetup status`, which only shows a connection state for
+// connections that are not.
+func peerEstablished(status, peer string) bool {
+	for _, p := range doStatusPeers(status) {
+		if p.name == peer {
+			return p.connection == "" || p.connection == "Connected"
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"reflect"
+	"testing"
+)
+
+const showR0 = `resource r0 {
+    options {
+        on-no-quorum    	suspend-io;
+    }
+    _this_host {
+        node-id			0;
+        volume 0 {
+            device			minor 100;
+        }
+    }
+    connection {
+        _peer_node_id 1;
+        path {
+            _this_host ipv4 10.0.0.1:7000;
+            _remote_host ipv4 10.0.0.2:7000;
+        }
+        net {
+            protocol          	A;
+            _name             	"node1";
+        }
+    }
+    connection {
+        _peer_node_id 2;
+        path {
+            _this_host ipv4 10.0.0.1:7000;
+            _remote_host ipv4 10.0.0.3:7000;
+        }
+        net {
+            protocol          	C;
+            _name             	"node2";
+        }
+    }
+}
+`
+
+func TestDoPeerProtocols(t *testing.T) {
+	var peerProtocolsTests = []struct {
+		status    string
+		protocols []PeerProtocol
+	}{
+		{"r0 role:Primary\n  disk:UpToDate\n  node1 role:Secondary\n    peer-disk:UpToDate\n  node2 role:Secondary\n    peer-disk:UpToDate\n",
+			[]PeerProtocol{{"node1", "A"}, {"node2", "C"}}},
+		{"r0 role:Primary\n  disk:UpToDate\n  node1 connection:Connecting\n  node2 role:Secondary\n    peer-disk:UpToDate\n",
+			[]PeerProtocol{{"node1", ProtocolUnknown}, {"node2", "C"}}},
+		{"r0 role:Primary\n  disk:UpToDate\n",
+			[]PeerProtocol{{"node1", ProtocolUnknown}, {"node2", ProtocolUnknown}}},
+	}
+
+	for _, tt := range peerProtocolsTests {
+		protocols := doPeerProtocols(showR0, tt.status)
+		if !reflect.DeepEqual(protocols, tt.protocols) {
+			t.Errorf("Called: doPeerProtocols(showR0, %q), Expected: %v, Got: %v", tt.status, tt.protocols, protocols)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PodsDir is where the Kubelet keeps a directory for every pod on the node,
+// which the pod's volumes are mounted below.
+var PodsDir = "/var/lib/kubelet/pods"
+
+// Orphan is a mount of a DRBD device that no resource assigned to this node
+// provides, e.g. one left behind by a node crash.
+type Orphan struct {
+	Device string `json:"device"`
+	Path   string `json:"path"`
+	// PodLive is set if a pod still uses the device, in which case its
+	// mounts are never cleaned up.
+	PodLive   bool   `json:"podLive"`
+	Unmounted bool   `json:"unmounted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// FindOrphans returns the orphaned mounts on the node. If clean is set, they
+// are unmounted, unless a pod still uses them.
+func FindOrphans(node string, clean bool) ([]Orphan, error) {
+	names, err := ListAssignedResources(node)
+	if err != nil {
+		return nil, err
+	}
+	assigned := make(map[string]bool)
+	for _, name := range names {
+		device, err := DevicePath(Resource{Name: name, NodeName: node})
+		if err != nil {
+			return nil, err
+		}
+		assigned[device] = true
+	}
+
+	mounts, err := Exec.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	orphans := findOrphans(string(mounts), assigned, podLive)
+	if !clean {
+		return orphans, nil
+	}
+
+	for i, o := range orphans {
+		if o.PodLive {
+			continue
+		}
+		path := o.Path
+		err := unmountAndRemove(path,
+			func() (bool, error) {
+				mounts, err := Exec.ReadFile("/proc/mounts")
+				return pathMounted(string(mounts), path), err
+			},
+			func() ([]byte, error) { return run(CmdUnmount, "umount", path) },
+			unmountRetryDelay)
+		if err != nil {
+			orphans[i].Error = err.Error()
+			continue
+		}
+		orphans[i].Unmounted = true
+	}
+	return orphans, nil
+}
+
+// findOrphans returns the mounts of DRBD devices in mounts, the contents of
+// /proc/mounts, whose device is not one of assigned. If one mount of a device
+// is used by a live pod, all of its mounts are, as they are likely the
+// staging mount and the bind mounts of the same volume.
+func findOrphans(mounts string, assigned map[string]bool, live func(path string) bool) []Orphan {
+	orphans := []Orphan{}
+	liveDevices := make(map[string]bool)
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/drbd") || assigned[fields[0]] {
+			continue
+		}
+		o := Orphan{Device: fields[0], Path: strings.Replace(fields[1], "\\040", " ", -1)}
+		if live(o.Path) {
+			liveDevices[o.Device] = true
+		}
+		orphans = append(orphans, o)
+	}
+	for i := range orphans {
+		orphans[i].PodLive = liveDevices[orphans[i].Device]
+	}
+	return orphans
+}
+
+// podLive reports whether path is below the directory of a pod that still
+// exists. Paths outside of PodsDir can't be told to belong to a pod.
+func podLive(path string) bool {
+	pod, ok := podDir(path)
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(pod)
+	return err == nil
+}
+
+// podDir returns the directory of the pod whose volume is mounted at path.
+func podDir(path string) (string, bool) {
+	rel, err := filepath.Rel(PodsDir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.Join(PodsDir, strings.Split(rel, string(filepath.Separator))[0]), true
+}
+
+// String describes the orphan and what was done about it.
+func (o Orphan) String() string {
+	switch {
+	case o.Unmounted:
+		return fmt.Sprintf("unmounted orphaned %s at %s", o.Device, o.Path)
+	case o.Error != "":
+		return fmt.Sprintf("unable to unmount orphaned %s at %s: %s", o.Device, o.Path, o.Error)
+	case o.PodLive:
+		return fmt.Sprintf("%s at %s is not assigned but still used by a pod", o.Device, o.Path)
+	}
+	return fmt.Sprintf("orphaned %s at %s", o.Device, o.Path)
+}
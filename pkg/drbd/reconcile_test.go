@@ -0,0 +1,87 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindOrphans(t *testing.T) {
+	mounts := `/dev/sda1 / ext4 rw,relatime 0 0
+/dev/drbd100 /var/lib/kubelet/plugins/kubernetes.io/flexvolume/linbit/drbd/mounts/r0 ext4 rw,relatime 0 0
+/dev/drbd101 /var/lib/kubelet/pods/gone/volumes/linbit~drbd/r1 ext4 rw,relatime 0 0
+/dev/drbd102 /var/lib/drbd-flexvolume/staging/r2 ext4 rw,relatime 0 0
+/dev/drbd102 /var/lib/kubelet/pods/live/volumes/linbit~drbd/r2 ext4 rw,relatime 0 0
+/dev/drbd103 /mnt/old\040data xfs rw,relatime 0 0
+tmpfs /var/lib/kubelet/pods/live/volumes/kubernetes.io~secret/token tmpfs rw 0 0
+`
+	assigned := map[string]bool{"/dev/drbd100": true}
+	live := func(path string) bool {
+		return path == "/var/lib/kubelet/pods/live/volumes/linbit~drbd/r2"
+	}
+
+	expected := []Orphan{
+		{Device: "/dev/drbd101", Path: "/var/lib/kubelet/pods/gone/volumes/linbit~drbd/r1"},
+		{Device: "/dev/drbd102", Path: "/var/lib/drbd-flexvolume/staging/r2", PodLive: true},
+		{Device: "/dev/drbd102", Path: "/var/lib/kubelet/pods/live/volumes/linbit~drbd/r2", PodLive: true},
+		{Device: "/dev/drbd103", Path: "/mnt/old data"},
+	}
+	if orphans := findOrphans(mounts, assigned, live); !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("Called: findOrphans(), Expected: %+v, Got: %+v", expected, orphans)
+	}
+
+	assigned = map[string]bool{"/dev/drbd101": true, "/dev/drbd102": true, "/dev/drbd103": true}
+	if orphans := findOrphans(mounts, assigned, live); len(orphans) != 1 || orphans[0].Device != "/dev/drbd100" {
+		t.Errorf("Called: findOrphans() with other devices assigned, Expected: /dev/drbd100, Got: %+v", orphans)
+	}
+}
+
+func TestPodLive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := PodsDir
+	PodsDir = dir
+	defer func() { PodsDir = oldDir }()
+	if err := os.Mkdir(filepath.Join(dir, "live"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var podLiveTests = []struct {
+		path string
+		live bool
+	}{
+		{filepath.Join(dir, "live", "volumes", "linbit~drbd", "r0"), true},
+		{filepath.Join(dir, "gone", "volumes", "linbit~drbd", "r0"), false},
+		{dir, false},
+		{"/var/lib/drbd-flexvolume/staging/r0", false},
+	}
+
+	for _, tt := range podLiveTests {
+		if live := podLive(tt.path); live != tt.live {
+			t.Errorf("Called: podLive(%q), Expected: %v, Got: %v", tt.path, tt.live, live)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VolumeSize returns the size in bytes of the resource's volume.
+func VolumeSize(r Resource) (int64, error) {
+	return backend.volumeSize(r)
+}
+
+// Parse the volume size from the output of `drbdmanage list-volumes`, which
+// reports it in KiB.
+func doVolumeSize(volInfo string) (int64, error) {
+	if volInfo == "" {
+		return 0, fmt.Errorf("DRBD: Resource is not configured")
+	}
+
+	s := strings.Split(volInfo, fieldSep)
+	if len(s) != 7 {
+		return 0, fmt.Errorf("DRBD: Malformed volume string: %q", volInfo)
+	}
+
+	size, err := strconv.ParseInt(s[3], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("DRBD: Bad volume size %q in volume string: %q", s[3], volInfo)
+	}
+	return size * 1024, nil
+}
+
+// checkExpand makes sure expanding from current to size bytes grows the
+// volume. Volumes are never shrunk.
+func checkExpand(current, size int64) error {
+	if size < current {
+		return fmt.Errorf("DRBD: Refusing to shrink volume from %d to %d bytes", current, size)
+	}
+	return nil
+}
+
+// Expand grows the resource's volume to size bytes, rounded up to whole KiB,
+// and returns its new size. The backend grows the backing storage on every
+// node and then resizes the DRBD device.
+func Expand(r Resource, size int64) (int64, error) {
+	current, err := VolumeSize(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkExpand(current, size); err != nil {
+		return current, err
+	}
+	if size == current {
+		return current, nil
+	}
+
+	if err := backend.usable(); err != nil {
+		return current, err
+	}
+	args := backend.resizeArgs(r, (size+1023)/1024)
+	out, err := run(CmdResize, args[0], args[1:]...)
+	if err != nil {
+		return current, fmt.Errorf("DRBD: Unable to resize resource %q: %w: %s", r.Name, err, out)
+	}
+
+	// The resize is carried out asynchronously.
+	for i := 0; i < 10; i++ {
+		current, err = VolumeSize(r)
+		if err == nil && current >= size {
+			return current, nil
+		}
+		time.Sleep(time.Second * 2)
+	}
+	if err != nil {
+		return current, err
+	}
+	return current, fmt.Errorf("DRBD: Resource %q still %d bytes after resizing to %d", r.Name, current, size)
+}
+
+// WaitForDeviceSize polls until the resource's device on this node is at
+// least size bytes. The configured size is reached before DRBD has resized
+// the device, and growing the filesystem any earlier leaves it at the old
+// size.
+func WaitForDeviceSize(r Resource, size int64, timeout time.Duration) error {
+	return waitForDeviceSize(func() (int64, error) { return GetDeviceSize(r) }, size, timeout, time.Second)
+}
+
+func waitForDeviceSize(deviceSize func() (int64, error), size int64, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := deviceSize()
+		if err == nil && current >= size {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("DRBD: Device still %d bytes after resizing to %d", current, size)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// GrowFilesystem grows the filesystem mounted at path to fill its device.
+func GrowFilesystem(path string) error {
+	out, err := run(CmdQuery, "findmnt", "-n", "-f", "-o", "SOURCE,FSTYPE", path)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to find filesystem mounted at %q: %w: %s", path, err, out)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return fmt.Errorf("DRBD: Unexpected findmnt output for %q: %q", path, out)
+	}
+
+	name, args, err := growfsArgs(fields[1], fields[0], path)
+	if err != nil {
+		return err
+	}
+	out, err = run(CmdResize, name, args...)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to grow %s filesystem at %q: %w: %s", fields[1], path, err, out)
+	}
+	return nil
+}
+
+// growfsArgs returns the command growing a mounted filesystem of fsType.
+func growfsArgs(fsType, device, path string) (string, []string, error) {
+	switch {
+	case isExtFS(fsType):
+		return "resize2fs", []string{device}, nil
+	case fsType == "xfs":
+		return "xfs_growfs", []string{path}, nil
+	}
+	return "", nil, fmt.Errorf("DRBD: Growing %s filesystems is not supported", fsType)
+}
@@ -0,0 +1,116 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDoVolumeSize(t *testing.T) {
+	var volumeSizeTests = []struct {
+		in   string
+		size int64
+		ok   bool
+	}{
+		{"test0,,0,102400,7001,130,\n", 102400 * 1024, true},
+		{"", 0, false},
+		{"test0,,0,big,7001,130,\n", 0, false},
+	}
+
+	for _, tt := range volumeSizeTests {
+		size, err := doVolumeSize(tt.in)
+		if size != tt.size || (err == nil) != tt.ok {
+			t.Errorf("Called: doVolumeSize(%q), Expected: %d, %v, Got: %d, %v", tt.in, tt.size, tt.ok, size, err)
+		}
+	}
+}
+
+func TestCheckExpand(t *testing.T) {
+	var checkExpandTests = []struct {
+		current int64
+		size    int64
+		ok      bool
+	}{
+		{1 << 30, 2 << 30, true},
+		{1 << 30, 1 << 30, true},
+		{2 << 30, 1 << 30, false},
+	}
+
+	for _, tt := range checkExpandTests {
+		err := checkExpand(tt.current, tt.size)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: checkExpand(%d, %d), Expected error: %v, Got: %v", tt.current, tt.size, !tt.ok, err)
+		}
+	}
+}
+
+func TestWaitForDeviceSize(t *testing.T) {
+	var waitTests = []struct {
+		name  string
+		sizes []int64
+		err   error
+		ok    bool
+	}{
+		{"grown", []int64{2 << 30}, nil, true},
+		{"growing", []int64{1 << 30, 1 << 30, 2 << 30}, nil, true},
+		{"never grows", []int64{1 << 30}, nil, false},
+		{"failing", []int64{0}, errors.New("blockdev failed"), false},
+	}
+
+	for _, tt := range waitTests {
+		polls := 0
+		err := waitForDeviceSize(func() (int64, error) {
+			i := polls
+			polls++
+			if i >= len(tt.sizes) {
+				i = len(tt.sizes) - 1
+			}
+			return tt.sizes[i], tt.err
+		}, 2<<30, time.Millisecond*50, time.Millisecond*5)
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: waitForDeviceSize() %s, Expected ok: %t, Got: %v", tt.name, tt.ok, err)
+		}
+		if tt.err != nil && err != tt.err {
+			t.Errorf("Called: waitForDeviceSize() %s, Expected: %v, Got: %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestGrowfsArgs(t *testing.T) {
+	var growfsTests = []struct {
+		fsType string
+		name   string
+		args   []string
+		ok     bool
+	}{
+		{"ext4", "resize2fs", []string{"/dev/drbd100"}, true},
+		{"xfs", "xfs_growfs", []string{"/mnt/r0"}, true},
+		{"btrfs", "", nil, false},
+	}
+
+	for _, tt := range growfsTests {
+		name, args, err := growfsArgs(tt.fsType, "/dev/drbd100", "/mnt/r0")
+		if name != tt.name || !reflect.DeepEqual(args, tt.args) || (err == nil) != tt.ok {
+			t.Errorf("Called: growfsArgs(%q, %q, %q), Expected: %q %q, %v, Got: %q %q, %v", tt.fsType, "/dev/drbd100", "/mnt/r0", tt.name, tt.args, tt.ok, name, args, err)
+		}
+	}
+}
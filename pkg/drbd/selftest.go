@@ -0,0 +1,84 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import "fmt"
+
+// Check is the outcome of one prerequisite check.
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Prerequisites are the outcomes of all checks made by CheckPrerequisites.
+type Prerequisites struct {
+	Checks []Check `json:"checks"`
+}
+
+// OK reports whether all checks passed.
+func (p Prerequisites) OK() bool {
+	for _, c := range p.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// prerequisiteBinaries are the commands the plugin needs on PATH, besides
+// those of a backend.
+var prerequisiteBinaries = []string{"drbdadm", "drbdsetup"}
+
+// CheckPrerequisites checks that the DRBD tools and a backend are on PATH, or
+// at the paths set for them, and the DRBD kernel module is loaded, without
+// running any of the tools.
+func CheckPrerequisites() Prerequisites {
+	return checkPrerequisites(lookPath, moduleLoaded)
+}
+
+func checkPrerequisites(lookPath func(string) (string, error), moduleLoaded func() bool) Prerequisites {
+	var p Prerequisites
+	for _, bin := range prerequisiteBinaries {
+		c := Check{Name: bin}
+		if path, err := lookPath(bin); err != nil {
+			c.Detail = fmt.Sprintf("%s not found in PATH", bin)
+		} else {
+			c.OK = true
+			c.Detail = path
+		}
+		p.Checks = append(p.Checks, c)
+	}
+
+	c := Check{Name: "backend"}
+	if b, err := detectBackend(lookPath); err != nil {
+		c.Detail = err.Error()
+	} else {
+		c.OK = true
+		c.Detail = b.Name()
+	}
+	p.Checks = append(p.Checks, c)
+
+	c = Check{Name: "kernel module", OK: moduleLoaded()}
+	if !c.OK {
+		c.Detail = ErrModuleNotLoaded.Error()
+	}
+	p.Checks = append(p.Checks, c)
+	return p
+}
@@ -0,0 +1,60 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckPrerequisites(t *testing.T) {
+	var prerequisitesTests = []struct {
+		missing      []string
+		moduleLoaded bool
+		ok           bool
+		failed       string
+	}{
+		{nil, true, true, ""},
+		{[]string{"drbdsetup"}, true, false, "drbdsetup"},
+		{[]string{"drbdmanage"}, true, true, ""},
+		{[]string{"drbdmanage", "linstor"}, true, false, "backend"},
+		{nil, false, false, "kernel module"},
+	}
+
+	for _, tt := range prerequisitesTests {
+		lookPath := func(bin string) (string, error) {
+			for _, m := range tt.missing {
+				if bin == m {
+					return "", errors.New("executable file not found in $PATH")
+				}
+			}
+			return "/usr/sbin/" + bin, nil
+		}
+		p := checkPrerequisites(lookPath, func() bool { return tt.moduleLoaded })
+		if p.OK() != tt.ok || len(p.Checks) != len(prerequisiteBinaries)+2 {
+			t.Errorf("Called: checkPrerequisites(missing %q, module %v), Expected ok: %v, Got: %+v", tt.missing, tt.moduleLoaded, tt.ok, p)
+			continue
+		}
+		for _, c := range p.Checks {
+			if c.OK == (c.Name == tt.failed) {
+				t.Errorf("Called: checkPrerequisites(missing %q, module %v), Expected %s ok: %v, Got: %+v", tt.missing, tt.moduleLoaded, c.Name, c.Name != tt.failed, c)
+			}
+		}
+	}
+}
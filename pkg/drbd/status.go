@@ -0,0 +1,99 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// GetDeviceSize returns the size in bytes of the resource's device on this
+// node.
+func GetDeviceSize(r Resource) (int64, error) {
+	device, err := DevicePath(r)
+	if err != nil {
+		return 0, err
+	}
+	out, err := run(CmdQuery, "blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get size of %s: %w: %s", device, err, out)
+	}
+	return doDeviceSize(string(out))
+}
+
+// OutOfSync returns how many bytes of the resource the peers, together, have
+// yet to catch up with.
+func OutOfSync(r Resource) (int64, error) {
+	out, err := run(CmdQuery, "drbdsetup", "status", "--statistics", r.Name)
+	if err != nil {
+		return 0, fmt.Errorf("DRBD: Unable to get statistics of resource %q: %w: %s", r.Name, err, out)
+	}
+	// drbdsetup counts out-of-sync data in KiB.
+	_, kib := doVerifyProgress(string(out))
+	return kib << 10, nil
+}
+
+// Parse the output of `blockdev --getsize64`, the size in bytes.
+func doDeviceSize(out string) (int64, error) {
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("DRBD: Bad device size %q", out)
+	}
+	return size, nil
+}
+
+// MountPoint returns a path device is mounted at on this node, empty if it
+// isn't mounted.
+func MountPoint(device string) (string, error) {
+	mounts, err := Exec.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	return doMountPoint(string(mounts), device), nil
+}
+
+// doMountPoint returns the first path device is mounted at according to
+// mounts, the contents of /proc/mounts. All of them, e.g. the staging mount
+// and the bind mounts of sub paths, share the same filesystem.
+func doMountPoint(mounts, device string) string {
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == device {
+			return strings.Replace(fields[1], "\\040", " ", -1)
+		}
+	}
+	return ""
+}
+
+// FSUsage returns the bytes used and available to unprivileged users on the
+// filesystem mounted at path, as df reports them.
+func FSUsage(path string) (uint64, uint64, error) {
+	return fsUsage(path, syscall.Statfs)
+}
+
+func fsUsage(path string, statfs func(string, *syscall.Statfs_t) error) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("DRBD: Unable to get usage of %s: %w", path, err)
+	}
+	bsize := uint64(stat.Bsize)
+	return (stat.Blocks - stat.Bfree) * bsize, stat.Bavail * bsize, nil
+}
@@ -0,0 +1,100 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestDoDeviceSize(t *testing.T) {
+	var sizeTests = []struct {
+		in   string
+		size int64
+		ok   bool
+	}{
+		{"1073741824\n", 1073741824, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"blockdev: cannot open /dev/drbd100", 0, false},
+	}
+
+	for _, tt := range sizeTests {
+		size, err := doDeviceSize(tt.in)
+		if size != tt.size || (err == nil) != tt.ok {
+			t.Errorf("Called: doDeviceSize(%q), Expected: %d, ok: %v, Got: %d, %v", tt.in, tt.size, tt.ok, size, err)
+		}
+	}
+}
+
+func TestOutOfSync(t *testing.T) {
+	f := &FakeExecutor{Commands: map[string]FakeCommand{
+		"drbdsetup status --statistics r0": {Output: "r0 role:Primary\n  disk:UpToDate\n" +
+			"  node2 role:Secondary\n    peer-disk:UpToDate out-of-sync:96\n" +
+			"  node3 role:Secondary\n    peer-disk:UpToDate out-of-sync:4\n"},
+	}}
+	defer useFake(f)()
+
+	if n, err := OutOfSync(Resource{Name: "r0"}); err != nil || n != 100<<10 {
+		t.Errorf("Called: OutOfSync(%q), Expected: %d, Got: %d, %v", "r0", 100<<10, n, err)
+	}
+	if _, err := OutOfSync(Resource{Name: "r1"}); err == nil {
+		t.Errorf("Called: OutOfSync(%q) failing, Expected: error, Got: nil", "r1")
+	}
+}
+
+func TestDoMountPoint(t *testing.T) {
+	mounts := `/dev/sda1 / ext4 rw 0 0
+/dev/drbd100 /var/lib/kubelet/pods/uid/volumes/linbit~drbd/my\040data ext4 rw 0 0
+/dev/drbd100 /var/lib/kubelet/pods/uid2/volumes/linbit~drbd/r0 ext4 rw 0 0
+`
+	var mountPointTests = []struct {
+		device string
+		path   string
+	}{
+		{"/dev/drbd100", "/var/lib/kubelet/pods/uid/volumes/linbit~drbd/my data"},
+		{"/dev/drbd101", ""},
+	}
+
+	for _, tt := range mountPointTests {
+		if path := doMountPoint(mounts, tt.device); path != tt.path {
+			t.Errorf("Called: doMountPoint(%q), Expected: %q, Got: %q", tt.device, tt.path, path)
+		}
+	}
+}
+
+func TestFSUsage(t *testing.T) {
+	statfs := func(path string, stat *syscall.Statfs_t) error {
+		stat.Bsize = 4096
+		stat.Blocks = 1000
+		stat.Bfree = 400
+		stat.Bavail = 350
+		return nil
+	}
+	used, avail, err := fsUsage("/mnt/r0", statfs)
+	if err != nil || used != 600*4096 || avail != 350*4096 {
+		t.Errorf("Called: fsUsage(%q), Expected: %d, %d, Got: %d, %d, %v", "/mnt/r0", 600*4096, 350*4096, used, avail, err)
+	}
+
+	failing := func(string, *syscall.Statfs_t) error { return errors.New("no such file or directory") }
+	if _, _, err := fsUsage("/mnt/r0", failing); err == nil {
+		t.Errorf("Called: fsUsage(%q) with failing statfs, Expected an error, Got: nil", "/mnt/r0")
+	}
+}
@@ -0,0 +1,181 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StagingDir holds the mounts of devices that are bind-mounted into pods,
+// whole or only a sub path of them, one directory per resource.
+var StagingDir = "/var/lib/drbd-flexvolume/staging"
+
+// CheckSubPath rejects sub paths that are absolute or would leave the volume.
+func CheckSubPath(subPath string) error {
+	if filepath.IsAbs(subPath) {
+		return fmt.Errorf("subPath %q must be relative", subPath)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(subPath), "/") {
+		if elem == ".." {
+			return fmt.Errorf("subPath %q must not contain \"..\"", subPath)
+		}
+	}
+	return nil
+}
+
+// stagingPath is where the device of the resource is mounted when it is
+// bind-mounted into pods.
+func (m Mounter) stagingPath() string {
+	return filepath.Join(StagingDir, m.Resource.Name)
+}
+
+// mountSubPath mounts the device at its staging path, unless another sub
+// path already did, and bind-mounts the sub path of it, or all of it, at
+// path. A staging mount made for path is torn down again if binding fails.
+func (m Mounter) mountSubPath(path string) (MountResult, error) {
+	staging := m.stagingPath()
+
+	var result MountResult
+	var err error
+	staged := false
+	if mounts, mErr := Exec.ReadFile("/proc/mounts"); mErr == nil && pathMounted(string(mounts), staging) {
+		result.Device, err = DevicePath(*m.Resource)
+		if err != nil {
+			return result, &MountError{ErrDeviceNotReady, err}
+		}
+	} else {
+		s := m
+		s.SubPath, s.StagedMount = "", false
+		if result, err = s.Mount(staging); err != nil {
+			m.discardStaging(staging)
+			return result, err
+		}
+		staged = true
+	}
+
+	err = bindSubPath(staging, m.SubPath, path, func(source, target string) error {
+		if out, err := run(CmdMount, "mount", "--bind", source, target); err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		if m.ReadOnly {
+			if out, err := run(CmdMount, "mount", "-o", "remount,bind,ro", target); err != nil {
+				run(CmdUnmount, "umount", target)
+				return fmt.Errorf("%w: %s", err, out)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if staged {
+			m.discardStaging(staging)
+		}
+		return result, &MountError{ErrMountFailed, err}
+	}
+	return result, nil
+}
+
+// discardStaging unmounts and removes what a failed mount left at the
+// staging path, demoting the resource if it was mounted.
+func (m Mounter) discardStaging(staging string) {
+	if err := m.UnMount(staging); err != nil {
+		log.Printf("DRBD: unable to tear down staging mount %s: %v", staging, err)
+	}
+}
+
+// bindSubPath creates the sub path below staging if it doesn't exist and
+// binds it to target. Symlinks within the volume must not lead out of it.
+func bindSubPath(staging, subPath, target string, bind func(source, target string) error) error {
+	if err := CheckSubPath(subPath); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(staging)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveSubPath(root, subPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to make mount directory: %w", err)
+	}
+	return bind(resolved, target)
+}
+
+// resolveSubPath walks subPath below root one element at a time, making sure
+// each existing one resolves to a directory within root before going on, and
+// only creates the missing elements, in the resolved directory. Nothing is
+// created outside of root, whatever the volume's symlinks point to.
+func resolveSubPath(root, subPath string) (string, error) {
+	cur := root
+	for _, elem := range strings.Split(filepath.ToSlash(subPath), "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		next := filepath.Join(cur, elem)
+		fi, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(next, 0755); err != nil {
+				return "", fmt.Errorf("failed to make sub path directory: %w", err)
+			}
+			cur = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if next, err = filepath.EvalSymlinks(next); err != nil {
+				return "", err
+			}
+			if next != root && !strings.HasPrefix(next, root+string(filepath.Separator)) {
+				return "", fmt.Errorf("subPath %q resolves to %s outside of the volume", subPath, next)
+			}
+			if fi, err = os.Stat(next); err != nil {
+				return "", err
+			}
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("failed to make sub path directory: %s is not a directory", next)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// stagedOnly returns the staging path the device is mounted at if that is
+// its only mount, i.e. no sub path of it is bind-mounted anymore.
+func stagedOnly(mounts, device string) (string, bool) {
+	var paths []string
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == device {
+			paths = append(paths, fields[1])
+		}
+	}
+	if len(paths) == 1 && filepath.Dir(paths[0]) == StagingDir {
+		return paths[0], true
+	}
+	return "", false
+}
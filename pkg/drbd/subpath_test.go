@@ -0,0 +1,224 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSubPath(t *testing.T) {
+	var subPathTests = []struct {
+		in string
+		ok bool
+	}{
+		{"", true},
+		{"data", true},
+		{"data/mysql", true},
+		{"./data", true},
+		{"data..old", true},
+		{"/etc", false},
+		{"..", false},
+		{"../r1", false},
+		{"data/../../r1", false},
+	}
+
+	for _, tt := range subPathTests {
+		if err := CheckSubPath(tt.in); (err == nil) != tt.ok {
+			t.Errorf("Called: CheckSubPath(%q), Expected ok: %v, Got: %v", tt.in, tt.ok, err)
+		}
+	}
+}
+
+func TestBindSubPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-subpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	staging := filepath.Join(dir, "staging", "r0")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(staging, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	var bindTests = []struct {
+		subPath string
+		source  string
+		ok      bool
+	}{
+		{"data/mysql", filepath.Join(staging, "data", "mysql"), true},
+		{"", staging, true},
+		{"../r1", "", false},
+		{"/etc", "", false},
+		{"escape", "", false},
+		// Nothing may be created through the symlink before it is checked.
+		{"escape/created", "", false},
+	}
+
+	for _, tt := range bindTests {
+		target := filepath.Join(dir, "pod", tt.subPath)
+		var bound string
+		err := bindSubPath(staging, tt.subPath, target, func(source, target string) error {
+			bound = source
+			return nil
+		})
+		if (err == nil) != tt.ok {
+			t.Errorf("Called: bindSubPath(%q), Expected ok: %v, Got: %v", tt.subPath, tt.ok, err)
+			continue
+		}
+		if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+			t.Errorf("Called: bindSubPath(%q), Expected nothing created outside the volume, Got: %s", tt.subPath, entries[0].Name())
+		}
+		if !tt.ok {
+			if bound != "" {
+				t.Errorf("Called: bindSubPath(%q), Expected nothing bound, Got: %s", tt.subPath, bound)
+			}
+			continue
+		}
+		resolved, _ := filepath.EvalSymlinks(tt.source)
+		if bound != resolved {
+			t.Errorf("Called: bindSubPath(%q), Expected: %s bound, Got: %s", tt.subPath, resolved, bound)
+		}
+		if fi, err := os.Stat(tt.source); err != nil || !fi.IsDir() {
+			t.Errorf("Called: bindSubPath(%q), Expected %s created, Got: %v", tt.subPath, tt.source, err)
+		}
+		if _, err := os.Stat(target); err != nil {
+			t.Errorf("Called: bindSubPath(%q), Expected mount point %s created, Got: %v", tt.subPath, target, err)
+		}
+	}
+}
+
+func TestStagedOnly(t *testing.T) {
+	stagingMount := "/dev/drbd100 " + filepath.Join(StagingDir, "r0") + " ext4 rw 0 0\n"
+	podMount := "/dev/drbd100 /var/lib/kubelet/pods/uid/volumes/linbit~drbd/r0 ext4 rw 0 0\n"
+	var stagedTests = []struct {
+		mounts string
+		ok     bool
+	}{
+		{stagingMount, true},
+		{stagingMount + podMount, false},
+		{podMount, false},
+		{"", false},
+	}
+
+	for _, tt := range stagedTests {
+		if path, ok := stagedOnly(tt.mounts, "/dev/drbd100"); ok != tt.ok {
+			t.Errorf("Called: stagedOnly(%q), Expected: %v, Got: %v %q", tt.mounts, tt.ok, ok, path)
+		}
+	}
+}
+
+func TestStagedMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-staged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldStaging := StagingDir
+	StagingDir = filepath.Join(dir, "staging")
+	defer func() { StagingDir = oldStaging }()
+	path := filepath.Join(dir, "pods", "volume")
+	staging := filepath.Join(StagingDir, "r0")
+	gid := int64(2000)
+
+	const volume = "r0,,0,102400,7000,100,\n"
+	stagingMounted := "/dev/drbd100 " + staging + " ext4 rw,relatime 0 0\n"
+	bound := stagingMounted + "/dev/drbd100 " + path + " ext4 rw,relatime 0 0\n"
+	commands := func() map[string]FakeCommand {
+		return map[string]FakeCommand{
+			"drbdmanage list-volumes --resources r0 --machine-readable": {Output: volume},
+			"drbdadm primary r0":                   {},
+			"blkid -o udev /dev/drbd100":           {Output: "ID_FS_TYPE=ext4\n"},
+			"mount /dev/drbd100 " + staging:        {Files: map[string]string{"/proc/mounts": stagingMounted}},
+			"chgrp -R 2000 " + staging:             {},
+			"chmod -R g+rwX " + staging:            {},
+			"mount --bind " + staging + " " + path: {Files: map[string]string{"/proc/mounts": bound}},
+			"test -d " + staging:                   {},
+			"findmnt -n -f -o SOURCE " + staging:   {Output: "/dev/drbd100\n"},
+			"umount " + staging:                    {Files: map[string]string{"/proc/mounts": ""}},
+			"test -d " + path:                      {},
+			"findmnt -n -f -o SOURCE " + path:      {Output: "/dev/drbd100\n"},
+			"umount " + path:                       {Files: map[string]string{"/proc/mounts": stagingMounted}},
+			"fuser /dev/drbd100":                   {Err: errors.New("exit status 1")},
+			"drbdadm secondary r0":                 {},
+		}
+	}
+	m := Mounter{Resource: &Resource{Name: "r0", NodeName: "node1"}, FSType: "ext4", FSGroup: &gid, StagedMount: true}
+
+	// Preparing or binding fails after the device is mounted at the staging
+	// path: path must never be bound and the staging mount must go again.
+	failed := FakeCommand{Output: "Operation not permitted", Err: errors.New("exit status 1")}
+	var failureTests = []struct {
+		command string
+		message string
+	}{
+		{"chgrp -R 2000 " + staging, "unable to change group"},
+		{"mount --bind " + staging + " " + path, "Operation not permitted"},
+	}
+	for _, tt := range failureTests {
+		f := &FakeExecutor{
+			Commands: commands(),
+			Files:    map[string]string{moduleDir: "", "/dev/drbd100": "", "/proc/mounts": ""},
+		}
+		f.Commands[tt.command] = failed
+		restore := useFake(f)
+		_, err := m.Mount(path)
+		restore()
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("Called: Mount(%q) with failing %q, Expected: %q, Got: %v", path, tt.command, tt.message, err)
+		}
+		if mounts := f.Files["/proc/mounts"]; mounts != "" {
+			t.Errorf("Called: Mount(%q) with failing %q, Expected: nothing mounted, Got: %q", path, tt.command, mounts)
+		}
+		if _, err := os.Stat(staging); !os.IsNotExist(err) {
+			t.Errorf("Called: Mount(%q) with failing %q, Expected: staging path removed, Got: %v", path, tt.command, err)
+		}
+	}
+
+	// Once prepared, the staging mount is bound at path, and unmounting
+	// path takes the staging mount with it.
+	f := &FakeExecutor{
+		Commands: commands(),
+		Files:    map[string]string{moduleDir: "", "/dev/drbd100": "", "/proc/mounts": ""},
+	}
+	defer useFake(f)()
+	if _, err := m.Mount(path); err != nil {
+		t.Fatalf("Called: Mount(%q), Unexpected error: %v, ran: %q", path, err, f.Ran())
+	}
+	if mounts := f.Files["/proc/mounts"]; mounts != bound {
+		t.Errorf("Called: Mount(%q), Expected: %q, Got: %q", path, bound, mounts)
+	}
+	if err := m.UnMount(path); err != nil {
+		t.Fatalf("Called: UnMount(%q), Unexpected error: %v, ran: %q", path, err, f.Ran())
+	}
+	if mounts := f.Files["/proc/mounts"]; mounts != "" {
+		t.Errorf("Called: UnMount(%q), Expected: nothing mounted, Got: %q", path, mounts)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VerifyDir holds the results of online verification runs.
+var VerifyDir = "/var/lib/drbd-flexvolume/verify"
+
+// Verification states recorded in VerifyResult.
+const (
+	VerifyRunning   = "running"
+	VerifyCompleted = "completed"
+	VerifyTimedOut  = "timeout"
+	VerifyFailed    = "failed"
+)
+
+// VerifyResult is the outcome of an online verification of a resource.
+type VerifyResult struct {
+	Resource string `json:"resource"`
+	State    string `json:"state"`
+	// OutOfSyncKiB is the amount of data found to differ between replicas.
+	OutOfSyncKiB int64     `json:"outOfSyncKiB"`
+	Message      string    `json:"message,omitempty"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished,omitempty"`
+}
+
+func verifyPath(r Resource) string {
+	return filepath.Join(VerifyDir, r.Name+".json")
+}
+
+// StartVerify starts an online verification of the resource against its
+// peers. The verification itself runs in the kernel, use WatchVerify to wait
+// for it to finish and record the result.
+func StartVerify(r Resource) error {
+	out, err := run(CmdAssign, "drbdadm", "verify", r.Name)
+	if err != nil {
+		return fmt.Errorf("DRBD: Unable to start verification of resource %q: %w: %s", r.Name, err, out)
+	}
+	return recordVerify(VerifyResult{Resource: r.Name, State: VerifyRunning, Started: time.Now()})
+}
+
+// WatchVerify polls the resource until its verification is done or timeout
+// has passed, and records the result.
+func WatchVerify(r Resource, timeout time.Duration) error {
+	result, err := GetVerifyResult(r)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		result = &VerifyResult{Resource: r.Name, Started: time.Now()}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := run(CmdQuery, "drbdsetup", "status", "--statistics", r.Name)
+		if err != nil {
+			result.State = VerifyFailed
+			result.Message = fmt.Sprintf("unable to get status: %s", out)
+			break
+		}
+
+		verifying, outOfSync := doVerifyProgress(string(out))
+		result.OutOfSyncKiB = outOfSync
+		if !verifying {
+			result.State = VerifyCompleted
+			break
+		}
+		if time.Now().After(deadline) {
+			result.State = VerifyTimedOut
+			break
+		}
+		time.Sleep(time.Second * 10)
+	}
+
+	result.Finished = time.Now()
+	return recordVerify(*result)
+}
+
+// GetVerifyResult returns the last recorded verification result of the
+// resource, nil if it was never verified.
+func GetVerifyResult(r Resource) (*VerifyResult, error) {
+	data, err := ioutil.ReadFile(verifyPath(r))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DRBD: Unable to read verification result of %q: %w", r.Name, err)
+	}
+
+	result := &VerifyResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("DRBD: Malformed verification result of %q: %v", r.Name, err)
+	}
+	return result, nil
+}
+
+func recordVerify(result VerifyResult) error {
+	data, _ := json.Marshal(result)
+	if err := writeAtomic(verifyPath(Resource{Name: result.Resource}), data); err != nil {
+		return fmt.Errorf("DRBD: Unable to record verification result of %q: %w", result.Resource, err)
+	}
+	return nil
+}
+
+// Parse `drbdsetup status --statistics` to see whether a verification is
+// still running against any peer, and how much data is out of sync in total.
+func doVerifyProgress(status string) (bool, int64) {
+	verifying := false
+	var outOfSync int64
+
+	for _, f := range strings.Fields(status) {
+		switch {
+		case f == "replication:VerifyS" || f == "replication:VerifyT":
+			verifying = true
+		case strings.HasPrefix(f, "out-of-sync:"):
+			n, err := strconv.ParseInt(strings.TrimPrefix(f, "out-of-sync:"), 10, 64)
+			if err == nil {
+				outOfSync += n
+			}
+		}
+	}
+	return verifying, outOfSync
+}
@@ -0,0 +1,41 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import "testing"
+
+func TestDoVerifyProgress(t *testing.T) {
+	var verifyProgressTests = []struct {
+		status    string
+		verifying bool
+		outOfSync int64
+	}{
+		{"r0 role:Secondary\n  disk:UpToDate\n  peer role:Primary\n    replication:VerifyS peer-disk:UpToDate done:45.20\n      received:0 sent:0 out-of-sync:0 pending:0 unacked:0\n", true, 0},
+		{"r0 role:Secondary\n  disk:UpToDate\n  peer role:Primary\n    replication:Established peer-disk:UpToDate\n      received:0 sent:0 out-of-sync:4096 pending:0 unacked:0\n", false, 4096},
+		{"r0 role:Secondary\n  disk:UpToDate\n  a role:Primary\n    replication:Established peer-disk:UpToDate\n      out-of-sync:8\n  b role:Secondary\n    replication:VerifyT peer-disk:UpToDate\n      out-of-sync:16\n", true, 24},
+		{"", false, 0},
+	}
+
+	for _, tt := range verifyProgressTests {
+		verifying, outOfSync := doVerifyProgress(tt.status)
+		if verifying != tt.verifying || outOfSync != tt.outOfSync {
+			t.Errorf("Called: doVerifyProgress(%q), Expected: %v, %d, Got: %v, %d", tt.status, tt.verifying, tt.outOfSync, verifying, outOfSync)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import (
+	"strings"
+)
+
+// VersionUnknown is reported for versions that can't be told.
+const VersionUnknown = "unknown"
+
+// procDRBD is where a loaded DRBD kernel module reports its version.
+const procDRBD = "/proc/drbd"
+
+// UtilsVersion is the version of the installed drbd-utils.
+func UtilsVersion() string {
+	out, _ := run(CmdQuery, "drbdadm", "--version")
+	if v := admVersion(string(out), "DRBDADM_VERSION"); v != "" {
+		return v
+	}
+	return VersionUnknown
+}
+
+// KernelVersion is the version of the DRBD kernel module, as drbdadm or
+// /proc/drbd report it while it is loaded, or modinfo otherwise.
+func KernelVersion() string {
+	out, _ := run(CmdQuery, "drbdadm", "--version")
+	if v := admVersion(string(out), "DRBD_KERNEL_VERSION"); v != "" {
+		return v
+	}
+	if proc, err := Exec.ReadFile(procDRBD); err == nil {
+		if v := doProcVersion(string(proc)); v != "" {
+			return v
+		}
+	}
+	if out, err := run(CmdQuery, "modinfo", "-F", "version", "drbd"); err == nil {
+		if v := strings.TrimSpace(string(out)); v != "" {
+			return v
+		}
+	}
+	return VersionUnknown
+}
+
+// Get the value of key from the KEY=value lines of `drbdadm --version`
+// output.
+func admVersion(out, key string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, key+"="))
+		}
+	}
+	return ""
+}
+
+// Parse the module version from the first line of /proc/drbd, e.g.
+// "version: 9.0.18-1 (api:2/proto:86-115)".
+func doProcVersion(proc string) string {
+	line := strings.SplitN(proc, "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "version:" {
+		return ""
+	}
+	return fields[1]
+}
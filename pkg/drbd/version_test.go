@@ -0,0 +1,69 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drbd
+
+import "testing"
+
+const drbdadmVersion = `DRBDADM_BUILDTAG=GIT-hash:\ 9d5f4ba6de8ad3a9ec7a8e1a8674b5d9c5ac81c0\ build\ by\ buildd@lcy01,\ 2019-06-12\ 10:45:05
+DRBDADM_API_VERSION=2
+DRBD_KERNEL_VERSION_CODE=0x090012
+DRBD_KERNEL_VERSION=9.0.18
+DRBDADM_VERSION_CODE=0x090901
+DRBDADM_VERSION=9.9.1
+`
+
+func TestAdmVersion(t *testing.T) {
+	var versionTests = []struct {
+		out     string
+		key     string
+		version string
+	}{
+		{drbdadmVersion, "DRBDADM_VERSION", "9.9.1"},
+		{drbdadmVersion, "DRBD_KERNEL_VERSION", "9.0.18"},
+		{"DRBDADM_API_VERSION=2\nDRBDADM_VERSION=9.9.1\n", "DRBD_KERNEL_VERSION", ""},
+		{"drbdadm: command not found", "DRBDADM_VERSION", ""},
+		{"", "DRBDADM_VERSION", ""},
+	}
+
+	for _, tt := range versionTests {
+		version := admVersion(tt.out, tt.key)
+		if version != tt.version {
+			t.Errorf("Called: admVersion(%q, %q), Expected: %q, Got: %q", tt.out, tt.key, tt.version, version)
+		}
+	}
+}
+
+func TestDoProcVersion(t *testing.T) {
+	var versionTests = []struct {
+		in      string
+		version string
+	}{
+		{"version: 9.0.18-1 (api:2/proto:86-115)\nGIT-hash: 1d4e3b4 build by buildd@lcy01, 2019-06-12 10:45:05\nTransports (api:16): tcp (9.0.18-1)\n", "9.0.18-1"},
+		{"version: 8.4.11-1 (api:1/proto:86-101)\nsrcversion: 4D4EC2B7E8B4B88E0AC5B04\n 0: cs:Connected ro:Primary/Secondary ds:UpToDate/UpToDate C r-----\n", "8.4.11-1"},
+		{"", ""},
+		{"GIT-hash: 1d4e3b4\n", ""},
+	}
+
+	for _, tt := range versionTests {
+		version := doProcVersion(tt.in)
+		if version != tt.version {
+			t.Errorf("Called: doProcVersion(%q), Expected: %q, Got: %q", tt.in, tt.version, version)
+		}
+	}
+}
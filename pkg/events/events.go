@@ -0,0 +1,167 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package events posts the outcome of volume operations as Kubernetes
+// Events. Posting is best effort: failures are returned to the caller to be
+// logged, never to fail the operation itself.
+package events
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config describes how to reach the Kubernetes API server.
+type Config struct {
+	// Server is the API server URL, e.g. https://10.0.0.1:6443.
+	Server string
+	// CredentialsDir holds a service account "token" and the "ca.crt" used
+	// to verify the API server, laid out like a mounted service account.
+	CredentialsDir string
+}
+
+// Enabled reports whether events should be posted at all.
+func (c Config) Enabled() bool {
+	return c.Server != ""
+}
+
+// ObjectReference identifies what an Event is about.
+type ObjectReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+type objectMeta struct {
+	GenerateName string `json:"generateName"`
+	Namespace    string `json:"namespace"`
+}
+
+type eventSource struct {
+	Component string `json:"component"`
+	Host      string `json:"host,omitempty"`
+}
+
+type event struct {
+	Kind           string          `json:"kind"`
+	APIVersion     string          `json:"apiVersion"`
+	Metadata       objectMeta      `json:"metadata"`
+	InvolvedObject ObjectReference `json:"involvedObject"`
+	Reason         string          `json:"reason"`
+	Message        string          `json:"message"`
+	Type           string          `json:"type"`
+	Source         eventSource     `json:"source"`
+	FirstTimestamp time.Time       `json:"firstTimestamp"`
+	LastTimestamp  time.Time       `json:"lastTimestamp"`
+	Count          int             `json:"count"`
+}
+
+// Event types.
+const (
+	Normal  = "Normal"
+	Warning = "Warning"
+)
+
+const postTimeout = time.Second * 5
+
+// Post creates an Event about obj. Events about cluster scoped objects are
+// created in the default namespace, as Kubernetes does itself.
+func Post(c Config, obj ObjectReference, eventType, reason, message, host string) error {
+	client, token, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	ns := obj.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+
+	now := time.Now()
+	body, _ := json.Marshal(event{
+		Kind:       "Event",
+		APIVersion: "v1",
+		Metadata: objectMeta{
+			GenerateName: strings.ToLower(obj.Name) + ".",
+			Namespace:    ns,
+		},
+		InvolvedObject: obj,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         eventSource{Component: "drbd-flexvolume", Host: host},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+
+	url := strings.TrimRight(c.Server, "/") + "/api/v1/namespaces/" + ns + "/events"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("events: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("events: unable to post event: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("events: API server refused event: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (c Config) client() (*http.Client, string, error) {
+	client := &http.Client{Timeout: postTimeout}
+	if c.CredentialsDir == "" {
+		return client, "", nil
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(c.CredentialsDir, "token"))
+	if err != nil {
+		return nil, "", fmt.Errorf("events: unable to read token: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(c.CredentialsDir, "ca.crt"))
+	if err != nil {
+		return nil, "", fmt.Errorf("events: unable to read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, "", fmt.Errorf("events: no certificates found in %s", filepath.Join(c.CredentialsDir, "ca.crt"))
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+
+	return client, strings.TrimSpace(string(token)), nil
+}
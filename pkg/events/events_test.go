@@ -0,0 +1,79 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPost(t *testing.T) {
+	var got event
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	obj := ObjectReference{Kind: "Pod", Namespace: "web", Name: "nginx-0", UID: "1234"}
+	err := Post(Config{Server: srv.URL}, obj, Warning, "FailedMount", "mountdevice failed", "node0")
+	if err != nil {
+		t.Fatalf("Called: Post(%v), Unexpected error: %v", obj, err)
+	}
+
+	if path != "/api/v1/namespaces/web/events" {
+		t.Errorf("Called: Post(%v), Expected path: %q, Got: %q", obj, "/api/v1/namespaces/web/events", path)
+	}
+	if got.InvolvedObject != obj || got.Reason != "FailedMount" || got.Type != Warning || got.Source.Host != "node0" {
+		t.Errorf("Called: Post(%v), Got unexpected event: %+v", obj, got)
+	}
+}
+
+func TestPostClusterScoped(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	obj := ObjectReference{Kind: "PersistentVolume", Name: "r0"}
+	if err := Post(Config{Server: srv.URL}, obj, Normal, "Attached", "", ""); err != nil {
+		t.Fatalf("Called: Post(%v), Unexpected error: %v", obj, err)
+	}
+	if path != "/api/v1/namespaces/default/events" {
+		t.Errorf("Called: Post(%v), Expected path: %q, Got: %q", obj, "/api/v1/namespaces/default/events", path)
+	}
+}
+
+func TestPostRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	obj := ObjectReference{Kind: "PersistentVolume", Name: "r0"}
+	if err := Post(Config{Server: srv.URL}, obj, Normal, "Attached", "", ""); err == nil {
+		t.Errorf("Called: Post(%v) against a refusing server, Expected an error, Got: nil", obj)
+	}
+}
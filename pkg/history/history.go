@@ -0,0 +1,134 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package history keeps an append-only, size-capped log of the volume
+// operations performed on each resource on this node.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Dir is where the per-resource event logs are kept.
+var Dir = "/var/lib/drbd-flexvolume/history"
+
+// MaxLogSize is the size in bytes after which a resource's log is rotated.
+// One rotated log is kept, so at most twice this much is stored per resource.
+var MaxLogSize int64 = 1 << 20
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Resource string    `json:"resource"`
+	Node     string    `json:"node,omitempty"`
+	Status   string    `json:"status"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// logPath returns the log of resource, refusing names that aren't a plain
+// file name.
+func logPath(resource string) (string, error) {
+	if resource == "" || resource == "." || resource == ".." || filepath.Base(resource) != resource {
+		return "", fmt.Errorf("history: invalid resource name %q", resource)
+	}
+	return filepath.Join(Dir, resource+".log"), nil
+}
+
+// Record appends e to the log of e.Resource, rotating the log first if it
+// has grown beyond MaxLogSize.
+func Record(e Event) error {
+	if e.Resource == "" {
+		return fmt.Errorf("history: refusing to record event without resource")
+	}
+	path, err := logPath(e.Resource)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return fmt.Errorf("history: unable to create %s: %v", Dir, err)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Size() >= MaxLogSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return fmt.Errorf("history: unable to rotate %s: %v", path, err)
+		}
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("history: unable to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Read returns the recorded events for resource, oldest first. Events outside
+// of since and until are skipped, zero times leave that end of the range open.
+func Read(resource string, since, until time.Time) ([]Event, error) {
+	events := []Event{}
+
+	path, err := logPath(resource)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("history: unable to open %s: %v", p, err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e Event
+			// Skip lines that were cut short, the rest of the log is still useful.
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if !since.IsZero() && e.Time.Before(since) {
+				continue
+			}
+			if !until.IsZero() && e.Time.After(until) {
+				continue
+			}
+			events = append(events, e)
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("history: unable to read %s: %v", p, err)
+		}
+	}
+
+	return events, nil
+}
@@ -0,0 +1,134 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func withTempDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := Dir
+	Dir = dir
+	return func() {
+		Dir = oldDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRecordAndRead(t *testing.T) {
+	defer withTempDir(t)()
+
+	start := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, action := range []string{"attach", "mountdevice", "unmountdevice", "detach"} {
+		err := Record(Event{
+			Time:     start.Add(time.Duration(i) * time.Minute),
+			Action:   action,
+			Resource: "r0",
+			Status:   "Success",
+		})
+		if err != nil {
+			t.Fatalf("Called: Record(%q), Unexpected error: %v", action, err)
+		}
+	}
+
+	var readTests = []struct {
+		since time.Time
+		until time.Time
+		out   []string
+	}{
+		{time.Time{}, time.Time{}, []string{"attach", "mountdevice", "unmountdevice", "detach"}},
+		{start.Add(time.Minute), time.Time{}, []string{"mountdevice", "unmountdevice", "detach"}},
+		{start.Add(time.Minute), start.Add(2 * time.Minute), []string{"mountdevice", "unmountdevice"}},
+		{start.Add(time.Hour), time.Time{}, []string{}},
+	}
+
+	for _, tt := range readTests {
+		events, err := Read("r0", tt.since, tt.until)
+		if err != nil {
+			t.Errorf("Called: Read(%q, %v, %v), Unexpected error: %v", "r0", tt.since, tt.until, err)
+			continue
+		}
+		actions := []string{}
+		for _, e := range events {
+			actions = append(actions, e.Action)
+		}
+		if len(actions) != len(tt.out) {
+			t.Errorf("Called: Read(%q, %v, %v), Expected: %q, Got: %q", "r0", tt.since, tt.until, tt.out, actions)
+			continue
+		}
+		for i := range actions {
+			if actions[i] != tt.out[i] {
+				t.Errorf("Called: Read(%q, %v, %v), Expected: %q, Got: %q", "r0", tt.since, tt.until, tt.out, actions)
+				break
+			}
+		}
+	}
+}
+
+func TestRecordRotates(t *testing.T) {
+	defer withTempDir(t)()
+
+	oldMax := MaxLogSize
+	MaxLogSize = 1
+	defer func() { MaxLogSize = oldMax }()
+
+	for _, action := range []string{"attach", "detach", "attach"} {
+		if err := Record(Event{Action: action, Resource: "r0"}); err != nil {
+			t.Fatalf("Called: Record(%q), Unexpected error: %v", action, err)
+		}
+	}
+
+	// Only the current and one rotated log are kept.
+	events, err := Read("r0", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Called: Read(%q) after rotation, Expected: 2 events, Got: %d", "r0", len(events))
+	}
+}
+
+func TestReadUnknownResource(t *testing.T) {
+	defer withTempDir(t)()
+
+	events, err := Read("nope", time.Time{}, time.Time{})
+	if err != nil || len(events) != 0 {
+		t.Errorf("Called: Read(%q), Expected: no events, Got: %v, %v", "nope", events, err)
+	}
+}
+
+func TestInvalidResourceNames(t *testing.T) {
+	defer withTempDir(t)()
+
+	for _, name := range []string{"..", "../r0", "r0/../../r1", "."} {
+		if err := Record(Event{Time: time.Now(), Action: "attach", Resource: name}); err == nil {
+			t.Errorf("Called: Record(%q), Expected: error, Got: nil", name)
+		}
+		if _, err := Read(name, time.Time{}, time.Time{}); err == nil {
+			t.Errorf("Called: Read(%q), Expected: error, Got: nil", name)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package jsonlog writes one JSON object per line, for logs meant to be
+// searched and parsed by tools.
+package jsonlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Level is the verbosity of a log line.
+type Level int
+
+// Levels in increasing verbosity.
+const (
+	Error Level = iota
+	Info
+	Debug
+)
+
+var levelNames = []string{"error", "info", "debug"}
+
+func (l Level) String() string {
+	if l < Error || l > Debug {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses "error", "info" or "debug".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("jsonlog: unknown level %q, must be one of \"error\", \"info\" or \"debug\"", s)
+}
+
+// Fields are the contents of a log line beside its time and level.
+type Fields map[string]interface{}
+
+// Logger writes lines up to its level to w.
+type Logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// New returns a Logger writing lines of level and below to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{w: w, level: level}
+}
+
+// Log writes fields as a line of the given level, unless the logger is less
+// verbose than that. A nil Logger discards everything.
+func (l *Logger) Log(level Level, fields Fields) {
+	if l == nil || level > l.level {
+		return
+	}
+
+	line := Fields{"time": time.Now().UTC().Format(time.RFC3339Nano), "level": level.String()}
+	for k, v := range fields {
+		line[k] = v
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(data, '\n'))
+}
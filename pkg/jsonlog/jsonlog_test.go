@@ -0,0 +1,71 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	var levelTests = []struct {
+		in    string
+		level Level
+		ok    bool
+	}{
+		{"error", Error, true},
+		{"info", Info, true},
+		{"debug", Debug, true},
+		{"verbose", Info, false},
+	}
+
+	for _, tt := range levelTests {
+		level, err := ParseLevel(tt.in)
+		if level != tt.level || (err == nil) != tt.ok {
+			t.Errorf("Called: ParseLevel(%q), Expected: %v, %v, Got: %v, %v", tt.in, tt.level, tt.ok, level, err)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Info)
+
+	l.Log(Error, Fields{"action": "attach"})
+	l.Log(Info, Fields{"action": "detach"})
+	l.Log(Debug, Fields{"action": "mountdevice"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Called: Log at error, info and debug with level info, Expected: 2 lines, Got: %q", buf.String())
+	}
+
+	line := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[1]), &line); err != nil {
+		t.Fatalf("Called: Log, Unexpected error decoding %q: %v", lines[1], err)
+	}
+	if line["level"] != "info" || line["action"] != "detach" || line["time"] == nil {
+		t.Errorf("Called: Log(Info, {action: detach}), Expected: time, level info, action detach, Got: %v", line)
+	}
+
+	var nilLogger *Logger
+	nilLogger.Log(Error, Fields{"action": "attach"})
+}
@@ -0,0 +1,159 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package lock serializes operations on a resource across the processes the
+// Kubelet starts for overlapping calls, using a lock file per resource.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Dir is where the lock files are kept.
+var Dir = "/var/lock/drbd-flexvolume"
+
+// InProcess keeps locks in memory instead of lock files, for nodes where
+// nothing may be written. They then only serialize calls within the process,
+// not the calls of other processes.
+var InProcess bool
+
+// ErrTimeout is returned if a lock is still held by someone else when the
+// timeout expires.
+var ErrTimeout = errors.New("lock: timed out")
+
+// pollInterval is how often a held lock is tried again.
+const pollInterval = time.Millisecond * 100
+
+// Lock is a held lock on a resource.
+type Lock struct {
+	resource string
+	f        *os.File
+}
+
+// held are the locks this process holds, for ReleaseAll.
+var held = struct {
+	sync.Mutex
+	locks map[*Lock]bool
+}{locks: map[*Lock]bool{}}
+
+// Acquire locks the resource, waiting up to timeout for other holders to
+// release it. Names that aren't a plain file name are refused.
+func Acquire(resource string, timeout time.Duration) (*Lock, error) {
+	if resource == "" || resource == "." || resource == ".." || filepath.Base(resource) != resource {
+		return nil, fmt.Errorf("lock: invalid resource name %q", resource)
+	}
+	if InProcess {
+		return acquireInProcess(resource, timeout)
+	}
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return nil, fmt.Errorf("lock: unable to create %s: %v", Dir, err)
+	}
+	path := filepath.Join(Dir, resource+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("lock: unable to open %s: %v", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			l := &Lock{resource: resource, f: f}
+			held.Lock()
+			held.locks[l] = true
+			held.Unlock()
+			return l, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("lock: unable to lock %s: %v", path, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, ErrTimeout
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// acquireInProcess locks the resource unless another lock of this process
+// holds it, waiting up to timeout for that one to be released.
+func acquireInProcess(resource string, timeout time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		held.Lock()
+		taken := false
+		for l := range held.locks {
+			if l.resource == resource {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			l := &Lock{resource: resource}
+			held.locks[l] = true
+			held.Unlock()
+			return l, nil
+		}
+		held.Unlock()
+		if time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Release gives up the lock. Locks are also released when the process exits.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	held.Lock()
+	defer held.Unlock()
+	return l.release()
+}
+
+// release gives up the lock, holding held.
+func (l *Lock) release() error {
+	delete(held.locks, l)
+	if l.f == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+	l.f = nil
+	return err
+}
+
+// ReleaseAll gives up all locks this process holds, e.g. before exiting on a
+// signal while a call is still running, and returns how many there were.
+func ReleaseAll() int {
+	held.Lock()
+	defer held.Unlock()
+	n := len(held.locks)
+	for l := range held.locks {
+		l.release()
+	}
+	return n
+}
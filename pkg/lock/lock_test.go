@@ -0,0 +1,180 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := Dir
+	Dir = dir
+	defer func() { Dir = oldDir }()
+
+	l, err := Acquire("r0", time.Second)
+	if err != nil {
+		t.Fatalf("Called: Acquire(%q), Unexpected error: %v", "r0", err)
+	}
+
+	// Other resources aren't affected.
+	other, err := Acquire("r1", 0)
+	if err != nil {
+		t.Errorf("Called: Acquire(%q) while %q is locked, Unexpected error: %v", "r1", "r0", err)
+	}
+	other.Release()
+
+	start := time.Now()
+	if _, err := Acquire("r0", time.Millisecond*200); err != ErrTimeout {
+		t.Errorf("Called: Acquire(%q) while locked, Expected: %v, Got: %v", "r0", ErrTimeout, err)
+	}
+	if waited := time.Since(start); waited < time.Millisecond*200 {
+		t.Errorf("Called: Acquire(%q) while locked, Expected to wait %v, Got: %v", "r0", time.Millisecond*200, waited)
+	}
+
+	if err := l.Release(); err != nil {
+		t.Fatalf("Called: Release(), Unexpected error: %v", err)
+	}
+	l, err = Acquire("r0", 0)
+	if err != nil {
+		t.Errorf("Called: Acquire(%q) after Release, Unexpected error: %v", "r0", err)
+	}
+	l.Release()
+
+	// Releasing twice is harmless.
+	if err := l.Release(); err != nil {
+		t.Errorf("Called: Release() twice, Unexpected error: %v", err)
+	}
+
+	// Names never lead out of Dir.
+	for _, name := range []string{"..", "../r0", "r0/../../r1", ""} {
+		if l, err := Acquire(name, 0); err == nil {
+			l.Release()
+			t.Errorf("Called: Acquire(%q), Expected: error, Got: nil", name)
+		}
+	}
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := Dir
+	Dir = dir
+	defer func() { Dir = oldDir }()
+
+	l, err := Acquire("r0", 0)
+	if err != nil {
+		t.Fatalf("Called: Acquire(%q), Unexpected error: %v", "r0", err)
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		l.Release()
+	}()
+
+	l2, err := Acquire("r0", time.Second*5)
+	if err != nil {
+		t.Errorf("Called: Acquire(%q) while being released, Unexpected error: %v", "r0", err)
+	}
+	l2.Release()
+}
+
+func TestInProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := Dir
+	Dir, InProcess = filepath.Join(dir, "lock"), true
+	defer func() { Dir, InProcess = oldDir, false }()
+
+	l, err := Acquire("r0", 0)
+	if err != nil {
+		t.Fatalf("Called: Acquire(%q) in process, Unexpected error: %v", "r0", err)
+	}
+	if _, err := Acquire("r0", time.Millisecond*200); err != ErrTimeout {
+		t.Errorf("Called: Acquire(%q) in process while locked, Expected: %v, Got: %v", "r0", ErrTimeout, err)
+	}
+	other, err := Acquire("r1", 0)
+	if err != nil {
+		t.Errorf("Called: Acquire(%q) in process while %q is locked, Unexpected error: %v", "r1", "r0", err)
+	}
+	other.Release()
+
+	l.Release()
+	if l, err = Acquire("r0", 0); err != nil {
+		t.Errorf("Called: Acquire(%q) in process after Release, Unexpected error: %v", "r0", err)
+	}
+	if n := ReleaseAll(); n != 1 {
+		t.Errorf("Called: ReleaseAll() in process, Expected: %d, Got: %d", 1, n)
+	}
+
+	if _, err := os.Stat(Dir); !os.IsNotExist(err) {
+		t.Errorf("Called: Acquire() in process, Expected: no lock directory, Got: %v", err)
+	}
+}
+
+func TestReleaseAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := Dir
+	Dir = dir
+	defer func() { Dir = oldDir }()
+
+	var locks []*Lock
+	for _, r := range []string{"r0", "r1"} {
+		l, err := Acquire(r, 0)
+		if err != nil {
+			t.Fatalf("Called: Acquire(%q), Unexpected error: %v", r, err)
+		}
+		locks = append(locks, l)
+	}
+	locks[1].Release()
+
+	if n := ReleaseAll(); n != 1 {
+		t.Errorf("Called: ReleaseAll(), Expected: %d, Got: %d", 1, n)
+	}
+	l, err := Acquire("r0", 0)
+	if err != nil {
+		t.Errorf("Called: Acquire(%q) after ReleaseAll, Unexpected error: %v", "r0", err)
+	}
+	l.Release()
+
+	// Locks released by ReleaseAll can still be released by their holders.
+	if err := locks[0].Release(); err != nil {
+		t.Errorf("Called: Release() after ReleaseAll, Unexpected error: %v", err)
+	}
+	if n := ReleaseAll(); n != 0 {
+		t.Errorf("Called: ReleaseAll() twice, Expected: %d, Got: %d", 0, n)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package metrics keeps Prometheus counters and histograms of plugin calls in
+// a file read by the node_exporter textfile collector. Every call runs in a
+// new process, so each one reads the file, adds its own call and replaces it.
+// Calls can also be sent to statsd.
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// File is where the metrics are kept, empty disables them.
+var File = "/var/lib/node_exporter/textfile_collector/drbd-flexvolume.prom"
+
+// Buckets are the upper bounds in seconds of the call duration histogram.
+var Buckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+const (
+	callsName    = "drbd_flexvolume_calls_total"
+	durationName = "drbd_flexvolume_call_duration_seconds"
+)
+
+var help = map[string]string{
+	callsName:    "# HELP " + callsName + " Calls of the DRBD FlexVolume plugin by action and result.\n# TYPE " + callsName + " counter\n",
+	durationName: "# HELP " + durationName + " Duration of calls of the DRBD FlexVolume plugin by action.\n# TYPE " + durationName + " histogram\n",
+}
+
+// Record counts a call of action with result, e.g. "success" or "failure",
+// that took d. Nothing is recorded if the directory of File doesn't exist,
+// i.e. the textfile collector isn't set up on the node.
+func Record(action, result string, d time.Duration) error {
+	if File == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Dir(File)); os.IsNotExist(err) {
+		return nil
+	}
+
+	lock, err := os.OpenFile(File+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("metrics: unable to open %s.lock: %v", File, err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("metrics: unable to lock %s: %v", File, err)
+	}
+
+	s := samples{}
+	if data, err := ioutil.ReadFile(File); err == nil {
+		s = parse(string(data))
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("metrics: unable to read %s: %v", File, err)
+	}
+	s.add(action, result, d)
+	return replaceFile(File, []byte(s.format()))
+}
+
+// samples maps series, e.g. `name{label="value"}`, to their values.
+type samples map[string]float64
+
+// parse reads samples in the Prometheus text format, skipping comments and
+// lines it can't make sense of.
+func parse(data string) samples {
+	s := samples{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		s[strings.TrimSpace(line[:i])] = v
+	}
+	return s
+}
+
+// add counts a call and its duration.
+func (s samples) add(action, result string, d time.Duration) {
+	a := `action="` + escape(action) + `"`
+	s[callsName+"{"+a+`,result="`+escape(result)+`"}`]++
+
+	secs := d.Seconds()
+	for _, b := range Buckets {
+		key := durationName + "_bucket{" + a + `,le="` + formatFloat(b) + `"}`
+		count := s[key]
+		if secs <= b {
+			count++
+		}
+		s[key] = count
+	}
+	s[durationName+"_bucket{"+a+`,le="+Inf"}`]++
+	s[durationName+"_sum{"+a+"}"] += secs
+	s[durationName+"_count{"+a+"}"]++
+}
+
+// format writes the samples in the Prometheus text format, grouped by metric
+// and with histogram buckets in ascending order.
+func (s samples) format() string {
+	series := make([]string, 0, len(s))
+	for k := range s {
+		series = append(series, k)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		fi, li, bi := sortKey(series[i])
+		fj, lj, bj := sortKey(series[j])
+		if fi != fj {
+			return fi < fj
+		}
+		if li != lj {
+			return li < lj
+		}
+		return bi < bj
+	})
+
+	var b strings.Builder
+	family := ""
+	for _, k := range series {
+		if f, _, _ := sortKey(k); f != family {
+			family = f
+			b.WriteString(help[family])
+		}
+		fmt.Fprintf(&b, "%s %s\n", k, formatFloat(s[k]))
+	}
+	return b.String()
+}
+
+var leLabel = regexp.MustCompile(`,?le="([^"]*)"`)
+
+// sortKey splits a series into its metric family, its labels other than le
+// with the histogram suffix, and its bucket bound.
+func sortKey(series string) (string, string, float64) {
+	name, labels := series, ""
+	if i := strings.Index(series, "{"); i >= 0 {
+		name, labels = series[:i], series[i:]
+	}
+	family := name
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if strings.HasPrefix(name, durationName) && strings.HasSuffix(name, suffix) {
+			family = strings.TrimSuffix(name, suffix)
+		}
+	}
+
+	le := math.Inf(1)
+	if m := leLabel.FindStringSubmatch(labels); m != nil {
+		if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+			le = v
+		}
+	}
+	return family, leLabel.ReplaceAllString(labels, "") + name[len(family):], le
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// tmpFiles are the temporary files being written by replaceFile.
+type tmpFiles struct {
+	sync.Mutex
+	names map[string]bool
+}
+
+// writing are the temporary files of this process, for Abort.
+var writing = tmpFiles{names: map[string]bool{}}
+
+func (f *tmpFiles) add(name string) {
+	f.Lock()
+	defer f.Unlock()
+	f.names[name] = true
+}
+
+// remove deletes the temporary file, unless Abort already did.
+func (f *tmpFiles) remove(name string) {
+	f.Lock()
+	defer f.Unlock()
+	if f.names[name] {
+		os.Remove(name)
+		delete(f.names, name)
+	}
+}
+
+// Abort deletes temporary files still being written, e.g. before exiting on
+// a signal. File itself is only ever replaced as a whole.
+func Abort() {
+	writing.Lock()
+	defer writing.Unlock()
+	for name := range writing.names {
+		os.Remove(name)
+		delete(writing.names, name)
+	}
+}
+
+// replaceFile atomically replaces path with data, so that the collector never
+// reads a partially written file.
+func replaceFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("metrics: unable to write %s: %v", path, err)
+	}
+	writing.add(tmp.Name())
+	defer writing.remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("metrics: unable to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("metrics: unable to write %s: %v", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("metrics: unable to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("metrics: unable to replace %s: %v", path, err)
+	}
+	return nil
+}
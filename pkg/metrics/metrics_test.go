@@ -0,0 +1,170 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdd(t *testing.T) {
+	oldBuckets := Buckets
+	Buckets = []float64{1, 10}
+	defer func() { Buckets = oldBuckets }()
+
+	s := samples{}
+	s.add("attach", "success", time.Millisecond*500)
+	s.add("attach", "failure", time.Second*5)
+	s.add("attach", "success", time.Second*20)
+
+	var addTests = []struct {
+		series string
+		value  float64
+	}{
+		{`drbd_flexvolume_calls_total{action="attach",result="success"}`, 2},
+		{`drbd_flexvolume_calls_total{action="attach",result="failure"}`, 1},
+		{`drbd_flexvolume_call_duration_seconds_bucket{action="attach",le="1"}`, 1},
+		{`drbd_flexvolume_call_duration_seconds_bucket{action="attach",le="10"}`, 2},
+		{`drbd_flexvolume_call_duration_seconds_bucket{action="attach",le="+Inf"}`, 3},
+		{`drbd_flexvolume_call_duration_seconds_sum{action="attach"}`, 25.5},
+		{`drbd_flexvolume_call_duration_seconds_count{action="attach"}`, 3},
+	}
+
+	for _, tt := range addTests {
+		if s[tt.series] != tt.value {
+			t.Errorf("Called: add(), Expected: %s %g, Got: %g", tt.series, tt.value, s[tt.series])
+		}
+	}
+}
+
+func TestFormatParse(t *testing.T) {
+	oldBuckets := Buckets
+	Buckets = []float64{0.5, 10}
+	defer func() { Buckets = oldBuckets }()
+
+	s := samples{}
+	s.add("detach", "success", time.Second)
+	s.add(`odd"action`, "failure", time.Second)
+
+	out := s.format()
+	expected := `# HELP drbd_flexvolume_call_duration_seconds Duration of calls of the DRBD FlexVolume plugin by action.
+# TYPE drbd_flexvolume_call_duration_seconds histogram
+drbd_flexvolume_call_duration_seconds_bucket{action="detach",le="0.5"} 0
+drbd_flexvolume_call_duration_seconds_bucket{action="detach",le="10"} 1
+drbd_flexvolume_call_duration_seconds_bucket{action="detach",le="+Inf"} 1
+drbd_flexvolume_call_duration_seconds_count{action="detach"} 1
+drbd_flexvolume_call_duration_seconds_sum{action="detach"} 1
+drbd_flexvolume_call_duration_seconds_bucket{action="odd\"action",le="0.5"} 0
+drbd_flexvolume_call_duration_seconds_bucket{action="odd\"action",le="10"} 1
+drbd_flexvolume_call_duration_seconds_bucket{action="odd\"action",le="+Inf"} 1
+drbd_flexvolume_call_duration_seconds_count{action="odd\"action"} 1
+drbd_flexvolume_call_duration_seconds_sum{action="odd\"action"} 1
+# HELP drbd_flexvolume_calls_total Calls of the DRBD FlexVolume plugin by action and result.
+# TYPE drbd_flexvolume_calls_total counter
+drbd_flexvolume_calls_total{action="detach",result="success"} 1
+drbd_flexvolume_calls_total{action="odd\"action",result="failure"} 1
+`
+	if out != expected {
+		t.Errorf("Called: format(), Expected:\n%s\nGot:\n%s", expected, out)
+	}
+
+	parsed := parse(out)
+	if len(parsed) != len(s) {
+		t.Errorf("Called: parse(format()), Expected: %d series, Got: %d", len(s), len(parsed))
+	}
+	for k, v := range s {
+		if parsed[k] != v {
+			t.Errorf("Called: parse(format()), Expected: %s %g, Got: %g", k, v, parsed[k])
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile := File
+	File = filepath.Join(dir, "drbd-flexvolume.prom")
+	defer func() { File = oldFile }()
+
+	for i := 0; i < 2; i++ {
+		if err := Record("attach", "success", time.Second); err != nil {
+			t.Fatalf("Called: Record(%q), Unexpected error: %v", "attach", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := `drbd_flexvolume_calls_total{action="attach",result="success"}`
+	if v := parse(string(data))[series]; v != 2 {
+		t.Errorf("Called: Record(%q) twice, Expected: %s 2, Got: %g", "attach", series, v)
+	}
+
+	// Only the metrics and the lock may be left behind, no temporary files.
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".tmp") {
+			t.Errorf("Called: Record(%q), Expected: no temporary files, Got: %s", "attach", f.Name())
+		}
+	}
+
+	File = filepath.Join(dir, "missing", "drbd-flexvolume.prom")
+	if err := Record("attach", "success", time.Second); err != nil {
+		t.Errorf("Called: Record(%q) without collector directory, Expected: nil, Got: %v", "attach", err)
+	}
+	if _, err := os.Stat(filepath.Dir(File)); !os.IsNotExist(err) {
+		t.Errorf("Called: Record(%q) without collector directory, Expected: no directory, Got: %v", "attach", err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A temporary file replaceFile is still writing when the plugin exits.
+	tmp := filepath.Join(dir, "drbd-flexvolume.prom.tmp123")
+	if err := ioutil.WriteFile(tmp, []byte("drbd_flexvolume_calls_total{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writing.add(tmp)
+
+	Abort()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Called: Abort(), Expected: %s removed, Got: %v", tmp, err)
+	}
+	// replaceFile returning afterwards leaves other files alone.
+	if err := ioutil.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writing.remove(tmp)
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("Called: remove(%q) after Abort(), Expected: file kept, Got: %v", tmp, err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+)
+
+// StatsdAddr is the host:port of a statsd or dogstatsd server calls are
+// sent to, empty disables it.
+var StatsdAddr string
+
+// statsdTimeout bounds how long sending to statsd may take, so that an
+// unreachable server never stalls a call.
+var statsdTimeout = time.Millisecond * 100
+
+const statsdPrefix = "drbd_flexvolume"
+
+// Emit sends the duration of a call of action and a count tagged with its
+// result, e.g. "success" or "failure", to StatsdAddr in a single UDP
+// packet. Nothing is sent, and no connection made, if it is empty.
+func Emit(action, result string, d time.Duration) error {
+	if StatsdAddr == "" {
+		return nil
+	}
+	conn, err := net.DialTimeout("udp", StatsdAddr, statsdTimeout)
+	if err != nil {
+		return fmt.Errorf("metrics: unable to reach statsd at %s: %v", StatsdAddr, err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(statsdTimeout))
+	if _, err := conn.Write([]byte(statsdPacket(action, result, d))); err != nil {
+		return fmt.Errorf("metrics: unable to send to statsd at %s: %v", StatsdAddr, err)
+	}
+	return nil
+}
+
+// statsdPacket formats the metrics of a call, with the result as a
+// dogstatsd tag.
+func statsdPacket(action, result string, d time.Duration) string {
+	name := statsdPrefix + "." + statsdName(action)
+	tags := "|#result:" + statsdName(result)
+	return fmt.Sprintf("%s.duration_ms:%d|ms%s\n%s.count:1|c%s", name, d.Nanoseconds()/int64(time.Millisecond), tags, name, tags)
+}
+
+var statsdInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// statsdName replaces what can't be part of a metric name or tag value.
+func statsdName(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return statsdInvalid.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,81 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdPacket(t *testing.T) {
+	var packetTests = []struct {
+		action string
+		result string
+		d      time.Duration
+		out    string
+	}{
+		{"attach", "success", time.Millisecond * 1500,
+			"drbd_flexvolume.attach.duration_ms:1500|ms|#result:success\ndrbd_flexvolume.attach.count:1|c|#result:success"},
+		{"mountdevice", "failure", time.Microsecond * 900,
+			"drbd_flexvolume.mountdevice.duration_ms:0|ms|#result:failure\ndrbd_flexvolume.mountdevice.count:1|c|#result:failure"},
+		{"", "failure", time.Millisecond,
+			"drbd_flexvolume.unknown.duration_ms:1|ms|#result:failure\ndrbd_flexvolume.unknown.count:1|c|#result:failure"},
+		{"a.b:c|d", "success", time.Millisecond,
+			"drbd_flexvolume.a_b_c_d.duration_ms:1|ms|#result:success\ndrbd_flexvolume.a_b_c_d.count:1|c|#result:success"},
+	}
+
+	for _, tt := range packetTests {
+		out := statsdPacket(tt.action, tt.result, tt.d)
+		if out != tt.out {
+			t.Errorf("Called: statsdPacket(%q, %q, %s), Expected: %q, Got: %q", tt.action, tt.result, tt.d, tt.out, out)
+		}
+	}
+}
+
+func TestEmit(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	oldAddr := StatsdAddr
+	defer func() { StatsdAddr = oldAddr }()
+
+	StatsdAddr = ""
+	if err := Emit("attach", "success", time.Second); err != nil {
+		t.Errorf("Called: Emit() without StatsdAddr, Unexpected error: %v", err)
+	}
+
+	StatsdAddr = listener.LocalAddr().String()
+	if err := Emit("attach", "success", time.Second); err != nil {
+		t.Fatalf("Called: Emit() to %s, Unexpected error: %v", StatsdAddr, err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 1024)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Called: Emit() to %s, Expected: a packet, Got: %v", StatsdAddr, err)
+	}
+	expected := "drbd_flexvolume.attach.duration_ms:1000|ms|#result:success\ndrbd_flexvolume.attach.count:1|c|#result:success"
+	if string(buf[:n]) != expected {
+		t.Errorf("Called: Emit() to %s, Expected: %q, Got: %q", StatsdAddr, expected, buf[:n])
+	}
+}
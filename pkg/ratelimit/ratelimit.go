@@ -0,0 +1,126 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package ratelimit caps how often the plugin may act on a node. Every call
+// runs in a new process, so the token bucket is kept in a file shared by all
+// of them.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// File is where the token bucket is kept.
+var File = "/var/lib/drbd-flexvolume/ratelimit.json"
+
+// Limiter allows Rate operations per second on average. Unused capacity
+// accumulates up to Burst operations, which may then start in quick
+// succession; it doesn't limit how many run at the same time.
+type Limiter struct {
+	Rate  float64
+	Burst float64
+}
+
+// Enabled reports whether the limiter limits anything.
+func (l Limiter) Enabled() bool {
+	return l.Rate > 0
+}
+
+// bucket is the shared state of the limiter.
+type bucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// Wait blocks until an operation may proceed, or fails if that would take
+// longer than timeout.
+func (l Limiter) Wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		wait, err := l.take(time.Now())
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("ratelimit: rate of %g operations per second exceeded, gave up after %s", l.Rate, timeout)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// take consumes a token if one is available and otherwise returns how long
+// until the next one is.
+func (l Limiter) take(now time.Time) (time.Duration, error) {
+	if err := os.MkdirAll(filepath.Dir(File), 0755); err != nil {
+		return 0, fmt.Errorf("ratelimit: unable to create %s: %v", filepath.Dir(File), err)
+	}
+	f, err := os.OpenFile(File, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("ratelimit: unable to open %s: %v", File, err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, fmt.Errorf("ratelimit: unable to lock %s: %v", File, err)
+	}
+
+	b := bucket{Tokens: l.Burst, Last: now}
+	if data, err := ioutil.ReadAll(f); err == nil && len(data) > 0 {
+		// A damaged bucket is replaced by a full one.
+		if json.Unmarshal(data, &b) != nil {
+			b = bucket{Tokens: l.Burst, Last: now}
+		}
+	}
+
+	b = l.refill(b, now)
+	var wait time.Duration
+	if b.Tokens >= 1 {
+		b.Tokens--
+	} else {
+		wait = time.Duration((1 - b.Tokens) / l.Rate * float64(time.Second))
+	}
+
+	data, _ := json.Marshal(b)
+	if err := f.Truncate(0); err != nil {
+		return 0, fmt.Errorf("ratelimit: unable to write %s: %v", File, err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return 0, fmt.Errorf("ratelimit: unable to write %s: %v", File, err)
+	}
+	return wait, nil
+}
+
+// refill adds the tokens accumulated since the bucket was last used.
+func (l Limiter) refill(b bucket, now time.Time) bucket {
+	if elapsed := now.Sub(b.Last); elapsed > 0 {
+		b.Tokens += elapsed.Seconds() * l.Rate
+	}
+	if b.Tokens > l.Burst {
+		b.Tokens = l.Burst
+	}
+	b.Last = now
+	return b
+}
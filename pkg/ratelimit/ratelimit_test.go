@@ -0,0 +1,76 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	l := Limiter{Rate: 2, Burst: 4}
+	start := time.Now()
+
+	var refillTests = []struct {
+		tokens  float64
+		elapsed time.Duration
+		out     float64
+	}{
+		{0, time.Second, 2},
+		{1, time.Second / 2, 2},
+		{3, time.Second * 10, 4},
+		{2, -time.Second, 2},
+	}
+
+	for _, tt := range refillTests {
+		b := l.refill(bucket{Tokens: tt.tokens, Last: start}, start.Add(tt.elapsed))
+		if b.Tokens != tt.out {
+			t.Errorf("Called: refill with %v tokens after %s, Expected: %v, Got: %v", tt.tokens, tt.elapsed, tt.out, b.Tokens)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile := File
+	File = filepath.Join(dir, "ratelimit.json")
+	defer func() { File = oldFile }()
+
+	l := Limiter{Rate: 10, Burst: 1}
+	if err := l.Wait(0); err != nil {
+		t.Fatalf("Called: Wait with a full bucket, Unexpected error: %v", err)
+	}
+	if err := l.Wait(time.Millisecond * 10); err == nil {
+		t.Errorf("Called: Wait(%s) with an empty bucket refilling every 100ms, Expected an error, Got: nil", time.Millisecond*10)
+	}
+	start := time.Now()
+	if err := l.Wait(time.Second); err != nil {
+		t.Errorf("Called: Wait(%s) with an empty bucket refilling every 100ms, Unexpected error: %v", time.Second, err)
+	}
+	if waited := time.Since(start); waited < time.Millisecond*50 {
+		t.Errorf("Called: Wait(%s) with an empty bucket, Expected to wait for a token, Got: waited %s", time.Second, waited)
+	}
+}
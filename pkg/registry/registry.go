@@ -0,0 +1,137 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package registry records what is mounted where on this node, along with
+// the Kubernetes objects each mount was made for.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Dir is where one entry per mounted resource is kept.
+var Dir = "/var/lib/drbd-flexvolume/mounts"
+
+// Entry describes a mount and the Kubernetes objects it serves. Kubernetes
+// fields are only as complete as the options the Kubelet passed.
+type Entry struct {
+	Resource     string    `json:"resource"`
+	Device       string    `json:"device"`
+	Path         string    `json:"path"`
+	PVName       string    `json:"pvName,omitempty"`
+	Namespace    string    `json:"namespace,omitempty"`
+	Pod          string    `json:"pod,omitempty"`
+	PodUID       string    `json:"podUID,omitempty"`
+	StorageClass string    `json:"storageClass,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+func entryPath(resource string) string {
+	return filepath.Join(Dir, resource+".json")
+}
+
+// Record stores e, replacing any earlier entry for the same resource.
+func Record(e Entry) error {
+	if e.Resource == "" {
+		return fmt.Errorf("registry: refusing to record mount without resource")
+	}
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return fmt.Errorf("registry: unable to create %s: %v", Dir, err)
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial entry.
+	tmp := entryPath(e.Resource) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("registry: unable to write %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, entryPath(e.Resource))
+}
+
+// Lookup returns the entry of the resource, or of the resource whose device
+// is mounted, when resourceOrDevice is a device path. The entry is nil if
+// nothing was recorded.
+func Lookup(resourceOrDevice string) (*Entry, error) {
+	if !strings.HasPrefix(resourceOrDevice, "/dev/") {
+		return read(entryPath(resourceOrDevice))
+	}
+	return find(func(e *Entry) bool { return e.Device == resourceOrDevice })
+}
+
+// List returns all recorded entries, ordered by resource.
+func List() ([]Entry, error) {
+	var entries []Entry
+	_, err := find(func(e *Entry) bool {
+		entries = append(entries, *e)
+		return false
+	})
+	return entries, err
+}
+
+// RemoveByPath drops the entry of whatever is mounted at path, if any.
+func RemoveByPath(path string) error {
+	e, err := find(func(e *Entry) bool { return e.Path == path })
+	if err != nil || e == nil {
+		return err
+	}
+	return os.Remove(entryPath(e.Resource))
+}
+
+func read(path string) (*Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("registry: unable to read %s: %v", path, err)
+	}
+
+	e := &Entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("registry: malformed entry %s: %v", path, err)
+	}
+	return e, nil
+}
+
+func find(match func(*Entry) bool) (*Entry, error) {
+	paths, err := filepath.Glob(filepath.Join(Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		e, err := read(p)
+		// Skip entries we can't make sense of, another one might match.
+		if err != nil || e == nil {
+			continue
+		}
+		if match(e) {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,84 @@
+/*
+* DRBD Flexvolume plugin for Kubernetes.
+* Copyright © 2017 LINBIT USA LLC
+*
+* This program is free software; you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation; either version 2 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program; if not, see <http://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRecordLookupRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drbd-flexvolume-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := Dir
+	Dir = dir
+	defer func() { Dir = oldDir }()
+
+	err = Record(Entry{
+		Resource:  "r0",
+		Device:    "/dev/drbd100",
+		Path:      "/var/lib/kubelet/plugins/r0",
+		PVName:    "r0",
+		Namespace: "default",
+	})
+	if err != nil {
+		t.Fatalf("Called: Record(%q), Unexpected error: %v", "r0", err)
+	}
+
+	var lookupTests = []struct {
+		in       string
+		resource string
+	}{
+		{"r0", "r0"},
+		{"/dev/drbd100", "r0"},
+		{"r1", ""},
+		{"/dev/drbd101", ""},
+	}
+
+	for _, tt := range lookupTests {
+		e, err := Lookup(tt.in)
+		if err != nil {
+			t.Errorf("Called: Lookup(%q), Unexpected error: %v", tt.in, err)
+			continue
+		}
+		resource := ""
+		if e != nil {
+			resource = e.Resource
+		}
+		if resource != tt.resource {
+			t.Errorf("Called: Lookup(%q), Expected: %q, Got: %q", tt.in, tt.resource, resource)
+		}
+	}
+
+	entries, err := List()
+	if err != nil || len(entries) != 1 || entries[0].Resource != "r0" {
+		t.Errorf("Called: List(), Expected: [r0], Got: %v, %v", entries, err)
+	}
+
+	if err := RemoveByPath("/var/lib/kubelet/plugins/r0"); err != nil {
+		t.Fatalf("Called: RemoveByPath(%q), Unexpected error: %v", "/var/lib/kubelet/plugins/r0", err)
+	}
+	if e, _ := Lookup("r0"); e != nil {
+		t.Errorf("Called: Lookup(%q) after RemoveByPath, Expected: nil, Got: %v", "r0", e)
+	}
+}